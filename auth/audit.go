@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+)
+
+// AuditEntry is a line of the audit log
+type AuditEntry struct {
+	Time      string `json:"time"`
+	Principal string `json:"principal"`
+	Role      string `json:"role"`
+	Remote    string `json:"remote"`
+	Action    string `json:"action"`
+	Detail    string `json:"detail,omitempty"`
+	Status    int    `json:"status"`
+}
+
+// auditLogger write json lines to the file at AUDIT_LOG, or to stderr with the other logs
+var auditLogger = log.New(os.Stderr, "AUDIT ", 0)
+
+// OpenAuditLog append audit entries to the file at AUDIT_LOG if it is set
+func OpenAuditLog() error {
+	path := os.Getenv("AUDIT_LOG")
+	if path == "" {
+		return nil
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	auditLogger = log.New(file, "", 0)
+	return nil
+}
+
+// Audit record an admin action of the principal and its resulting status
+func Audit(principal Principal, remote, action, detail string, status int) {
+	name := principal.Name
+	if name == "" {
+		name = "anonymous"
+	}
+	marshal, err := json.Marshal(AuditEntry{
+		Time:      time.Now().Format(time.RFC3339Nano),
+		Principal: name,
+		Role:      principal.Role.String(),
+		Remote:    remote,
+		Action:    action,
+		Detail:    detail,
+		Status:    status,
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	auditLogger.Println(string(marshal))
+}
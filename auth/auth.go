@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Role is what a caller is allowed to do, a higher role can do everything of a lower one
+type Role int
+
+const (
+	// RoleNone is for routes open to everyone, such as worker callbacks inside the cluster
+	RoleNone Role = iota
+	// RoleDevice submits tasks and reads the results and usage of its own tasks
+	RoleDevice
+	// RoleOperator manages workers, resources, policies and the scheduler itself
+	RoleOperator
+)
+
+var roleNames = []string{"none", "device", "operator"}
+
+func (r Role) String() string {
+	if r < RoleNone || r > RoleOperator {
+		return fmt.Sprintf("role(%d)", int(r))
+	}
+	return roleNames[r]
+}
+
+func ParseRole(name string) (Role, error) {
+	for i, roleName := range roleNames {
+		if roleName == name && Role(i) != RoleNone {
+			return Role(i), nil
+		}
+	}
+	return RoleNone, fmt.Errorf("unknown role %v", name)
+}
+
+// Principal is an authenticated caller, Tenant is the tenant its tasks are accounted to
+type Principal struct {
+	Name   string
+	Role   Role
+	Tenant string
+}
+
+// Token is an api token given to a device or an operator, a device token may belong to a tenant
+type Token struct {
+	Token  string `json:"token"`
+	Name   string `json:"name"`
+	Role   string `json:"role"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+var authLock = sync.RWMutex{}
+
+// map from token to its principal, auth is disabled while it is empty and no client ca is set
+var tokens = map[string]Principal{}
+
+// clientCA tell whether client certificates are verified by a ca, see SetClientCA
+var clientCA = false
+
+// map from api key of a tenant to its device principal, see SetTenantKeys
+var tenantKeys = map[string]Principal{}
+
+// SetTokens replace all api tokens
+func SetTokens(newTokens []Token) error {
+	principals := map[string]Principal{}
+	for _, token := range newTokens {
+		if token.Token == "" {
+			return fmt.Errorf("empty token of %v", token.Name)
+		}
+		role, err := ParseRole(token.Role)
+		if err != nil {
+			return err
+		}
+		principals[token.Token] = Principal{Name: token.Name, Role: role, Tenant: token.Tenant}
+	}
+
+	authLock.Lock()
+	defer authLock.Unlock()
+	for key, principal := range tenantKeys {
+		if _, ok := principals[key]; ok {
+			return fmt.Errorf("api token of %v is also an api key of tenant %v", principals[key].Name, principal.Tenant)
+		}
+	}
+	tokens = principals
+	return nil
+}
+
+// LoadTokensFromEnv load tokens from the json file at AUTH_TOKENS_FILE, or the json of AUTH_TOKENS
+func LoadTokensFromEnv() error {
+	rawTokens := []byte(os.Getenv("AUTH_TOKENS"))
+	if path := os.Getenv("AUTH_TOKENS_FILE"); path != "" {
+		var err error
+		if rawTokens, err = os.ReadFile(path); err != nil {
+			return err
+		}
+	}
+	if len(rawTokens) == 0 {
+		return nil
+	}
+
+	var newTokens []Token
+	if err := json.Unmarshal(rawTokens, &newTokens); err != nil {
+		return err
+	}
+	return SetTokens(newTokens)
+}
+
+// SetTenantKeys replace the api keys of tenants, map from api key to tenant.
+// A key authenticates a device of its tenant like a token, but does not enable auth by itself
+func SetTenantKeys(keys map[string]string) error {
+	authLock.Lock()
+	defer authLock.Unlock()
+	principals := map[string]Principal{}
+	for key, tenant := range keys {
+		if _, ok := tokens[key]; ok {
+			return fmt.Errorf("api key of tenant %v is also an api token", tenant)
+		}
+		principals[key] = Principal{Name: tenant, Role: RoleDevice, Tenant: tenant}
+	}
+	tenantKeys = principals
+	return nil
+}
+
+// SetClientCA turn auth on when client certificates are verified by a ca,
+// a caller without a certificate or a token is refused even if no token is configured
+func SetClientCA(configured bool) {
+	authLock.Lock()
+	clientCA = configured
+	authLock.Unlock()
+}
+
+func enabled() bool {
+	authLock.RLock()
+	defer authLock.RUnlock()
+	return len(tokens) != 0 || clientCA
+}
+
+// LookupToken return the principal of an api token or an api key of a tenant
+func LookupToken(token string) (Principal, bool) {
+	authLock.RLock()
+	defer authLock.RUnlock()
+	for _, principals := range []map[string]Principal{tokens, tenantKeys} {
+		for candidate, principal := range principals {
+			if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+				return principal, true
+			}
+		}
+	}
+	return Principal{}, false
+}
+
+// Authenticate identify the caller of an http request by a verified client certificate,
+// whose first organizational unit is the role, common name is the name and organization is the tenant,
+// or by "Authorization: Bearer <token>", or by the api key of a tenant in X-API-Key
+func Authenticate(r *http.Request) (Principal, bool) {
+	if principal, ok := AuthenticateTLS(r.TLS); ok {
+		return principal, true
+	}
+	if apiKey := r.Header.Get("X-API-Key"); apiKey != "" && r.Header.Get("Authorization") == "" {
+		return LookupToken(apiKey)
+	}
+	return AuthenticateHeader(r.Header.Get("Authorization"))
+}
+
+// AuthenticateTLS identify the caller by the verified client certificate of a tls connection
+func AuthenticateTLS(state *tls.ConnectionState) (Principal, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return Principal{}, false
+	}
+	cert := state.VerifiedChains[0][0]
+	if len(cert.Subject.OrganizationalUnit) == 0 {
+		return Principal{}, false
+	}
+	role, err := ParseRole(cert.Subject.OrganizationalUnit[0])
+	if err != nil {
+		return Principal{}, false
+	}
+	principal := Principal{Name: cert.Subject.CommonName, Role: role}
+	if len(cert.Subject.Organization) != 0 {
+		principal.Tenant = cert.Subject.Organization[0]
+	}
+	return principal, true
+}
+
+// AuthenticateHeader identify the caller by the value of an Authorization header
+func AuthenticateHeader(header string) (Principal, bool) {
+	token := strings.TrimPrefix(header, "Bearer ")
+	if token == "" || token == header {
+		return Principal{}, false
+	}
+	return LookupToken(token)
+}
+
+// Allowed tell whether the principal can call a route requiring the role.
+// Everything is allowed while no token and no client ca are configured
+func Allowed(principal Principal, ok bool, required Role) bool {
+	if required == RoleNone || !enabled() && !ok {
+		return true
+	}
+	return ok && principal.Role >= required
+}
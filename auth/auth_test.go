@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// useTokens configure tokens and tenant keys for a test, auth is disabled again afterwards
+func useTokens(t *testing.T, newTokens []Token, keys map[string]string) {
+	t.Cleanup(func() {
+		authLock.Lock()
+		tokens, tenantKeys = map[string]Principal{}, map[string]Principal{}
+		authLock.Unlock()
+	})
+	if err := SetTokens(newTokens); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetTenantKeys(keys); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func request(headers map[string]string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/new_task", nil)
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+	return r
+}
+
+func TestParseRole(t *testing.T) {
+	for _, role := range []Role{RoleDevice, RoleOperator} {
+		parsed, err := ParseRole(role.String())
+		if err != nil || parsed != role {
+			t.Fatalf("expected %v, got %v %v", role, parsed, err)
+		}
+	}
+	if _, err := ParseRole("none"); err == nil {
+		t.Fatal("none should not be given to a token")
+	}
+}
+
+func TestSetTokensValidate(t *testing.T) {
+	useTokens(t, nil, nil)
+	if err := SetTokens([]Token{{Token: "", Name: "empty", Role: "device"}}); err == nil {
+		t.Fatal("empty token should fail")
+	}
+	if err := SetTokens([]Token{{Token: "t", Name: "admin", Role: "root"}}); err == nil {
+		t.Fatal("unknown role should fail")
+	}
+}
+
+func TestAuthenticateHeader(t *testing.T) {
+	useTokens(t, []Token{
+		{Token: "op-token", Name: "ops", Role: "operator"},
+		{Token: "cam-token", Name: "camera", Role: "device", Tenant: "factory"},
+	}, map[string]string{"tenant-key": "shop"})
+
+	principal, ok := Authenticate(request(map[string]string{"Authorization": "Bearer op-token"}))
+	if !ok || principal.Role != RoleOperator || principal.Name != "ops" {
+		t.Fatalf("unexpected principal %+v %v", principal, ok)
+	}
+	principal, ok = Authenticate(request(map[string]string{"Authorization": "Bearer cam-token"}))
+	if !ok || principal.Tenant != "factory" {
+		t.Fatalf("the token should carry its tenant, got %+v %v", principal, ok)
+	}
+
+	// the api key of a tenant is a device of the tenant, by either header
+	for _, headers := range []map[string]string{
+		{"X-API-Key": "tenant-key"}, {"Authorization": "Bearer tenant-key"},
+	} {
+		principal, ok = Authenticate(request(headers))
+		if !ok || principal.Role != RoleDevice || principal.Tenant != "shop" {
+			t.Fatalf("%v: unexpected principal %+v %v", headers, principal, ok)
+		}
+	}
+
+	for _, headers := range []map[string]string{
+		{}, {"Authorization": "op-token"}, {"Authorization": "Bearer unknown"}, {"X-API-Key": "unknown"},
+		// an unauthenticated client id never picks the tenant
+		{"X-Client-ID": "shop"},
+	} {
+		if principal, ok = Authenticate(request(headers)); ok {
+			t.Fatalf("%v should not authenticate, got %+v", headers, principal)
+		}
+	}
+}
+
+func TestTenantKeyCollision(t *testing.T) {
+	useTokens(t, []Token{{Token: "shared", Name: "ops", Role: "operator"}}, nil)
+	if err := SetTenantKeys(map[string]string{"shared": "shop"}); err == nil {
+		t.Fatal("a tenant key equal to a token should fail")
+	}
+
+	if err := SetTenantKeys(map[string]string{"key": "shop"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetTokens([]Token{{Token: "key", Name: "ops", Role: "operator"}}); err == nil {
+		t.Fatal("a token equal to a tenant key should fail")
+	}
+	if principal, ok := LookupToken("shared"); !ok || principal.Role != RoleOperator {
+		t.Fatalf("a refused config should keep the tokens, got %+v %v", principal, ok)
+	}
+}
+
+func TestAuthenticateTLS(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{
+		CommonName: "camera-1", OrganizationalUnit: []string{"device"}, Organization: []string{"factory"},
+	}}
+	principal, ok := AuthenticateTLS(&tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}})
+	if !ok || principal.Name != "camera-1" || principal.Role != RoleDevice || principal.Tenant != "factory" {
+		t.Fatalf("unexpected principal %+v %v", principal, ok)
+	}
+
+	if _, ok = AuthenticateTLS(&tls.ConnectionState{}); ok {
+		t.Fatal("an unverified connection should not authenticate")
+	}
+	cert.Subject.OrganizationalUnit = []string{"admin"}
+	if _, ok = AuthenticateTLS(&tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}); ok {
+		t.Fatal("an unknown role should not authenticate")
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	useTokens(t, nil, map[string]string{"tenant-key": "shop"})
+	// tenant keys alone do not enable auth
+	if !Allowed(Principal{}, false, RoleOperator) {
+		t.Fatal("everything should be allowed without tokens")
+	}
+
+	useTokens(t, []Token{{Token: "op-token", Name: "ops", Role: "operator"}}, nil)
+	device := Principal{Name: "camera", Role: RoleDevice}
+	cases := []struct {
+		principal     Principal
+		authenticated bool
+		required      Role
+		allowed       bool
+	}{
+		{Principal{}, false, RoleNone, true},
+		{Principal{}, false, RoleDevice, false},
+		{device, true, RoleDevice, true},
+		{device, true, RoleOperator, false},
+		{Principal{Name: "ops", Role: RoleOperator}, true, RoleDevice, true},
+	}
+	for _, c := range cases {
+		if allowed := Allowed(c.principal, c.authenticated, c.required); allowed != c.allowed {
+			t.Fatalf("%+v: expected %v, got %v", c, c.allowed, allowed)
+		}
+	}
+}
+
+// with a client ca and no tokens, a caller without certificate is refused
+func TestAllowedClientCA(t *testing.T) {
+	useTokens(t, nil, nil)
+	SetClientCA(true)
+	t.Cleanup(func() { SetClientCA(false) })
+
+	principal, ok := Authenticate(request(nil))
+	if ok || Allowed(principal, ok, RoleDevice) || Allowed(principal, ok, RoleOperator) {
+		t.Fatal("a caller without certificate should be denied")
+	}
+	if !Allowed(principal, ok, RoleNone) {
+		t.Fatal("open routes should stay open")
+	}
+	if !Allowed(Principal{Name: "camera", Role: RoleDevice}, true, RoleDevice) {
+		t.Fatal("a verified certificate should be allowed")
+	}
+}
@@ -2,60 +2,250 @@ package buffer_pool
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"runtime"
+	"sort"
 	"sync"
 	"time"
 )
 
-var bufferLock *sync.Mutex = &sync.Mutex{}
-var bufferPool *[]*BufferElem = nil
-var buferAvalable []bool
+// sizeClass holds buffers for payloads up to size
+// at most maxOutstanding buffers of the class are held at the same time, further
+// acquisitions wait, which is the backpressure of the scheduler.
+// A returned buffer grown beyond maxRetain is dropped instead of retained
+type sizeClass struct {
+	size           int
+	maxOutstanding int
+	maxRetain      int
 
-const bufferSize = 100
+	slots chan struct{}
+	lock  sync.Mutex
+	free  []*bytes.Buffer
+
+	hits     int64
+	misses   int64
+	waits    int64
+	timeouts int64
+	dropped  int64
+}
+
+var sizeClasses = []*sizeClass{
+	newSizeClass(64*1024, 256, 128*1024),
+	newSizeClass(1024*1024, 64, 2*1024*1024),
+	newSizeClass(16*1024*1024, 16, 32*1024*1024),
+}
+
+func newSizeClass(size, maxOutstanding, maxRetain int) *sizeClass {
+	return &sizeClass{
+		size:           size,
+		maxOutstanding: maxOutstanding,
+		maxRetain:      maxRetain,
+		slots:          make(chan struct{}, maxOutstanding),
+	}
+}
 
 type BufferElem struct {
 	Buffer *bytes.Buffer
-	index  int
+
+	id         uint64
+	class      *sizeClass
+	acquiredAt time.Time
+	caller     string
 }
 
-func GetBuffer() *BufferElem {
-	bufferLock.Lock()
-	if bufferPool == nil {
-		bufferPool = &[]*BufferElem{}
-		for i := 0; i < bufferSize; i++ {
-			*bufferPool = append(*bufferPool, &BufferElem{
-				Buffer: &bytes.Buffer{},
-				index:  i,
-			})
-			buferAvalable = append(buferAvalable, true)
+var outstandingLock = sync.Mutex{}
+var nextID uint64 = 0
+
+// map from id to buffers not returned yet
+var outstanding = map[uint64]*BufferElem{}
+
+// ErrTimeout is returned when no buffer becomes available before the context is done,
+// a request should answer 503 and a result should go to the failure callback
+var ErrTimeout = errors.New("no buffer available in time")
+
+// AcquireTimeout is how long a buffer is waited for by a context of AcquireContext
+var AcquireTimeout = 10 * time.Second
+
+// AcquireContext return a context of parent which expires after AcquireTimeout
+func AcquireContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, AcquireTimeout)
+}
+
+// GetBuffer return a buffer of the smallest class, wait until one is available or ctx is done
+func GetBuffer(ctx context.Context) (*BufferElem, error) {
+	return acquire(ctx, 0)
+}
+
+// GetSizedBuffer return a buffer of the class fits sizeHint bytes, wait until one is available
+// or ctx is done
+func GetSizedBuffer(ctx context.Context, sizeHint int) (*BufferElem, error) {
+	return acquire(ctx, sizeHint)
+}
+
+func acquire(ctx context.Context, sizeHint int) (*BufferElem, error) {
+	class := sizeClasses[len(sizeClasses)-1]
+	for _, candidate := range sizeClasses {
+		if sizeHint <= candidate.size {
+			class = candidate
+			break
 		}
 	}
 
-	var chooseBuffer *BufferElem = nil
-	for {
-		for i := 0; i < bufferSize; i++ {
-			if buferAvalable[i] {
-				buferAvalable[i] = false
-				chooseBuffer = (*bufferPool)[i]
-				break
-			}
-		}
-		if chooseBuffer != nil {
-			break
+	select {
+	case class.slots <- struct{}{}:
+	default:
+		class.lock.Lock()
+		class.waits++
+		class.lock.Unlock()
+		log.Printf("No available buffer of %v bytes, wait", class.size)
+
+		select {
+		case class.slots <- struct{}{}:
+		case <-ctx.Done():
+			class.lock.Lock()
+			class.timeouts++
+			class.lock.Unlock()
+			return nil, fmt.Errorf("%w, %v bytes: %v", ErrTimeout, class.size, ctx.Err())
 		}
-		bufferLock.Unlock()
-		log.Printf("No avalable buffer, wait for 5 second")
-		time.Sleep(5 * time.Second)
-		bufferLock.Lock()
 	}
 
-	bufferLock.Unlock()
-	return chooseBuffer
+	var buffer *bytes.Buffer
+	class.lock.Lock()
+	if n := len(class.free); n > 0 {
+		buffer = class.free[n-1]
+		class.free = class.free[:n-1]
+		class.hits++
+	} else {
+		class.misses++
+	}
+	class.lock.Unlock()
+
+	if buffer == nil {
+		buffer = bytes.NewBuffer(make([]byte, 0, class.size))
+	}
+
+	bufferElem := &BufferElem{
+		Buffer:     buffer,
+		class:      class,
+		acquiredAt: time.Now(),
+	}
+	if _, callerFile, callerLine, ok := runtime.Caller(2); ok {
+		bufferElem.caller = fmt.Sprintf("%v:%v", callerFile, callerLine)
+	}
+
+	outstandingLock.Lock()
+	nextID++
+	bufferElem.id = nextID
+	outstanding[bufferElem.id] = bufferElem
+	outstandingLock.Unlock()
+
+	return bufferElem, nil
 }
 
 func ReturnBuffer(bufferElem *BufferElem) {
-	bufferLock.Lock()
-	buferAvalable[bufferElem.index] = true
-	bufferElem.Buffer.Reset()
-	bufferLock.Unlock()
+	outstandingLock.Lock()
+	_, ok := outstanding[bufferElem.id]
+	delete(outstanding, bufferElem.id)
+	outstandingLock.Unlock()
+
+	if !ok {
+		log.Printf("Buffer from %v is returned twice", bufferElem.caller)
+		return
+	}
+
+	class := bufferElem.class
+	buffer := bufferElem.Buffer
+	bufferElem.Buffer = nil
+
+	class.lock.Lock()
+	if buffer.Cap() > class.maxRetain {
+		class.dropped++
+	} else {
+		buffer.Reset()
+		class.free = append(class.free, buffer)
+	}
+	class.lock.Unlock()
+
+	<-class.slots
+}
+
+// ClassMetrics is the json view of a size class
+type ClassMetrics struct {
+	Size           int   `json:"size"`
+	MaxOutstanding int   `json:"max_outstanding"`
+	Outstanding    int   `json:"outstanding"`
+	Retained       int   `json:"retained"`
+	Hits           int64 `json:"hits"`
+	Misses         int64 `json:"misses"`
+	Waits          int64 `json:"waits"`
+	Timeouts       int64 `json:"timeouts"`
+	Dropped        int64 `json:"dropped"`
+}
+
+// Leak is a buffer held longer than the leak threshold
+type Leak struct {
+	Caller string `json:"caller"`
+	Held   string `json:"held"`
+	Size   int    `json:"size"`
+}
+
+type Metrics struct {
+	Classes []ClassMetrics `json:"classes"`
+	Leaks   []Leak         `json:"leaks"`
+}
+
+// LeakThreshold is how long a buffer can be held before it is reported as leaked
+var LeakThreshold = 2 * time.Minute
+
+func GetMetrics() Metrics {
+	metrics := Metrics{Classes: []ClassMetrics{}, Leaks: findLeaks(LeakThreshold)}
+	for _, class := range sizeClasses {
+		class.lock.Lock()
+		metrics.Classes = append(metrics.Classes, ClassMetrics{
+			Size:           class.size,
+			MaxOutstanding: class.maxOutstanding,
+			Outstanding:    len(class.slots),
+			Retained:       len(class.free),
+			Hits:           class.hits,
+			Misses:         class.misses,
+			Waits:          class.waits,
+			Timeouts:       class.timeouts,
+			Dropped:        class.dropped,
+		})
+		class.lock.Unlock()
+	}
+	return metrics
+}
+
+func findLeaks(threshold time.Duration) []Leak {
+	leaks := []Leak{}
+	outstandingLock.Lock()
+	for _, bufferElem := range outstanding {
+		if held := time.Since(bufferElem.acquiredAt); held > threshold {
+			leaks = append(leaks, Leak{
+				Caller: bufferElem.caller,
+				Held:   held.String(),
+				Size:   bufferElem.class.size,
+			})
+		}
+	}
+	outstandingLock.Unlock()
+
+	sort.Slice(leaks, func(i, j int) bool {
+		return leaks[i].Caller < leaks[j].Caller
+	})
+	return leaks
+}
+
+// RunLeakDetector log buffers held longer than LeakThreshold every interval, never return
+func RunLeakDetector(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, leak := range findLeaks(LeakThreshold) {
+			log.Printf("Buffer of %v bytes from %v is not returned for %v",
+				leak.Size, leak.Caller, leak.Held)
+		}
+	}
 }
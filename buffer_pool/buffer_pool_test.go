@@ -0,0 +1,118 @@
+package buffer_pool
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useClasses replace the size classes for a test by one class of 1KB with max outstanding buffers
+func useClasses(t *testing.T, maxOutstanding int) *sizeClass {
+	previous := sizeClasses
+	class := newSizeClass(1024, maxOutstanding, 2048)
+	sizeClasses = []*sizeClass{class}
+	t.Cleanup(func() { sizeClasses = previous })
+	return class
+}
+
+func TestGetBufferReuse(t *testing.T) {
+	class := useClasses(t, 2)
+
+	bufferElem, err := GetBuffer(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bufferElem.Buffer.WriteString("frame")
+	ReturnBuffer(bufferElem)
+	// a second return is ignored instead of freeing a slot twice
+	ReturnBuffer(bufferElem)
+
+	bufferElem, err = GetBuffer(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ReturnBuffer(bufferElem)
+	if bufferElem.Buffer.Len() != 0 {
+		t.Fatal("a reused buffer should be reset")
+	}
+	if class.hits != 1 || class.misses != 1 || len(class.slots) != 1 {
+		t.Fatalf("unexpected class %+v", class)
+	}
+}
+
+// an exhausted class blocks acquisitions until a buffer is returned
+func TestGetBufferExhausted(t *testing.T) {
+	useClasses(t, 1)
+	held, err := GetBuffer(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan *BufferElem)
+	go func() {
+		bufferElem, _ := GetBuffer(context.Background())
+		acquired <- bufferElem
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("the class should be exhausted")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ReturnBuffer(held)
+	select {
+	case bufferElem := <-acquired:
+		ReturnBuffer(bufferElem)
+	case <-time.After(time.Second):
+		t.Fatal("the returned buffer should be acquired")
+	}
+	if metrics := GetMetrics(); metrics.Classes[0].Waits != 1 || metrics.Classes[0].Outstanding != 0 {
+		t.Fatalf("unexpected metrics %+v", metrics)
+	}
+}
+
+func TestGetBufferTimeout(t *testing.T) {
+	useClasses(t, 1)
+	previous := AcquireTimeout
+	AcquireTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { AcquireTimeout = previous })
+
+	held, err := GetBuffer(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ReturnBuffer(held)
+
+	ctx, cancel := AcquireContext(context.Background())
+	defer cancel()
+	if _, err = GetSizedBuffer(ctx, 100); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected %v, got %v", ErrTimeout, err)
+	}
+	if metrics := GetMetrics(); metrics.Classes[0].Timeouts != 1 || metrics.Classes[0].Outstanding != 1 {
+		t.Fatalf("a timeout should not take a slot, got %+v", metrics)
+	}
+}
+
+func TestFindLeaks(t *testing.T) {
+	useClasses(t, 1)
+	bufferElem, err := GetBuffer(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ReturnBuffer(bufferElem)
+
+	if leaks := findLeaks(time.Hour); len(leaks) != 0 {
+		t.Fatalf("a fresh buffer is not leaked, got %+v", leaks)
+	}
+	time.Sleep(time.Millisecond)
+	leaks := findLeaks(0)
+	if len(leaks) != 1 || leaks[0].Size != 1024 {
+		t.Fatalf("expected the held buffer, got %+v", leaks)
+	}
+	// the caller of GetBuffer is reported
+	if caller := leaks[0].Caller; !strings.Contains(caller, "buffer_pool_test.go") {
+		t.Fatalf("unexpected caller %v", caller)
+	}
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"Scheduler/auth"
 	"Scheduler/buffer_pool"
 	"Scheduler/handler"
+	"Scheduler/overload"
+	"Scheduler/session"
 	"Scheduler/utils"
 	"Scheduler/worker_pool"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -14,11 +19,16 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 var schedulerPort = ":8081"
 
+// sessionIdleTimeout close a session without Last if it has no frame for the duration
+// overridden by env SESSION_IDLE_TIMEOUT, such as 90s
+var sessionIdleTimeout = 2 * time.Minute
+
 const (
 	STATUS_BEGIN   = "Begin"
 	STATUS_RUNNING = "Running"
@@ -27,13 +37,103 @@ const (
 
 type router struct{}
 
+// routeRoles is the role required by each route, routes not listed are open,
+// such as worker callbacks and registration from inside the cluster
+var routeRoles = map[string]auth.Role{
+	"/new_task":            auth.RoleDevice,
+	"/complete_task":       auth.RoleDevice,
+	"/stream_session":      auth.RoleDevice,
+	"/query_metric":        auth.RoleDevice,
+	"/close_session":       auth.RoleDevice,
+	"/update_cpu":          auth.RoleOperator,
+	"/create_workers":      auth.RoleOperator,
+	"/restart":             auth.RoleOperator,
+	"/drain_status":        auth.RoleOperator,
+	"/completion_metrics":  auth.RoleOperator,
+	"/buffer_metrics":      auth.RoleOperator,
+	"/preprocess":          auth.RoleOperator,
+	"/overload_policy":     auth.RoleOperator,
+	"/batch_config":        auth.RoleOperator,
+	"/queue_metrics":       auth.RoleOperator,
+	"/worker_connections":  auth.RoleOperator,
+	"/node_resources":      auth.RoleOperator,
+	"/gpu_allocations":     auth.RoleOperator,
+	"/pod_templates":       auth.RoleOperator,
+	"/worker_states":       auth.RoleOperator,
+	"/worker_ports":        auth.RoleOperator,
+	"/workers":             auth.RoleOperator,
+	"/drain_worker":        auth.RoleOperator,
+	"/cordon_worker":       auth.RoleOperator,
+	"/delete_worker":       auth.RoleOperator,
+	"/dashboard/events":    auth.RoleOperator,
+	"/tenants":             auth.RoleOperator,
+	"/sessions":            auth.RoleOperator,
+	"/debug/pprof/profile": auth.RoleOperator,
+}
+
+// adminActions are audited on every call, other operator routes are audited when they are changed by POST
+var adminActions = map[string]bool{
+	"/update_cpu":          true,
+	"/create_workers":      true,
+	"/restart":             true,
+	"/close_session":       true,
+	"/drain_worker":        true,
+	"/cordon_worker":       true,
+	"/delete_worker":       true,
+	"/debug/pprof/profile": true,
+}
+
+// statusRecorder remember the status code written to an audited response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
 func (r *router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	//log.Printf("Receive Path: [%v]", req.URL.Path)
+	required := routeRoles[req.URL.Path]
+	principal, authenticated := auth.Authenticate(req)
+	audited := adminActions[req.URL.Path] ||
+		(required == auth.RoleOperator && req.Method == http.MethodPost)
+
+	if !auth.Allowed(principal, authenticated, required) {
+		status := http.StatusForbidden
+		if !authenticated {
+			status = http.StatusUnauthorized
+		}
+		if audited {
+			auth.Audit(principal, req.RemoteAddr, req.URL.Path, "denied", status)
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	if audited {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		auth.Audit(principal, req.RemoteAddr, req.URL.Path, "started "+req.URL.RawQuery, 0)
+		defer func() {
+			auth.Audit(principal, req.RemoteAddr, req.URL.Path, "finished", recorder.status)
+		}()
+		w = recorder
+	}
+
+	// stream sessions are long-lived and counted as sessions by the drain
+	if required == auth.RoleDevice && req.URL.Path != "/stream_session" {
+		defer trackRequest()()
+	}
+
 	switch req.URL.Path {
 	case "/new_task":
 		newTask(w, req)
 	case "/complete_task":
 		completeTask(w, req)
+	case "/stream_session":
+		streamSession(w, req)
 	case "/worker_register":
 		workerRegister(w, req)
 	case "/query_metric":
@@ -52,6 +152,46 @@ func (r *router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		createWorkers(w, req)
 	case "/restart":
 		restart(w, req)
+	case "/drain_status":
+		drainStatusHandler(w, req)
+	case "/completion_metrics":
+		completionMetrics(w, req)
+	case "/buffer_metrics":
+		bufferMetrics(w, req)
+	case "/preprocess":
+		preprocess(w, req)
+	case "/overload_policy":
+		overloadPolicy(w, req)
+	case "/batch_config":
+		batchConfig(w, req)
+	case "/queue_metrics":
+		queueMetrics(w, req)
+	case "/worker_connections":
+		workerConnections(w, req)
+	case "/node_resources":
+		nodeResources(w, req)
+	case "/gpu_allocations":
+		gpuAllocations(w, req)
+	case "/pod_templates":
+		podTemplates(w, req)
+	case "/worker_states":
+		workerStates(w, req)
+	case "/worker_ports":
+		workerPorts(w, req)
+	case "/workers":
+		workers(w, req)
+	case "/drain_worker", "/cordon_worker", "/delete_worker":
+		workerAction(w, req)
+	case "/dashboard":
+		dashboard(w, req)
+	case "/dashboard/events":
+		dashboardEvents(w, req)
+	case "/tenants":
+		tenants(w, req)
+	case "/sessions":
+		listSessions(w, req)
+	case "/close_session":
+		closeSession(w, req)
 	case "/debug/pprof/profile":
 		pprof.Profile(w, req)
 	default:
@@ -60,17 +200,113 @@ func (r *router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 }
 
 func RunHttpServer() {
-	server := &http.Server{
+	if rawTimeout := os.Getenv("SESSION_IDLE_TIMEOUT"); rawTimeout != "" {
+		timeout, err := time.ParseDuration(rawTimeout)
+		if err != nil {
+			log.Panic(err)
+		}
+		sessionIdleTimeout = timeout
+	}
+	// PREPROCESS_CONFIG is a json object from task name to its preprocess config
+	if rawConfigs := os.Getenv("PREPROCESS_CONFIG"); rawConfigs != "" {
+		configs := map[string]*handler.PreprocessConfig{}
+		if err := json.Unmarshal([]byte(rawConfigs), &configs); err != nil {
+			log.Panic(err)
+		}
+		for taskName, config := range configs {
+			if err := handler.SetPreprocessConfig(taskName, config); err != nil {
+				log.Panic(err)
+			}
+		}
+	}
+
+	if err := auth.LoadTokensFromEnv(); err != nil {
+		log.Panic(err)
+	}
+	// TENANTS_CONFIG is a json array of tenant configs, their api keys are checked against the tokens
+	if err := worker_pool.LoadDefaultTenantQuotasFromEnv(); err != nil {
+		log.Panic(err)
+	}
+	if rawTenants := os.Getenv("TENANTS_CONFIG"); rawTenants != "" {
+		var tenants []*worker_pool.TenantConfig
+		if err := json.Unmarshal([]byte(rawTenants), &tenants); err != nil {
+			log.Panic(err)
+		}
+		if err := setTenants(tenants); err != nil {
+			log.Panic(err)
+		}
+	}
+	if err := auth.OpenAuditLog(); err != nil {
+		log.Panic(err)
+	}
+	if err := worker_pool.LoadGPUCapacityFromEnv(); err != nil {
+		log.Panic(err)
+	}
+	if err := worker_pool.LoadWorkerClientFromEnv(); err != nil {
+		log.Panic(err)
+	}
+	if err := worker_pool.LoadWorkerTLSFromEnv(); err != nil {
+		log.Panic(err)
+	}
+	if err := worker_pool.LoadPodTemplatesFromEnv(); err != nil {
+		log.Panic(err)
+	}
+	if err := worker_pool.LoadReadinessFromEnv(); err != nil {
+		log.Panic(err)
+	}
+	if err := worker_pool.LoadPortsFromEnv(); err != nil {
+		log.Panic(err)
+	}
+	if err := worker_pool.LoadQueueFromEnv(); err != nil {
+		log.Panic(err)
+	}
+	if err := worker_pool.LoadHealthFromEnv(); err != nil {
+		log.Panic(err)
+	}
+	loadStreamOriginsFromEnv()
+
+	if rawTimeout := os.Getenv("DRAIN_TIMEOUT"); rawTimeout != "" {
+		timeout, err := time.ParseDuration(rawTimeout)
+		if err != nil {
+			log.Panic(err)
+		}
+		drainTimeout = timeout
+	}
+	if rawDeletePods := os.Getenv("DRAIN_DELETE_PODS"); rawDeletePods != "" {
+		deletePods, err := strconv.ParseBool(rawDeletePods)
+		if err != nil {
+			log.Panic(err)
+		}
+		drainDeletePods = deletePods
+	}
+
+	go handleSignals()
+	go session.RunIdleChecker(sessionIdleTimeout)
+	go worker_pool.RunTenantCPUSampler(30 * time.Second)
+	go buffer_pool.RunLeakDetector(time.Minute)
+
+	httpServer = &http.Server{
 		Addr:         schedulerPort,
 		ReadTimeout:  1 * time.Minute,
 		WriteTimeout: 1 * time.Minute,
 		IdleTimeout:  1 * time.Minute,
 		Handler:      &router{},
+		TLSConfig:    serverTLSConfig,
 	}
 
-	if err := server.ListenAndServe(); err != nil {
+	var err error
+	if serverTLSConfig != nil {
+		// the certificate is served by TLSConfig.GetCertificate
+		err = httpServer.ListenAndServeTLS("", "")
+	} else {
+		err = httpServer.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
 		log.Panicf("listen: %s\n", err)
 	}
+	// the server is closed by drain, wait for it to finish before exit
+	<-drained
+	log.Printf("Scheduler drained, exit")
 
 }
 
@@ -81,12 +317,9 @@ type CreateInfo struct {
 	GpuLimits     map[string]int `json:"gpu_limit"`
 	GpuMemory     map[string]int `json:"gpu_memory"`
 	BatchSize     map[string]int
-}
-
-func restart(w http.ResponseWriter, r *http.Request) {
-	w.Write([]byte("OK"))
-	r.Body.Close()
-	os.Exit(0)
+	// Placement is binpack or spread to choose the nodes of Count workers instead of WorkerNumbers
+	Placement string `json:"placement"`
+	Count     int    `json:"count"`
 }
 
 func createWorkers(w http.ResponseWriter, r *http.Request) {
@@ -101,17 +334,83 @@ func createWorkers(w http.ResponseWriter, r *http.Request) {
 		log.Panic(err)
 	}
 
+	if _, err = createWorkersWithInfo(info); err != nil {
+		http.Error(w, err.Error(), createWorkersStatus(err))
+		return
+	}
+}
+
+// errCreateWorkers is wrapped by the error of workers failed to be created after the plan is admitted
+var errCreateWorkers = errors.New("create workers failed")
+
+// createWorkersLock serialize admission and creation, so a plan is admitted against the pods
+// of the plans admitted before it
+var createWorkersLock = sync.Mutex{}
+
+// createWorkersStatus is the http status of an error of createWorkersWithInfo
+func createWorkersStatus(err error) int {
+	if errors.Is(err, errCreateWorkers) {
+		return http.StatusInternalServerError
+	}
+	return http.StatusConflict
+}
+
+// createWorkersWithInfo place the workers if asked, and refuse the plan if it overcommits any node.
+// The workers created are returned even if some of them failed
+func createWorkersWithInfo(info *CreateInfo) ([]*worker_pool.Worker, error) {
+	createWorkersLock.Lock()
+	defer createWorkersLock.Unlock()
+
 	info.BatchSize = map[string]int{
 		"controller": 8,
 		"as1":        4,
 		"gpu1":       3,
 	}
 
+	if info.Placement != "" {
+		workerNumbers, err := worker_pool.PlaceWorkers(info.TaskName, info.Count, info.Placement,
+			info.CpuLimits, info.GpuLimits, info.GpuMemory)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("%v workers of %v are placed by %v: %v", info.Count, info.TaskName, info.Placement, workerNumbers)
+		info.WorkerNumbers = workerNumbers
+	}
+
+	if err := worker_pool.AdmitPlan(info.TaskName, info.WorkerNumbers, info.CpuLimits,
+		info.GpuLimits, info.GpuMemory); err != nil {
+		log.Printf("Refuse to create workers of %v: %v", info.TaskName, err)
+		return nil, err
+	}
+
 	utils.DebugWithTimeWait("Before creating workers")
 	log.Printf("Creating some workers... \n%v", info)
-	worker_pool.InitWorkers(info.WorkerNumbers, info.BatchSize, info.CpuLimits,
+	pool, err := worker_pool.InitWorkers(info.WorkerNumbers, info.BatchSize, info.CpuLimits,
 		info.GpuLimits, info.GpuMemory, info.TaskName)
 	utils.DebugWithTimeWait("After creating workers")
+	if err != nil {
+		return pool, fmt.Errorf("%w: only %v workers of %v created: %v",
+			errCreateWorkers, len(pool), info.TaskName, err)
+	}
+	return pool, nil
+}
+
+// nodeResources write the resource model of every node
+func nodeResources(w http.ResponseWriter, r *http.Request) {
+	nodes, err := worker_pool.GetNodeResources()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	marshal, err := json.Marshal(nodes)
+	if err != nil {
+		log.Panic(err)
+	}
+	_, err = w.Write(marshal)
+	if err != nil {
+		log.Panic(err)
+	}
 }
 
 func updateCPU(w http.ResponseWriter, r *http.Request) {
@@ -130,6 +429,31 @@ func updateCPU(w http.ResponseWriter, r *http.Request) {
 		log.Panic(err)
 	}
 
+	updateNodeCPU(nodeName, cpuLimit)
+}
+
+// gpuAllocations write the allocation table of every gpu, ?sync=true rebuild it from the cluster first
+func gpuAllocations(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("sync") == "true" {
+		if err := worker_pool.SyncGPUs(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+
+	marshal, err := json.Marshal(worker_pool.GetGPUAllocations())
+	if err != nil {
+		log.Panic(err)
+	}
+	_, err = w.Write(marshal)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// updateNodeCPU update cpu limit of fusion workers in the node, return number of updated workers
+func updateNodeCPU(nodeName string, cpuLimit int) int {
+	updated := 0
 	workerPool := worker_pool.GetWorkerPool("fusion")
 
 	log.Printf("Has %v workers", len(workerPool))
@@ -139,28 +463,82 @@ func updateCPU(w http.ResponseWriter, r *http.Request) {
 		for _, worker := range pool {
 			if worker.GetNodeName() == nodeName {
 				worker.UpdateResourceLimit(int64(cpuLimit))
+				updated++
 			}
 		}
 	}
+	return updated
 }
 
 // Each worker_pool node should register their IP When join the cluster
 // TODO worker_pool nodes should also register their resources info
 // workerRegister return back assigned port for the worker_pool
+// A worker co-located with the scheduler may send a json worker_pool.TransportSpec with its
+// register token to receive requests by unix socket or shared memory, an operator may change it too.
+// The spec with the paths the scheduler uses is written back
 func workerRegister(w http.ResponseWriter, r *http.Request) {
 	ip := strings.Split(r.RemoteAddr, ":")[0]
 
-	bufferElem := buffer_pool.GetBuffer()
+	ctx, cancel := buffer_pool.AcquireContext(r.Context())
+	defer cancel()
+	bufferElem, err := buffer_pool.GetBuffer(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer buffer_pool.ReturnBuffer(bufferElem)
 	buffer := bufferElem.Buffer
 	if _, err := io.Copy(buffer, r.Body); err != nil {
 		log.Panic(err)
 	}
 
-	buffer_pool.ReturnBuffer(bufferElem)
-
 	log.Println("Worker ", ip, " Has been Registered")
+
+	spec := worker_pool.TransportSpec{}
+	if buffer.Len() == 0 || json.Unmarshal(buffer.Bytes(), &spec) != nil || spec.Transport == "" {
+		return
+	}
+
+	worker, ok := worker_pool.FindWorker(ip, spec.Port)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no worker at %v:%v", ip, spec.Port), http.StatusNotFound)
+		return
+	}
+	principal, authenticated := auth.Authenticate(r)
+	operator := authenticated && principal.Role >= auth.RoleOperator
+	if !operator && !worker.CheckRegisterToken(spec.Token) {
+		http.Error(w, "invalid register token", http.StatusForbidden)
+		return
+	}
+	if spec.Transport != worker_pool.TransportHTTP && !worker_pool.IsLocalIP(ip) {
+		http.Error(w, fmt.Sprintf("%v transport requires the worker on the host of the scheduler",
+			spec.Transport), http.StatusForbidden)
+		return
+	}
+	if err := worker_pool.SetWorkerTransport(worker, spec); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	spec.Token = ""
+	if spec.Transport != worker_pool.TransportHTTP {
+		spec.SocketPath = worker_pool.SocketPathOf(worker)
+		spec.ShmPath = worker_pool.ShmPathOf(worker)
+	}
+	marshal, err := json.Marshal(spec)
+	if err != nil {
+		log.Panic(err)
+	}
+	_, err = w.Write(marshal)
+	if err != nil {
+		log.Panic(err)
+	}
 }
 
+// maxUploadMemory is the size of an uploaded file kept in memory, a larger one as a video
+// goes to a temporary file
+const maxUploadMemory = 2 * 1024 * 1024
+
 type CompleteTaskInfo struct {
 	DETNodeName        string `json:"det_node_name"`
 	DETTaskID          string `json:"det_task_id"`
@@ -169,19 +547,27 @@ type CompleteTaskInfo struct {
 	Status             string `json:"status"`
 	DeleteDETWorker    bool   `json:"delete_det_worker"`
 	DeleteFusionWorker bool   `json:"delete_fusion_worker"`
+	// priority class and deadline in milliseconds to get workers when Begin
+	Priority   string `json:"priority"`
+	DeadlineMs int64  `json:"deadline_ms"`
+	// identified from the request instead of the json
+	Tenant string `json:"-"`
 }
 
 func completeTask(w http.ResponseWriter, r *http.Request) {
 
-	reader, err := r.MultipartReader()
-	if err != nil {
-		log.Panic(err)
-	}
-
-	form, err := reader.ReadForm(1024 * 1024 * 2)
+	form, err := handler.ReadTaskForm(r, maxUploadMemory)
 	if err != nil {
-		log.Panic(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+	// the form is closed by the task once it is sent
+	dispatched := false
+	defer func() {
+		if !dispatched {
+			form.Close()
+		}
+	}()
 
 	if len(form.Value["json"]) != 1 {
 		log.Panicf("Expected len %v, got %v", 1, len(form.Value["json"]))
@@ -191,60 +577,143 @@ func completeTask(w http.ResponseWriter, r *http.Request) {
 	taskInfo := &CompleteTaskInfo{}
 	json.Unmarshal([]byte(rawJson), taskInfo)
 
+	if taskInfo.Tenant, err = tenantOf(r); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	principal, authenticated := auth.Authenticate(r)
+	if taskInfo.Status != STATUS_BEGIN {
+		if err = validateTaskIDs(taskInfo.DETTaskID, taskInfo.FusionTaskID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !canAccessSession(principal, authenticated, taskInfo.DETTaskID) {
+			http.Error(w, errNotSessionOwner.Error(), http.StatusForbidden)
+			return
+		}
+
+		if reason := admitFrame(taskInfo.DETTaskID, handler.FormFrame(form), taskInfo.Status); reason != "" {
+			log.Printf("Frame of task %v is skipped: %v", taskInfo.DETTaskID, reason)
+			w.Header().Set("X-Frame-Dropped", reason)
+			_, err = w.Write([]byte(fmt.Sprintf("%v:%v", taskInfo.DETTaskID, taskInfo.FusionTaskID)))
+			if err != nil {
+				log.Panic(err)
+			}
+			return
+		}
+	}
+
+	taskHandler, err := bindCompleteTask(r.Context(), taskInfo, handler.FormFrame(form), r.RemoteAddr,
+		sessionOwner(principal, authenticated))
+	if err != nil {
+		overload.Done(taskInfo.DETTaskID)
+		if err == errWorkersGone {
+			w.Write([]byte("Failed"))
+		} else {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		}
+		return
+	}
+
+	done := handler.TrackSend()
+	dispatched = true
+	go func() {
+		defer done()
+		defer form.Close()
+		taskHandler.SendTask()
+	}()
+
+	_, err = w.Write([]byte(fmt.Sprintf("%v:%v", taskInfo.DETTaskID, taskInfo.FusionTaskID)))
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+var errWorkersGone = errors.New("workers of the task are gone")
+
+// bindCompleteTask occupy det and fusion workers and open their session of owner when Begin,
+// or find the bound workers.
+// Assigned task ids are written back to taskInfo. Return errWorkersGone if the workers are gone,
+// or the error of the pending queue if workers can not be occupied
+func bindCompleteTask(ctx context.Context, taskInfo *CompleteTaskInfo, frame handler.FrameOpener,
+	clientAddress, owner string) (*handler.CompleteTaskHandler, error) {
 	var detWorker, fusionWorker *worker_pool.Worker
-	var detTaskID, fusionTaskID string
 
 	if taskInfo.Status == STATUS_BEGIN {
-		detTaskID = utils.GetUniqueID()
-		fusionTaskID = utils.GetUniqueID()
+		if draining.Load() {
+			return nil, errDraining
+		}
+		class, err := parseTaskClass(taskInfo.Priority, taskInfo.DeadlineMs)
+		if err != nil {
+			return nil, err
+		}
+		class.Tenant = taskInfo.Tenant
 
-		detWorker = worker_pool.OccupyWorker("det", detTaskID, taskInfo.DETNodeName)
-		fusionWorker = worker_pool.OccupyWorker("fusion", fusionTaskID, taskInfo.FusionNodeName)
+		taskInfo.DETTaskID = utils.GetUniqueID()
+		taskInfo.FusionTaskID = utils.GetUniqueID()
+
+		detWorker, err = handler.OccupyTaskWorker(ctx, "det", taskInfo.DETTaskID, taskInfo.DETNodeName, class)
+		if err != nil {
+			return nil, err
+		}
+		fusionWorker, err = worker_pool.OccupyWorkerWithClass(ctx, "fusion", taskInfo.FusionTaskID,
+			taskInfo.FusionNodeName, class)
+		if err != nil {
+			detWorker.ReturnToPool(taskInfo.DETTaskID)
+			return nil, err
+		}
+		session.Open(session.KindComplete, owner, nil,
+			session.Binding{TaskName: "det", TaskID: taskInfo.DETTaskID},
+			session.Binding{TaskName: "fusion", TaskID: taskInfo.FusionTaskID})
+		overload.Admit(taskInfo.DETTaskID, nil, true)
 	} else {
-		detWorker = worker_pool.GetWorkerByTaskID(taskInfo.DETTaskID)
-		fusionWorker = worker_pool.GetWorkerByTaskID(taskInfo.FusionTaskID)
+		if taskInfo.Status == STATUS_LAST {
+			if !session.End(taskInfo.DETTaskID) {
+				log.Printf("Session %v has been closed before Last", taskInfo.DETTaskID)
+				return nil, errWorkersGone
+			}
+		} else {
+			session.Touch(taskInfo.DETTaskID)
+		}
 
-		if detWorker == nil || fusionWorker == nil {
+		var detOK, fusionOK bool
+		detWorker, detOK = worker_pool.LookupWorker(taskInfo.DETTaskID)
+		fusionWorker, fusionOK = worker_pool.LookupWorker(taskInfo.FusionTaskID)
+		if !detOK || !fusionOK {
 			log.Printf("Maybe work not complete before delete, occationally internal bugs")
-			w.Write([]byte("Failed"))
-			return
+			return nil, errWorkersGone
 		}
-
-		detTaskID = taskInfo.DETTaskID
-		fusionTaskID = taskInfo.FusionTaskID
 	}
 
-	taskHandler := handler.NewCompleteTaskHandler(
+	return handler.NewCompleteTaskHandler(
 		detWorker,
 		fusionWorker,
-		detTaskID,
-		fusionTaskID,
-		form,
+		taskInfo.DETTaskID,
+		taskInfo.FusionTaskID,
+		frame,
 		taskInfo.Status,
 		taskInfo.DeleteDETWorker,
 		taskInfo.DeleteFusionWorker,
-		r.RemoteAddr)
-	go taskHandler.SendTask()
-
-	_, err = w.Write([]byte(fmt.Sprintf("%v:%v", detTaskID, fusionTaskID)))
-	if err != nil {
-		log.Panic(err)
-	}
+		clientAddress), nil
 }
 
 // Receive a task from devices, and submit to specific worker_pool
 // Write back task id
 // TODO apply and plug Scheduling and Resource Allocation Strategy
 func newTask(w http.ResponseWriter, r *http.Request) {
-	reader, err := r.MultipartReader()
-	if err != nil {
-		log.Panic(err)
-	}
-
-	form, err := reader.ReadForm(1024 * 1024 * 2)
+	form, err := handler.ReadTaskForm(r, maxUploadMemory)
 	if err != nil {
-		log.Panic(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+	// the form is closed by SendBackResult once the task is done
+	dispatched := false
+	defer func() {
+		if !dispatched {
+			form.Close()
+		}
+	}()
 
 	taskName := form.Value["task_name"][0]
 	if err != nil {
@@ -261,28 +730,69 @@ func newTask(w http.ResponseWriter, r *http.Request) {
 		log.Panic(err)
 	}
 
+	handlers := handler.GetHandler(taskName)
+	// only frames go through the overload policy, a video of mcmot is never skipped
+	isFrameTask := handlers.StartFrameTask != nil
+
+	principal, authenticated := auth.Authenticate(r)
 	taskID := form.Value["task_id"][0]
-	if err != nil {
-		log.Panic(err)
-	}
+	if status != STATUS_BEGIN {
+		if err = validateTaskIDs(taskID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !canAccessSession(principal, authenticated, taskID) {
+			http.Error(w, errNotSessionOwner.Error(), http.StatusForbidden)
+			return
+		}
 
-	var worker *worker_pool.Worker
-	var returnWorker bool
+		if isFrameTask {
+			if reason := admitFrame(taskID, handler.FormFrame(form), status); reason != "" {
+				log.Printf("Frame of task %v is skipped: %v", taskID, reason)
+				w.Header().Set("X-Frame-Dropped", reason)
+				_, err = w.Write([]byte(taskID))
+				if err != nil {
+					log.Panic(err)
+				}
+				return
+			}
+		}
+	}
 
+	var class worker_pool.TaskClass
 	if status == STATUS_BEGIN {
-		taskID = utils.GetUniqueID()
-		// TODO Make Decision Here, Apply True Resource Allocation
-		// Default Round Robin and Allocate Expected Resource
-		worker = worker_pool.OccupyWorker(taskName, taskID, nodeName)
-		//worker := worker_pool.CreateWorker(podsInfo.TaskName, podsInfo.NodeName, podsInfo.HostName, cpuLimit)
-		//worker.bindTaskID(strconv.Itoa(taskID))
-		returnWorker = false
-	} else if status == STATUS_RUNNING {
-		worker = worker_pool.GetWorkerByTaskID(taskID)
-		returnWorker = false
-	} else if status == STATUS_LAST {
-		worker = worker_pool.GetWorkerByTaskID(taskID)
-		returnWorker = true
+		var deadlineMs int64
+		if len(form.Value["deadline_ms"]) != 0 {
+			if deadlineMs, err = strconv.ParseInt(form.Value["deadline_ms"][0], 10, 64); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		priority := ""
+		if len(form.Value["priority"]) != 0 {
+			priority = form.Value["priority"][0]
+		}
+		if class, err = parseTaskClass(priority, deadlineMs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if class.Tenant, err = tenantOf(r); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	worker, taskID, returnWorker, err := bindTask(r.Context(), taskName, nodeName, status, taskID, class,
+		sessionOwner(principal, authenticated))
+	if err == errTaskNotFound {
+		if isFrameTask {
+			overload.Done(taskID)
+		}
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
 	}
 
 	log.Printf("Receive task %v, assigned id %v, worker_pool %v", taskName, taskID, worker.Describe())
@@ -295,11 +805,11 @@ func newTask(w http.ResponseWriter, r *http.Request) {
 
 	deleteWorker := len(form.Value["delete"]) != 0
 
-	handlers := handler.GetHandler(taskName)
 	now := time.Now()
-	handlers.StartTask(worker, form, taskID)
+	completion := handlers.StartTask(worker, form, taskID)
 	log.Printf("New Task start task %v", time.Since(now))
-	handlers.SendBackResult(r, taskID, worker, returnWorker, deleteWorker)
+	dispatched = true
+	handlers.SendBackResult(r, form, completion, worker, returnWorker, deleteWorker)
 
 	_, err = w.Write([]byte(taskID))
 	if err != nil {
@@ -307,38 +817,676 @@ func newTask(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func queryMetrics(w http.ResponseWriter, r *http.Request) {
-	bufferElem := buffer_pool.GetBuffer()
-	buffer := bufferElem.Buffer
-	if _, err := io.Copy(buffer, r.Body); err != nil {
-		log.Panic(err)
+// admitFrame pass a Running or Last frame through the overload policy of its session,
+// it must be called before bindTask since the session of a Last frame is ended there,
+// and the Last frame waits for the frame in flight. Return the reason if the frame is skipped
+func admitFrame(taskID string, frame handler.FrameOpener, status string) string {
+	return overload.Admit(taskID, frame, status == STATUS_LAST)
+}
+
+// validateTaskIDs check task ids sent by clients are generated by this scheduler
+func validateTaskIDs(taskIDs ...string) error {
+	for _, taskID := range taskIDs {
+		if err := utils.ValidateTaskID(taskID); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	taskID := buffer.String()
-	buffer_pool.ReturnBuffer(bufferElem)
-	worker := worker_pool.GetWorkerByTaskID(taskID)
-	var usage *worker_pool.ResourceUsage
-	if worker != nil {
-		usage = worker_pool.QueryResourceUsage(worker.GetPodName())
-	} else {
-		usage = &worker_pool.ResourceUsage{
-			CPU:              0,
-			Memory:           0,
-			Storage:          0,
-			StorageEphemeral: 0,
-			CollectedTime:    "Task has been ended",
-			Window:           0,
-			Available:        false,
+// tenantOf identify the tenant of a request by its authenticated identity, see tenantOfPrincipal
+func tenantOf(r *http.Request) (string, error) {
+	principal, authenticated := auth.Authenticate(r)
+	hasCredentials := r.Header.Get("Authorization") != "" || r.Header.Get("X-API-Key") != ""
+	return tenantOfPrincipal(principal, authenticated, hasCredentials)
+}
+
+// tenantOfPrincipal is the tenant of the principal, or the default tenant for a principal of no tenant
+// or an anonymous caller while auth is disabled. Credentials that do not authenticate are an error
+func tenantOfPrincipal(principal auth.Principal, authenticated, hasCredentials bool) (string, error) {
+	if authenticated {
+		if principal.Tenant != "" {
+			return principal.Tenant, nil
 		}
+		return worker_pool.DefaultTenant, nil
+	}
+	if hasCredentials {
+		return "", errors.New("unknown api key")
 	}
+	return worker_pool.DefaultTenant, nil
+}
 
-	marshal, err := json.Marshal(usage)
-	if err != nil {
-		log.Panic(err)
+var errNotSessionOwner = errors.New("the session belongs to another client")
+
+// sessionOwner is the owner of the sessions opened by the principal, empty for anonymous callers
+func sessionOwner(principal auth.Principal, authenticated bool) string {
+	if !authenticated {
+		return ""
 	}
-	_, err = w.Write(marshal)
-	if err != nil {
-		log.Panic(err)
+	return principal.Name
+}
+
+// canAccessSession tell whether the principal may act on the session of taskID. Operators, and
+// everyone while auth is disabled, may act on any session, a device only on the sessions it opened.
+// A session not exist is left to the caller to report
+func canAccessSession(principal auth.Principal, authenticated bool, taskID string) bool {
+	if auth.Allowed(principal, authenticated, auth.RoleOperator) {
+		return true
 	}
+	owner, ok := session.Owner(taskID)
+	return !ok || owner == principal.Name
+}
 
+// parseTaskClass parse the priority class name and the deadline in milliseconds from now,
+// a deadline <= 0 means no deadline
+func parseTaskClass(priority string, deadlineMs int64) (worker_pool.TaskClass, error) {
+	class := worker_pool.TaskClass{}
+	var err error
+	if class.Priority, err = worker_pool.ParsePriority(priority); err != nil {
+		return class, err
+	}
+	if deadlineMs > 0 {
+		class.Deadline = time.Now().Add(time.Duration(deadlineMs) * time.Millisecond)
+	}
+	return class, nil
+}
+
+var errTaskNotFound = errors.New("no worker is bound to the task")
+
+// bindTask occupy a worker for the task when Begin, waiting in the pending queue by class,
+// and open its session of owner, or find the bound worker. Return the worker, the task id, and whether the worker should be
+// returned after this frame. The error is returned when Begin is preempted or misses its deadline,
+// or errTaskNotFound if no worker is bound to a Running or Last task
+func bindTask(ctx context.Context, taskName, nodeName, status, taskID string,
+	class worker_pool.TaskClass, owner string) (*worker_pool.Worker, string, bool, error) {
+	var worker *worker_pool.Worker
+	var returnWorker bool
+
+	if status == STATUS_BEGIN {
+		if draining.Load() {
+			return nil, taskID, false, errDraining
+		}
+		taskID = utils.GetUniqueID()
+		// TODO Make Decision Here, Apply True Resource Allocation
+		// Default Round Robin and Allocate Expected Resource
+		var err error
+		worker, err = handler.OccupyTaskWorker(ctx, taskName, taskID, nodeName, class)
+		if err != nil {
+			return nil, taskID, false, err
+		}
+		//worker := worker_pool.CreateWorker(podsInfo.TaskName, podsInfo.NodeName, podsInfo.HostName, cpuLimit)
+		//worker.bindTaskID(strconv.Itoa(taskID))
+		returnWorker = false
+		session.Open(session.KindTask, owner, nil,
+			session.Binding{TaskName: taskName, TaskID: taskID})
+		// the Begin frame is never skipped, but counted in flight
+		if handler.GetHandler(taskName).StartFrameTask != nil {
+			overload.Admit(taskID, nil, true)
+		}
+	} else if status == STATUS_RUNNING || status == STATUS_LAST {
+		// a session closed meanwhile has returned its worker, the Last frame must not return it again
+		if status == STATUS_LAST {
+			if !session.End(taskID) {
+				log.Printf("Session %v has been closed before Last", taskID)
+				return nil, taskID, false, errTaskNotFound
+			}
+			returnWorker = true
+		} else {
+			session.Touch(taskID)
+		}
+		var ok bool
+		if worker, ok = worker_pool.LookupWorker(taskID); !ok {
+			return nil, taskID, false, errTaskNotFound
+		}
+	}
+
+	return worker, taskID, returnWorker, nil
+}
+
+func queryMetrics(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := buffer_pool.AcquireContext(r.Context())
+	defer cancel()
+	bufferElem, err := buffer_pool.GetBuffer(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	buffer := bufferElem.Buffer
+	if _, err := io.Copy(buffer, r.Body); err != nil {
+		log.Panic(err)
+	}
+
+	taskID := buffer.String()
+	buffer_pool.ReturnBuffer(bufferElem)
+
+	if err := validateTaskIDs(taskID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if principal, authenticated := auth.Authenticate(r); !canAccessSession(principal, authenticated, taskID) {
+		http.Error(w, errNotSessionOwner.Error(), http.StatusForbidden)
+		return
+	}
+
+	marshal, err := json.Marshal(queryTaskUsage(taskID))
+	if err != nil {
+		log.Panic(err)
+	}
+	_, err = w.Write(marshal)
+	if err != nil {
+		log.Panic(err)
+	}
+
+}
+
+func queryTaskUsage(taskID string) *worker_pool.ResourceUsage {
+	var usage *worker_pool.ResourceUsage
+	if worker, ok := worker_pool.LookupWorker(taskID); ok {
+		usage = worker_pool.QueryResourceUsage(worker.GetPodName())
+	} else {
+		usage = &worker_pool.ResourceUsage{
+			CPU:              0,
+			Memory:           0,
+			Storage:          0,
+			StorageEphemeral: 0,
+			CollectedTime:    "Task has been ended",
+			Window:           0,
+			Available:        false,
+		}
+	}
+
+	return usage
+}
+
+func listSessions(w http.ResponseWriter, r *http.Request) {
+	marshal, err := json.Marshal(session.List())
+	if err != nil {
+		log.Panic(err)
+	}
+	_, err = w.Write(marshal)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// closeSession force close the session of the task id in body, reset and return its workers.
+// A device may only close the sessions it opened
+func closeSession(w http.ResponseWriter, r *http.Request) {
+	rawTaskID, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if err = validateTaskIDs(string(rawTaskID)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if principal, authenticated := auth.Authenticate(r); !canAccessSession(principal, authenticated, string(rawTaskID)) {
+		http.Error(w, errNotSessionOwner.Error(), http.StatusForbidden)
+		return
+	}
+
+	if !session.Close(string(rawTaskID), "closed by request") {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	_, err = w.Write([]byte("OK"))
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// completionMetrics write counters of worker results and the tasks still waiting for results
+func completionMetrics(w http.ResponseWriter, r *http.Request) {
+	marshal, err := json.Marshal(handler.GetCompletionMetrics())
+	if err != nil {
+		log.Panic(err)
+	}
+	_, err = w.Write(marshal)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// bufferMetrics write the usage of each buffer size class and the buffers suspected to be leaked
+func bufferMetrics(w http.ResponseWriter, r *http.Request) {
+	marshal, err := json.Marshal(buffer_pool.GetMetrics())
+	if err != nil {
+		log.Panic(err)
+	}
+	_, err = w.Write(marshal)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+type PreprocessInfo struct {
+	TaskName string                    `json:"task_name"`
+	Config   *handler.PreprocessConfig `json:"config"`
+}
+
+// preprocess write configs and bytes saved of frame preprocessing on GET,
+// and set the config of a task type on POST, a null config disables it
+func preprocess(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		rawInfo, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		info := &PreprocessInfo{}
+		if err = json.Unmarshal(rawInfo, info); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// only frame tasks can be preprocessed
+		if handler.GetHandler(info.TaskName).StartFrameTask == nil {
+			http.Error(w, fmt.Sprintf("Task %v has no frame to preprocess", info.TaskName), http.StatusBadRequest)
+			return
+		}
+
+		if err = handler.SetPreprocessConfig(info.TaskName, info.Config); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("preprocess config of %v is set to %+v", info.TaskName, info.Config)
+	}
+
+	marshal, err := json.Marshal(handler.GetPreprocessStatus())
+	if err != nil {
+		log.Panic(err)
+	}
+	_, err = w.Write(marshal)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// OverloadPolicyInfo set the policy of a task type by TaskName, or of a session by TaskID
+type OverloadPolicyInfo struct {
+	TaskName string           `json:"task_name"`
+	TaskID   string           `json:"task_id"`
+	Policy   *overload.Policy `json:"policy"`
+}
+
+// overloadPolicy write policies and dropped frames of sessions on GET,
+// and set a policy on POST, a null policy disables it
+func overloadPolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		rawInfo, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		info := &OverloadPolicyInfo{}
+		if err = json.Unmarshal(rawInfo, info); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if info.TaskID != "" {
+			if err = validateTaskIDs(info.TaskID); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			found, err := overload.SetSessionPolicy(info.TaskID, info.Policy)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !found {
+				http.Error(w, "Session not found", http.StatusNotFound)
+				return
+			}
+		} else {
+			if handler.GetHandler(info.TaskName).StartFrameTask == nil {
+				http.Error(w, fmt.Sprintf("Task %v has no frame to skip", info.TaskName), http.StatusBadRequest)
+				return
+			}
+			if err = overload.SetPolicy(info.TaskName, info.Policy); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		log.Printf("overload policy of %v%v is set to %+v", info.TaskName, info.TaskID, info.Policy)
+	}
+
+	marshal, err := json.Marshal(overload.GetStatus())
+	if err != nil {
+		log.Panic(err)
+	}
+	_, err = w.Write(marshal)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// batchConfig write the det batch config and metrics on GET, and replace the config on POST
+func batchConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		rawConfig, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		config := handler.BatchConfig{}
+		if err = json.Unmarshal(rawConfig, &config); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err = handler.SetBatchConfig(config); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("det batch config is set to %+v", config)
+	}
+
+	marshal, err := json.Marshal(handler.GetBatchStatus())
+	if err != nil {
+		log.Panic(err)
+	}
+	_, err = w.Write(marshal)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// WorkerConnections is the client config and the connection metrics of every worker
+type WorkerConnections struct {
+	Config  worker_pool.WorkerClientConfig `json:"config"`
+	Workers []worker_pool.ConnMetrics      `json:"workers"`
+}
+
+// workerConnections write the worker client config and connection metrics,
+// and replace the client config on POST
+func workerConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		rawConfig, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		config := worker_pool.GetWorkerClientConfig()
+		if err = json.Unmarshal(rawConfig, &config); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		worker_pool.SetWorkerClientConfig(config)
+		log.Printf("worker client config is set to %+v", config)
+	}
+
+	marshal, err := json.Marshal(WorkerConnections{
+		Config:  worker_pool.GetWorkerClientConfig(),
+		Workers: worker_pool.GetConnMetrics(),
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	_, err = w.Write(marshal)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// PodTemplate is the yaml pod template of a task type, see worker_pool/template.go
+type PodTemplate struct {
+	TaskType string `json:"task_type"`
+	Template string `json:"template"`
+}
+
+// PodTemplates is the worker namespace and the pod template of every task type
+type PodTemplates struct {
+	Namespace string            `json:"namespace"`
+	Templates map[string]string `json:"templates"`
+}
+
+// podTemplates write the pod templates, and replace the template of a task type on POST,
+// an empty template removes it. Workers already created keep their pods
+func podTemplates(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		rawTemplate, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		template := PodTemplate{}
+		if err = json.Unmarshal(rawTemplate, &template); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if template.TaskType == "" {
+			http.Error(w, "task_type is required", http.StatusBadRequest)
+			return
+		}
+
+		if err = worker_pool.SetPodTemplate(template.TaskType, template.Template); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	marshal, err := json.Marshal(PodTemplates{
+		Namespace: worker_pool.WorkerNamespace(),
+		Templates: worker_pool.GetPodTemplates(),
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	_, err = w.Write(marshal)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// workerStates write the lifecycle state and recent transitions of every worker
+func workerStates(w http.ResponseWriter, r *http.Request) {
+	marshal, err := json.Marshal(worker_pool.GetWorkerStates())
+	if err != nil {
+		log.Panic(err)
+	}
+	_, err = w.Write(marshal)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// WorkerPorts is the port range of every host and the ports leased to workers
+type WorkerPorts struct {
+	Ranges map[string]worker_pool.PortRange `json:"ranges"`
+	Leases []worker_pool.PortLease          `json:"leases"`
+}
+
+// workerPorts write the port ranges and the leased ports of workers
+func workerPorts(w http.ResponseWriter, r *http.Request) {
+	ranges, leases := worker_pool.GetPortLeases()
+	marshal, err := json.Marshal(WorkerPorts{Ranges: ranges, Leases: leases})
+	if err != nil {
+		log.Panic(err)
+	}
+	_, err = w.Write(marshal)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// SingleWorker is a worker of TaskName to create in the logical node NodeName, such as as1 or gpu1
+type SingleWorker struct {
+	TaskName  string `json:"task_name"`
+	NodeName  string `json:"node_name"`
+	CpuLimit  int    `json:"cpu_limit"`
+	GpuLimit  int    `json:"gpu_limit"`
+	GpuMemory int    `json:"gpu_memory"`
+}
+
+// workers write every worker on GET, ?usage=true also queries the resource usage of their pods.
+// POST a SingleWorker to create it, the plan is admitted as /create_workers does
+func workers(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		rawInfo, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		single := SingleWorker{}
+		if err = json.Unmarshal(rawInfo, &single); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, ok := worker_pool.PodsInfo[single.TaskName+"-"+single.NodeName]; !ok {
+			http.Error(w, fmt.Sprintf("%v workers are not supported in %v", single.TaskName, single.NodeName),
+				http.StatusBadRequest)
+			return
+		}
+
+		created, err := createWorkersWithInfo(&CreateInfo{
+			TaskName:      single.TaskName,
+			WorkerNumbers: map[string]int{single.NodeName: 1},
+			CpuLimits:     map[string]int{single.NodeName: single.CpuLimit},
+			GpuLimits:     map[string]int{single.NodeName: single.GpuLimit},
+			GpuMemory:     map[string]int{single.NodeName: single.GpuMemory},
+		})
+		if err != nil {
+			http.Error(w, err.Error(), createWorkersStatus(err))
+			return
+		}
+		log.Printf("worker %v is created by request", created[0].GetWorkerName())
+	}
+
+	infos := worker_pool.GetWorkerInfos(r.URL.Query().Get("usage") == "true")
+	for i := range infos {
+		if infos[i].TaskID == "" {
+			continue
+		}
+		if age, ok := session.Age(infos[i].TaskID); ok {
+			infos[i].SessionAge = age.String()
+		}
+	}
+
+	marshal, err := json.Marshal(infos)
+	if err != nil {
+		log.Panic(err)
+	}
+	_, err = w.Write(marshal)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// WorkerAction is the body of /drain_worker, /cordon_worker and /delete_worker,
+// Cordon false resumes a cordoned worker
+type WorkerAction struct {
+	Worker string `json:"worker"`
+	Cordon bool   `json:"cordon"`
+}
+
+// workerAction drain, cordon or delete the worker of the name. Drain deletes it once its task is
+// returned, delete refuses a worker running a task
+func workerAction(w http.ResponseWriter, r *http.Request) {
+	rawAction, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	action := WorkerAction{}
+	if err = json.Unmarshal(rawAction, &action); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	worker, ok := worker_pool.FindWorkerByName(action.Worker)
+	if !ok {
+		http.Error(w, fmt.Sprintf("worker %v not found", action.Worker), http.StatusNotFound)
+		return
+	}
+
+	result := "OK"
+	switch r.URL.Path {
+	case "/drain_worker":
+		if worker.Drain() {
+			result = "Deleted"
+		} else {
+			result = "Draining"
+		}
+	case "/cordon_worker":
+		worker.Cordon(action.Cordon)
+	case "/delete_worker":
+		if err = worker.Delete(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		result = "Deleted"
+	}
+
+	_, err = w.Write([]byte(result))
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// queueMetrics write tasks waiting for workers and the served, preempted and
+// deadline missed counts of each priority class
+func queueMetrics(w http.ResponseWriter, r *http.Request) {
+	marshal, err := json.Marshal(worker_pool.GetQueueMetrics())
+	if err != nil {
+		log.Panic(err)
+	}
+	_, err = w.Write(marshal)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// setTenants replace the tenant configs and the api keys authenticating their devices
+func setTenants(configs []*worker_pool.TenantConfig) error {
+	keys := map[string]string{}
+	for _, config := range configs {
+		for _, apiKey := range config.APIKeys {
+			keys[apiKey] = config.ID
+		}
+	}
+	if err := auth.SetTenantKeys(keys); err != nil {
+		return err
+	}
+	if err := worker_pool.SetTenants(configs); err != nil {
+		// keep the keys of the tenants still configured
+		if restoreErr := auth.SetTenantKeys(worker_pool.TenantAPIKeys()); restoreErr != nil {
+			log.Printf("restore api keys of tenants failed: %v", restoreErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// tenants write the usage report of every tenant on GET, and replace all tenant configs on POST
+func tenants(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		rawTenants, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		var configs []*worker_pool.TenantConfig
+		if err = json.Unmarshal(rawTenants, &configs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err = setTenants(configs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("%v tenants are configured", len(configs))
+	}
+
+	marshal, err := json.Marshal(worker_pool.GetTenantUsage())
+	if err != nil {
+		log.Panic(err)
+	}
+	_, err = w.Write(marshal)
+	if err != nil {
+		log.Panic(err)
+	}
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"Scheduler/auth"
+	"Scheduler/session"
+	"Scheduler/utils"
+	"Scheduler/worker_pool"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// the tenant comes only from the authenticated identity
+func TestTenantOfPrincipal(t *testing.T) {
+	cases := []struct {
+		principal      auth.Principal
+		authenticated  bool
+		hasCredentials bool
+		tenant         string
+		fails          bool
+	}{
+		{auth.Principal{Name: "shop", Role: auth.RoleDevice, Tenant: "shop"}, true, true, "shop", false},
+		{auth.Principal{Name: "ops", Role: auth.RoleOperator}, true, true, worker_pool.DefaultTenant, false},
+		{auth.Principal{}, false, false, worker_pool.DefaultTenant, false},
+		{auth.Principal{}, false, true, "", true},
+	}
+	for _, c := range cases {
+		tenant, err := tenantOfPrincipal(c.principal, c.authenticated, c.hasCredentials)
+		if (err != nil) != c.fails || tenant != c.tenant {
+			t.Fatalf("%+v: got %q %v", c, tenant, err)
+		}
+	}
+}
+
+// a device may only close the sessions it opened, operators may close any
+func TestCloseSessionChecksOwner(t *testing.T) {
+	if err := auth.SetTokens([]auth.Token{
+		{Token: "token-a", Name: "camera-a", Role: "device"},
+		{Token: "token-b", Name: "camera-b", Role: "device"},
+		{Token: "token-ops", Name: "ops", Role: "operator"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = auth.SetTokens(nil) })
+
+	closeAs := func(token, taskID string) int {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/close_session", strings.NewReader(taskID))
+		r.Header.Set("Authorization", "Bearer "+token)
+		closeSession(recorder, r)
+		return recorder.Code
+	}
+
+	first, second := utils.GetUniqueID(), utils.GetUniqueID()
+	session.Open(session.KindTask, "camera-a", nil, session.Binding{TaskName: "det", TaskID: first})
+	session.Open(session.KindTask, "camera-a", nil, session.Binding{TaskName: "det", TaskID: second})
+	t.Cleanup(func() {
+		session.End(first)
+		session.End(second)
+	})
+
+	if code := closeAs("token-b", first); code != http.StatusForbidden {
+		t.Fatalf("another device should be forbidden, got %v", code)
+	}
+	if code := closeAs("token-a", first); code != http.StatusOK {
+		t.Fatalf("the owner should close its session, got %v", code)
+	}
+	if code := closeAs("token-ops", second); code != http.StatusOK {
+		t.Fatalf("an operator should close any session, got %v", code)
+	}
+	if code := closeAs("token-a", second); code != http.StatusNotFound {
+		t.Fatalf("a closed session should not be found, got %v", code)
+	}
+}
+
+// a Last frame of a session closed meanwhile does not get the worker the close returned
+func TestBindTaskLastAfterClose(t *testing.T) {
+	taskID := utils.GetUniqueID()
+	session.Open(session.KindTask, "", nil, session.Binding{TaskName: "det", TaskID: taskID})
+	if !session.Close(taskID, "test") {
+		t.Fatal("the session should be closed")
+	}
+	if _, _, _, err := bindTask(context.Background(), "det", "gpu1", STATUS_LAST, taskID,
+		worker_pool.TaskClass{}, ""); err != errTaskNotFound {
+		t.Fatalf("expected %v, got %v", errTaskNotFound, err)
+	}
+}
+
+// worker actions find the worker by name, and delete refuses a worker running a task
+func TestWorkerAction(t *testing.T) {
+	pool := &sync.Map{}
+	pool.Store("busy", &worker_pool.Worker{})
+	worker_pool.WorkerMap.Store("action-test", pool)
+	t.Cleanup(func() { worker_pool.WorkerMap.Delete("action-test") })
+
+	act := func(path, body string) (int, string) {
+		recorder := httptest.NewRecorder()
+		workerAction(recorder, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return recorder.Code, strings.TrimSpace(recorder.Body.String())
+	}
+
+	cases := []struct {
+		path, body string
+		code       int
+		result     string
+	}{
+		{"/delete_worker", `{"worker": "missing"}`, http.StatusNotFound, "worker missing not found"},
+		{"/delete_worker", `{"worker":`, http.StatusBadRequest, ""},
+		{"/cordon_worker", `{"worker": "busy", "cordon": true}`, http.StatusOK, "OK"},
+		{"/delete_worker", `{"worker": "busy"}`, http.StatusConflict, ""},
+		{"/drain_worker", `{"worker": "busy"}`, http.StatusOK, "Draining"},
+	}
+	for _, c := range cases {
+		code, result := act(c.path, c.body)
+		if code != c.code || (c.result != "" && result != c.result) {
+			t.Fatalf("%v %v: got %v %q", c.path, c.body, code, result)
+		}
+	}
+
+	for _, info := range worker_pool.GetWorkerInfos(false) {
+		if info.TaskType == "action-test" && (!info.Cordoned || !info.Draining) {
+			t.Fatalf("the worker should be cordoned and draining, got %+v", info)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"Scheduler/handler"
+	"Scheduler/session"
+	"Scheduler/worker_pool"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+//go:embed dashboard/index.html
+var dashboardPage []byte
+
+// dashboardInterval is how often a dashboard receives the state
+var dashboardInterval = 2 * time.Second
+
+// dashboardStreamFor ends an event stream before the write timeout of the http server,
+// the page reconnects with the time of the last samples it has
+var dashboardStreamFor = 50 * time.Second
+
+// nodesRefresh is how often the resource model of nodes is rebuilt for dashboards
+var nodesRefresh = 10 * time.Second
+
+// PoolOccupancy counts the workers of a task type by state, and the tasks waiting for them
+type PoolOccupancy struct {
+	TaskType  string `json:"task_type"`
+	Workers   int    `json:"workers"`
+	Ready     int    `json:"ready"`
+	Busy      int    `json:"busy"`
+	WarmingUp int    `json:"warming_up"`
+	Failed    int    `json:"failed"`
+	Cordoned  int    `json:"cordoned"`
+	Queued    int    `json:"queued"`
+}
+
+// DashboardState is an event of /dashboard/events. Latency and CPU only carry the samples
+// after the time asked by the page
+type DashboardState struct {
+	Time       time.Time                   `json:"time"`
+	Drain      DrainStatus                 `json:"drain"`
+	Nodes      []worker_pool.NodeResources `json:"nodes"`
+	NodesError string                      `json:"nodes_error,omitempty"`
+	Pools      []PoolOccupancy             `json:"pools"`
+	Workers    []worker_pool.WorkerInfo    `json:"workers"`
+	Sessions   []session.Info              `json:"sessions"`
+	Queue      worker_pool.QueueMetrics    `json:"queue"`
+	Latency    []handler.LatencySample     `json:"latency"`
+	CPU        []worker_pool.CPUSample     `json:"cpu"`
+}
+
+var dashboardNodesLock = sync.Mutex{}
+var dashboardNodes []worker_pool.NodeResources
+var dashboardNodesError string
+var dashboardNodesAt time.Time
+
+// nodesForDashboard return the resource model of nodes, rebuilt at most every nodesRefresh
+// for all dashboards
+func nodesForDashboard() ([]worker_pool.NodeResources, string) {
+	dashboardNodesLock.Lock()
+	defer dashboardNodesLock.Unlock()
+	if time.Since(dashboardNodesAt) < nodesRefresh {
+		return dashboardNodes, dashboardNodesError
+	}
+	dashboardNodesAt = time.Now()
+
+	// the kubernetes api may be unavailable, it should not end the stream
+	func() {
+		defer func() {
+			if err := recover(); err != nil {
+				dashboardNodesError = fmt.Sprint(err)
+			}
+		}()
+		nodes, err := worker_pool.GetNodeResources()
+		if err != nil {
+			dashboardNodesError = err.Error()
+			return
+		}
+		dashboardNodes, dashboardNodesError = nodes, ""
+	}()
+	return dashboardNodes, dashboardNodesError
+}
+
+func dashboardSnapshot(latencySince, cpuSince time.Time) DashboardState {
+	state := DashboardState{
+		Time:     time.Now(),
+		Drain:    getDrainStatus(),
+		Workers:  worker_pool.GetWorkerInfos(false),
+		Sessions: session.List(),
+		Queue:    worker_pool.GetQueueMetrics(),
+		Latency:  handler.GetLatencySamples(latencySince),
+		CPU:      worker_pool.GetCPUSamples(cpuSince),
+	}
+	state.Nodes, state.NodesError = nodesForDashboard()
+
+	pools := map[string]*PoolOccupancy{}
+	poolOf := func(taskType string) *PoolOccupancy {
+		if _, ok := pools[taskType]; !ok {
+			pools[taskType] = &PoolOccupancy{TaskType: taskType}
+		}
+		return pools[taskType]
+	}
+	for _, worker := range state.Workers {
+		pool := poolOf(worker.TaskType)
+		pool.Workers++
+		switch worker.State {
+		case worker_pool.WorkerReady:
+			pool.Ready++
+		case worker_pool.WorkerBusy:
+			pool.Busy++
+		case worker_pool.WorkerCreating, worker_pool.WorkerWarmingUp:
+			pool.WarmingUp++
+		case worker_pool.WorkerFailed:
+			pool.Failed++
+		}
+		if worker.Cordoned {
+			pool.Cordoned++
+		}
+	}
+	for _, pending := range state.Queue.Pending {
+		poolOf(pending.TaskType).Queued++
+	}
+
+	state.Pools = []PoolOccupancy{}
+	for _, pool := range pools {
+		state.Pools = append(state.Pools, *pool)
+	}
+	sort.Slice(state.Pools, func(i, j int) bool {
+		return state.Pools[i].TaskType < state.Pools[j].TaskType
+	})
+	return state
+}
+
+// dashboard serve the page, the page is static and reads the state from /dashboard/events
+func dashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, err := w.Write(dashboardPage)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// dashboardEvents stream a DashboardState every dashboardInterval as server-sent events.
+// ?latency_since= and ?cpu_since= in RFC3339 skip the samples the page already has
+func dashboardEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var latencySince, cpuSince time.Time
+	for param, since := range map[string]*time.Time{"latency_since": &latencySince, "cpu_since": &cpuSince} {
+		if raw := r.URL.Query().Get(param); raw != "" {
+			parsed, err := time.Parse(time.RFC3339Nano, raw)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			*since = parsed
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ticker := time.NewTicker(dashboardInterval)
+	defer ticker.Stop()
+	end := time.After(dashboardStreamFor)
+	for {
+		state := dashboardSnapshot(latencySince, cpuSince)
+		if len(state.Latency) != 0 {
+			latencySince = state.Latency[len(state.Latency)-1].At
+		}
+		if len(state.CPU) != 0 {
+			cpuSince = state.CPU[len(state.CPU)-1].At
+		}
+
+		marshal, err := json.Marshal(state)
+		if err != nil {
+			log.Panic(err)
+		}
+		if _, err = fmt.Fprintf(w, "event: state\ndata: %s\n\n", marshal); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		// the http server waits for open streams when it shuts down
+		if state.Drain.Draining {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-end:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"Scheduler/handler"
+	"Scheduler/session"
+	"Scheduler/worker_pool"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// drainTimeout is how long a drain waits for sessions to end by themselves and in-flight
+// tasks to be sent back, remaining sessions are closed and their workers reset after it
+var drainTimeout = 30 * time.Second
+
+// drainGrace is how long a drain waits for the results of closed sessions and the servers to stop
+var drainGrace = 10 * time.Second
+
+// drainDeletePods delete all worker pods after drain, set by DRAIN_DELETE_PODS
+var drainDeletePods = false
+
+var errDraining = errors.New("scheduler is draining, no new session is accepted")
+
+// DrainStatus is the progress of a drain
+type DrainStatus struct {
+	Draining       bool   `json:"draining"`
+	Phase          string `json:"phase,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+	StartedAt      string `json:"started_at,omitempty"`
+	DeletePods     bool   `json:"delete_pods"`
+	Sessions       int    `json:"sessions"`
+	Requests       int64  `json:"requests"`
+	SendsInFlight  int64  `json:"sends_in_flight"`
+	FailedTasks    int    `json:"failed_tasks"`
+	ClosedSessions int    `json:"closed_sessions"`
+}
+
+var draining atomic.Bool
+
+// requestsInFlight counts device requests being served, stream sessions are counted as sessions
+var requestsInFlight atomic.Int64
+
+var drainLock = sync.Mutex{}
+
+var drainStatus = DrainStatus{}
+
+// drained is closed when the drain is finished and the process should exit
+var drained = make(chan struct{})
+
+var httpServer *http.Server
+
+// trackRequest count a device request until the returned func is called
+func trackRequest() func() {
+	requestsInFlight.Add(1)
+	return func() {
+		requestsInFlight.Add(-1)
+	}
+}
+
+func setDrainPhase(phase string) {
+	drainLock.Lock()
+	drainStatus.Phase = phase
+	drainLock.Unlock()
+	log.Printf("Drain: %v", phase)
+}
+
+func getDrainStatus() DrainStatus {
+	drainLock.Lock()
+	status := drainStatus
+	drainLock.Unlock()
+
+	status.Draining = draining.Load()
+	status.Sessions = len(session.List())
+	status.Requests = requestsInFlight.Load()
+	status.SendsInFlight = handler.SendsInFlight()
+	return status
+}
+
+// startDrain stop accepting new sessions and drain in background, return false if already draining
+func startDrain(reason string, deletePods bool) bool {
+	if !draining.CompareAndSwap(false, true) {
+		return false
+	}
+
+	drainLock.Lock()
+	drainStatus.Reason = reason
+	drainStatus.StartedAt = time.Now().Format(time.RFC3339Nano)
+	drainStatus.DeletePods = deletePods
+	drainLock.Unlock()
+
+	log.Printf("Drain started by %v, timeout %v, delete pods %v", reason, drainTimeout, deletePods)
+	go drain(deletePods)
+	return true
+}
+
+// waitIdle poll until nothing is in flight, and no session is living if withSessions.
+// Return false if the deadline passed first
+func waitIdle(deadline time.Time, withSessions bool) bool {
+	for {
+		if requestsInFlight.Load() == 0 && handler.SendsInFlight() == 0 &&
+			(!withSessions || len(session.List()) == 0) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func drain(deletePods bool) {
+	defer close(drained)
+
+	// tasks waiting for workers would only hold the drain until the grace period
+	setDrainPhase("failing queued tasks")
+	failed := worker_pool.RefuseQueue(errDraining)
+	drainLock.Lock()
+	drainStatus.FailedTasks = failed
+	drainLock.Unlock()
+
+	setDrainPhase("waiting for sessions and in-flight tasks")
+	if !waitIdle(time.Now().Add(drainTimeout), true) {
+		setDrainPhase("closing remaining sessions")
+		closed := 0
+		for _, info := range session.List() {
+			// an unreachable worker should not stop the drain
+			func() {
+				defer func() {
+					if err := recover(); err != nil {
+						log.Printf("Close session %v failed: %v", info.ID, err)
+					}
+				}()
+				if session.Close(info.ID, "scheduler draining") {
+					closed++
+				}
+			}()
+		}
+		drainLock.Lock()
+		drainStatus.ClosedSessions = closed
+		drainLock.Unlock()
+
+		setDrainPhase("waiting for results of closed sessions")
+		if !waitIdle(time.Now().Add(drainGrace), false) {
+			log.Printf("Drain: %v requests and %v sends are still in flight, give up waiting",
+				requestsInFlight.Load(), handler.SendsInFlight())
+		}
+	}
+
+	if deletePods {
+		setDrainPhase("deleting worker pods")
+		deleteAllWorkers()
+	}
+
+	setDrainPhase("stopping servers")
+	ctx, cancel := context.WithTimeout(context.Background(), drainGrace)
+	defer cancel()
+	stopGrpcServer(ctx)
+	if httpServer != nil {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.Printf("Drain: shutdown http server: %v", err)
+		}
+	}
+
+	setDrainPhase("drained")
+}
+
+func deleteAllWorkers() {
+	var workers []*worker_pool.Worker
+	worker_pool.WorkerMap.Range(func(key, value any) bool {
+		workers = append(workers, worker_pool.GetWorkerPool(key.(string))...)
+		return true
+	})
+
+	wg := sync.WaitGroup{}
+	wg.Add(len(workers))
+	for _, worker := range workers {
+		go func(worker *worker_pool.Worker) {
+			defer wg.Done()
+			defer func() {
+				if err := recover(); err != nil {
+					log.Printf("Delete worker %v failed: %v", worker.GetWorkerName(), err)
+				}
+			}()
+			worker.DeleteWorker()
+		}(worker)
+	}
+	wg.Wait()
+}
+
+// handleSignals drain on SIGTERM or SIGINT, a second signal exits immediately
+func handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	for sig := range signals {
+		if !startDrain(sig.String(), drainDeletePods) {
+			log.Printf("Receive %v again while draining, exit now", sig)
+			os.Exit(1)
+		}
+	}
+}
+
+// restart drain the scheduler and exit, ?delete_pods=true also deletes all worker pods
+func restart(w http.ResponseWriter, r *http.Request) {
+	deletePods := drainDeletePods
+	if rawDeletePods := r.URL.Query().Get("delete_pods"); rawDeletePods != "" {
+		var err error
+		if deletePods, err = strconv.ParseBool(rawDeletePods); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !startDrain("restart from "+r.RemoteAddr, deletePods) {
+		http.Error(w, "Already draining", http.StatusConflict)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+func drainStatusHandler(w http.ResponseWriter, r *http.Request) {
+	marshal, err := json.Marshal(getDrainStatus())
+	if err != nil {
+		log.Panic(err)
+	}
+	_, err = w.Write(marshal)
+	if err != nil {
+		log.Panic(err)
+	}
+}
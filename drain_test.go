@@ -0,0 +1,81 @@
+package main
+
+import (
+	"Scheduler/session"
+	"Scheduler/utils"
+	"Scheduler/worker_pool"
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useDrain shorten the drain for a test and make the scheduler accept sessions again afterwards
+func useDrain(t *testing.T) {
+	previousTimeout, previousGrace := drainTimeout, drainGrace
+	drainTimeout, drainGrace = 200*time.Millisecond, 200*time.Millisecond
+	t.Cleanup(func() {
+		drainTimeout, drainGrace = previousTimeout, previousGrace
+		worker_pool.RefuseQueue(nil)
+		draining.Store(false)
+		drained = make(chan struct{})
+		drainLock.Lock()
+		drainStatus = DrainStatus{}
+		drainLock.Unlock()
+	})
+}
+
+// a drain fails the queued tasks at once, closes the sessions left at the timeout and ends drained
+func TestDrain(t *testing.T) {
+	useDrain(t)
+
+	// a pool whose only worker is never available, so tasks of it wait in the queue
+	pool := &sync.Map{}
+	pool.Store("busy", &worker_pool.Worker{})
+	worker_pool.WorkerMap.Store("drain-test", pool)
+	t.Cleanup(func() { worker_pool.WorkerMap.Delete("drain-test") })
+
+	queued := make(chan error, 1)
+	go func() {
+		_, err := worker_pool.OccupyWorkerWithClass(context.Background(), "drain-test", utils.GetUniqueID(),
+			"node", worker_pool.TaskClass{})
+		queued <- err
+	}()
+	for deadline := time.Now().Add(time.Second); len(worker_pool.GetQueueMetrics().Pending) != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("the task should be queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	taskID := utils.GetUniqueID()
+	session.Open(session.KindTask, "", nil, session.Binding{TaskName: "det", TaskID: taskID})
+	defer session.Close(taskID, "test")
+
+	if !startDrain("test", false) || startDrain("test again", false) {
+		t.Fatal("only the first drain should start")
+	}
+	select {
+	case err := <-queued:
+		if err != errDraining {
+			t.Fatalf("expected %v, got %v", errDraining, err)
+		}
+	case <-time.After(drainTimeout / 2):
+		t.Fatal("the queued task should fail when the drain starts")
+	}
+
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the drain should end, got %+v", getDrainStatus())
+	}
+	status := getDrainStatus()
+	if !status.Draining || status.Phase != "drained" || status.FailedTasks != 1 ||
+		status.ClosedSessions != 1 || status.Sessions != 0 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	if _, _, _, err := bindTask(context.Background(), "det", "node", STATUS_BEGIN, "", worker_pool.TaskClass{}, ""); err != errDraining {
+		t.Fatalf("a new session should be refused, got %v", err)
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"Scheduler/auth"
+	"Scheduler/handler"
+	"Scheduler/overload"
+	"Scheduler/rpc"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"runtime/debug"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var grpcPort = ":8082"
+
+// grpcServer serve rpc.SchedulerServer with the same scheduling logic as the http router
+type grpcServer struct {
+	rpc.UnimplementedSchedulerServer
+}
+
+var grpcServerLock = sync.Mutex{}
+
+var runningGrpcServer *grpc.Server
+
+// stopGrpcServer wait for running calls until ctx is done, then cancel them
+func stopGrpcServer(ctx context.Context) {
+	grpcServerLock.Lock()
+	server := runningGrpcServer
+	grpcServerLock.Unlock()
+	if server == nil {
+		return
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		server.Stop()
+	}
+}
+
+// maxMessageSize is the largest message a client can send, by gRPC or by a stream session
+const maxMessageSize = 16 * 1024 * 1024
+
+func RunGrpcServer() {
+	listener, err := net.Listen("tcp", grpcPort)
+	if err != nil {
+		log.Panicf("listen: %s\n", err)
+	}
+
+	options := []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(maxMessageSize),
+		grpc.ChainUnaryInterceptor(recoverUnaryInterceptor, authUnaryInterceptor),
+		grpc.ChainStreamInterceptor(recoverStreamInterceptor, authStreamInterceptor),
+	}
+	if serverTLSConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(serverTLSConfig)))
+	}
+	server := grpc.NewServer(options...)
+	rpc.RegisterSchedulerServer(server, &grpcServer{})
+	grpcServerLock.Lock()
+	runningGrpcServer = server
+	grpcServerLock.Unlock()
+
+	if err = server.Serve(listener); err != nil {
+		log.Panicf("serve grpc: %s\n", err)
+	}
+}
+
+func (s *grpcServer) SubmitTask(req *rpc.TaskRequest, stream rpc.Scheduler_SubmitTaskServer) error {
+	taskHandler := handler.GetHandler(req.TaskName)
+	if taskHandler.StartFrameTask == nil {
+		return status.Errorf(codes.InvalidArgument, "task type %v not support frame task", req.TaskName)
+	}
+
+	if req.Status != STATUS_BEGIN && req.Status != STATUS_RUNNING && req.Status != STATUS_LAST {
+		return status.Errorf(codes.InvalidArgument, "unknown status %v", req.Status)
+	}
+
+	principal, authenticated, _ := grpcAuthenticate(stream.Context())
+	frame := handler.BytesFrame(req.Frame)
+	if req.Status != STATUS_BEGIN {
+		if err := validateTaskIDs(req.TaskId); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		if !canAccessSession(principal, authenticated, req.TaskId) {
+			return status.Error(codes.PermissionDenied, errNotSessionOwner.Error())
+		}
+
+		if reason := admitFrame(req.TaskId, frame, req.Status); reason != "" {
+			return stream.Send(&rpc.TaskResult{TaskId: req.TaskId, Dropped: reason})
+		}
+	}
+
+	class, err := parseTaskClass(req.Priority, req.DeadlineMs)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if class.Tenant, err = grpcTenant(stream.Context()); err != nil {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	worker, taskID, returnWorker, err := bindTask(stream.Context(), req.TaskName, req.NodeName, req.Status, req.TaskId, class,
+		sessionOwner(principal, authenticated))
+	if err == errDraining {
+		return status.Error(codes.Unavailable, err.Error())
+	} else if err == errTaskNotFound {
+		overload.Done(req.TaskId)
+		return status.Errorf(codes.NotFound, "worker of task %v not exist", req.TaskId)
+	} else if err != nil {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	log.Printf("Receive grpc task %v, assigned id %v, worker_pool %v", req.TaskName, taskID, worker.Describe())
+
+	if err := stream.Send(&rpc.TaskResult{TaskId: taskID}); err != nil {
+		return err
+	}
+
+	values := map[string]string{}
+	if req.DetectResult != "" {
+		values["detect_result"] = req.DetectResult
+	}
+
+	finishForm, err := handler.RunFrame(worker, req.TaskName, taskID, frame,
+		values, returnWorker, req.DeleteWorker)
+	dropped := overload.Done(taskID)
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+
+	result := map[string]string{}
+	for key, value := range finishForm.Value {
+		if len(value) != 0 {
+			result[key] = value[0]
+		}
+	}
+
+	return stream.Send(&rpc.TaskResult{TaskId: taskID, Result: result, DroppedFrames: toRpcDroppedFrames(dropped)})
+}
+
+func (s *grpcServer) SubmitCompleteTask(req *rpc.CompleteTaskRequest,
+	stream rpc.Scheduler_SubmitCompleteTaskServer) error {
+	taskInfo := &CompleteTaskInfo{
+		DETNodeName:        req.DetNodeName,
+		DETTaskID:          req.DetTaskId,
+		FusionNodeName:     req.FusionNodeName,
+		FusionTaskID:       req.FusionTaskId,
+		Status:             req.Status,
+		DeleteDETWorker:    req.DeleteDetWorker,
+		DeleteFusionWorker: req.DeleteFusionWorker,
+		Priority:           req.Priority,
+		DeadlineMs:         req.DeadlineMs,
+	}
+
+	tenant, err := grpcTenant(stream.Context())
+	if err != nil {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	taskInfo.Tenant = tenant
+
+	principal, authenticated, _ := grpcAuthenticate(stream.Context())
+	frame := handler.BytesFrame(req.Frame)
+	if req.Status != STATUS_BEGIN {
+		if err := validateTaskIDs(req.DetTaskId, req.FusionTaskId); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		if !canAccessSession(principal, authenticated, req.DetTaskId) {
+			return status.Error(codes.PermissionDenied, errNotSessionOwner.Error())
+		}
+
+		if reason := admitFrame(req.DetTaskId, frame, req.Status); reason != "" {
+			return stream.Send(&rpc.CompleteTaskResult{
+				DetTaskId:    req.DetTaskId,
+				FusionTaskId: req.FusionTaskId,
+				Dropped:      reason,
+			})
+		}
+	}
+
+	clientAddress := ""
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		clientAddress = p.Addr.String()
+	}
+
+	taskHandler, err := bindCompleteTask(stream.Context(), taskInfo, frame, clientAddress,
+		sessionOwner(principal, authenticated))
+	if err == errWorkersGone {
+		overload.Done(req.DetTaskId)
+		return status.Errorf(codes.NotFound, "workers of task %v:%v not exist",
+			req.DetTaskId, req.FusionTaskId)
+	} else if err == errDraining {
+		return status.Error(codes.Unavailable, err.Error())
+	} else if err != nil {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+
+	if err := stream.Send(&rpc.CompleteTaskResult{
+		DetTaskId:    taskInfo.DETTaskID,
+		FusionTaskId: taskInfo.FusionTaskID,
+	}); err != nil {
+		return err
+	}
+
+	fusionResult, err := taskHandler.Process()
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+
+	latency := map[string]string{}
+	for name, duration := range taskHandler.Latency() {
+		latency[name] = duration.String()
+	}
+
+	return stream.Send(&rpc.CompleteTaskResult{
+		DetTaskId:     taskInfo.DETTaskID,
+		FusionTaskId:  taskInfo.FusionTaskID,
+		FusionResult:  fusionResult,
+		Latency:       latency,
+		DroppedFrames: toRpcDroppedFrames(taskHandler.DroppedFrames()),
+	})
+}
+
+func toRpcDroppedFrames(dropped overload.Counters) *rpc.DroppedFrames {
+	return &rpc.DroppedFrames{
+		Admitted:  dropped.Admitted,
+		Stale:     dropped.Stale,
+		Duplicate: dropped.Duplicate,
+		Fps:       dropped.FPS,
+	}
+}
+
+func (s *grpcServer) CreateWorkers(ctx context.Context, req *rpc.CreateWorkersRequest) (*rpc.CreateWorkersReply, error) {
+	toIntMap := func(m map[string]int32) map[string]int {
+		result := map[string]int{}
+		for key, value := range m {
+			result[key] = int(value)
+		}
+		return result
+	}
+
+	pool, err := createWorkersWithInfo(&CreateInfo{
+		CpuLimits:     toIntMap(req.CpuLimit),
+		WorkerNumbers: toIntMap(req.WorkerNumbers),
+		TaskName:      req.TaskName,
+		GpuLimits:     toIntMap(req.GpuLimit),
+		GpuMemory:     toIntMap(req.GpuMemory),
+		Placement:     req.Placement,
+		Count:         int(req.Count),
+	})
+	if errors.Is(err, errCreateWorkers) {
+		return nil, status.Error(codes.Internal, err.Error())
+	} else if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	return &rpc.CreateWorkersReply{Created: int32(len(pool))}, nil
+}
+
+func (s *grpcServer) UpdateCPU(ctx context.Context, req *rpc.UpdateCPURequest) (*rpc.UpdateCPUReply, error) {
+	updated := updateNodeCPU(req.NodeName, int(req.CpuLimit))
+	return &rpc.UpdateCPUReply{Updated: int32(updated)}, nil
+}
+
+func (s *grpcServer) QueryMetric(ctx context.Context, req *rpc.QueryMetricRequest) (*rpc.ResourceUsage, error) {
+	if err := validateTaskIDs(req.TaskId); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if principal, authenticated, _ := grpcAuthenticate(ctx); !canAccessSession(principal, authenticated, req.TaskId) {
+		return nil, status.Error(codes.PermissionDenied, errNotSessionOwner.Error())
+	}
+
+	usage := queryTaskUsage(req.TaskId)
+	return &rpc.ResourceUsage{
+		Cpu:              usage.CPU,
+		Memory:           usage.Memory,
+		Storage:          usage.Storage,
+		StorageEphemeral: usage.StorageEphemeral,
+		CollectedTime:    usage.CollectedTime,
+		Window:           usage.Window,
+		Available:        usage.Available,
+		PodName:          usage.PodName,
+	}, nil
+}
+
+// grpcTenant identify the tenant by the authenticated identity, as tenantOf
+func grpcTenant(ctx context.Context) (string, error) {
+	principal, authenticated, hasCredentials := grpcAuthenticate(ctx)
+	return tenantOfPrincipal(principal, authenticated, hasCredentials)
+}
+
+// grpcRoles is the role required by each method, the same as the http routes
+var grpcRoles = map[string]auth.Role{
+	"/scheduler.Scheduler/SubmitTask":         auth.RoleDevice,
+	"/scheduler.Scheduler/SubmitCompleteTask": auth.RoleDevice,
+	"/scheduler.Scheduler/QueryMetric":        auth.RoleDevice,
+	"/scheduler.Scheduler/CreateWorkers":      auth.RoleOperator,
+	"/scheduler.Scheduler/UpdateCPU":          auth.RoleOperator,
+}
+
+// grpcAuthenticate identify the caller by the client certificate, the authorization metadata,
+// or the api key of a tenant in x-api-key, as auth.Authenticate. Also tell whether it sent credentials
+func grpcAuthenticate(ctx context.Context) (auth.Principal, bool, bool) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(key string) string {
+		if values := md.Get(key); len(values) != 0 {
+			return values[0]
+		}
+		return ""
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			if principal, ok := auth.AuthenticateTLS(&tlsInfo.State); ok {
+				return principal, true, true
+			}
+		}
+	}
+
+	header, apiKey := first("authorization"), first("x-api-key")
+	if apiKey != "" && header == "" {
+		principal, authenticated := auth.LookupToken(apiKey)
+		return principal, authenticated, true
+	}
+	principal, authenticated := auth.AuthenticateHeader(header)
+	return principal, authenticated, header != ""
+}
+
+// grpcAuthorize check the authorization metadata against the role of the method
+func grpcAuthorize(ctx context.Context, method string) (auth.Principal, error) {
+	principal, authenticated, _ := grpcAuthenticate(ctx)
+
+	required := grpcRoles[method]
+	if auth.Allowed(principal, authenticated, required) {
+		return principal, nil
+	}
+	code := codes.PermissionDenied
+	if !authenticated {
+		code = codes.Unauthenticated
+	}
+	if required == auth.RoleOperator {
+		auth.Audit(principal, grpcRemote(ctx), method, "denied", int(code))
+	}
+	return principal, status.Errorf(code, "%v requires role %v", method, required)
+}
+
+func grpcRemote(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+func authUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo,
+	next grpc.UnaryHandler) (any, error) {
+	principal, err := grpcAuthorize(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	if grpcRoles[info.FullMethod] != auth.RoleOperator {
+		defer trackRequest()()
+		return next(ctx, req)
+	}
+
+	resp, err := next(ctx, req)
+	auth.Audit(principal, grpcRemote(ctx), info.FullMethod, "finished", int(status.Code(err)))
+	return resp, err
+}
+
+func authStreamInterceptor(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo,
+	next grpc.StreamHandler) error {
+	if _, err := grpcAuthorize(stream.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	defer trackRequest()()
+	return next(srv, stream)
+}
+
+// recoverUnaryInterceptor turn a panic of a call into codes.Internal, like the recovery of net/http,
+// instead of crashing the scheduler
+func recoverUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo,
+	next grpc.UnaryHandler) (resp any, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			log.Printf("grpc %v panic: %v\n%s", info.FullMethod, recovered, debug.Stack())
+			err = status.Errorf(codes.Internal, "%v", recovered)
+		}
+	}()
+	return next(ctx, req)
+}
+
+func recoverStreamInterceptor(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo,
+	next grpc.StreamHandler) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			log.Printf("grpc %v panic: %v\n%s", info.FullMethod, recovered, debug.Stack())
+			err = status.Errorf(codes.Internal, "%v", recovered)
+		}
+	}()
+	return next(srv, stream)
+}
@@ -0,0 +1,309 @@
+package handler
+
+import (
+	"Scheduler/worker_pool"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// BatchConfig is how det frames in flight are batched into one worker request.
+// Sessions of det in a node that batches share one det worker of the node, see OccupyTaskWorker.
+// Frames of all those sessions are collected until MaxBatchSize frames or MaxDelayMs after
+// the first one, then sent to the shared worker together.
+// Nodes are the node names whose det workers accept batches, empty means all nodes
+type BatchConfig struct {
+	Enabled      bool     `json:"enabled"`
+	MaxBatchSize int      `json:"max_batch_size"`
+	MaxDelayMs   int      `json:"max_delay_ms"`
+	Nodes        []string `json:"nodes"`
+}
+
+// BatchMetrics counts batches sent since the scheduler started
+type BatchMetrics struct {
+	Batches      int64   `json:"batches"`
+	Frames       int64   `json:"frames"`
+	FullFlushes  int64   `json:"full_flushes"`
+	DelayFlushes int64   `json:"delay_flushes"`
+	Failures     int64   `json:"failures"`
+	AvgBatchSize float64 `json:"avg_batch_size"`
+}
+
+// BatchStatus is the config, metrics and the frames pending by worker name
+type BatchStatus struct {
+	Config  BatchConfig    `json:"config"`
+	Metrics BatchMetrics   `json:"metrics"`
+	Pending map[string]int `json:"pending"`
+}
+
+type batchedFrame struct {
+	worker     *worker_pool.Worker
+	taskID     string
+	frame      FrameOpener
+	fileName   string
+	completion *Completion
+}
+
+// batcher collects frames of a shared worker, generation tells a delay timer whether its batch
+// has been flushed by size already
+type batcher struct {
+	frames     []*batchedFrame
+	generation int64
+}
+
+var batchLock = sync.Mutex{}
+
+var batchConfig = BatchConfig{MaxBatchSize: 8, MaxDelayMs: 10}
+
+var batchMetrics = BatchMetrics{}
+
+// map from the name of a shared worker to its *batcher
+var batchers = map[string]*batcher{}
+
+// SetBatchConfig replace the batch config, pending frames are flushed by their own timers
+func SetBatchConfig(config BatchConfig) error {
+	if config.MaxBatchSize <= 0 {
+		return fmt.Errorf("invalid max batch size %v", config.MaxBatchSize)
+	}
+	if config.MaxDelayMs < 0 {
+		return fmt.Errorf("invalid max delay %vms", config.MaxDelayMs)
+	}
+
+	batchLock.Lock()
+	batchConfig = config
+	var unshared []*worker_pool.Worker
+	for _, worker := range worker_pool.SharedWorkers("det") {
+		if !batchEnabledLocked(worker.GetNodeName()) {
+			unshared = append(unshared, worker)
+		}
+	}
+	batchLock.Unlock()
+
+	// sessions already on them keep their worker, new ones occupy a worker of their own
+	for _, worker := range unshared {
+		worker.Unshare()
+	}
+	return nil
+}
+
+// OccupyTaskWorker occupy a worker of taskType for taskID, a det task in a node that batches
+// binds to the shared det worker of the node if there is one or a free worker to share.
+// The wait in the pending queue is given up once ctx is done
+func OccupyTaskWorker(ctx context.Context, taskType, taskID, nodeName string,
+	class worker_pool.TaskClass) (*worker_pool.Worker, error) {
+	if taskType == "det" {
+		batchLock.Lock()
+		enabled := batchEnabledLocked(worker_pool.PodsInfo[taskType+"-"+nodeName].NodeName)
+		batchLock.Unlock()
+		if enabled {
+			if worker, ok := worker_pool.OccupySharedWorker(taskType, taskID, nodeName, class); ok {
+				return worker, nil
+			}
+		}
+	}
+	return worker_pool.OccupyWorkerWithClass(ctx, taskType, taskID, nodeName, class)
+}
+
+func GetBatchStatus() BatchStatus {
+	batchLock.Lock()
+	defer batchLock.Unlock()
+
+	status := BatchStatus{Config: batchConfig, Metrics: batchMetrics, Pending: map[string]int{}}
+	if batchMetrics.Batches != 0 {
+		status.Metrics.AvgBatchSize = float64(batchMetrics.Frames) / float64(batchMetrics.Batches)
+	}
+	for workerName, b := range batchers {
+		status.Pending[workerName] = len(b.frames)
+	}
+	return status
+}
+
+// batchEnabledLocked should be called with batchLock held
+func batchEnabledLocked(nodeName string) bool {
+	if !batchConfig.Enabled {
+		return false
+	}
+	if len(batchConfig.Nodes) == 0 {
+		return true
+	}
+	for _, batchNode := range batchConfig.Nodes {
+		if batchNode == nodeName {
+			return true
+		}
+	}
+	return false
+}
+
+// submitDET submit a det frame, batched with frames of other sessions in flight to the same
+// shared worker if enabled for the node. A worker of its own gets the frame at once
+func submitDET(worker *worker_pool.Worker, taskID string, frame FrameOpener) *Completion {
+	workerName := worker.GetWorkerName()
+	shared := worker.IsShared()
+
+	batchLock.Lock()
+	if !shared || !batchEnabledLocked(worker.GetNodeName()) {
+		batchLock.Unlock()
+		return submitFrame(worker, "det", taskID, nil, frame)
+	}
+
+	completion := newCompletion("det", taskID)
+
+	b, ok := batchers[workerName]
+	if !ok {
+		b = &batcher{}
+		batchers[workerName] = b
+	}
+	b.frames = append(b.frames, &batchedFrame{
+		worker:     worker,
+		taskID:     taskID,
+		frame:      frame,
+		completion: completion,
+	})
+
+	if len(b.frames) >= batchConfig.MaxBatchSize {
+		frames := b.take()
+		batchMetrics.FullFlushes++
+		delete(batchers, workerName)
+		batchLock.Unlock()
+		go postBatch(frames)
+		return completion
+	}
+
+	if len(b.frames) == 1 {
+		generation := b.generation
+		time.AfterFunc(time.Duration(batchConfig.MaxDelayMs)*time.Millisecond, func() {
+			batchLock.Lock()
+			if b.generation != generation {
+				batchLock.Unlock()
+				return
+			}
+			frames := b.take()
+			batchMetrics.DelayFlushes++
+			if batchers[workerName] == b {
+				delete(batchers, workerName)
+			}
+			batchLock.Unlock()
+			postBatch(frames)
+		})
+	}
+	batchLock.Unlock()
+
+	return completion
+}
+
+// take should be called with batchLock held, the batcher is removed by the caller
+// so batchers of deleted workers are not kept
+func (b *batcher) take() []*batchedFrame {
+	frames := b.frames
+	b.frames = nil
+	b.generation++
+	batchMetrics.Batches++
+	batchMetrics.Frames += int64(len(frames))
+	return frames
+}
+
+// postBatch post the frames of a shared worker as one request with batch=True, task_id and frame are repeated
+// in the same order. The worker calls back det_finish with task_id and det_result in that order
+func postBatch(frames []*batchedFrame) {
+	// a rejected frame fails alone instead of the whole batch
+	var accepted []*batchedFrame
+	for _, batched := range frames {
+		frame, fileName, err := preprocessFrame("det", batched.taskID, batched.frame)
+		if err != nil {
+			batched.completion.fail(err)
+			continue
+		}
+		batched.frame, batched.fileName = frame, fileName
+		accepted = append(accepted, batched)
+	}
+	if len(accepted) == 0 {
+		return
+	}
+	frames = accepted
+	worker := frames[0].worker
+
+	bodyReader, bodyWriter := io.Pipe()
+	multipartWriter := multipart.NewWriter(bodyWriter)
+
+	go func() {
+		bodyWriter.CloseWithError(writeBatch(multipartWriter, frames))
+	}()
+
+	request, err := http.NewRequest(http.MethodPost, worker.GetURL("run_task"), bodyReader)
+	if err == nil {
+		request.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+		err = doRequest(request)
+	}
+	// unblock the writer if the request failed before the body is read
+	bodyReader.Close()
+
+	if err != nil {
+		batchLock.Lock()
+		batchMetrics.Failures++
+		batchLock.Unlock()
+
+		err = fmt.Errorf("submit batch of %v frames to %v failed: %v", len(frames), worker.GetWorkerName(), err)
+		log.Print(err)
+		for _, batched := range frames {
+			batched.completion.fail(err)
+		}
+	}
+}
+
+func writeBatch(multipartWriter *multipart.Writer, frames []*batchedFrame) error {
+	fields := []formField{
+		{Key: "task_name", Value: "det"},
+		{Key: "batch", Value: "True"},
+		{Key: "reset", Value: "False"},
+	}
+	for _, field := range fields {
+		if err := multipartWriter.WriteField(field.Key, field.Value); err != nil {
+			return err
+		}
+	}
+
+	for i, batched := range frames {
+		if err := multipartWriter.WriteField("task_id", batched.taskID); err != nil {
+			return err
+		}
+
+		file, _, err := batched.frame()
+		if err != nil {
+			return err
+		}
+		formFile, err := multipartWriter.CreateFormFile("frame", fmt.Sprintf("%v_%v", i, batched.fileName))
+		if err == nil {
+			_, err = io.Copy(formFile, file)
+		}
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return multipartWriter.Close()
+}
+
+// deliverBatchResult demultiplex the det results of a batch to each task
+func deliverBatchResult(w http.ResponseWriter, form *multipart.Form) {
+	taskIDs, detResults := form.Value["task_id"], form.Value["det_result"]
+	if len(taskIDs) != len(detResults) {
+		http.Error(w, fmt.Sprintf("%v task ids but %v det results", len(taskIDs), len(detResults)),
+			http.StatusBadRequest)
+		return
+	}
+
+	for i, taskID := range taskIDs {
+		deliverResult(taskID, &multipart.Form{
+			Value: map[string][]string{
+				"task_id":    {taskID},
+				"det_result": {detResults[i]},
+			},
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"Scheduler/worker_pool"
+	"context"
+	"fmt"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// batchWorker start a det worker of gpu1 served by an http server, which sends the task ids
+// of each request it gets. Pods of the fake cluster run once created
+func batchWorker(t *testing.T) (*worker_pool.Worker, chan []string) {
+	t.Setenv("Debug", "False")
+	requests := make(chan []string, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requests <- r.MultipartForm.Value["task_id"]
+	}))
+	t.Cleanup(server.Close)
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	t.Setenv("WORKER_PORTS", fmt.Sprintf(`{"ranges": {"default": {"min": %v, "max": %v}}, "probe": false, "state_file": ""}`,
+		port, port))
+	if err := worker_pool.LoadPortsFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	cluster := fake.NewSimpleClientset()
+	cluster.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		action.(k8stesting.CreateAction).GetObject().(*corev1.Pod).Status.Phase = corev1.PodRunning
+		return false, nil, nil
+	})
+	worker_pool.SetClusterClient(cluster)
+	t.Cleanup(func() {
+		worker_pool.SetClusterClient(nil)
+		worker_pool.WorkerMap.Delete("det")
+	})
+
+	worker, err := worker_pool.CreateWorker("det", "gpu1", "127.0.0.1", "100m", "0", "0", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); worker.GetState() != worker_pool.WorkerReady; {
+		if time.Now().After(deadline) {
+			t.Fatalf("the worker is not ready, got %v", worker.GetState())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return worker, requests
+}
+
+// useBatchConfig set the batch config for a test, batching is disabled again afterwards
+func useBatchConfig(t *testing.T, config BatchConfig) {
+	t.Cleanup(func() {
+		if err := SetBatchConfig(BatchConfig{MaxBatchSize: 8, MaxDelayMs: 10}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if err := SetBatchConfig(config); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// frames of two sessions in the same node are sent in one batch, and the results go back to each task
+func TestBatchAcrossSessions(t *testing.T) {
+	worker, requests := batchWorker(t)
+	useBatchConfig(t, BatchConfig{Enabled: true, MaxBatchSize: 2, MaxDelayMs: 5000})
+
+	taskIDs := []string{newTestTaskID(t) + "-a", newTestTaskID(t) + "-b"}
+	var completions []*Completion
+	for _, taskID := range taskIDs {
+		bound, err := OccupyTaskWorker(context.Background(), "det", taskID, "gpu1", worker_pool.TaskClass{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bound != worker || !bound.IsShared() {
+			t.Fatalf("session %v should share the det worker of the node", taskID)
+		}
+		defer bound.ReturnToPool(taskID)
+		completions = append(completions, submitDET(bound, taskID, BytesFrame([]byte("frame"))))
+	}
+
+	select {
+	case batch := <-requests:
+		if len(batch) != 2 || batch[0] != taskIDs[0] || batch[1] != taskIDs[1] {
+			t.Fatalf("the frames of both sessions should be in one batch, got %v", batch)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the full batch should be sent at once")
+	}
+
+	recorder := httptest.NewRecorder()
+	deliverBatchResult(recorder, &multipart.Form{Value: map[string][]string{
+		"task_id":    taskIDs,
+		"det_result": {"result-a", "result-b"},
+	}})
+	for i, completion := range completions {
+		form, err := completion.Wait(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result := form.Value["det_result"]; len(result) != 1 || result[0] != []string{"result-a", "result-b"}[i] {
+			t.Fatalf("task %v got the result %v", taskIDs[i], result)
+		}
+	}
+}
+
+// with batching disabled for the node, sessions occupy workers of their own
+func TestBatchDisabledOccupiesWorker(t *testing.T) {
+	worker, requests := batchWorker(t)
+	useBatchConfig(t, BatchConfig{Enabled: true, MaxBatchSize: 2, MaxDelayMs: 5000, Nodes: []string{"other"}})
+
+	taskID := newTestTaskID(t)
+	bound, err := OccupyTaskWorker(context.Background(), "det", taskID, "gpu1", worker_pool.TaskClass{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bound.ReturnToPool(taskID)
+	if bound != worker || bound.IsShared() {
+		t.Fatal("the session should occupy the worker alone")
+	}
+
+	// a frame of a worker of its own is sent at once instead of waiting for a batch
+	completion := submitDET(bound, taskID, BytesFrame([]byte("frame")))
+	select {
+	case sent := <-requests:
+		if len(sent) != 1 || sent[0] != taskID {
+			t.Fatalf("unexpected request %v", sent)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the frame should be sent without batching")
+	}
+	CancelTask(taskID)
+	if _, err = completion.Wait(time.Second); err == nil {
+		t.Fatal("the canceled completion should fail")
+	}
+}
@@ -2,12 +2,13 @@ package handler
 
 import (
 	"Scheduler/buffer_pool"
+	"Scheduler/overload"
 	"Scheduler/worker_pool"
-	"io"
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"mime/multipart"
-	"net/http"
-	"strings"
 	"sync"
 	"time"
 )
@@ -21,7 +22,7 @@ type CompleteTaskHandler struct {
 	detTaskID    string
 	fusionTaskID string
 
-	form   *multipart.Form
+	frame  FrameOpener
 	status string
 
 	deleteDETWorker    bool
@@ -35,6 +36,8 @@ type CompleteTaskHandler struct {
 	detComputeLatency  time.Duration
 	fusionLatency      time.Duration
 	totalLatency       time.Duration
+
+	dropped overload.Counters
 }
 
 func NewCompleteTaskHandler(
@@ -42,7 +45,7 @@ func NewCompleteTaskHandler(
 	fusionWorker *worker_pool.Worker,
 	detTaskID string,
 	fusionTaskID string,
-	form *multipart.Form,
+	frame FrameOpener,
 	status string,
 	deleteDETWorker bool,
 	deleteFusionWorker bool,
@@ -52,7 +55,7 @@ func NewCompleteTaskHandler(
 		fusionWorker:       fusionWorker,
 		detTaskID:          detTaskID,
 		fusionTaskID:       fusionTaskID,
-		form:               form,
+		frame:              frame,
 		status:             status,
 		deleteDETWorker:    deleteDETWorker,
 		deleteFusionWorker: deleteFusionWorker,
@@ -61,143 +64,132 @@ func NewCompleteTaskHandler(
 }
 
 func (handler *CompleteTaskHandler) SendTask() {
+	fusionResult, err := handler.Process()
+	if err != nil {
+		sendFailureToClient(handler.clientAddress, "complete_task",
+			handler.detTaskID+":"+handler.fusionTaskID, err)
+		return
+	}
+	handler.sendBackToClient(fusionResult)
+}
+
+// Process run det, slam and fusion of the frame, and return the fusion result
+// If any stage failed, both workers are returned to pool, the client should Begin again
+func (handler *CompleteTaskHandler) Process() (string, error) {
+	// frames of a complete task session are admitted by the det task id
+	defer func() {
+		handler.dropped = overload.Done(handler.detTaskID)
+	}()
+
 	wg := sync.WaitGroup{}
 	wg.Add(2)
 
 	totalTick := time.Now()
 
 	var detResult string
+	var detErr, slamErr error
 	go func() {
 		// start det and get det result
-		detResult = handler.sendToDET()
+		detResult, detErr = handler.sendToDET()
 		wg.Done()
 	}()
 
 	go func() {
 		now := time.Now()
 		// trigger localization
-		handler.startLocalization()
+		slamErr = handler.startLocalization()
 		handler.slamIOLatency = time.Since(now)
 		wg.Done()
 	}()
 
 	wg.Wait()
 
+	if detErr != nil || slamErr != nil {
+		handler.release()
+		if detErr != nil {
+			return "", detErr
+		}
+		return "", slamErr
+	}
+
 	// send det result to the fusion, fusion worker will complete
 	// localization first, then do fusion, then sendback result
-	fusionResult := handler.sendDETResultToFusion(detResult)
+	fusionResult, err := handler.sendDETResultToFusion(detResult)
+	if err != nil {
+		handler.release()
+		return "", err
+	}
 	handler.totalLatency = time.Since(totalTick)
+	recordLatency(handler.detTaskID, handler.Latency())
 
-	handler.sendBackToClient(fusionResult)
+	return fusionResult, nil
 }
 
-func (handler *CompleteTaskHandler) startLocalization() {
-	//log.Printf("submit to %v", handler.fusionWorker.GetIP())
-
-	workerURL := handler.fusionWorker.GetURL("run_task")
-
-	bufferElem := buffer_pool.GetBuffer()
-	postBody := bufferElem.Buffer
-
-	multipartWriter := multipart.NewWriter(postBody)
-
-	if err := multipartWriter.WriteField("cmd", "slam"); err != nil {
-		log.Panic(err)
+// release return the workers still bound to the task ids
+func (handler *CompleteTaskHandler) release() {
+	if worker, ok := worker_pool.LookupWorker(handler.detTaskID); ok {
+		worker.ReturnToPool(handler.detTaskID)
 	}
-
-	if err := multipartWriter.WriteField("task_name", "fusion"); err != nil {
-		log.Panic(err)
-	}
-
-	if err := multipartWriter.WriteField("task_id", handler.fusionTaskID); err != nil {
-		log.Panic(err)
-	}
-
-	if err := multipartWriter.WriteField("reset", "False"); err != nil {
-		log.Panic(err)
-	}
-
-	fileHeader := handler.form.File["frame"][0]
-	writer, err := multipartWriter.CreateFormFile("frame", "input.png")
-	if err != nil {
-		log.Panic(err)
-	}
-	file, err := fileHeader.Open()
-	if err != nil {
-		log.Panic(err)
+	if worker, ok := worker_pool.LookupWorker(handler.fusionTaskID); ok {
+		worker.ReturnToPool(handler.fusionTaskID)
 	}
+}
 
-	frameBytes, err := io.ReadAll(file)
-	//log.Printf("Receive bytes %v", len(frameBytes))
-	if err != nil {
-		log.Panic(err)
-	}
+// DroppedFrames return the frames of the session skipped by the overload policy,
+// counted when the last frame is processed
+func (handler *CompleteTaskHandler) DroppedFrames() overload.Counters {
+	return handler.dropped
+}
 
-	_, err = writer.Write(frameBytes)
-	//log.Printf("Write %v bytes. Buffer size is %v", n, postBody.Cap())
-	if err != nil {
-		log.Panic(err)
+// Latency return each stage latency of the last processed frame
+func (handler *CompleteTaskHandler) Latency() map[string]time.Duration {
+	return map[string]time.Duration{
+		"slam_compute_latency": handler.slamComputeLatency,
+		"slam_io_latency":      handler.slamIOLatency,
+		"det_compute_latency":  handler.detComputeLatency,
+		"det_io_latency":       handler.detIOLatency,
+		"fusion_latency":       handler.fusionLatency,
+		"total_latency":        handler.totalLatency,
 	}
+}
 
-	err = file.Close()
-	if err != nil {
-		log.Panic(err)
-	}
+func (handler *CompleteTaskHandler) startLocalization() error {
+	//log.Printf("submit to %v", handler.fusionWorker.GetIP())
 
-	err = multipartWriter.Close()
-	if err != nil {
-		log.Panic(err)
-	}
+	workerURL := handler.fusionWorker.GetURL("run_task")
 
-	_, err = http.Post(workerURL, multipartWriter.FormDataContentType(), postBody)
+	// the frame is streamed from the upload, shared with det instead of read twice
+	err := postFrame(workerURL, "fusion", handler.fusionTaskID, []formField{
+		{Key: "cmd", Value: "slam"},
+		{Key: "task_name", Value: "fusion"},
+		{Key: "task_id", Value: handler.fusionTaskID},
+		{Key: "reset", Value: "False"},
+	}, handler.frame)
 	if err != nil {
-		log.Panic(err)
+		// a rejected frame is not the fault of the worker
+		if !errors.Is(err, ErrFrameTooLarge) {
+			handler.fusionWorker.ReportFailure()
+		}
+		return fmt.Errorf("start localization of task %v failed: %w", handler.fusionTaskID, err)
 	}
 
-	buffer_pool.ReturnBuffer(bufferElem)
+	return nil
 }
 
-func (handler *CompleteTaskHandler) sendToDET() string {
+func (handler *CompleteTaskHandler) sendToDET() (string, error) {
 	now := time.Now()
 	detHandler := GetHandler("det")
-	detHandler.StartTask(handler.detWorker, handler.form, handler.detTaskID)
+	completion := detHandler.StartFrameTask(handler.detWorker, handler.frame, nil, handler.detTaskID)
 	handler.detIOLatency = time.Since(now)
 
-	notifier, _ := taskFinishNotifier.Load(handler.detTaskID)
-	finishForm := <-notifier.(chan *multipart.Form)
-	taskFinishNotifier.Delete(handler.detTaskID)
+	detWorker, finishForm, err := awaitFrame(handler.detWorker, completion, handler.frame, nil)
+	handler.detWorker = detWorker
+	if err != nil {
+		return "", err
+	}
 
 	if handler.status == STATUS_LAST {
-		workerURL := handler.detWorker.GetURL("run_task")
-
-		resetBufferElem := buffer_pool.GetBuffer()
-		postBody := resetBufferElem.Buffer
-		multipartWriter := multipart.NewWriter(postBody)
-
-		if err := multipartWriter.WriteField("reset", "True"); err != nil {
-			log.Panic(err)
-		}
-
-		if err := multipartWriter.WriteField("task_name", "det"); err != nil {
-			log.Panic(err)
-		}
-
-		if err := multipartWriter.WriteField("task_id", handler.detTaskID); err != nil {
-			log.Panic(err)
-		}
-
-		err := multipartWriter.Close()
-		if err != nil {
-			log.Panic(err)
-		}
-
-		_, err = http.Post(workerURL, multipartWriter.FormDataContentType(), postBody)
-		if err != nil {
-			log.Panic(err)
-		}
-
-		buffer_pool.ReturnBuffer(resetBufferElem)
-
+		ResetWorker(handler.detWorker, "det", handler.detTaskID)
 		handler.detWorker.ReturnToPool(handler.detTaskID)
 	}
 
@@ -206,25 +198,32 @@ func (handler *CompleteTaskHandler) sendToDET() string {
 		log.Printf("det worker deleted")
 	}
 
-	var err error
-	handler.detComputeLatency, err = time.ParseDuration(finishForm.Value["det_latency"][0])
+	detLatency, err := formValue(finishForm, "det_latency")
+	if err == nil {
+		handler.detComputeLatency, err = time.ParseDuration(detLatency)
+	}
 	if err != nil {
-		log.Panic(err)
+		return "", fmt.Errorf("det latency of task %v: %v", handler.detTaskID, err)
 	}
 
 	//log.Printf("receive result of task id: %v.task id is %v, det_result is %v",
 	//handler.detTaskID, len(finishForm.Value["task_id"]), len(finishForm.Value["det_result"]))
 
-	return finishForm.Value["det_result"][0]
+	return formValue(finishForm, "det_result")
 }
 
-func (handler *CompleteTaskHandler) sendDETResultToFusion(detResult string) string {
+func (handler *CompleteTaskHandler) sendDETResultToFusion(detResult string) (string, error) {
 	// submit fusion task to the worker_pool
 	//log.Printf("submit to %v", handler.fusionWorker.GetIP())
 
 	workerURL := handler.fusionWorker.GetURL("run_task")
 
-	bufferElem := buffer_pool.GetBuffer()
+	ctx, cancel := buffer_pool.AcquireContext(context.Background())
+	defer cancel()
+	bufferElem, err := buffer_pool.GetBuffer(ctx)
+	if err != nil {
+		return "", err
+	}
 	postBody := bufferElem.Buffer
 
 	multipartWriter := multipart.NewWriter(postBody)
@@ -249,67 +248,53 @@ func (handler *CompleteTaskHandler) sendDETResultToFusion(detResult string) stri
 		log.Panic(err)
 	}
 
-	err := multipartWriter.Close()
+	err = multipartWriter.Close()
 	if err != nil {
 		log.Panic(err)
 	}
 
-	notifier := make(chan *multipart.Form)
-	taskFinishNotifier.Store(handler.fusionTaskID, notifier)
+	completion := newCompletion("fusion", handler.fusionTaskID)
 
-	_, err = http.Post(workerURL, multipartWriter.FormDataContentType(), postBody)
+	err = postMultipart(workerURL, multipartWriter.FormDataContentType(), postBody)
 	if err != nil {
-		log.Panic(err)
+		completion.fail(fmt.Errorf("submit task %v to %v failed: %v", handler.fusionTaskID,
+			handler.fusionWorker.GetWorkerName(), err))
 	}
 
 	buffer_pool.ReturnBuffer(bufferElem)
 
-	finishForm := <-notifier
-	if len(finishForm.Value["fusion_result"]) != 1 {
-		log.Panicf("len of fusion result is %v", len(finishForm.Value["fusion_result"]))
-	}
-
-	log.Println("Fusion Notified!")
-
-	handler.slamComputeLatency, err = time.ParseDuration(finishForm.Value["slam_latency"][0])
+	// fusion depends on the slam state in the worker, so it can not be retried in another worker
+	finishForm, err := completion.Wait(FinishTimeout)
 	if err != nil {
-		log.Panic(err)
+		handler.fusionWorker.ReportFailure()
+		return "", err
 	}
+	handler.fusionWorker.ReportSuccess()
 
-	handler.fusionLatency, err = time.ParseDuration(finishForm.Value["fusion_latency"][0])
-	if err != nil {
-		log.Panic(err)
+	if len(finishForm.Value["fusion_result"]) != 1 {
+		return "", fmt.Errorf("len of fusion result is %v", len(finishForm.Value["fusion_result"]))
 	}
 
-	if handler.status == STATUS_LAST {
-		resetBufferElem := buffer_pool.GetBuffer()
-		postBody := resetBufferElem.Buffer
-		multipartWriter := multipart.NewWriter(postBody)
-
-		if err := multipartWriter.WriteField("reset", "True"); err != nil {
-			log.Panic(err)
-		}
-
-		if err := multipartWriter.WriteField("task_name", "fusion"); err != nil {
-			log.Panic(err)
-		}
-
-		if err := multipartWriter.WriteField("task_id", handler.fusionTaskID); err != nil {
-			log.Panic(err)
-		}
+	log.Println("Fusion Notified!")
 
-		err := multipartWriter.Close()
-		if err != nil {
-			log.Panic(err)
+	for _, latency := range []struct {
+		field string
+		value *time.Duration
+	}{
+		{"slam_latency", &handler.slamComputeLatency},
+		{"fusion_latency", &handler.fusionLatency},
+	} {
+		rawLatency, err := formValue(finishForm, latency.field)
+		if err == nil {
+			*latency.value, err = time.ParseDuration(rawLatency)
 		}
-
-		_, err = http.Post(workerURL, multipartWriter.FormDataContentType(), postBody)
 		if err != nil {
-			log.Panic(err)
+			return "", fmt.Errorf("%v of task %v: %v", latency.field, handler.fusionTaskID, err)
 		}
+	}
 
-		buffer_pool.ReturnBuffer(resetBufferElem)
-
+	if handler.status == STATUS_LAST {
+		ResetWorker(handler.fusionWorker, "fusion", handler.fusionTaskID)
 		handler.fusionWorker.ReturnToPool(handler.fusionTaskID)
 	}
 
@@ -318,12 +303,19 @@ func (handler *CompleteTaskHandler) sendDETResultToFusion(detResult string) stri
 		log.Printf("fusion worker deleted")
 	}
 
-	return finishForm.Value["fusion_result"][0]
+	return finishForm.Value["fusion_result"][0], nil
 }
 
 func (handler *CompleteTaskHandler) sendBackToClient(fusionResult string) {
 
-	sendBackBufferElem := buffer_pool.GetBuffer()
+	ctx, cancel := buffer_pool.AcquireContext(context.Background())
+	defer cancel()
+	sendBackBufferElem, err := buffer_pool.GetBuffer(ctx)
+	if err != nil {
+		sendBackFailed(handler.clientAddress, "complete_task", handler.detTaskID+":"+handler.fusionTaskID, err)
+		return
+	}
+	defer buffer_pool.ReturnBuffer(sendBackBufferElem)
 	buffer := sendBackBufferElem.Buffer
 	multipartWriter := multipart.NewWriter(buffer)
 
@@ -339,34 +331,25 @@ func (handler *CompleteTaskHandler) sendBackToClient(fusionResult string) {
 		log.Panic(err)
 	}
 
-	writeLatency := func(fieldName string, latency time.Duration) {
+	for fieldName, latency := range handler.Latency() {
 		if err := multipartWriter.WriteField(fieldName, latency.String()); err != nil {
 			log.Panic(err)
 		}
 	}
 
-	writeLatency("slam_compute_latency", handler.slamComputeLatency)
-	writeLatency("slam_io_latency", handler.slamIOLatency)
-	writeLatency("det_compute_latency", handler.detComputeLatency)
-	writeLatency("det_io_latency", handler.detIOLatency)
-	writeLatency("fusion_latency", handler.fusionLatency)
-	writeLatency("total_latency", handler.totalLatency)
+	writeDroppedFrames(multipartWriter, handler.dropped)
 
-	err := multipartWriter.Close()
+	err = multipartWriter.Close()
 	if err != nil {
 		log.Panic(err)
 	}
 
-	// split ip and port
-	clientIP := "http://" + strings.Split(handler.clientAddress, ":")[0]
-	resultAddress := clientIP + ":8080/complete_task"
+	resultAddress := clientURL(handler.clientAddress, "complete_task")
 
 	//log.Printf("result send back to %v", resultAddress)
 
-	_, err = http.Post(resultAddress, multipartWriter.FormDataContentType(), buffer)
+	err = postToClient(resultAddress, multipartWriter.FormDataContentType(), buffer)
 	if err != nil {
-		log.Panic(err)
+		sendBackFailed(handler.clientAddress, "complete_task", handler.detTaskID+":"+handler.fusionTaskID, err)
 	}
-
-	buffer_pool.ReturnBuffer(sendBackBufferElem)
 }
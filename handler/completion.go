@@ -0,0 +1,228 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrCanceled is the error of a canceled completion
+var ErrCanceled = errors.New("task canceled")
+
+// Completion is the future of a worker result of a task id.
+// It is registered before the task is dispatched, so a callback never misses its waiter,
+// and it is resolved exactly once by the result, a failure, a timeout or a cancellation
+type Completion struct {
+	TaskName  string
+	TaskID    string
+	CreatedAt time.Time
+
+	done     chan struct{}
+	form     *multipart.Form
+	err      error
+	resolved bool
+}
+
+// OutstandingTask is the json view of a pending completion
+type OutstandingTask struct {
+	TaskName string `json:"task_name"`
+	TaskID   string `json:"task_id"`
+	Age      string `json:"age"`
+}
+
+// CompletionMetrics counts completions since the scheduler started
+type CompletionMetrics struct {
+	Outstanding      int               `json:"outstanding"`
+	Registered       int64             `json:"registered"`
+	Completed        int64             `json:"completed"`
+	Failed           int64             `json:"failed"`
+	Canceled         int64             `json:"canceled"`
+	Timeouts         int64             `json:"timeouts"`
+	Duplicates       int64             `json:"duplicates"`
+	Late             int64             `json:"late"`
+	OutstandingTasks []OutstandingTask `json:"outstanding_tasks"`
+}
+
+var completionLock = sync.Mutex{}
+
+// map from task id to the pending *Completion
+var completionMap = map[string]*Completion{}
+
+var completionMetrics = CompletionMetrics{}
+
+// map from task id to the cancel of its wait for a replacement worker, guarded by completionLock
+var replacementCancels = map[string]context.CancelFunc{}
+
+// replacementContext is the context of taskID waiting for another worker, done at the timeout
+// or when the task is canceled
+func replacementContext(taskID string, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	completionLock.Lock()
+	replacementCancels[taskID] = cancel
+	completionLock.Unlock()
+
+	return ctx, func() {
+		completionLock.Lock()
+		delete(replacementCancels, taskID)
+		completionLock.Unlock()
+		cancel()
+	}
+}
+
+// newCompletion register the completion of taskID, it must be called before the task is posted
+// A pending completion with the same task id is failed and replaced
+func newCompletion(taskName, taskID string) *Completion {
+	completion := &Completion{
+		TaskName:  taskName,
+		TaskID:    taskID,
+		CreatedAt: time.Now(),
+		done:      make(chan struct{}),
+	}
+
+	completionLock.Lock()
+	if old, ok := completionMap[taskID]; ok {
+		old.resolveLocked(nil, fmt.Errorf("task %v is dispatched again", taskID),
+			&completionMetrics.Failed)
+	}
+	completionMap[taskID] = completion
+	completionMetrics.Registered++
+	completionLock.Unlock()
+
+	return completion
+}
+
+// resolveLocked should be called with completionLock held, return false if already resolved
+func (c *Completion) resolveLocked(form *multipart.Form, err error, counter *int64) bool {
+	if c.resolved {
+		return false
+	}
+	c.resolved = true
+	c.form = form
+	c.err = err
+	*counter++
+	close(c.done)
+	return true
+}
+
+func (c *Completion) resolve(form *multipart.Form, err error, counter *int64) bool {
+	completionLock.Lock()
+	defer completionLock.Unlock()
+	return c.resolveLocked(form, err, counter)
+}
+
+// fail resolve the completion with the dispatch error
+func (c *Completion) fail(err error) {
+	c.resolve(nil, err, &completionMetrics.Failed)
+}
+
+// Wait block until the completion is resolved or timeout, then unregister it
+// A timeout <= 0 waits forever
+func (c *Completion) Wait(timeout time.Duration) (*multipart.Form, error) {
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		select {
+		case <-c.done:
+		case <-timer.C:
+			c.resolve(nil, fmt.Errorf("task %v has no result in %v", c.TaskID, timeout),
+				&completionMetrics.Timeouts)
+		}
+		timer.Stop()
+	} else {
+		<-c.done
+	}
+
+	completionLock.Lock()
+	if completionMap[c.TaskID] == c {
+		delete(completionMap, c.TaskID)
+	}
+	completionLock.Unlock()
+
+	return c.form, c.err
+}
+
+// deliverResult resolve the pending completion of taskID with the worker callback form
+func deliverResult(taskID string, form *multipart.Form) {
+	completionLock.Lock()
+	defer completionLock.Unlock()
+
+	completion, ok := completionMap[taskID]
+	if !ok {
+		completionMetrics.Late++
+		log.Printf("task %v is not waiting, maybe the result is too late", taskID)
+		return
+	}
+
+	if !completion.resolveLocked(form, nil, &completionMetrics.Completed) {
+		completionMetrics.Duplicates++
+		log.Printf("task %v has been resolved, drop the duplicated result", taskID)
+	}
+}
+
+// CancelTask cancel the pending completion of taskID, or its wait for a replacement worker.
+// Return false if it is neither pending nor waiting
+func CancelTask(taskID string) bool {
+	completionLock.Lock()
+	defer completionLock.Unlock()
+
+	if cancel, ok := replacementCancels[taskID]; ok {
+		cancel()
+		return true
+	}
+	completion, ok := completionMap[taskID]
+	if !ok {
+		return false
+	}
+	return completion.resolveLocked(nil, ErrCanceled, &completionMetrics.Canceled)
+}
+
+// GetCompletionMetrics return the counters and the pending completions ordered by age
+func GetCompletionMetrics() CompletionMetrics {
+	completionLock.Lock()
+	metrics := completionMetrics
+	metrics.OutstandingTasks = []OutstandingTask{}
+	now := time.Now()
+	var pending []*Completion
+	for _, completion := range completionMap {
+		if !completion.resolved {
+			pending = append(pending, completion)
+		}
+	}
+	completionLock.Unlock()
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].CreatedAt.Before(pending[j].CreatedAt)
+	})
+
+	for _, completion := range pending {
+		metrics.OutstandingTasks = append(metrics.OutstandingTasks, OutstandingTask{
+			TaskName: completion.TaskName,
+			TaskID:   completion.TaskID,
+			Age:      now.Sub(completion.CreatedAt).String(),
+		})
+	}
+	metrics.Outstanding = len(pending)
+
+	return metrics
+}
+
+// sendsInFlight counts goroutines awaiting worker results and sending them back to clients
+var sendsInFlight atomic.Int64
+
+// TrackSend count a send back goroutine until the returned func is called
+func TrackSend() func() {
+	sendsInFlight.Add(1)
+	return func() {
+		sendsInFlight.Add(-1)
+	}
+}
+
+// SendsInFlight return the number of results not sent back to clients yet
+func SendsInFlight() int64 {
+	return sendsInFlight.Load()
+}
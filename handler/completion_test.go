@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"mime/multipart"
+	"testing"
+	"time"
+)
+
+// newTestTaskID is a task id only used by one test
+func newTestTaskID(t *testing.T) string {
+	return fmt.Sprintf("%v-%v", t.Name(), time.Now().UnixNano())
+}
+
+func TestCompletionResult(t *testing.T) {
+	before := GetCompletionMetrics()
+	taskID := newTestTaskID(t)
+	completion := newCompletion("det", taskID)
+
+	if metrics := GetCompletionMetrics(); metrics.Outstanding != before.Outstanding+1 {
+		t.Fatalf("the completion should be outstanding, got %+v", metrics)
+	}
+
+	form := &multipart.Form{Value: map[string][]string{"det_result": {"[]"}}}
+	go deliverResult(taskID, form)
+	result, err := completion.Wait(time.Second)
+	if err != nil || result != form {
+		t.Fatalf("expected the delivered form, got %v %v", result, err)
+	}
+
+	// the completion is unregistered once waited, a later result is late
+	deliverResult(taskID, form)
+	metrics := GetCompletionMetrics()
+	if metrics.Completed != before.Completed+1 || metrics.Late != before.Late+1 ||
+		metrics.Outstanding != before.Outstanding {
+		t.Fatalf("unexpected metrics %+v, before %+v", metrics, before)
+	}
+}
+
+func TestCompletionDuplicate(t *testing.T) {
+	before := GetCompletionMetrics()
+	taskID := newTestTaskID(t)
+	completion := newCompletion("det", taskID)
+
+	first := &multipart.Form{}
+	deliverResult(taskID, first)
+	deliverResult(taskID, &multipart.Form{})
+	if result, err := completion.Wait(time.Second); err != nil || result != first {
+		t.Fatalf("the first result should win, got %v %v", result, err)
+	}
+	if metrics := GetCompletionMetrics(); metrics.Duplicates != before.Duplicates+1 {
+		t.Fatalf("expected a duplicate, got %+v", metrics)
+	}
+}
+
+func TestCompletionTimeout(t *testing.T) {
+	before := GetCompletionMetrics()
+	completion := newCompletion("det", newTestTaskID(t))
+	if _, err := completion.Wait(10 * time.Millisecond); err == nil {
+		t.Fatal("the completion should time out")
+	}
+	if metrics := GetCompletionMetrics(); metrics.Timeouts != before.Timeouts+1 {
+		t.Fatalf("expected a timeout, got %+v", metrics)
+	}
+}
+
+func TestCompletionCancelAndRedispatch(t *testing.T) {
+	before := GetCompletionMetrics()
+	taskID := newTestTaskID(t)
+
+	completion := newCompletion("det", taskID)
+	if !CancelTask(taskID) || CancelTask(newTestTaskID(t)) {
+		t.Fatal("only a pending completion can be canceled")
+	}
+	if _, err := completion.Wait(time.Second); err != ErrCanceled {
+		t.Fatalf("expected %v, got %v", ErrCanceled, err)
+	}
+
+	// dispatching the task id again fails the pending completion, the new one is kept
+	old := newCompletion("det", taskID)
+	current := newCompletion("det", taskID)
+	if _, err := old.Wait(time.Second); err == nil {
+		t.Fatal("the replaced completion should fail")
+	}
+	deliverResult(taskID, &multipart.Form{})
+	if _, err := current.Wait(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failure to post resolves at once
+	failed := newCompletion("det", taskID)
+	failed.fail(fmt.Errorf("connection refused"))
+	if _, err := failed.Wait(0); err == nil {
+		t.Fatal("the failed completion should return its error")
+	}
+
+	metrics := GetCompletionMetrics()
+	if metrics.Canceled != before.Canceled+1 || metrics.Failed != before.Failed+2 {
+		t.Fatalf("unexpected metrics %+v, before %+v", metrics, before)
+	}
+}
+
+// a task waiting for a replacement worker is canceled with its session
+func TestCancelReplacement(t *testing.T) {
+	taskID := newTestTaskID(t)
+	ctx, cancel := replacementContext(taskID, time.Minute)
+	if !CancelTask(taskID) || ctx.Err() != context.Canceled {
+		t.Fatalf("the wait for a replacement should be canceled, got %v", ctx.Err())
+	}
+	cancel()
+	if CancelTask(taskID) {
+		t.Fatal("a finished replacement can not be canceled")
+	}
+}
+
+func TestTrackSend(t *testing.T) {
+	before := SendsInFlight()
+	done := TrackSend()
+	if SendsInFlight() != before+1 {
+		t.Fatal("the send should be counted")
+	}
+	done()
+	if SendsInFlight() != before {
+		t.Fatal("the send should be done")
+	}
+}
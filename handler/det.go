@@ -1,82 +1,22 @@
 package handler
 
 import (
-	"Scheduler/buffer_pool"
+	"Scheduler/overload"
+	"Scheduler/utils"
 	"Scheduler/worker_pool"
-	"io"
 	"log"
-	"mime/multipart"
 	"net/http"
-	"strings"
 	"time"
 )
 
-func doDET(worker *worker_pool.Worker, form *multipart.Form, taskID string) {
-
+func doDET(worker *worker_pool.Worker, form *TaskForm, taskID string) *Completion {
 	// submit det task to the worker_pool
 	//log.Printf("submit to %v", worker.GetIP())
+	return submitDET(worker, taskID, FormFrame(form))
+}
 
-	workerURL := worker.GetURL("run_task")
-
-	bufferElem := buffer_pool.GetBuffer()
-	postBody := bufferElem.Buffer
-
-	multipartWriter := multipart.NewWriter(postBody)
-
-	if err := multipartWriter.WriteField("task_name", "det"); err != nil {
-		log.Panic(err)
-	}
-
-	if err := multipartWriter.WriteField("task_id", taskID); err != nil {
-		log.Panic(err)
-	}
-
-	fileHeader := form.File["frame"][0]
-	writer, err := multipartWriter.CreateFormFile("frame", "input.png")
-	if err != nil {
-		log.Panic(err)
-	}
-
-	file, err := fileHeader.Open()
-	if err != nil {
-		log.Panic(err)
-	}
-
-	frameBytes, err := io.ReadAll(file)
-	//log.Printf("Receive bytes %v", len(frameBytes))
-	if err != nil {
-		log.Panic(err)
-	}
-
-	err = file.Close()
-	if err != nil {
-		log.Panic(err)
-	}
-
-	_, err = writer.Write(frameBytes)
-	//log.Printf("Write %v bytes. Buffer size is %v", n, postBody.Cap())
-	if err != nil {
-		log.Panic(err)
-	}
-
-	if err = multipartWriter.WriteField("reset", "False"); err != nil {
-		log.Panic(err)
-	}
-
-	err = multipartWriter.Close()
-	if err != nil {
-		log.Panic(err)
-	}
-
-	notifier := make(chan *multipart.Form)
-	taskFinishNotifier.Store(taskID, notifier)
-
-	_, err = http.Post(workerURL, multipartWriter.FormDataContentType(), postBody)
-	if err != nil {
-		log.Panic(err)
-	}
-
-	buffer_pool.ReturnBuffer(bufferElem)
+func doDETFrame(worker *worker_pool.Worker, frame FrameOpener, values map[string]string, taskID string) *Completion {
+	return submitDET(worker, taskID, frame)
 }
 
 func detFinish(w http.ResponseWriter, r *http.Request) {
@@ -95,54 +35,45 @@ func detFinish(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	taskID := form.Value["task_id"][0]
+	for _, taskID := range form.Value["task_id"] {
+		if err = utils.ValidateTaskID(taskID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
-	notifier, _ := taskFinishNotifier.Load(taskID)
+	// result of a batch, see batch.go
+	if len(form.Value["task_id"]) > 1 {
+		deliverBatchResult(w, form)
+		return
+	}
 
-	notifier.(chan *multipart.Form) <- form
+	deliverResult(form.Value["task_id"][0], form)
 }
 
-func SendBackDET(r *http.Request, taskID string, worker *worker_pool.Worker,
-	returnWorker, deleteWorker bool) {
+func SendBackDET(r *http.Request, form *TaskForm, completion *Completion,
+	worker *worker_pool.Worker, returnWorker, deleteWorker bool) {
+	taskID := completion.TaskID
+	done := TrackSend()
 	go func(clientIP string) {
+		defer done()
+		// the frame is no longer opened once the task is done
+		defer form.Close()
 		now := time.Now()
-		notifier, _ := taskFinishNotifier.Load(taskID)
-		finishForm := <-notifier.(chan *multipart.Form)
-		close((notifier.(chan *multipart.Form)))
-		taskFinishNotifier.Delete(taskID)
+		worker, finishForm, err := awaitFrame(worker, completion, FormFrame(form), nil)
+		// the next pending frame of the session is admitted once this one is done
+		dropped := overload.Done(taskID)
+		if err != nil {
+			if worker != nil {
+				worker.ReturnToPool(taskID)
+			}
+			sendFailureToClient(clientIP, "det", taskID, err)
+			return
+		}
 		log.Printf("Notified %v", time.Since(now))
 
 		if returnWorker {
-			workerURL := worker.GetURL("run_task")
-
-			resetBufferElem := buffer_pool.GetBuffer()
-			postBody := resetBufferElem.Buffer
-			multipartWriter := multipart.NewWriter(postBody)
-
-			if err := multipartWriter.WriteField("reset", "True"); err != nil {
-				log.Panic(err)
-			}
-
-			if err := multipartWriter.WriteField("task_name", "det"); err != nil {
-				log.Panic(err)
-			}
-
-			if err := multipartWriter.WriteField("task_id", taskID); err != nil {
-				log.Panic(err)
-			}
-
-			err := multipartWriter.Close()
-			if err != nil {
-				log.Panic(err)
-			}
-
-			_, err = http.Post(workerURL, multipartWriter.FormDataContentType(), postBody)
-			if err != nil {
-				log.Panic(err)
-			}
-
-			buffer_pool.ReturnBuffer(resetBufferElem)
-
+			ResetWorker(worker, "det", taskID)
 			worker.ReturnToPool(taskID)
 		}
 
@@ -154,36 +85,9 @@ func SendBackDET(r *http.Request, taskID string, worker *worker_pool.Worker,
 		log.Printf("receive result of task id: %v.task id is %v, det_result is %v",
 			taskID, len(finishForm.Value["task_id"]), len(finishForm.Value["det_result"]))
 
-		sendBackBufferElem := buffer_pool.GetBuffer()
-		buffer := sendBackBufferElem.Buffer
-		multipartWriter := multipart.NewWriter(buffer)
-
-		if err := multipartWriter.WriteField("task_id",
-			finishForm.Value["task_id"][0]); err != nil {
-			log.Panic(err)
-		}
-
-		if err := multipartWriter.WriteField("det_result",
-			finishForm.Value["det_result"][0]); err != nil {
-			log.Panic(err)
-		}
-
-		err := multipartWriter.Close()
+		err = sendResultToClient(clientIP, "det", finishForm, []string{"task_id", "det_result"}, dropped)
 		if err != nil {
-			log.Panic(err)
+			sendBackFailed(clientIP, "det", taskID, err)
 		}
-
-		// split ip and port
-		clientIP = "http://" + strings.Split(clientIP, ":")[0]
-
-		log.Printf("result send back to %v", clientIP+":8080/det")
-
-		_, err = http.Post(clientIP+":8080/det", multipartWriter.FormDataContentType(), buffer)
-		if err != nil {
-			log.Panic(err)
-		}
-
-		buffer_pool.ReturnBuffer(sendBackBufferElem)
-
 	}(r.RemoteAddr)
 }
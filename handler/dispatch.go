@@ -0,0 +1,360 @@
+package handler
+
+import (
+	"Scheduler/buffer_pool"
+	"Scheduler/overload"
+	"Scheduler/worker_pool"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FinishTimeout is the deadline of a worker to call back the result of a frame
+var FinishTimeout = 30 * time.Second
+
+// MaxAttempts is the max number of workers a frame is dispatched to
+var MaxAttempts = 3
+
+// reservedFields are the form fields of a frame set by the scheduler, extra values never override them
+var reservedFields = map[string]bool{"task_name": true, "task_id": true, "reset": true}
+
+// CheckFrameValues refuse extra values of a frame from clients which collide with reserved fields
+func CheckFrameValues(values map[string]string) error {
+	for key := range values {
+		if reservedFields[key] {
+			return fmt.Errorf("field %v is reserved", key)
+		}
+	}
+	return nil
+}
+
+// submitFrame post a frame of taskName to the worker, and return the completion of its result
+// values are extra form fields, such as detect_result of fusion, reserved fields among them are skipped
+// If the post failed, the completion fails fast
+func submitFrame(worker *worker_pool.Worker, taskName, taskID string,
+	values map[string]string, frame FrameOpener) *Completion {
+	fields := []formField{
+		{Key: "task_name", Value: taskName},
+		{Key: "task_id", Value: taskID},
+	}
+	for key, value := range values {
+		if reservedFields[key] {
+			log.Printf("reserved field %v of task %v is skipped", key, taskID)
+			continue
+		}
+		fields = append(fields, formField{Key: key, Value: value})
+	}
+	fields = append(fields, formField{Key: "reset", Value: "False"})
+
+	completion := newCompletion(taskName, taskID)
+
+	err := postFrame(worker.GetURL("run_task"), taskName, taskID, fields, frame)
+	if err != nil {
+		completion.fail(fmt.Errorf("submit task %v to %v failed: %w", taskID, worker.GetWorkerName(), err))
+	}
+
+	return completion
+}
+
+// postMultipart post the body and check it is accepted
+func postMultipart(url, contentType string, body io.Reader) error {
+	request, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", contentType)
+	return doRequest(request)
+}
+
+// doRequest send the request, drain the response and check it is accepted
+func doRequest(request *http.Request) error {
+	resp, err := worker_pool.WorkerClient().Do(request)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("response %v", resp.Status)
+	}
+	return nil
+}
+
+// clientLock guards clientScheme and clientHTTP
+var clientLock = sync.RWMutex{}
+
+// clientScheme is the scheme of device urls, https once ConfigureClientTLS is called
+var clientScheme = "http"
+
+// clientHTTP send results back to devices, apart from the connections to workers
+var clientHTTP = &http.Client{Timeout: 30 * time.Second}
+
+// ConfigureClientTLS send results back to devices over https with config
+func ConfigureClientTLS(config *tls.Config) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+
+	clientLock.Lock()
+	previous := clientHTTP
+	clientScheme = "https"
+	clientHTTP = &http.Client{Timeout: 30 * time.Second, Transport: transport}
+	clientLock.Unlock()
+
+	previous.CloseIdleConnections()
+}
+
+// clientURL is the url of route at port 8080 of the device at clientAddress
+func clientURL(clientAddress, route string) string {
+	clientLock.RLock()
+	defer clientLock.RUnlock()
+	// split ip and port
+	return clientScheme + "://" + strings.Split(clientAddress, ":")[0] + ":8080/" + route
+}
+
+// postToClient post a result to a device and drain the response so the connection is reused.
+// Only a failed request is an error, a device answering non 2xx is logged
+func postToClient(url, contentType string, body io.Reader) error {
+	clientLock.RLock()
+	client := clientHTTP
+	clientLock.RUnlock()
+
+	resp, err := client.Post(url, contentType, body)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		log.Printf("client %v response %v", url, resp.Status)
+	}
+	return nil
+}
+
+// awaitFrame wait the result of a submitted frame. If the worker failed or timeout,
+// the frame is dispatched again to another worker with the same task id, which
+// begins a fresh state for the task in the new worker. Another worker is waited for
+// no longer than FinishTimeout.
+// Return the worker finally bound to the task id, nil if the task lost its worker in a retry
+// or was canceled
+func awaitFrame(worker *worker_pool.Worker, completion *Completion, frame FrameOpener,
+	values map[string]string) (*worker_pool.Worker, *multipart.Form, error) {
+	taskName, taskID := completion.TaskName, completion.TaskID
+	for attempt := 1; ; attempt++ {
+		finishForm, err := completion.Wait(FinishTimeout)
+		if err == nil {
+			worker.ReportSuccess()
+			worker_pool.RecordFrame(taskID)
+			return worker, finishForm, nil
+		}
+
+		// the worker of a canceled task is returned by the close of its session
+		if err == ErrCanceled {
+			return nil, nil, err
+		}
+		// a rejected frame fails the same on any worker, and is not the fault of this one
+		if errors.Is(err, ErrFrameTooLarge) {
+			return worker, nil, err
+		}
+
+		worker.ReportFailure()
+		log.Printf("attempt %v of task %v in worker %v failed: %v",
+			attempt, taskID, worker.GetWorkerName(), err)
+
+		if attempt >= MaxAttempts {
+			return worker, nil, err
+		}
+
+		// the old worker may hold a partial state of the task, clear it before it is returned
+		ResetWorker(worker, taskName, taskID)
+		ctx, cancel := replacementContext(taskID, FinishTimeout)
+		newWorker, replaceErr := worker_pool.ReplaceWorker(ctx, worker, taskID)
+		cancel()
+		if replaceErr == context.Canceled {
+			return nil, nil, ErrCanceled
+		} else if replaceErr != nil {
+			return nil, nil, fmt.Errorf("%v, and no other %v worker: %v", err, taskName, replaceErr)
+		}
+		worker = newWorker
+
+		completion = GetHandler(taskName).StartFrameTask(worker, frame, values, taskID)
+	}
+}
+
+// RunFrame submit the frame and block until the worker result,
+// the worker is reset and returned to pool if returnWorker
+func RunFrame(worker *worker_pool.Worker, taskName, taskID string, frame FrameOpener,
+	values map[string]string, returnWorker, deleteWorker bool) (*multipart.Form, error) {
+	completion := GetHandler(taskName).StartFrameTask(worker, frame, values, taskID)
+
+	worker, finishForm, err := awaitFrame(worker, completion, frame, values)
+	if err != nil {
+		if worker != nil {
+			worker.ReturnToPool(taskID)
+		}
+		return nil, err
+	}
+
+	if returnWorker {
+		ResetWorker(worker, taskName, taskID)
+		worker.ReturnToPool(taskID)
+	}
+
+	if deleteWorker {
+		worker.DeleteWorker()
+		log.Printf("worker deleted")
+	}
+
+	return finishForm, nil
+}
+
+// ResetWorker clear the model state of taskID in the worker
+func ResetWorker(worker *worker_pool.Worker, taskName, taskID string) {
+	workerURL := worker.GetURL("run_task")
+
+	ctx, cancel := buffer_pool.AcquireContext(context.Background())
+	defer cancel()
+	resetBufferElem, err := buffer_pool.GetBuffer(ctx)
+	if err != nil {
+		log.Printf("reset task %v in %v failed: %v", taskID, worker.GetWorkerName(), err)
+		return
+	}
+	postBody := resetBufferElem.Buffer
+	multipartWriter := multipart.NewWriter(postBody)
+
+	if err := multipartWriter.WriteField("reset", "True"); err != nil {
+		log.Panic(err)
+	}
+
+	if err := multipartWriter.WriteField("task_name", taskName); err != nil {
+		log.Panic(err)
+	}
+
+	if err := multipartWriter.WriteField("task_id", taskID); err != nil {
+		log.Panic(err)
+	}
+
+	err = multipartWriter.Close()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	err = postMultipart(workerURL, multipartWriter.FormDataContentType(), postBody)
+	if err != nil {
+		log.Printf("reset task %v in %v failed: %v", taskID, worker.GetWorkerName(), err)
+	}
+
+	buffer_pool.ReturnBuffer(resetBufferElem)
+}
+
+// sendFailureToClient tell the client the task failed, at http(s)://client_ip:8080/task_failed
+func sendFailureToClient(clientAddress, taskName, taskID string, taskErr error) {
+	ctx, cancel := buffer_pool.AcquireContext(context.Background())
+	defer cancel()
+	bufferElem, err := buffer_pool.GetBuffer(ctx)
+	if err != nil {
+		log.Printf("send failure of task %v to client failed: %v", taskID, err)
+		return
+	}
+	buffer := bufferElem.Buffer
+	multipartWriter := multipart.NewWriter(buffer)
+
+	if err := multipartWriter.WriteField("task_name", taskName); err != nil {
+		log.Panic(err)
+	}
+
+	if err := multipartWriter.WriteField("task_id", taskID); err != nil {
+		log.Panic(err)
+	}
+
+	if err := multipartWriter.WriteField("error", taskErr.Error()); err != nil {
+		log.Panic(err)
+	}
+
+	err = multipartWriter.Close()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	url := clientURL(clientAddress, "task_failed")
+	log.Printf("failure of task %v send back to %v", taskID, url)
+
+	err = postToClient(url, multipartWriter.FormDataContentType(), buffer)
+	if err != nil {
+		log.Printf("send failure of task %v to client failed: %v", taskID, err)
+	}
+
+	buffer_pool.ReturnBuffer(bufferElem)
+}
+
+// formValue return the first value of key in the result of a worker, an error if it is missing
+func formValue(form *multipart.Form, key string) (string, error) {
+	if values := form.Value[key]; len(values) != 0 {
+		return values[0], nil
+	}
+	return "", fmt.Errorf("no %v in the result", key)
+}
+
+// sendResultToClient post the fields of the worker result and the frames of the session
+// dropped by the overload policy to route of the client
+func sendResultToClient(clientAddress, route string, finishForm *multipart.Form, fields []string,
+	dropped overload.Counters) error {
+	ctx, cancel := buffer_pool.AcquireContext(context.Background())
+	defer cancel()
+	sendBackBufferElem, err := buffer_pool.GetBuffer(ctx)
+	if err != nil {
+		return err
+	}
+	defer buffer_pool.ReturnBuffer(sendBackBufferElem)
+	buffer := sendBackBufferElem.Buffer
+	multipartWriter := multipart.NewWriter(buffer)
+
+	for _, field := range fields {
+		value, err := formValue(finishForm, field)
+		if err != nil {
+			return err
+		}
+		if err = multipartWriter.WriteField(field, value); err != nil {
+			return err
+		}
+	}
+
+	writeDroppedFrames(multipartWriter, dropped)
+
+	if err := multipartWriter.Close(); err != nil {
+		return err
+	}
+
+	url := clientURL(clientAddress, route)
+	log.Printf("result send back to %v", url)
+
+	return postToClient(url, multipartWriter.FormDataContentType(), buffer)
+}
+
+// sendBackFailed log a result which could not be sent back, and tell the client by the failure callback
+func sendBackFailed(clientAddress, taskName, taskID string, err error) {
+	log.Printf("send result of task %v back to client failed: %v", taskID, err)
+	sendFailureToClient(clientAddress, taskName, taskID, err)
+}
+
+// writeDroppedFrames write the frames of the session skipped by the overload policy
+// as json field "dropped_frames" of a result callback
+func writeDroppedFrames(multipartWriter *multipart.Writer, dropped overload.Counters) {
+	marshal, err := json.Marshal(dropped)
+	if err != nil {
+		log.Panic(err)
+	}
+	if err = multipartWriter.WriteField("dropped_frames", string(marshal)); err != nil {
+		log.Panic(err)
+	}
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"Scheduler/overload"
+	"crypto/tls"
+	"crypto/x509"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckFrameValues(t *testing.T) {
+	if err := CheckFrameValues(map[string]string{"detect_result": "[]"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"task_name", "task_id", "reset"} {
+		if err := CheckFrameValues(map[string]string{"detect_result": "[]", key: "x"}); err == nil {
+			t.Fatalf("%v should be refused", key)
+		}
+	}
+}
+
+// a result missing a field is refused before anything is posted to the client
+func TestSendResultMissingField(t *testing.T) {
+	form := &multipart.Form{Value: map[string][]string{"task_id": {"task"}}}
+	if value, err := formValue(form, "task_id"); err != nil || value != "task" {
+		t.Fatalf("unexpected value %v %v", value, err)
+	}
+	if err := sendResultToClient("192.0.2.1:1234", "det", form, []string{"task_id", "det_result"},
+		overload.Counters{}); err == nil {
+		t.Fatal("a result without det_result should fail")
+	}
+}
+
+// with tls enabled, results go back to devices over https verified by the configured CA
+func TestClientTLS(t *testing.T) {
+	clientLock.Lock()
+	previousScheme, previousClient := clientScheme, clientHTTP
+	clientLock.Unlock()
+	t.Cleanup(func() {
+		clientLock.Lock()
+		clientScheme, clientHTTP = previousScheme, previousClient
+		clientLock.Unlock()
+	})
+
+	received := make(chan string, 1)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.URL.Path
+	}))
+	defer server.Close()
+
+	if url := clientURL("10.0.0.1:5555", "det"); url != "http://10.0.0.1:8080/det" {
+		t.Fatalf("unexpected url %v", url)
+	}
+	if err := postToClient(server.URL+"/det", "text/plain", strings.NewReader("result")); err == nil {
+		t.Fatal("a device certificate of an unknown CA should be refused")
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	ConfigureClientTLS(&tls.Config{MinVersion: tls.VersionTLS12, RootCAs: pool})
+	if url := clientURL("10.0.0.1:5555", "det"); url != "https://10.0.0.1:8080/det" {
+		t.Fatalf("unexpected url %v", url)
+	}
+	if err := postToClient(server.URL+"/det", "text/plain", strings.NewReader("result")); err != nil {
+		t.Fatal(err)
+	}
+	if path := <-received; path != "/det" {
+		t.Fatalf("unexpected path %v", path)
+	}
+}
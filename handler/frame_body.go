@@ -0,0 +1,226 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+)
+
+// formField is a text field of a multipart body, in order
+type formField struct {
+	Key   string
+	Value string
+}
+
+// FrameOpener open the frame of a task and return its size, or -1 if unknown
+// It may be opened more than once, e.g. by det and slam of a complete task or by retry,
+// and each reader shares the same uploaded bytes
+type FrameOpener func() (io.ReadCloser, int64, error)
+
+// TaskForm is a multipart upload of a device read part by part by ReadTaskForm,
+// File is the opener of each file field. Close it once the task is done with its files
+type TaskForm struct {
+	Value map[string][]string
+	File  map[string]FrameOpener
+
+	// temporary files of parts beyond maxMemory
+	spilled []*os.File
+}
+
+// Close close the temporary files of the form, they can not be opened afterwards.
+// It may be called more than once
+func (form *TaskForm) Close() {
+	for _, file := range form.spilled {
+		file.Close()
+	}
+	form.spilled = nil
+}
+
+// maxTaskValues limit the text fields of a TaskForm, which are always kept in memory
+const maxTaskValues = 1024 * 1024
+
+var errTaskValuesTooLarge = errors.New("text fields of the form are too large")
+
+// ReadTaskForm read the parts of the upload by NextPart. A file is read once from the request
+// into a buffer sized by the content length, or into an unlinked temporary file once beyond maxMemory,
+// instead of the growing buffer of ReadForm and then its temporary file.
+// The file is kept until the form is closed, since it may be opened again by retry.
+// A part is not streamed to the worker as it arrives: a retry or the det and slam of a complete task
+// open the frame again, and the request is answered before the worker has read it
+func ReadTaskForm(r *http.Request, maxMemory int64) (*TaskForm, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	sizeHint := r.ContentLength
+	if sizeHint < 0 || sizeHint > maxMemory {
+		sizeHint = maxMemory
+	}
+
+	form := &TaskForm{Value: map[string][]string{}, File: map[string]FrameOpener{}}
+	valuesLeft := int64(maxTaskValues)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return form, nil
+		} else if err != nil {
+			form.Close()
+			return nil, err
+		}
+
+		name := part.FormName()
+		if name == "" {
+			part.Close()
+			continue
+		}
+		if part.FileName() == "" {
+			value := &bytes.Buffer{}
+			n, err := io.Copy(value, io.LimitReader(part, valuesLeft+1))
+			part.Close()
+			if err != nil {
+				form.Close()
+				return nil, err
+			}
+			if valuesLeft -= n; valuesLeft < 0 {
+				form.Close()
+				return nil, errTaskValuesTooLarge
+			}
+			form.Value[name] = append(form.Value[name], value.String())
+			continue
+		}
+
+		opener, file, err := readFilePart(part, maxMemory, sizeHint)
+		part.Close()
+		if err != nil {
+			form.Close()
+			return nil, err
+		}
+		if file != nil {
+			form.spilled = append(form.spilled, file)
+		}
+		if _, ok := form.File[name]; !ok {
+			form.File[name] = opener
+		}
+	}
+}
+
+// readFilePart read the part into memory, or into an unlinked temporary file returned
+// to be closed with the form if it is beyond maxMemory
+func readFilePart(part io.Reader, maxMemory, sizeHint int64) (FrameOpener, *os.File, error) {
+	head := &bytes.Buffer{}
+	// ReadFrom grows the buffer unless MinRead bytes are free after the content
+	head.Grow(int(sizeHint) + bytes.MinRead)
+	n, err := io.Copy(head, io.LimitReader(part, maxMemory+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if n <= maxMemory {
+		return BytesFrame(head.Bytes()), nil, nil
+	}
+
+	file, err := os.CreateTemp("", "scheduler-upload-")
+	if err != nil {
+		return nil, nil, err
+	}
+	// the space is freed once the file is closed
+	if err = os.Remove(file.Name()); err == nil {
+		if _, err = file.Write(head.Bytes()); err == nil {
+			_, err = io.Copy(file, part)
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	size := info.Size()
+	return func() (io.ReadCloser, int64, error) {
+		return io.NopCloser(io.NewSectionReader(file, 0, size)), size, nil
+	}, file, nil
+}
+
+// FormFrame open the "frame" file of the form
+func FormFrame(form *TaskForm) FrameOpener {
+	return FormFile(form, "frame")
+}
+
+// FormFile open the file field of the form, without reading it into memory again
+func FormFile(form *TaskForm, fieldName string) FrameOpener {
+	return func() (io.ReadCloser, int64, error) {
+		opener, ok := form.File[fieldName]
+		if !ok {
+			return nil, 0, fmt.Errorf("no file %v in the form", fieldName)
+		}
+		return opener()
+	}
+}
+
+// BytesFrame open a frame already in memory
+func BytesFrame(frame []byte) FrameOpener {
+	return func() (io.ReadCloser, int64, error) {
+		return io.NopCloser(bytes.NewReader(frame)), int64(len(frame)), nil
+	}
+}
+
+// postFile post fields and a single file to url as multipart.
+// Only the small multipart headers are encoded in memory, the file is streamed from
+// its reader into the request, so a frame is never buffered or copied as a whole
+func postFile(url string, fields []formField, fieldName, fileName string, opener FrameOpener) error {
+	file, size, err := opener()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	head := &bytes.Buffer{}
+	multipartWriter := multipart.NewWriter(head)
+
+	for _, field := range fields {
+		if err = multipartWriter.WriteField(field.Key, field.Value); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	if _, err = multipartWriter.CreateFormFile(fieldName, fileName); err != nil {
+		log.Panic(err)
+	}
+
+	// the closing boundary follows the file content
+	tail := &bytes.Buffer{}
+	closer := multipart.NewWriter(tail)
+	if err = closer.SetBoundary(multipartWriter.Boundary()); err != nil {
+		log.Panic(err)
+	}
+	if err = closer.Close(); err != nil {
+		log.Panic(err)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, url, io.MultiReader(head, file, tail))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+	if size >= 0 {
+		request.ContentLength = int64(head.Len()) + size + int64(tail.Len())
+	}
+
+	return doRequest(request)
+}
+
+// postFrame preprocess the frame by the config of taskName and post it with fields as "frame" file
+func postFrame(url, taskName, taskID string, fields []formField, frame FrameOpener) error {
+	frame, fileName, err := preprocessFrame(taskName, taskID, frame)
+	if err != nil {
+		return err
+	}
+	return postFile(url, fields, "frame", fileName, frame)
+}
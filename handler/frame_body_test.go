@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// uploadRequest is a request of a device with the multipart body
+func uploadRequest(body []byte, boundary string) *http.Request {
+	request := httptest.NewRequest(http.MethodPost, "/new_task", bytes.NewReader(body))
+	request.Header.Set("Content-Type", "multipart/form-data; boundary="+boundary)
+	return request
+}
+
+// uploadBody encode the fields and a frame of frameSize bytes as a device upload
+func uploadBody(t testing.TB, fields map[string]string, frameSize int) ([]byte, string) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for key, value := range fields {
+		if err := writer.WriteField(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file, err := writer.CreateFormFile("frame", "frame.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = file.Write(bytes.Repeat([]byte{0xab}, frameSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return body.Bytes(), writer.Boundary()
+}
+
+func readFrame(t testing.TB, opener FrameOpener) []byte {
+	file, size, err := opener()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	content, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(content)) != size {
+		t.Fatalf("opener said %v bytes, read %v", size, len(content))
+	}
+	return content
+}
+
+func TestReadTaskForm(t *testing.T) {
+	for _, frameSize := range []int{0, 1024, 64 * 1024} {
+		body, boundary := uploadBody(t, map[string]string{"task_name": "det", "status": "Begin"}, frameSize)
+		// the larger frame goes to a temporary file
+		form, err := ReadTaskForm(uploadRequest(body, boundary), 4*1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if form.Value["task_name"][0] != "det" || form.Value["status"][0] != "Begin" {
+			t.Fatalf("unexpected values %v", form.Value)
+		}
+
+		// a frame is opened again by retry
+		for i := 0; i < 2; i++ {
+			if frame := readFrame(t, FormFrame(form)); !bytes.Equal(frame, bytes.Repeat([]byte{0xab}, frameSize)) {
+				t.Fatalf("frame of %v bytes is read as %v bytes", frameSize, len(frame))
+			}
+		}
+	}
+}
+
+// the temporary file of a large frame is closed with the form, instead of by its finalizer
+func TestReadTaskFormClose(t *testing.T) {
+	body, boundary := uploadBody(t, nil, 64*1024)
+	form, err := ReadTaskForm(uploadRequest(body, boundary), 4*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(form.spilled) != 1 {
+		t.Fatalf("the frame should be spilled to a temporary file, got %v", len(form.spilled))
+	}
+
+	form.Close()
+	form.Close()
+	file, _, err := FormFrame(form)()
+	if err == nil {
+		defer file.Close()
+		_, err = io.ReadAll(file)
+	}
+	if err == nil {
+		t.Fatal("a frame of a closed form should not be read")
+	}
+}
+
+func TestReadTaskFormMissingFile(t *testing.T) {
+	body, boundary := uploadBody(t, nil, 10)
+	form, err := ReadTaskForm(uploadRequest(body, boundary), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = FormFile(form, "video")(); err == nil {
+		t.Fatal("open a missing file should fail")
+	}
+}
+
+func TestReadTaskFormValuesTooLarge(t *testing.T) {
+	large := string(bytes.Repeat([]byte{'a'}, maxTaskValues+1))
+	body, boundary := uploadBody(t, map[string]string{"json": large}, 10)
+	if _, err := ReadTaskForm(uploadRequest(body, boundary), 1024); err != errTaskValuesTooLarge {
+		t.Fatalf("expected errTaskValuesTooLarge, got %v", err)
+	}
+}
+
+var frameSizes = []int{64 * 1024, 512 * 1024, 4 * 1024 * 1024}
+
+// BenchmarkReadForm is how the upload was read before ReadTaskForm, for comparison
+func BenchmarkReadForm(b *testing.B) {
+	for _, frameSize := range frameSizes {
+		body, boundary := uploadBody(b, map[string]string{"task_name": "det"}, frameSize)
+		b.Run(fmt.Sprintf("%vKB", frameSize/1024), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(frameSize))
+			for i := 0; i < b.N; i++ {
+				form, err := multipart.NewReader(bytes.NewReader(body), boundary).ReadForm(2 * 1024 * 1024)
+				if err != nil {
+					b.Fatal(err)
+				}
+				file, err := form.File["frame"][0].Open()
+				if err != nil {
+					b.Fatal(err)
+				}
+				_, _ = io.Copy(io.Discard, file)
+				file.Close()
+				form.RemoveAll()
+			}
+		})
+	}
+}
+
+func BenchmarkReadTaskForm(b *testing.B) {
+	for _, frameSize := range frameSizes {
+		body, boundary := uploadBody(b, map[string]string{"task_name": "det"}, frameSize)
+		b.Run(fmt.Sprintf("%vKB", frameSize/1024), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(frameSize))
+			for i := 0; i < b.N; i++ {
+				form, err := ReadTaskForm(uploadRequest(body, boundary), 2*1024*1024)
+				if err != nil {
+					b.Fatal(err)
+				}
+				file, _, err := FormFrame(form)()
+				if err != nil {
+					b.Fatal(err)
+				}
+				_, _ = io.Copy(io.Discard, file)
+				file.Close()
+			}
+		})
+	}
+}
+
+// BenchmarkPostFile is the latency and memory to forward a frame to a worker
+func BenchmarkPostFile(b *testing.B) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+	}))
+	defer server.Close()
+
+	for _, frameSize := range frameSizes {
+		frame := BytesFrame(bytes.Repeat([]byte{0xab}, frameSize))
+		b.Run(fmt.Sprintf("%vKB", frameSize/1024), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(frameSize))
+			for i := 0; i < b.N; i++ {
+				err := postFile(server.URL, []formField{{Key: "task_name", Value: "det"}}, "frame", "frame.jpg", frame)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,84 +1,25 @@
 package handler
 
 import (
-	"Scheduler/buffer_pool"
+	"Scheduler/overload"
+	"Scheduler/utils"
 	"Scheduler/worker_pool"
-	"io"
 	"log"
-	"mime/multipart"
 	"net/http"
-	"strings"
 )
 
-func doFusion(worker *worker_pool.Worker, form *multipart.Form, taskID string) {
-
+func doFusion(worker *worker_pool.Worker, form *TaskForm, taskID string) *Completion {
 	// submit fusion task to the worker_pool
 	//log.Printf("submit to %v", worker.GetIP())
+	return submitFrame(worker, "fusion", taskID, map[string]string{
+		"detect_result": form.Value["detect_result"][0],
+	}, FormFrame(form))
+}
 
-	workerURL := worker.GetURL("run_task")
-
-	bufferElem := buffer_pool.GetBuffer()
-	postBody := bufferElem.Buffer
-
-	multipartWriter := multipart.NewWriter(postBody)
-
-	if err := multipartWriter.WriteField("task_name", "fusion"); err != nil {
-		log.Panic(err)
-	}
-
-	if err := multipartWriter.WriteField("task_id", taskID); err != nil {
-		log.Panic(err)
-	}
-
-	if err := multipartWriter.WriteField("detect_result", form.Value["detect_result"][0]); err != nil {
-		log.Panic(err)
-	}
-
-	fileHeader := form.File["frame"][0]
-	writer, err := multipartWriter.CreateFormFile("frame", "input.png")
-	if err != nil {
-		log.Panic(err)
-	}
-	file, err := fileHeader.Open()
-	if err != nil {
-		log.Panic(err)
-	}
-
-	frameBytes, err := io.ReadAll(file)
-	//log.Printf("Receive bytes %v", len(frameBytes))
-	if err != nil {
-		log.Panic(err)
-	}
-
-	err = file.Close()
-	if err != nil {
-		log.Panic(err)
-	}
-
-	n, err := writer.Write(frameBytes)
-	log.Printf("Write %v bytes. Buffer size is %v", n, postBody.Cap())
-	if err != nil {
-		log.Panic(err)
-	}
-
-	if err = multipartWriter.WriteField("reset", "False"); err != nil {
-		log.Panic(err)
-	}
-
-	err = multipartWriter.Close()
-	if err != nil {
-		log.Panic(err)
-	}
-
-	notifier := make(chan *multipart.Form)
-	taskFinishNotifier.Store(taskID, notifier)
-
-	_, err = http.Post(workerURL, multipartWriter.FormDataContentType(), postBody)
-	if err != nil {
-		log.Panic(err)
-	}
-
-	buffer_pool.ReturnBuffer(bufferElem)
+func doFusionFrame(worker *worker_pool.Worker, frame FrameOpener, values map[string]string, taskID string) *Completion {
+	return submitFrame(worker, "fusion", taskID, map[string]string{
+		"detect_result": values["detect_result"],
+	}, frame)
 }
 
 func fusionFinish(w http.ResponseWriter, r *http.Request) {
@@ -98,56 +39,38 @@ func fusionFinish(w http.ResponseWriter, r *http.Request) {
 	}
 
 	taskID := form.Value["task_id"][0]
+	if err = utils.ValidateTaskID(taskID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	log.Printf("Receive from task id %v", taskID)
 
-	notifier, ok := taskFinishNotifier.Load(taskID)
-	if !ok {
-		log.Panicf("notified with task id %v is not stored", taskID)
-	}
-
-	notifier.(chan *multipart.Form) <- form
+	deliverResult(taskID, form)
 }
 
-func SendBackFusion(r *http.Request, taskID string, worker *worker_pool.Worker,
-	returnWorker, deleteWorker bool) {
+func SendBackFusion(r *http.Request, form *TaskForm, completion *Completion,
+	worker *worker_pool.Worker, returnWorker, deleteWorker bool) {
+	taskID := completion.TaskID
+	// checked by doFusion before the frame is submitted
+	values := map[string]string{"detect_result": form.Value["detect_result"][0]}
+	done := TrackSend()
 	go func(clientIP string) {
-		notifier, _ := taskFinishNotifier.Load(taskID)
-		finishForm := <-notifier.(chan *multipart.Form)
-		close((notifier.(chan *multipart.Form)))
-		taskFinishNotifier.Delete(taskID)
-
-		if returnWorker {
-			workerURL := worker.GetURL("run_task")
-
-			resetBufferElem := buffer_pool.GetBuffer()
-			postBody := resetBufferElem.Buffer
-			multipartWriter := multipart.NewWriter(postBody)
-
-			if err := multipartWriter.WriteField("reset", "True"); err != nil {
-				log.Panic(err)
-			}
-
-			if err := multipartWriter.WriteField("task_name", "fusion"); err != nil {
-				log.Panic(err)
-			}
-
-			if err := multipartWriter.WriteField("task_id", taskID); err != nil {
-				log.Panic(err)
-			}
-
-			err := multipartWriter.Close()
-			if err != nil {
-				log.Panic(err)
-			}
-
-			_, err = http.Post(workerURL, multipartWriter.FormDataContentType(), postBody)
-			if err != nil {
-				log.Panic(err)
+		defer done()
+		// the frame is no longer opened once the task is done
+		defer form.Close()
+		worker, finishForm, err := awaitFrame(worker, completion, FormFrame(form), values)
+		dropped := overload.Done(taskID)
+		if err != nil {
+			if worker != nil {
+				worker.ReturnToPool(taskID)
 			}
+			sendFailureToClient(clientIP, "fusion", taskID, err)
+			return
+		}
 
-			buffer_pool.ReturnBuffer(resetBufferElem)
-
+		if returnWorker {
+			ResetWorker(worker, "fusion", taskID)
 			worker.ReturnToPool(taskID)
 		}
 
@@ -159,36 +82,9 @@ func SendBackFusion(r *http.Request, taskID string, worker *worker_pool.Worker,
 		log.Printf("receive result of task id: %v.task id is %v, fusion_result is %v",
 			taskID, len(finishForm.Value["task_id"]), len(finishForm.Value["fusion_result"]))
 
-		sendBackBufferElem := buffer_pool.GetBuffer()
-		buffer := sendBackBufferElem.Buffer
-		multipartWriter := multipart.NewWriter(buffer)
-
-		if err := multipartWriter.WriteField("task_id",
-			finishForm.Value["task_id"][0]); err != nil {
-			log.Panic(err)
-		}
-
-		if err := multipartWriter.WriteField("fusion_result",
-			finishForm.Value["fusion_result"][0]); err != nil {
-			log.Panic(err)
-		}
-
-		err := multipartWriter.Close()
+		err = sendResultToClient(clientIP, "fusion", finishForm, []string{"task_id", "fusion_result"}, dropped)
 		if err != nil {
-			log.Panic(err)
+			sendBackFailed(clientIP, "fusion", taskID, err)
 		}
-
-		// split ip and port
-		clientIP = "http://" + strings.Split(clientIP, ":")[0]
-
-		log.Printf("result send back to %v", clientIP+":8080/fusion")
-
-		_, err = http.Post(clientIP+":8080/fusion", multipartWriter.FormDataContentType(), buffer)
-		if err != nil {
-			log.Panic(err)
-		}
-
-		buffer_pool.ReturnBuffer(sendBackBufferElem)
-
 	}(r.RemoteAddr)
 }
@@ -2,24 +2,27 @@ package handler
 
 import (
 	"Scheduler/worker_pool"
+	"fmt"
 	"io"
-	"log"
 	"mime/multipart"
 	"net/http"
-	"sync"
 )
 
-var taskFinishNotifier sync.Map
-
-type StartTask func(worker *worker_pool.Worker, form *multipart.Form, taskID string)
+type StartTask func(worker *worker_pool.Worker, form *TaskForm, taskID string) *Completion
 type FinishTask func(w http.ResponseWriter, r *http.Request)
-type SendBackResult func(r *http.Request, taskID string, worker *worker_pool.Worker,
-	returnWorker, deleteWorker bool)
+type SendBackResult func(r *http.Request, form *TaskForm, completion *Completion,
+	worker *worker_pool.Worker, returnWorker, deleteWorker bool)
+
+// StartFrameTask submit a raw frame instead of a multipart form, used by stream sessions
+// nil if the task type does not support frame streaming
+type StartFrameTask func(worker *worker_pool.Worker, frame FrameOpener, values map[string]string,
+	taskID string) *Completion
 
 type Handler struct {
 	StartTask
 	FinishTask
 	SendBackResult
+	StartFrameTask
 }
 
 var handlerMap *map[string]Handler
@@ -36,16 +39,19 @@ func GetHandler(taskName string) Handler {
 				StartTask:      doSlam,
 				FinishTask:     slamFinish,
 				SendBackResult: SendBackSlam,
+				StartFrameTask: doSlamFrame,
 			},
 			"fusion": {
 				StartTask:      doFusion,
 				FinishTask:     fusionFinish,
 				SendBackResult: SendBackFusion,
+				StartFrameTask: doFusionFrame,
 			},
 			"det": {
 				StartTask:      doDET,
 				FinishTask:     detFinish,
 				SendBackResult: SendBackDET,
+				StartFrameTask: doDETFrame,
 			},
 		}
 	}
@@ -53,25 +59,21 @@ func GetHandler(taskName string) Handler {
 	return (*handlerMap)[taskName]
 }
 
-func saveFile(fieldName, fileName string, form *multipart.Form, multipartWriter *multipart.Writer) {
+func saveFile(fieldName, fileName string, form *multipart.Form, multipartWriter *multipart.Writer) error {
+	if len(form.File[fieldName]) == 0 {
+		return fmt.Errorf("no %v in the result", fieldName)
+	}
 	file, err := form.File[fieldName][0].Open()
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
+	defer file.Close()
 
 	formFile, err := multipartWriter.CreateFormFile(fieldName, fileName)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
 	_, err = io.Copy(formFile, file)
-	if err != nil {
-		log.Panic(err)
-	}
-
-	err = file.Close()
-	if err != nil {
-		log.Panic(err)
-	}
-
+	return err
 }
@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"sync"
+	"time"
+)
+
+// LatencySample is the stage latencies in milliseconds of a frame processed by a complete task
+type LatencySample struct {
+	At     time.Time          `json:"at"`
+	TaskID string             `json:"task_id"`
+	Stages map[string]float64 `json:"stages"`
+}
+
+// latencyHistorySize is how many frames are kept for the dashboard
+const latencyHistorySize = 600
+
+var latencyLock = sync.Mutex{}
+
+// ring of the latest samples, oldest first
+var latencySamples []LatencySample
+
+func recordLatency(taskID string, latency map[string]time.Duration) {
+	sample := LatencySample{At: time.Now(), TaskID: taskID, Stages: map[string]float64{}}
+	for stage, duration := range latency {
+		sample.Stages[stage] = float64(duration.Microseconds()) / 1000
+	}
+
+	latencyLock.Lock()
+	latencySamples = append(latencySamples, sample)
+	if len(latencySamples) > latencyHistorySize {
+		latencySamples = latencySamples[len(latencySamples)-latencyHistorySize:]
+	}
+	latencyLock.Unlock()
+}
+
+// GetLatencySamples return the samples recorded after since, oldest first
+func GetLatencySamples(since time.Time) []LatencySample {
+	latencyLock.Lock()
+	defer latencyLock.Unlock()
+	samples := []LatencySample{}
+	for _, sample := range latencySamples {
+		if sample.At.After(since) {
+			samples = append(samples, sample)
+		}
+	}
+	return samples
+}
@@ -1,17 +1,21 @@
 package handler
 
 import (
+	"Scheduler/buffer_pool"
+	"Scheduler/utils"
 	"Scheduler/worker_pool"
-	"bytes"
-	"io"
+	"context"
+	"fmt"
 	"log"
 	"mime/multipart"
 	"net/http"
-	"strconv"
-	"strings"
+	"time"
 )
 
-func doMCMOT(worker *worker_pool.Worker, form *multipart.Form, taskID string) {
+// MCMOTTimeout is the deadline of a whole video to be processed
+var MCMOTTimeout = 30 * time.Minute
+
+func doMCMOT(worker *worker_pool.Worker, form *TaskForm, taskID string) *Completion {
 
 	// submit MCMOT task to the worker_pool
 
@@ -19,37 +23,18 @@ func doMCMOT(worker *worker_pool.Worker, form *multipart.Form, taskID string) {
 
 	workerURL := worker.GetURL("run_task")
 
-	postBody := &bytes.Buffer{}
-	multipartWriter := multipart.NewWriter(postBody)
-
-	if err := multipartWriter.WriteField("task_name", "mcmot"); err != nil {
-		log.Panic(err)
-	}
+	completion := newCompletion("mcmot", taskID)
 
-	if err := multipartWriter.WriteField("task_id", taskID); err != nil {
-		log.Panic(err)
-	}
-
-	fileHeader := form.File["video"][0]
-	writer, err := multipartWriter.CreateFormFile("video", "input.avi")
+	// the video is streamed from the upload instead of copied into a buffer
+	err := postFile(workerURL, []formField{
+		{Key: "task_name", Value: "mcmot"},
+		{Key: "task_id", Value: taskID},
+	}, "video", "input.avi", FormFile(form, "video"))
 	if err != nil {
-		log.Panic(err)
-	}
-	file, err := fileHeader.Open()
-	_, err = io.Copy(writer, file)
-	if err != nil {
-		log.Panic(err)
+		completion.fail(fmt.Errorf("submit task %v to %v failed: %v", taskID, worker.GetWorkerName(), err))
 	}
 
-	err = multipartWriter.Close()
-	if err != nil {
-		log.Panic(err)
-	}
-
-	_, err = http.Post(workerURL, multipartWriter.FormDataContentType(), postBody)
-	if err != nil {
-		log.Panic(err)
-	}
+	return completion
 }
 
 func MCMOTFinish(w http.ResponseWriter, r *http.Request) {
@@ -59,57 +44,90 @@ func MCMOTFinish(w http.ResponseWriter, r *http.Request) {
 	}
 
 	form, err := multipartReader.ReadForm(15 * 1024 * 1024)
-	taskID, err := strconv.Atoi(form.Value["task_id"][0])
 	if err != nil {
 		log.Panic(err)
 	}
 
-	notifier, _ := taskFinishNotifier.LoadAndDelete(taskID)
+	taskID := form.Value["task_id"][0]
+	if err = utils.ValidateTaskID(taskID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	notifier.(chan *multipart.Form) <- form
+	deliverResult(taskID, form)
 }
 
-func SendBackMCMOT(r *http.Request, taskID string, worker *worker_pool.Worker,
-	returnWorker, deleteWorker bool) {
-	notifier := make(chan *multipart.Form, 1)
-	taskFinishNotifier.Store(taskID, notifier)
+func SendBackMCMOT(r *http.Request, form *TaskForm, completion *Completion,
+	worker *worker_pool.Worker, returnWorker, deleteWorker bool) {
+	taskID := completion.TaskID
 
+	done := TrackSend()
 	go func(clientIP string) {
-		finishForm := <-notifier
-		taskFinishNotifier.Delete(taskID)
+		defer done()
+		// the frame is no longer opened once the task is done
+		defer form.Close()
+		finishForm, err := completion.Wait(MCMOTTimeout)
+		if err != nil {
+			worker.ReportFailure()
+			worker.ReturnToPool(taskID)
+			sendFailureToClient(clientIP, "mcmot", taskID, err)
+			return
+		}
+		worker.ReportSuccess()
 
 		log.Printf("receive result of task id: %v", taskID)
 		if returnWorker {
 			worker.ReturnToPool(taskID)
 		}
 
-		buffer := &bytes.Buffer{}
-		multipartWriter := multipart.NewWriter(buffer)
-
-		saveFile("video", "output.mp4", finishForm, multipartWriter)
-		saveFile("bbox_txt", "output.txt", finishForm, multipartWriter)
-		saveFile("bbox_xlsx", "output.xlsx", finishForm, multipartWriter)
-
-		if err := multipartWriter.WriteField("container_output",
-			finishForm.Value["container_output"][0]); err != nil {
-			log.Panic(err)
+		if err = sendMCMOTResult(clientIP, finishForm); err != nil {
+			sendBackFailed(clientIP, "mcmot", taskID, err)
 		}
+		//worker.DeleteWorker()
+	}(r.RemoteAddr)
+}
 
-		err := multipartWriter.Close()
-		if err != nil {
-			log.Panic(err)
+// sendMCMOTResult post the result video, the bounding box files and the container output to the client
+func sendMCMOTResult(clientAddress string, finishForm *multipart.Form) error {
+	// the result video can be large, take a buffer of the class fits all the files
+	sizeHint := 0
+	for _, fileHeaders := range finishForm.File {
+		for _, fileHeader := range fileHeaders {
+			sizeHint += int(fileHeader.Size)
+		}
+	}
+	ctx, cancel := buffer_pool.AcquireContext(context.Background())
+	defer cancel()
+	sendBackBufferElem, err := buffer_pool.GetSizedBuffer(ctx, sizeHint)
+	if err != nil {
+		return err
+	}
+	defer buffer_pool.ReturnBuffer(sendBackBufferElem)
+	buffer := sendBackBufferElem.Buffer
+	multipartWriter := multipart.NewWriter(buffer)
+
+	for _, file := range []struct{ fieldName, fileName string }{
+		{"video", "output.mp4"}, {"bbox_txt", "output.txt"}, {"bbox_xlsx", "output.xlsx"},
+	} {
+		if err = saveFile(file.fieldName, file.fileName, finishForm, multipartWriter); err != nil {
+			return err
 		}
+	}
 
-		// split ip and port
-		clientIP = "http://" + strings.Split(clientIP, ":")[0]
+	containerOutput, err := formValue(finishForm, "container_output")
+	if err != nil {
+		return err
+	}
+	if err = multipartWriter.WriteField("container_output", containerOutput); err != nil {
+		return err
+	}
 
-		log.Printf("result send back to %v", clientIP+":8080/mcmot")
+	if err = multipartWriter.Close(); err != nil {
+		return err
+	}
 
-		_, err = http.Post(clientIP+":8080/mcmot", multipartWriter.FormDataContentType(), buffer)
-		if err != nil {
-			log.Panic(err)
-		}
+	url := clientURL(clientAddress, "mcmot")
+	log.Printf("result send back to %v", url)
 
-		//worker.DeleteWorker()
-	}(r.RemoteAddr)
+	return postToClient(url, multipartWriter.FormDataContentType(), buffer)
 }
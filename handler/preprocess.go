@@ -0,0 +1,220 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"sync"
+
+	"golang.org/x/image/draw"
+)
+
+// CropRect is a region of interest in pixels of the original frame
+type CropRect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// PreprocessConfig is how frames of a task type are transformed before dispatch.
+// The frame is cropped first, then resized to Width x Height, a zero side keeps the aspect ratio.
+// JPEGQuality > 0 re-encodes the frame as jpeg, otherwise it is encoded as png.
+// Note that the worker results are in the coordinates of the transformed frame
+type PreprocessConfig struct {
+	Crop        *CropRect `json:"crop"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	JPEGQuality int       `json:"jpeg_quality"`
+}
+
+// MaxFramePixels is the largest frame preprocessing decodes, larger frames are rejected
+// by their header before the pixels are allocated
+var MaxFramePixels int64 = 8192 * 8192
+
+// ErrFrameTooLarge is the error of a frame above MaxFramePixels, it fails the task on any worker
+var ErrFrameTooLarge = errors.New("frame is too large")
+
+// PreprocessMetrics counts the frames preprocessed of a task type
+type PreprocessMetrics struct {
+	Frames     int64 `json:"frames"`
+	Errors     int64 `json:"errors"`
+	Rejected   int64 `json:"rejected"`
+	BytesIn    int64 `json:"bytes_in"`
+	BytesOut   int64 `json:"bytes_out"`
+	BytesSaved int64 `json:"bytes_saved"`
+}
+
+var preprocessLock = sync.Mutex{}
+
+// map from task name to its PreprocessConfig, frames of task names not in map are sent as-is
+var preprocessConfigs = map[string]PreprocessConfig{}
+
+var preprocessMetrics = map[string]*PreprocessMetrics{}
+
+// SetPreprocessConfig enable preprocessing of taskName, a nil config disables it
+func SetPreprocessConfig(taskName string, config *PreprocessConfig) error {
+	if config != nil {
+		if config.Width < 0 || config.Height < 0 {
+			return fmt.Errorf("invalid size %vx%v", config.Width, config.Height)
+		}
+		if config.JPEGQuality < 0 || config.JPEGQuality > 100 {
+			return fmt.Errorf("invalid jpeg quality %v", config.JPEGQuality)
+		}
+		if crop := config.Crop; crop != nil && (crop.X < 0 || crop.Y < 0 || crop.Width <= 0 || crop.Height <= 0) {
+			return fmt.Errorf("invalid crop %+v", *crop)
+		}
+	}
+
+	preprocessLock.Lock()
+	defer preprocessLock.Unlock()
+	if config == nil {
+		delete(preprocessConfigs, taskName)
+	} else {
+		preprocessConfigs[taskName] = *config
+	}
+	return nil
+}
+
+// PreprocessStatus is the json view of the configs and metrics of all task types
+type PreprocessStatus struct {
+	Configs map[string]PreprocessConfig  `json:"configs"`
+	Metrics map[string]PreprocessMetrics `json:"metrics"`
+}
+
+func GetPreprocessStatus() PreprocessStatus {
+	preprocessLock.Lock()
+	defer preprocessLock.Unlock()
+
+	status := PreprocessStatus{
+		Configs: map[string]PreprocessConfig{},
+		Metrics: map[string]PreprocessMetrics{},
+	}
+	for taskName, config := range preprocessConfigs {
+		status.Configs[taskName] = config
+	}
+	for taskName, metrics := range preprocessMetrics {
+		status.Metrics[taskName] = *metrics
+	}
+	return status
+}
+
+// preprocessFrame transform the frame by the config of taskName, and return the frame
+// to dispatch with its file name. On any decode error the original frame is sent,
+// but a frame above MaxFramePixels is rejected with ErrFrameTooLarge
+func preprocessFrame(taskName, taskID string, frame FrameOpener) (FrameOpener, string, error) {
+	preprocessLock.Lock()
+	config, ok := preprocessConfigs[taskName]
+	preprocessLock.Unlock()
+	if !ok {
+		return frame, "input.png", nil
+	}
+
+	origin, processed, err := transformFrame(frame, config)
+
+	preprocessLock.Lock()
+	metrics, ok := preprocessMetrics[taskName]
+	if !ok {
+		metrics = &PreprocessMetrics{}
+		preprocessMetrics[taskName] = metrics
+	}
+	if errors.Is(err, ErrFrameTooLarge) {
+		metrics.Rejected++
+	} else if err != nil {
+		metrics.Errors++
+	} else {
+		metrics.Frames++
+		metrics.BytesIn += int64(origin)
+		metrics.BytesOut += int64(len(processed))
+		metrics.BytesSaved += int64(origin - len(processed))
+	}
+	preprocessLock.Unlock()
+
+	if errors.Is(err, ErrFrameTooLarge) {
+		log.Printf("frame of task %v is rejected: %v", taskID, err)
+		return nil, "", err
+	} else if err != nil {
+		log.Printf("preprocess frame of task %v failed, send it as-is: %v", taskID, err)
+		return frame, "input.png", nil
+	}
+
+	log.Printf("preprocess frame of task %v: %v -> %v bytes, saved %v bytes",
+		taskID, origin, len(processed), origin-len(processed))
+
+	fileName := "input.png"
+	if config.JPEGQuality > 0 {
+		fileName = "input.jpg"
+	}
+	return BytesFrame(processed), fileName, nil
+}
+
+// transformFrame return the size of the original frame and the encoded transformed frame
+func transformFrame(frame FrameOpener, config PreprocessConfig) (int, []byte, error) {
+	file, _, err := frame()
+	if err != nil {
+		return 0, nil, err
+	}
+	raw, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	header, _, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		return len(raw), nil, err
+	}
+	if pixels := int64(header.Width) * int64(header.Height); pixels > MaxFramePixels {
+		return len(raw), nil, fmt.Errorf("%w: %vx%v above %v pixels", ErrFrameTooLarge,
+			header.Width, header.Height, MaxFramePixels)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return len(raw), nil, err
+	}
+
+	if crop := config.Crop; crop != nil {
+		cropRect := image.Rect(crop.X, crop.Y, crop.X+crop.Width, crop.Y+crop.Height).
+			Add(img.Bounds().Min).Intersect(img.Bounds())
+		if cropRect.Empty() {
+			return len(raw), nil, fmt.Errorf("crop %+v is out of the frame %v", *crop, img.Bounds())
+		}
+		cropped := image.NewRGBA(image.Rect(0, 0, cropRect.Dx(), cropRect.Dy()))
+		draw.Draw(cropped, cropped.Bounds(), img, cropRect.Min, draw.Src)
+		img = cropped
+	}
+
+	if config.Width > 0 || config.Height > 0 {
+		width, height := config.Width, config.Height
+		bounds := img.Bounds()
+		if width == 0 {
+			width = bounds.Dx() * height / bounds.Dy()
+		} else if height == 0 {
+			height = bounds.Dy() * width / bounds.Dx()
+		}
+		if width <= 0 || height <= 0 {
+			return len(raw), nil, fmt.Errorf("invalid size %vx%v for frame %v", width, height, bounds)
+		}
+		resized := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.BiLinear.Scale(resized, resized.Bounds(), img, bounds, draw.Src, nil)
+		img = resized
+	}
+
+	encoded := &bytes.Buffer{}
+	if config.JPEGQuality > 0 {
+		err = jpeg.Encode(encoded, img, &jpeg.Options{Quality: config.JPEGQuality})
+	} else {
+		err = png.Encode(encoded, img)
+	}
+	if err != nil {
+		return len(raw), nil, err
+	}
+
+	return len(raw), encoded.Bytes(), nil
+}
@@ -0,0 +1,204 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// gradientFrame encode a png of width x height whose pixel at x, y is R=x, G=y
+func gradientFrame(t *testing.T, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), A: 255})
+		}
+	}
+	encoded := &bytes.Buffer{}
+	if err := png.Encode(encoded, img); err != nil {
+		t.Fatal(err)
+	}
+	return encoded.Bytes()
+}
+
+// usePreprocessConfig enable preprocessing of a task name only used by the test
+func usePreprocessConfig(t *testing.T, config PreprocessConfig) string {
+	taskName := "preprocess-" + newTestTaskID(t)
+	if err := SetPreprocessConfig(taskName, &config); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetPreprocessConfig(taskName, nil) })
+	return taskName
+}
+
+func TestTransformFrameCropAndResize(t *testing.T) {
+	frame := BytesFrame(gradientFrame(t, 100, 50))
+	for _, test := range []struct {
+		name          string
+		config        PreprocessConfig
+		width, height int
+		// the color of the top left pixel, only checked without resize
+		origin [2]uint8
+	}{
+		{"crop", PreprocessConfig{Crop: &CropRect{X: 10, Y: 5, Width: 40, Height: 20}}, 40, 20, [2]uint8{10, 5}},
+		{"crop beyond the frame", PreprocessConfig{Crop: &CropRect{X: 80, Y: 40, Width: 40, Height: 20}}, 20, 10, [2]uint8{80, 40}},
+		{"resize", PreprocessConfig{Width: 50, Height: 10}, 50, 10, [2]uint8{}},
+		{"width keeps aspect ratio", PreprocessConfig{Width: 20}, 20, 10, [2]uint8{}},
+		{"height keeps aspect ratio", PreprocessConfig{Height: 25}, 50, 25, [2]uint8{}},
+		{"crop then resize", PreprocessConfig{Crop: &CropRect{Width: 40, Height: 20}, Width: 20}, 20, 10, [2]uint8{}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			origin, processed, err := transformFrame(frame, test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if raw := readFrame(t, frame); origin != len(raw) {
+				t.Fatalf("origin size is %v, want %v", origin, len(raw))
+			}
+			img, err := png.Decode(bytes.NewReader(processed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bounds := img.Bounds(); bounds.Dx() != test.width || bounds.Dy() != test.height {
+				t.Fatalf("frame is %vx%v, want %vx%v", bounds.Dx(), bounds.Dy(), test.width, test.height)
+			}
+			if test.config.Width == 0 && test.config.Height == 0 {
+				r, g, _, _ := img.At(0, 0).RGBA()
+				if got := [2]uint8{uint8(r >> 8), uint8(g >> 8)}; got != test.origin {
+					t.Fatalf("top left pixel is %v, want %v", got, test.origin)
+				}
+			}
+		})
+	}
+}
+
+func TestTransformFrameZeroSide(t *testing.T) {
+	// 1000x1 resized to width 10 keeps the aspect ratio with a height of 0
+	frame := BytesFrame(gradientFrame(t, 1000, 1))
+	if _, _, err := transformFrame(frame, PreprocessConfig{Width: 10}); err == nil {
+		t.Fatal("a zero side is accepted")
+	}
+	if _, _, err := transformFrame(frame, PreprocessConfig{Crop: &CropRect{X: 1000, Width: 1, Height: 1}}); err == nil {
+		t.Fatal("a crop out of the frame is accepted")
+	}
+}
+
+func TestTransformFrameEncoding(t *testing.T) {
+	frame := BytesFrame(gradientFrame(t, 100, 50))
+	for _, test := range []struct {
+		config   PreprocessConfig
+		format   string
+		fileName string
+	}{
+		{PreprocessConfig{JPEGQuality: 80}, "jpeg", "input.jpg"},
+		{PreprocessConfig{Width: 50}, "png", "input.png"},
+	} {
+		taskName := usePreprocessConfig(t, test.config)
+		processed, fileName, err := preprocessFrame(taskName, newTestTaskID(t), frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fileName != test.fileName {
+			t.Fatalf("file name is %v, want %v", fileName, test.fileName)
+		}
+		_, format, err := image.DecodeConfig(bytes.NewReader(readFrame(t, processed)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format != test.format {
+			t.Fatalf("frame is encoded as %v, want %v", format, test.format)
+		}
+	}
+}
+
+func TestPreprocessMetrics(t *testing.T) {
+	raw := gradientFrame(t, 100, 50)
+	taskName := usePreprocessConfig(t, PreprocessConfig{Width: 20, JPEGQuality: 50})
+
+	processed, _, err := preprocessFrame(taskName, newTestTaskID(t), BytesFrame(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := len(readFrame(t, processed))
+
+	// a frame that does not decode is sent as-is
+	invalid := BytesFrame([]byte("not an image"))
+	sent, fileName, err := preprocessFrame(taskName, newTestTaskID(t), invalid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(readFrame(t, sent)) != "not an image" || fileName != "input.png" {
+		t.Fatalf("invalid frame is not sent as-is, got %v", fileName)
+	}
+
+	metrics := GetPreprocessStatus().Metrics[taskName]
+	want := PreprocessMetrics{
+		Frames:     1,
+		Errors:     1,
+		BytesIn:    int64(len(raw)),
+		BytesOut:   int64(out),
+		BytesSaved: int64(len(raw) - out),
+	}
+	if metrics != want {
+		t.Fatalf("metrics are %+v, want %+v", metrics, want)
+	}
+
+	// frames of a task type without config are not counted
+	untouched := "preprocess-" + newTestTaskID(t)
+	if _, fileName, err = preprocessFrame(untouched, newTestTaskID(t), BytesFrame(raw)); err != nil || fileName != "input.png" {
+		t.Fatalf("frame without config is %v, %v", fileName, err)
+	}
+	if _, ok := GetPreprocessStatus().Metrics[untouched]; ok {
+		t.Fatal("frame without config is counted")
+	}
+}
+
+// hugeFrame is a png whose header claims width x height, without the pixels
+func hugeFrame(t *testing.T, width, height uint32) []byte {
+	frame := gradientFrame(t, 1, 1)
+	// the 8 bytes signature, then the length and type of IHDR
+	ihdr := frame[8+8 : 8+8+13]
+	binary.BigEndian.PutUint32(ihdr[0:4], width)
+	binary.BigEndian.PutUint32(ihdr[4:8], height)
+	binary.BigEndian.PutUint32(frame[8+8+13:], crc32.ChecksumIEEE(frame[8+4:8+8+13]))
+	return frame
+}
+
+func TestPreprocessFrameTooLarge(t *testing.T) {
+	taskName := usePreprocessConfig(t, PreprocessConfig{Width: 20})
+
+	// only the header is read, the pixels of such a frame would take 160GB
+	frame := BytesFrame(hugeFrame(t, 200000, 200000))
+	if _, _, err := preprocessFrame(taskName, newTestTaskID(t), frame); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("huge frame returns %v", err)
+	}
+
+	maxFramePixels := MaxFramePixels
+	MaxFramePixels = 100*50 - 1
+	t.Cleanup(func() { MaxFramePixels = maxFramePixels })
+	if _, _, err := preprocessFrame(taskName, newTestTaskID(t), BytesFrame(gradientFrame(t, 100, 50))); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("frame above the limit returns %v", err)
+	}
+
+	if metrics := GetPreprocessStatus().Metrics[taskName]; metrics.Rejected != 2 || metrics.Errors != 0 {
+		t.Fatalf("metrics are %+v, want 2 rejected", metrics)
+	}
+
+	// a rejected frame is never posted to the worker
+	posted := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted++
+	}))
+	defer server.Close()
+	err := postFrame(server.URL, taskName, newTestTaskID(t), nil, frame)
+	if !errors.Is(err, ErrFrameTooLarge) || posted != 0 {
+		t.Fatalf("rejected frame returns %v and is posted %v times", err, posted)
+	}
+}
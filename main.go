@@ -1,6 +1,13 @@
 package main
 
+import "log"
+
 func main() {
 	initLog()
+	// the listeners of both servers share the tls config
+	if err := loadServerTLS(); err != nil {
+		log.Panic(err)
+	}
+	go RunGrpcServer()
 	RunHttpServer()
 }
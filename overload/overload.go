@@ -0,0 +1,306 @@
+package overload
+
+import (
+	"Scheduler/worker_pool"
+	"fmt"
+	"io"
+	"log"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ReasonStale     = "stale"
+	ReasonDuplicate = "duplicate"
+	ReasonFPS       = "fps"
+)
+
+// Policy is how frames of a session are skipped when workers can not keep up.
+// KeepLatest holds at most one frame while a frame is in flight, and a newer frame replaces it.
+// Dedup skips a frame whose perceptual hash differs from the last admitted one in at most
+// DedupDistance bits. MaxFPS > 0 skips frames coming faster than it.
+// If UnderLoadOnly, Dedup and MaxFPS apply only while a frame of the session is in flight
+// or the pool of the task type has no free worker
+type Policy struct {
+	KeepLatest    bool    `json:"keep_latest"`
+	Dedup         bool    `json:"dedup"`
+	DedupDistance int     `json:"dedup_distance"`
+	MaxFPS        float64 `json:"max_fps"`
+	UnderLoadOnly bool    `json:"under_load_only"`
+}
+
+// Counters are the frames of a session skipped for each reason
+type Counters struct {
+	Admitted  int64 `json:"admitted"`
+	Stale     int64 `json:"stale"`
+	Duplicate int64 `json:"duplicate"`
+	FPS       int64 `json:"fps"`
+}
+
+// gate is the overload state of a task id
+type gate struct {
+	taskName string
+	policy   *Policy
+
+	inFlight     int
+	pending      chan bool
+	pendingMust  bool
+	lastHash     uint64
+	hasHash      bool
+	lastAdmitted time.Time
+	ended        bool
+
+	counters Counters
+}
+
+var overloadLock = sync.Mutex{}
+
+// map from task name to its default *Policy
+var taskPolicies = map[string]*Policy{}
+
+// map from task id to *gate, only task ids of a session have a gate
+var gates = map[string]*gate{}
+
+func validate(policy *Policy) error {
+	if policy == nil {
+		return nil
+	}
+	if policy.DedupDistance < 0 || policy.DedupDistance > 64 {
+		return fmt.Errorf("invalid dedup distance %v", policy.DedupDistance)
+	}
+	if policy.MaxFPS < 0 {
+		return fmt.Errorf("invalid max fps %v", policy.MaxFPS)
+	}
+	return nil
+}
+
+// SetPolicy set the default policy of taskName, a nil policy disables it
+func SetPolicy(taskName string, policy *Policy) error {
+	if err := validate(policy); err != nil {
+		return err
+	}
+
+	overloadLock.Lock()
+	defer overloadLock.Unlock()
+	if policy == nil {
+		delete(taskPolicies, taskName)
+	} else {
+		taskPolicies[taskName] = policy
+	}
+	return nil
+}
+
+// SetSessionPolicy override the policy of the session of taskID, a nil policy falls back
+// to the policy of the task type. Return false if taskID has no session
+func SetSessionPolicy(taskID string, policy *Policy) (bool, error) {
+	if err := validate(policy); err != nil {
+		return false, err
+	}
+
+	overloadLock.Lock()
+	defer overloadLock.Unlock()
+	g, ok := gates[taskID]
+	if !ok {
+		return false, nil
+	}
+	g.policy = policy
+	return true, nil
+}
+
+func (g *gate) effectivePolicy() *Policy {
+	if g.policy != nil {
+		return g.policy
+	}
+	return taskPolicies[g.taskName]
+}
+
+// Open create the gate of taskID when its session is opened
+func Open(taskName, taskID string) {
+	overloadLock.Lock()
+	gates[taskID] = &gate{taskName: taskName}
+	overloadLock.Unlock()
+}
+
+// End drop the pending frame of taskID when its session is ended or closed.
+// The gate is kept until the frames in flight are done
+func End(taskID string) {
+	overloadLock.Lock()
+	defer overloadLock.Unlock()
+
+	g, ok := gates[taskID]
+	if !ok {
+		return
+	}
+	g.ended = true
+	g.dropPending()
+	if g.inFlight == 0 {
+		delete(gates, taskID)
+	}
+}
+
+func (g *gate) dropPending() {
+	if g.pending != nil {
+		g.pending <- false
+		g.pending = nil
+		g.counters.Stale++
+	}
+}
+
+// Admit decide whether a frame of taskID is dispatched, it blocks while the frame is pending.
+// Return the reason if the frame is skipped, or "" if admitted, then Done must be called
+// when its result is back. A mustRun frame, such as the Last frame, is never skipped.
+// Frames of task ids without a session are always admitted
+func Admit(taskID string, frame func() (io.ReadCloser, int64, error), mustRun bool) string {
+	overloadLock.Lock()
+	g, ok := gates[taskID]
+	var policy *Policy
+	if ok {
+		policy = g.effectivePolicy()
+	}
+	overloadLock.Unlock()
+
+	if !ok {
+		return ""
+	}
+
+	// hash outside the lock, decoding a frame is slow
+	var hash uint64
+	hashed := false
+	if policy != nil && policy.Dedup && !mustRun {
+		var err error
+		if hash, err = perceptualHash(frame); err != nil {
+			log.Printf("hash frame of task %v failed: %v", taskID, err)
+		} else {
+			hashed = true
+		}
+	}
+
+	overloadLock.Lock()
+
+	if policy == nil {
+		g.inFlight++
+		g.counters.Admitted++
+		overloadLock.Unlock()
+		return ""
+	}
+
+	overloaded := !policy.UnderLoadOnly || g.inFlight > 0 ||
+		worker_pool.CountAvailable(g.taskName) == 0
+
+	if !mustRun && overloaded {
+		if policy.MaxFPS > 0 && !g.lastAdmitted.IsZero() &&
+			time.Since(g.lastAdmitted) < time.Duration(float64(time.Second)/policy.MaxFPS) {
+			g.counters.FPS++
+			overloadLock.Unlock()
+			return ReasonFPS
+		}
+
+		if hashed && g.hasHash && bits.OnesCount64(hash^g.lastHash) <= policy.DedupDistance {
+			g.counters.Duplicate++
+			overloadLock.Unlock()
+			return ReasonDuplicate
+		}
+	}
+
+	g.lastAdmitted = time.Now()
+	if hashed {
+		g.lastHash, g.hasHash = hash, true
+	}
+
+	if !policy.KeepLatest || g.inFlight == 0 {
+		g.inFlight++
+		g.counters.Admitted++
+		overloadLock.Unlock()
+		return ""
+	}
+
+	// a pending mustRun frame is never replaced, the newer frame is the one skipped
+	if g.pending != nil && g.pendingMust && !mustRun {
+		g.counters.Stale++
+		overloadLock.Unlock()
+		return ReasonStale
+	}
+	g.dropPending()
+
+	pending := make(chan bool, 1)
+	g.pending = pending
+	g.pendingMust = mustRun
+	overloadLock.Unlock()
+
+	if !<-pending {
+		return ReasonStale
+	}
+	return ""
+}
+
+// Done finish an admitted frame of taskID, admit the pending frame if any,
+// and return the counters of the session
+func Done(taskID string) Counters {
+	overloadLock.Lock()
+	defer overloadLock.Unlock()
+
+	g, ok := gates[taskID]
+	if !ok {
+		return Counters{}
+	}
+
+	if g.inFlight > 0 {
+		g.inFlight--
+	}
+	if g.inFlight == 0 && g.pending != nil {
+		g.pending <- true
+		g.pending = nil
+		g.inFlight++
+		g.counters.Admitted++
+	}
+
+	if g.ended && g.inFlight == 0 {
+		delete(gates, taskID)
+	}
+
+	return g.counters
+}
+
+// SessionCounters is the json view of the counters of a task id
+type SessionCounters struct {
+	TaskID   string   `json:"task_id"`
+	TaskName string   `json:"task_name"`
+	Policy   *Policy  `json:"policy"`
+	InFlight int      `json:"in_flight"`
+	Pending  bool     `json:"pending"`
+	Counters Counters `json:"counters"`
+}
+
+// Status is the json view of the policies and all session counters
+type Status struct {
+	Policies map[string]*Policy `json:"policies"`
+	Sessions []SessionCounters  `json:"sessions"`
+}
+
+func GetStatus() Status {
+	overloadLock.Lock()
+	defer overloadLock.Unlock()
+
+	status := Status{Policies: map[string]*Policy{}, Sessions: []SessionCounters{}}
+	for taskName, policy := range taskPolicies {
+		status.Policies[taskName] = policy
+	}
+	for taskID, g := range gates {
+		status.Sessions = append(status.Sessions, SessionCounters{
+			TaskID:   taskID,
+			TaskName: g.taskName,
+			Policy:   g.effectivePolicy(),
+			InFlight: g.inFlight,
+			Pending:  g.pending != nil,
+			Counters: g.counters,
+		})
+	}
+
+	// task ids are sortable by created time
+	sort.Slice(status.Sessions, func(i, j int) bool {
+		return status.Sessions[i].TaskID < status.Sessions[j].TaskID
+	})
+	return status
+}
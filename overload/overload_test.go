@@ -0,0 +1,185 @@
+package overload
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+// openGate open the gate of a session only used by the test, with policy
+func openGate(t *testing.T, policy Policy) string {
+	taskID := fmt.Sprintf("%v-%v", t.Name(), time.Now().UnixNano())
+	Open("overload-test", taskID)
+	if ok, err := SetSessionPolicy(taskID, &policy); !ok || err != nil {
+		t.Fatalf("set policy of %v: %v, %v", taskID, ok, err)
+	}
+	t.Cleanup(func() { End(taskID) })
+	return taskID
+}
+
+// admitAsync admit a frame in the background, the reason is sent once it is decided
+func admitAsync(taskID string, mustRun bool) chan string {
+	reason := make(chan string, 1)
+	go func() {
+		reason <- Admit(taskID, nil, mustRun)
+	}()
+	return reason
+}
+
+// waitPending wait until the session of taskID holds a pending frame
+func waitPending(t *testing.T, taskID string) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		for _, session := range GetStatus().Sessions {
+			if session.TaskID == taskID && session.Pending {
+				return
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("no frame of %v is pending", taskID)
+}
+
+func receive(t *testing.T, reason chan string) string {
+	select {
+	case got := <-reason:
+		return got
+	case <-time.After(time.Second):
+		t.Fatal("frame is still pending")
+		return ""
+	}
+}
+
+func TestKeepLatest(t *testing.T) {
+	taskID := openGate(t, Policy{KeepLatest: true})
+
+	if reason := Admit(taskID, nil, false); reason != "" {
+		t.Fatalf("first frame is skipped: %v", reason)
+	}
+
+	// a newer frame replaces the pending one
+	second := admitAsync(taskID, false)
+	waitPending(t, taskID)
+	third := admitAsync(taskID, false)
+	if reason := receive(t, second); reason != ReasonStale {
+		t.Fatalf("replaced frame returns %q", reason)
+	}
+	waitPending(t, taskID)
+
+	// the pending frame is admitted once the frame in flight is done
+	Done(taskID)
+	if reason := receive(t, third); reason != "" {
+		t.Fatalf("pending frame is skipped: %v", reason)
+	}
+
+	counters := Done(taskID)
+	if counters != (Counters{Admitted: 2, Stale: 1}) {
+		t.Fatalf("counters are %+v", counters)
+	}
+}
+
+func TestKeepLatestMustRun(t *testing.T) {
+	taskID := openGate(t, Policy{KeepLatest: true})
+	Admit(taskID, nil, false)
+
+	// a pending mustRun frame is never replaced, the newer frame is skipped instead
+	last := admitAsync(taskID, true)
+	waitPending(t, taskID)
+	if reason := Admit(taskID, nil, false); reason != ReasonStale {
+		t.Fatalf("frame after a pending mustRun frame returns %q", reason)
+	}
+
+	Done(taskID)
+	if reason := receive(t, last); reason != "" {
+		t.Fatalf("mustRun frame is skipped: %v", reason)
+	}
+	Done(taskID)
+}
+
+func TestEndDropsPending(t *testing.T) {
+	taskID := openGate(t, Policy{KeepLatest: true})
+	Admit(taskID, nil, false)
+
+	pending := admitAsync(taskID, false)
+	waitPending(t, taskID)
+	End(taskID)
+	if reason := receive(t, pending); reason != ReasonStale {
+		t.Fatalf("pending frame of an ended session returns %q", reason)
+	}
+
+	// the gate is kept until the frame in flight is done
+	if counters := Done(taskID); counters != (Counters{Admitted: 1, Stale: 1}) {
+		t.Fatalf("counters are %+v", counters)
+	}
+	if counters := Done(taskID); counters != (Counters{}) {
+		t.Fatalf("gate is kept after the frames are done: %+v", counters)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	taskID := openGate(t, Policy{Dedup: true, DedupDistance: 4})
+	frame := pngFrame(t, waves)
+	brighter := pngFrame(t, func(x, y int) uint8 { return waves(x, y)/2 + 8 })
+	mirrored := pngFrame(t, func(x, y int) uint8 { return waves(63-x, y) })
+
+	for _, test := range []struct {
+		name    string
+		frame   func() (io.ReadCloser, int64, error)
+		mustRun bool
+		reason  string
+	}{
+		{"first frame", frame, false, ""},
+		{"same frame", frame, false, ReasonDuplicate},
+		{"similar frame", brighter, false, ReasonDuplicate},
+		{"mustRun frame", frame, true, ""},
+		{"different frame", mirrored, false, ""},
+		// compared with the last admitted frame, not the first one
+		{"back to the first frame", frame, false, ""},
+	} {
+		reason := Admit(taskID, test.frame, test.mustRun)
+		if reason != test.reason {
+			t.Fatalf("%v returns %q, want %q", test.name, reason, test.reason)
+		}
+		if reason == "" {
+			Done(taskID)
+		}
+	}
+
+	if counters := Done(taskID); counters != (Counters{Admitted: 4, Duplicate: 2}) {
+		t.Fatalf("counters are %+v", counters)
+	}
+}
+
+func TestMaxFPS(t *testing.T) {
+	taskID := openGate(t, Policy{MaxFPS: 10})
+
+	if reason := Admit(taskID, nil, false); reason != "" {
+		t.Fatalf("first frame is skipped: %v", reason)
+	}
+	Done(taskID)
+	if reason := Admit(taskID, nil, false); reason != ReasonFPS {
+		t.Fatalf("frame within 100ms returns %q", reason)
+	}
+	if reason := Admit(taskID, nil, true); reason != "" {
+		t.Fatalf("mustRun frame is skipped: %v", reason)
+	}
+	Done(taskID)
+
+	time.Sleep(110 * time.Millisecond)
+	if reason := Admit(taskID, nil, false); reason != "" {
+		t.Fatalf("frame after 100ms is skipped: %v", reason)
+	}
+	if counters := Done(taskID); counters != (Counters{Admitted: 3, FPS: 1}) {
+		t.Fatalf("counters are %+v", counters)
+	}
+}
+
+func TestAdmitWithoutSession(t *testing.T) {
+	if reason := Admit("no-session", nil, false); reason != "" {
+		t.Fatalf("frame without session is skipped: %v", reason)
+	}
+	if counters := Done("no-session"); counters != (Counters{}) {
+		t.Fatalf("counters without session are %+v", counters)
+	}
+}
@@ -0,0 +1,40 @@
+package overload
+
+import (
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+
+	"golang.org/x/image/draw"
+)
+
+// perceptualHash return the 64 bits difference hash of the frame: the frame is shrunk
+// to 9x8 gray pixels, and each bit tells whether a pixel is brighter than its right one.
+// Similar frames have hashes differing in few bits
+func perceptualHash(frame func() (io.ReadCloser, int64, error)) (uint64, error) {
+	file, _, err := frame()
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return 0, err
+	}
+
+	small := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if small.GrayAt(x, y).Y > small.GrayAt(x+1, y).Y {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
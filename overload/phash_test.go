@@ -0,0 +1,67 @@
+package overload
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math/bits"
+	"testing"
+)
+
+// pngFrame encode a 64x64 gray png whose pixel at x, y is shade(x, y)
+func pngFrame(t *testing.T, shade func(x, y int) uint8) func() (io.ReadCloser, int64, error) {
+	img := image.NewGray(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetGray(x, y, color.Gray{Y: shade(x, y)})
+		}
+	}
+	encoded := &bytes.Buffer{}
+	if err := png.Encode(encoded, img); err != nil {
+		t.Fatal(err)
+	}
+	return func() (io.ReadCloser, int64, error) {
+		return io.NopCloser(bytes.NewReader(encoded.Bytes())), int64(encoded.Len()), nil
+	}
+}
+
+// waves is a frame with bright and dark columns, so the hash has bits of both values
+func waves(x, y int) uint8 {
+	return uint8((x*37 + y*11) % 256)
+}
+
+func hash(t *testing.T, frame func() (io.ReadCloser, int64, error)) uint64 {
+	hash, err := perceptualHash(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestPerceptualHash(t *testing.T) {
+	origin := hash(t, pngFrame(t, waves))
+	if again := hash(t, pngFrame(t, waves)); again != origin {
+		t.Fatalf("same frame hashes %x and %x", origin, again)
+	}
+
+	// a slightly brighter frame keeps the gradients
+	brighter := hash(t, pngFrame(t, func(x, y int) uint8 { return waves(x, y)/2 + 8 }))
+	if distance := bits.OnesCount64(origin ^ brighter); distance > 4 {
+		t.Fatalf("brighter frame is %v bits away", distance)
+	}
+
+	// the mirrored frame flips the gradients
+	mirrored := hash(t, pngFrame(t, func(x, y int) uint8 { return waves(63-x, y) }))
+	if distance := bits.OnesCount64(origin ^ mirrored); distance < 16 {
+		t.Fatalf("mirrored frame is only %v bits away", distance)
+	}
+
+	invalid := func() (io.ReadCloser, int64, error) {
+		return io.NopCloser(bytes.NewReader([]byte("not an image"))), 12, nil
+	}
+	if _, err := perceptualHash(invalid); err == nil {
+		t.Fatal("invalid frame is hashed")
+	}
+}
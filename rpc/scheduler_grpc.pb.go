@@ -0,0 +1,318 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             (unknown)
+// source: scheduler.proto
+
+package rpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// SchedulerClient is the client API for Scheduler service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type SchedulerClient interface {
+	// SubmitTask is /new_task. The first result carries the assigned task_id,
+	// the second result carries the worker result of the frame
+	SubmitTask(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (Scheduler_SubmitTaskClient, error)
+	// SubmitCompleteTask is /complete_task. The first result carries the
+	// assigned task ids, the second result carries the fusion result and latencies
+	SubmitCompleteTask(ctx context.Context, in *CompleteTaskRequest, opts ...grpc.CallOption) (Scheduler_SubmitCompleteTaskClient, error)
+	// CreateWorkers is /create_workers
+	CreateWorkers(ctx context.Context, in *CreateWorkersRequest, opts ...grpc.CallOption) (*CreateWorkersReply, error)
+	// UpdateCPU is /update_cpu
+	UpdateCPU(ctx context.Context, in *UpdateCPURequest, opts ...grpc.CallOption) (*UpdateCPUReply, error)
+	// QueryMetric is /query_metric
+	QueryMetric(ctx context.Context, in *QueryMetricRequest, opts ...grpc.CallOption) (*ResourceUsage, error)
+}
+
+type schedulerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSchedulerClient(cc grpc.ClientConnInterface) SchedulerClient {
+	return &schedulerClient{cc}
+}
+
+func (c *schedulerClient) SubmitTask(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (Scheduler_SubmitTaskClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Scheduler_ServiceDesc.Streams[0], "/scheduler.Scheduler/SubmitTask", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &schedulerSubmitTaskClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Scheduler_SubmitTaskClient interface {
+	Recv() (*TaskResult, error)
+	grpc.ClientStream
+}
+
+type schedulerSubmitTaskClient struct {
+	grpc.ClientStream
+}
+
+func (x *schedulerSubmitTaskClient) Recv() (*TaskResult, error) {
+	m := new(TaskResult)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *schedulerClient) SubmitCompleteTask(ctx context.Context, in *CompleteTaskRequest, opts ...grpc.CallOption) (Scheduler_SubmitCompleteTaskClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Scheduler_ServiceDesc.Streams[1], "/scheduler.Scheduler/SubmitCompleteTask", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &schedulerSubmitCompleteTaskClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Scheduler_SubmitCompleteTaskClient interface {
+	Recv() (*CompleteTaskResult, error)
+	grpc.ClientStream
+}
+
+type schedulerSubmitCompleteTaskClient struct {
+	grpc.ClientStream
+}
+
+func (x *schedulerSubmitCompleteTaskClient) Recv() (*CompleteTaskResult, error) {
+	m := new(CompleteTaskResult)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *schedulerClient) CreateWorkers(ctx context.Context, in *CreateWorkersRequest, opts ...grpc.CallOption) (*CreateWorkersReply, error) {
+	out := new(CreateWorkersReply)
+	err := c.cc.Invoke(ctx, "/scheduler.Scheduler/CreateWorkers", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *schedulerClient) UpdateCPU(ctx context.Context, in *UpdateCPURequest, opts ...grpc.CallOption) (*UpdateCPUReply, error) {
+	out := new(UpdateCPUReply)
+	err := c.cc.Invoke(ctx, "/scheduler.Scheduler/UpdateCPU", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *schedulerClient) QueryMetric(ctx context.Context, in *QueryMetricRequest, opts ...grpc.CallOption) (*ResourceUsage, error) {
+	out := new(ResourceUsage)
+	err := c.cc.Invoke(ctx, "/scheduler.Scheduler/QueryMetric", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SchedulerServer is the server API for Scheduler service.
+// All implementations must embed UnimplementedSchedulerServer
+// for forward compatibility
+type SchedulerServer interface {
+	// SubmitTask is /new_task. The first result carries the assigned task_id,
+	// the second result carries the worker result of the frame
+	SubmitTask(*TaskRequest, Scheduler_SubmitTaskServer) error
+	// SubmitCompleteTask is /complete_task. The first result carries the
+	// assigned task ids, the second result carries the fusion result and latencies
+	SubmitCompleteTask(*CompleteTaskRequest, Scheduler_SubmitCompleteTaskServer) error
+	// CreateWorkers is /create_workers
+	CreateWorkers(context.Context, *CreateWorkersRequest) (*CreateWorkersReply, error)
+	// UpdateCPU is /update_cpu
+	UpdateCPU(context.Context, *UpdateCPURequest) (*UpdateCPUReply, error)
+	// QueryMetric is /query_metric
+	QueryMetric(context.Context, *QueryMetricRequest) (*ResourceUsage, error)
+	mustEmbedUnimplementedSchedulerServer()
+}
+
+// UnimplementedSchedulerServer must be embedded to have forward compatible implementations.
+type UnimplementedSchedulerServer struct {
+}
+
+func (UnimplementedSchedulerServer) SubmitTask(*TaskRequest, Scheduler_SubmitTaskServer) error {
+	return status.Errorf(codes.Unimplemented, "method SubmitTask not implemented")
+}
+func (UnimplementedSchedulerServer) SubmitCompleteTask(*CompleteTaskRequest, Scheduler_SubmitCompleteTaskServer) error {
+	return status.Errorf(codes.Unimplemented, "method SubmitCompleteTask not implemented")
+}
+func (UnimplementedSchedulerServer) CreateWorkers(context.Context, *CreateWorkersRequest) (*CreateWorkersReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateWorkers not implemented")
+}
+func (UnimplementedSchedulerServer) UpdateCPU(context.Context, *UpdateCPURequest) (*UpdateCPUReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateCPU not implemented")
+}
+func (UnimplementedSchedulerServer) QueryMetric(context.Context, *QueryMetricRequest) (*ResourceUsage, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method QueryMetric not implemented")
+}
+func (UnimplementedSchedulerServer) mustEmbedUnimplementedSchedulerServer() {}
+
+// UnsafeSchedulerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to SchedulerServer will
+// result in compilation errors.
+type UnsafeSchedulerServer interface {
+	mustEmbedUnimplementedSchedulerServer()
+}
+
+func RegisterSchedulerServer(s grpc.ServiceRegistrar, srv SchedulerServer) {
+	s.RegisterService(&Scheduler_ServiceDesc, srv)
+}
+
+func _Scheduler_SubmitTask_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(TaskRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(SchedulerServer).SubmitTask(m, &schedulerSubmitTaskServer{stream})
+}
+
+type Scheduler_SubmitTaskServer interface {
+	Send(*TaskResult) error
+	grpc.ServerStream
+}
+
+type schedulerSubmitTaskServer struct {
+	grpc.ServerStream
+}
+
+func (x *schedulerSubmitTaskServer) Send(m *TaskResult) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Scheduler_SubmitCompleteTask_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(CompleteTaskRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(SchedulerServer).SubmitCompleteTask(m, &schedulerSubmitCompleteTaskServer{stream})
+}
+
+type Scheduler_SubmitCompleteTaskServer interface {
+	Send(*CompleteTaskResult) error
+	grpc.ServerStream
+}
+
+type schedulerSubmitCompleteTaskServer struct {
+	grpc.ServerStream
+}
+
+func (x *schedulerSubmitCompleteTaskServer) Send(m *CompleteTaskResult) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Scheduler_CreateWorkers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateWorkersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SchedulerServer).CreateWorkers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/scheduler.Scheduler/CreateWorkers",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SchedulerServer).CreateWorkers(ctx, req.(*CreateWorkersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Scheduler_UpdateCPU_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateCPURequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SchedulerServer).UpdateCPU(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/scheduler.Scheduler/UpdateCPU",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SchedulerServer).UpdateCPU(ctx, req.(*UpdateCPURequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Scheduler_QueryMetric_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QueryMetricRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SchedulerServer).QueryMetric(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/scheduler.Scheduler/QueryMetric",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SchedulerServer).QueryMetric(ctx, req.(*QueryMetricRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Scheduler_ServiceDesc is the grpc.ServiceDesc for Scheduler service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Scheduler_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "scheduler.Scheduler",
+	HandlerType: (*SchedulerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CreateWorkers",
+			Handler:    _Scheduler_CreateWorkers_Handler,
+		},
+		{
+			MethodName: "UpdateCPU",
+			Handler:    _Scheduler_UpdateCPU_Handler,
+		},
+		{
+			MethodName: "QueryMetric",
+			Handler:    _Scheduler_QueryMetric_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SubmitTask",
+			Handler:       _Scheduler_SubmitTask_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "SubmitCompleteTask",
+			Handler:       _Scheduler_SubmitCompleteTask_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "scheduler.proto",
+}
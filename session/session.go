@@ -0,0 +1,255 @@
+package session
+
+import (
+	"Scheduler/handler"
+	"Scheduler/overload"
+	"Scheduler/worker_pool"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	KindTask     = "task"
+	KindComplete = "complete_task"
+	KindStream   = "stream"
+)
+
+// Binding is a task id of the session, the worker of the task id is looked up
+// from worker_pool since retry may move the task to another worker
+type Binding struct {
+	TaskName string
+	TaskID   string
+}
+
+// Session is a Begin/Running/Last sequence of a client
+// A session holds its workers until it is ended by Last, closed by idle timeout or closed by force
+type Session struct {
+	ID           string
+	Kind         string
+	Bindings     []Binding
+	CreatedAt    time.Time
+	LastActivity time.Time
+
+	// Owner is the principal name of the client opened the session, empty while auth is disabled
+	Owner string
+
+	// onClose is called when the session is closed by the manager, such as closing a stream connection
+	onClose func()
+}
+
+// Info is the json view of a session
+type Info struct {
+	ID           string   `json:"id"`
+	Kind         string   `json:"kind"`
+	Owner        string   `json:"owner"`
+	TaskNames    []string `json:"task_names"`
+	TaskIDs      []string `json:"task_ids"`
+	Workers      []string `json:"workers"`
+	CreatedAt    string   `json:"created_at"`
+	LastActivity string   `json:"last_activity"`
+	Idle         string   `json:"idle"`
+}
+
+var sessionLock = sync.Mutex{}
+
+// map from task id to *Session, a complete task session is stored under both task ids
+var sessionMap = map[string]*Session{}
+
+// Open register a session of owner whose id is the first binding task id
+func Open(kind, owner string, onClose func(), bindings ...Binding) *Session {
+	now := time.Now()
+	session := &Session{
+		ID:           bindings[0].TaskID,
+		Kind:         kind,
+		Owner:        owner,
+		Bindings:     bindings,
+		CreatedAt:    now,
+		LastActivity: now,
+		onClose:      onClose,
+	}
+
+	sessionLock.Lock()
+	for _, binding := range bindings {
+		sessionMap[binding.TaskID] = session
+		overload.Open(binding.TaskName, binding.TaskID)
+	}
+	sessionLock.Unlock()
+
+	log.Printf("Session %v of %v opened", session.ID, kind)
+	return session
+}
+
+// Touch refresh the last activity of the session that taskID belongs to
+func Touch(taskID string) {
+	sessionLock.Lock()
+	if session, ok := sessionMap[taskID]; ok {
+		session.LastActivity = time.Now()
+	}
+	sessionLock.Unlock()
+}
+
+// End unregister the session that taskID belongs to, the caller is responsible to
+// reset and return its workers. Return false if the session has already been closed
+func End(taskID string) bool {
+	return remove(taskID) != nil
+}
+
+// Close reset the workers of the session that taskID belongs to and return them to pool
+// Return false if the session does not exist
+func Close(taskID, reason string) bool {
+	sessionLock.Lock()
+	session := removeLocked(taskID)
+	// the tasks are unbound with the session, so a frame of the session arriving meanwhile
+	// does not find the workers this close returns
+	var workers []*worker_pool.Worker
+	if session != nil {
+		for _, binding := range session.Bindings {
+			worker, _ := worker_pool.UnbindTask(binding.TaskID)
+			workers = append(workers, worker)
+		}
+	}
+	sessionLock.Unlock()
+	if session == nil {
+		return false
+	}
+
+	log.Printf("Session %v of %v closed: %v", session.ID, session.Kind, reason)
+
+	if session.onClose != nil {
+		session.onClose()
+	}
+
+	for i, binding := range session.Bindings {
+		// a frame in flight will never be waited
+		handler.CancelTask(binding.TaskID)
+
+		worker := workers[i]
+		if worker == nil {
+			continue
+		}
+		handler.ResetWorker(worker, binding.TaskName, binding.TaskID)
+		worker.ReturnToPool(binding.TaskID)
+	}
+
+	return true
+}
+
+func remove(taskID string) *Session {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	return removeLocked(taskID)
+}
+
+// removeLocked should be called with sessionLock held
+func removeLocked(taskID string) *Session {
+	session, ok := sessionMap[taskID]
+	if !ok {
+		return nil
+	}
+
+	for _, binding := range session.Bindings {
+		delete(sessionMap, binding.TaskID)
+		overload.End(binding.TaskID)
+	}
+
+	return session
+}
+
+// Owner return the owner of the session that taskID belongs to, false if the session does not exist
+func Owner(taskID string) (string, bool) {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	session, ok := sessionMap[taskID]
+	if !ok {
+		return "", false
+	}
+	return session.Owner, true
+}
+
+// Age return how long ago the session that taskID belongs to was opened
+func Age(taskID string) (time.Duration, bool) {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	session, ok := sessionMap[taskID]
+	if !ok {
+		return 0, false
+	}
+	return time.Since(session.CreatedAt), true
+}
+
+// List return all living sessions ordered by created time
+func List() []Info {
+	sessionLock.Lock()
+	var sessions []*Session
+	for taskID, session := range sessionMap {
+		if taskID == session.ID {
+			sessions = append(sessions, session)
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+
+	now := time.Now()
+	infos := []Info{}
+	for _, session := range sessions {
+		info := Info{
+			ID:           session.ID,
+			Kind:         session.Kind,
+			Owner:        session.Owner,
+			CreatedAt:    session.CreatedAt.Format(time.RFC3339Nano),
+			LastActivity: session.LastActivity.Format(time.RFC3339Nano),
+			Idle:         now.Sub(session.LastActivity).String(),
+		}
+		for _, binding := range session.Bindings {
+			info.TaskNames = append(info.TaskNames, binding.TaskName)
+			info.TaskIDs = append(info.TaskIDs, binding.TaskID)
+			if worker, ok := worker_pool.LookupWorker(binding.TaskID); ok {
+				info.Workers = append(info.Workers, worker.GetWorkerName())
+			}
+		}
+		infos = append(infos, info)
+	}
+	sessionLock.Unlock()
+
+	return infos
+}
+
+// RunIdleChecker close sessions which have no activity for idleTimeout, never return
+func RunIdleChecker(idleTimeout time.Duration) {
+	interval := idleTimeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	for range time.Tick(interval) {
+		closeIdle(idleTimeout)
+	}
+}
+
+// closeIdle close sessions which have no activity for idleTimeout
+func closeIdle(idleTimeout time.Duration) {
+	var expired []string
+	sessionLock.Lock()
+	for taskID, session := range sessionMap {
+		if taskID == session.ID && time.Since(session.LastActivity) > idleTimeout {
+			expired = append(expired, taskID)
+		}
+	}
+	sessionLock.Unlock()
+
+	for _, taskID := range expired {
+		// an unreachable worker should not crash the checker
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					log.Printf("Close session %v failed: %v", taskID, err)
+				}
+			}()
+			Close(taskID, "idle timeout")
+		}()
+	}
+}
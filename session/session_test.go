@@ -0,0 +1,184 @@
+package session
+
+import (
+	"Scheduler/worker_pool"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// sessionWorker start a det worker of gpu1 served by an http server counting the reset requests.
+// Pods of the fake cluster run once created
+func sessionWorker(t *testing.T) (*worker_pool.Worker, *atomic.Int64) {
+	t.Setenv("Debug", "False")
+	resets := &atomic.Int64{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("reset") == "True" {
+			resets.Add(1)
+		}
+	}))
+	t.Cleanup(server.Close)
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	t.Setenv("WORKER_PORTS", fmt.Sprintf(`{"ranges": {"default": {"min": %v, "max": %v}}, "probe": false, "state_file": ""}`,
+		port, port))
+	if err := worker_pool.LoadPortsFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	cluster := fake.NewSimpleClientset()
+	cluster.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		action.(k8stesting.CreateAction).GetObject().(*corev1.Pod).Status.Phase = corev1.PodRunning
+		return false, nil, nil
+	})
+	worker_pool.SetClusterClient(cluster)
+	t.Cleanup(func() {
+		worker_pool.SetClusterClient(nil)
+		worker_pool.WorkerMap.Delete("det")
+	})
+
+	worker, err := worker_pool.CreateWorker("det", "gpu1", "127.0.0.1", "100m", "0", "0", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); worker.GetState() != worker_pool.WorkerReady; {
+		if time.Now().After(deadline) {
+			t.Fatalf("the worker is not ready, got %v", worker.GetState())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return worker, resets
+}
+
+// openSession occupy the worker for a new task and open its session
+func openSession(t *testing.T, onClose func()) string {
+	taskID := fmt.Sprintf("%v-%v", t.Name(), time.Now().UnixNano())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := worker_pool.OccupyWorkerWithClass(ctx, "det", taskID, "gpu1", worker_pool.TaskClass{}); err != nil {
+		t.Fatal(err)
+	}
+	Open(KindTask, "camera", onClose, Binding{TaskName: "det", TaskID: taskID})
+	return taskID
+}
+
+func TestOpen(t *testing.T) {
+	worker, _ := sessionWorker(t)
+	taskID := openSession(t, nil)
+	defer Close(taskID, "test")
+
+	if owner, ok := Owner(taskID); !ok || owner != "camera" {
+		t.Fatalf("unexpected owner %v %v", owner, ok)
+	}
+	if age, ok := Age(taskID); !ok || age < 0 {
+		t.Fatalf("unexpected age %v %v", age, ok)
+	}
+	var info *Info
+	for _, session := range List() {
+		if session.ID == taskID {
+			info = &session
+		}
+	}
+	if info == nil || info.Kind != KindTask || len(info.Workers) != 1 || info.Workers[0] != worker.GetWorkerName() {
+		t.Fatalf("unexpected session %+v", info)
+	}
+}
+
+// a session without activity is closed by the idle checker, and its worker is reset and returned
+func TestCloseIdle(t *testing.T) {
+	worker, resets := sessionWorker(t)
+	taskID := openSession(t, nil)
+
+	closeIdle(time.Hour)
+	if _, ok := Owner(taskID); !ok {
+		t.Fatal("an active session should be kept")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	Touch(taskID)
+	closeIdle(5 * time.Millisecond)
+	if _, ok := Owner(taskID); !ok {
+		t.Fatal("a touched session should be kept")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	closeIdle(5 * time.Millisecond)
+	if _, ok := Owner(taskID); ok {
+		t.Fatal("the idle session should be closed")
+	}
+	if resets.Load() != 1 || worker_pool.CountAvailable("det") != 1 || worker.GetState() != worker_pool.WorkerReady {
+		t.Fatalf("the worker should be reset once and returned, got %v resets", resets.Load())
+	}
+}
+
+func TestForcedClose(t *testing.T) {
+	_, resets := sessionWorker(t)
+	closed := false
+	taskID := openSession(t, func() { closed = true })
+
+	if !Close(taskID, "by operator") || Close(taskID, "again") {
+		t.Fatal("only an open session can be closed")
+	}
+	if !closed {
+		t.Fatal("the close callback of the session should be called")
+	}
+	if _, ok := worker_pool.LookupWorker(taskID); ok {
+		t.Fatal("the task should be unbound")
+	}
+	if resets.Load() != 1 || worker_pool.CountAvailable("det") != 1 {
+		t.Fatalf("the worker should be reset once and returned, got %v resets", resets.Load())
+	}
+	if End(taskID) {
+		t.Fatal("a closed session can not be ended")
+	}
+}
+
+// a Last frame ending the session races with a close of it, only one of them returns the worker
+func TestCloseRacesWithEnd(t *testing.T) {
+	worker, resets := sessionWorker(t)
+	for i := 0; i < 20; i++ {
+		taskID := openSession(t, nil)
+		resetsBefore := resets.Load()
+
+		var ended, closed bool
+		wg := sync.WaitGroup{}
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			// as the Last frame does, the worker is only looked up once the session is ended
+			if ended = End(taskID); ended {
+				if bound, ok := worker_pool.LookupWorker(taskID); ok {
+					bound.ReturnToPool(taskID)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			closed = Close(taskID, "race")
+		}()
+		wg.Wait()
+
+		if ended == closed {
+			t.Fatalf("exactly one of end and close should win, got %v %v", ended, closed)
+		}
+		if closed && resets.Load() != resetsBefore+1 {
+			t.Fatal("the closed session should reset its worker once")
+		}
+		if _, ok := worker_pool.LookupWorker(taskID); ok {
+			t.Fatal("the task should not be bound after either")
+		}
+		if worker_pool.CountAvailable("det") != 1 || worker.GetState() != worker_pool.WorkerReady {
+			t.Fatalf("the worker should be returned once, got %v", worker.GetState())
+		}
+	}
+}
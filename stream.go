@@ -0,0 +1,252 @@
+package main
+
+import (
+	"Scheduler/auth"
+	"Scheduler/handler"
+	"Scheduler/overload"
+	"Scheduler/session"
+	"Scheduler/utils"
+	"Scheduler/worker_pool"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var streamUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024 * 1024,
+	WriteBufferSize: 1024 * 1024,
+	CheckOrigin:     checkStreamOrigin,
+}
+
+// streamAllowedOrigins is the origins of browser pages allowed to open stream sessions besides
+// the scheduler itself, "*" allows any. Set by the comma separated STREAM_ALLOWED_ORIGINS,
+// e.g. https://dashboard.example.com,http://localhost:3000
+var streamAllowedOrigins []string
+
+// loadStreamOriginsFromEnv load STREAM_ALLOWED_ORIGINS
+func loadStreamOriginsFromEnv() {
+	streamAllowedOrigins = nil
+	for _, origin := range strings.Split(os.Getenv("STREAM_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			streamAllowedOrigins = append(streamAllowedOrigins, origin)
+		}
+	}
+}
+
+// checkStreamOrigin allow clients without Origin, which are not browsers, the origin of the scheduler,
+// and streamAllowedOrigins, so a page of another site can not open sessions with the credentials of its user
+func checkStreamOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range streamAllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	originURL, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(originURL.Host, r.Host) {
+		return true
+	}
+	log.Printf("stream session from origin %v is refused", origin)
+	return false
+}
+
+// streamPongWait is how long a stream session waits for a message or a pong of the client,
+// a half-open connection is closed after it instead of holding its worker until the idle checker
+var streamPongWait = 60 * time.Second
+
+// keepStreamAlive limit messages of the connection to maxMessageSize, and ping the client
+// so each pong renews the read deadline. The returned func stops the pings
+func keepStreamAlive(conn *websocket.Conn) func() {
+	pongWait := streamPongWait
+	conn.SetReadLimit(maxMessageSize)
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(pongWait / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				// WriteControl is safe along the other writes of the session
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pongWait)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// streamSession open a websocket session bound to a worker
+// ws://scheduler:8081/stream_session?task_name=det&node_name=gpu1&priority=high&deadline_ms=500
+// Server first write {"task_id": xxx} as a text message
+// Client write a text message of json object for extra fields of the next frame (e.g. detect_result of fusion),
+// task_name, task_id and reset are reserved and close the session. Then write the frame as a binary message.
+// Each frame is answered by a text message of the worker result,
+// such as {"task_id": xxx, "det_result": xxx, "dropped_frames": xxx}.
+// A frame skipped by the overload policy is answered by {"task_id": xxx, "dropped": reason}
+// Closing the session reset the worker and return it to pool, same as the Last status.
+// A message above maxMessageSize, or no pong to the pings of the server, closes the session
+func streamSession(w http.ResponseWriter, r *http.Request) {
+	taskName := r.URL.Query().Get("task_name")
+	nodeName := r.URL.Query().Get("node_name")
+
+	taskHandler := handler.GetHandler(taskName)
+	if taskHandler.StartFrameTask == nil {
+		http.Error(w, "Task type not support stream session", http.StatusBadRequest)
+		return
+	}
+
+	var deadlineMs int64
+	if rawDeadline := r.URL.Query().Get("deadline_ms"); rawDeadline != "" {
+		var err error
+		if deadlineMs, err = strconv.ParseInt(rawDeadline, 10, 64); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	class, err := parseTaskClass(r.URL.Query().Get("priority"), deadlineMs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if class.Tenant, err = tenantOf(r); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if draining.Load() {
+		http.Error(w, errDraining.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, err := streamUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("stream session upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// the session is long-lived, drop the write deadline of the http server
+	if err = conn.SetWriteDeadline(time.Time{}); err != nil {
+		log.Panic(err)
+	}
+	defer keepStreamAlive(conn)()
+
+	taskID := utils.GetUniqueID()
+	worker, err := handler.OccupyTaskWorker(r.Context(), taskName, taskID, nodeName, class)
+	if err != nil {
+		log.Printf("stream session of %v failed to get a worker: %v", taskName, err)
+		conn.WriteJSON(map[string]string{"error": err.Error()})
+		return
+	}
+	log.Printf("Stream session %v of %v opened, worker_pool %v", taskID, taskName, worker.Describe())
+
+	principal, authenticated := auth.Authenticate(r)
+	session.Open(session.KindStream, sessionOwner(principal, authenticated), func() { conn.Close() },
+		session.Binding{TaskName: taskName, TaskID: taskID})
+
+	defer func() {
+		// the worker has been reset if the session is closed by timeout or by force,
+		// and the task may have been moved to another worker by retry
+		if session.End(taskID) {
+			if worker, ok := worker_pool.LookupWorker(taskID); ok {
+				handler.ResetWorker(worker, taskName, taskID)
+				worker.ReturnToPool(taskID)
+			}
+		}
+		log.Printf("Stream session %v of %v closed", taskID, taskName)
+	}()
+
+	if err = conn.WriteJSON(map[string]string{"task_id": taskID}); err != nil {
+		log.Printf("stream session %v write failed: %v", taskID, err)
+		return
+	}
+
+	values := map[string]string{}
+	for {
+		if err = conn.SetReadDeadline(time.Now().Add(streamPongWait)); err != nil {
+			return
+		}
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("stream session %v read failed: %v", taskID, err)
+			}
+			return
+		}
+
+		if messageType == websocket.TextMessage {
+			values = map[string]string{}
+			if err = json.Unmarshal(message, &values); err != nil {
+				log.Printf("stream session %v receive invalid fields: %v", taskID, err)
+				return
+			}
+			if err = handler.CheckFrameValues(values); err != nil {
+				log.Printf("stream session %v receive invalid fields: %v", taskID, err)
+				conn.WriteJSON(map[string]string{"task_id": taskID, "error": err.Error()})
+				return
+			}
+			continue
+		}
+
+		session.Touch(taskID)
+		frame := handler.BytesFrame(message)
+		if reason := overload.Admit(taskID, frame, false); reason != "" {
+			if err = conn.WriteJSON(map[string]string{"task_id": taskID, "dropped": reason}); err != nil {
+				log.Printf("stream session %v write failed: %v", taskID, err)
+				return
+			}
+			continue
+		}
+
+		// a retry of the previous frame may have moved the task to another worker
+		var ok bool
+		if worker, ok = worker_pool.LookupWorker(taskID); !ok {
+			overload.Done(taskID)
+			log.Printf("stream session %v lost its worker", taskID)
+			conn.WriteJSON(map[string]string{"task_id": taskID, "error": errTaskNotFound.Error()})
+			return
+		}
+		finishForm, err := handler.RunFrame(worker, taskName, taskID, frame, values, false, false)
+		dropped := overload.Done(taskID)
+		if err != nil {
+			// the task is unbound from any worker, the client should open a new session
+			log.Printf("stream session %v failed: %v", taskID, err)
+			conn.WriteJSON(map[string]string{"task_id": taskID, "error": err.Error()})
+			return
+		}
+
+		result := map[string]string{}
+		for key, value := range finishForm.Value {
+			if len(value) != 0 {
+				result[key] = value[0]
+			}
+		}
+		droppedFrames, err := json.Marshal(dropped)
+		if err != nil {
+			log.Panic(err)
+		}
+		result["dropped_frames"] = string(droppedFrames)
+
+		if err = conn.WriteJSON(result); err != nil {
+			log.Printf("stream session %v write failed: %v", taskID, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCheckStreamOrigin(t *testing.T) {
+	t.Setenv("STREAM_ALLOWED_ORIGINS", " https://dashboard.example.com/, http://localhost:3000")
+	loadStreamOriginsFromEnv()
+	t.Cleanup(func() { streamAllowedOrigins = nil })
+
+	cases := map[string]bool{
+		"":                              true,
+		"https://dashboard.example.com": true,
+		"http://localhost:3000":         true,
+		"http://scheduler:8081":         true,
+		"https://evil.example.com":      false,
+		"http://localhost:3001":         false,
+	}
+	for origin, allowed := range cases {
+		r := httptest.NewRequest(http.MethodGet, "http://scheduler:8081/stream_session", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if checkStreamOrigin(r) != allowed {
+			t.Fatalf("origin %q: expected allowed %v", origin, allowed)
+		}
+	}
+
+	streamAllowedOrigins = []string{"*"}
+	r := httptest.NewRequest(http.MethodGet, "http://scheduler:8081/stream_session", nil)
+	r.Header.Set("Origin", "https://evil.example.com")
+	if !checkStreamOrigin(r) {
+		t.Fatal("* should allow any origin")
+	}
+}
+
+// streamConn start a server reading messages as a stream session does, and return a client
+// connected to it and the error the server read failed with.
+// The session is closed and waited for when the test ends
+func streamConn(t *testing.T) (*websocket.Conn, chan error) {
+	readErr := make(chan error, 1)
+	sessions := sync.WaitGroup{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessions.Add(1)
+		defer sessions.Done()
+		conn, err := streamUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			readErr <- err
+			return
+		}
+		defer conn.Close()
+		defer keepStreamAlive(conn)()
+		for {
+			if err = conn.SetReadDeadline(time.Now().Add(streamPongWait)); err == nil {
+				_, _, err = conn.ReadMessage()
+			}
+			if err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		// a hijacked connection is not waited for by server.Close
+		sessions.Wait()
+	})
+	return client, readErr
+}
+
+func TestStreamReadLimit(t *testing.T) {
+	client, readErr := streamConn(t)
+	if err := client.WriteMessage(websocket.BinaryMessage, make([]byte, maxMessageSize+1)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-readErr:
+		if err != websocket.ErrReadLimit {
+			t.Fatalf("expected %v, got %v", websocket.ErrReadLimit, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a message above the limit should be refused")
+	}
+}
+
+func TestStreamPongDeadline(t *testing.T) {
+	previous := streamPongWait
+	streamPongWait = 200 * time.Millisecond
+	t.Cleanup(func() { streamPongWait = previous })
+
+	// a client reading its messages answers the pings, so the session stays open without frames
+	client, readErr := streamConn(t)
+	go func() {
+		for {
+			if _, _, err := client.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case err := <-readErr:
+		t.Fatalf("a client answering pings should stay connected, got %v", err)
+	case <-time.After(3 * streamPongWait):
+	}
+
+	// a client which never reads is half-open to the server, which gives up after streamPongWait
+	_, readErr = streamConn(t)
+	select {
+	case err := <-readErr:
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			t.Fatalf("expected a timeout, got %v", err)
+		}
+	case <-time.After(3 * streamPongWait):
+		t.Fatal("a client without pongs should be dropped")
+	}
+}
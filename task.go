@@ -19,7 +19,7 @@ type ExitInfo struct {
 // ExitInfo Exit code, signal and execution output of this task
 // StdOutput the standard output of the task. Like print(xxx)
 type TaskInfo struct {
-	TaskID   int      `json:"taskID"`
+	TaskID   string   `json:"taskID"`
 	ExitInfo ExitInfo `json:"exitInfo"`
 	WorkerIP *string  `json:"workerIP"`
 }
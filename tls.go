@@ -0,0 +1,166 @@
+package main
+
+import (
+	"Scheduler/auth"
+	"Scheduler/handler"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serve the certificate of the scheduler listeners,
+// and load it again once the certificate or key file is modified
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	lock    sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// certReloadInterval is how often the certificate files are checked for changes
+var certReloadInterval = 30 * time.Second
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// latestModTime is the latest modification time of the certificate and key files
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certReloader) reload() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	c.cert = &cert
+	c.modTime = modTime
+	c.lock.Unlock()
+	return nil
+}
+
+// run check the files every interval, never return
+func (c *certReloader) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		c.check()
+	}
+}
+
+// check reload the certificate if the files are modified.
+// A broken certificate is logged and the previous one is kept
+func (c *certReloader) check() {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		log.Printf("Check certificate %v failed: %v", c.certFile, err)
+		return
+	}
+
+	c.lock.RLock()
+	changed := modTime.After(c.modTime)
+	c.lock.RUnlock()
+	if !changed {
+		return
+	}
+
+	if err = c.reload(); err != nil {
+		log.Printf("Reload certificate %v failed, keep the previous one: %v", c.certFile, err)
+		return
+	}
+	log.Printf("Certificate %v reloaded", c.certFile)
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cert, nil
+}
+
+// getClientCertificate present the same certificate when the scheduler is the client
+func (c *certReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cert, nil
+}
+
+// serverTLSConfig is the tls config of the http and grpc listeners, nil if tls is disabled
+var serverTLSConfig *tls.Config
+
+// loadServerTLS enable tls of the listeners if TLS_CERT_FILE and TLS_KEY_FILE are set.
+// Client certificates signed by TLS_CLIENT_CA_FILE are verified if given,
+// they identify devices and operators, see auth.Authenticate.
+// Results are then sent back to devices over https too, presenting the same certificate.
+// Device certificates are verified by TLS_CLIENT_CA_FILE, or the system roots if it is not set,
+// and TLS_DEVICE_SERVER_NAME overrides the verified name, since devices are dialed by ip
+func loadServerTLS() error {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if certFile == "" && keyFile == "" {
+		return nil
+	}
+	if certFile == "" || keyFile == "" {
+		return fmt.Errorf("both TLS_CERT_FILE and TLS_KEY_FILE are required")
+	}
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	go reloader.run(certReloadInterval)
+
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.getCertificate,
+	}
+	clientConfig := &tls.Config{
+		MinVersion:           tls.VersionTLS12,
+		GetClientCertificate: reloader.getClientCertificate,
+		ServerName:           os.Getenv("TLS_DEVICE_SERVER_NAME"),
+	}
+
+	if caFile := os.Getenv("TLS_CLIENT_CA_FILE"); caFile != "" {
+		rawCA, err := os.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(rawCA) {
+			return fmt.Errorf("no certificate found in %v", caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		clientConfig.RootCAs = pool
+		// a client without certificate may still use a token, but is never let in anonymously
+		auth.SetClientCA(true)
+	}
+
+	serverTLSConfig = config
+	handler.ConfigureClientTLS(clientConfig)
+	log.Printf("TLS enabled with certificate %v", certFile)
+	return nil
+}
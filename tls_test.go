@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert write a self-signed certificate of commonName and its key, modified at modTime
+func writeCert(t *testing.T, certFile, keyFile, commonName string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	rawCert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: rawCert},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: rawKey},
+	} {
+		if err = os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func commonNameOf(t *testing.T, reloader *certReloader) string {
+	cert, err := reloader.getCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	now := time.Now()
+	writeCert(t, certFile, keyFile, "first", now)
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader.check()
+	if name := commonNameOf(t, reloader); name != "first" {
+		t.Fatalf("expected the first certificate, got %v", name)
+	}
+
+	writeCert(t, certFile, keyFile, "second", now.Add(time.Second))
+	reloader.check()
+	if name := commonNameOf(t, reloader); name != "second" {
+		t.Fatalf("the modified certificate should be reloaded, got %v", name)
+	}
+	clientCert, err := reloader.getClientCertificate(&tls.CertificateRequestInfo{})
+	if err != nil || clientCert != reloader.cert {
+		t.Fatal("the reloaded certificate should be presented as client too")
+	}
+
+	// a broken certificate keeps the previous one
+	if err = os.WriteFile(certFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(certFile, now.Add(2*time.Second), now.Add(2*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	reloader.check()
+	if name := commonNameOf(t, reloader); name != "second" {
+		t.Fatalf("the previous certificate should be kept, got %v", name)
+	}
+}
@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Task id is a snowflake style 64 bits integer
+// | 41 bits milliseconds since idEpoch | 10 bits scheduler node | 12 bits sequence |
+// encoded as 13 chars of Crockford base32, so that ids are unique across restarts and
+// schedulers, and sort by their created time in both string and integer order
+const (
+	nodeBits     = 10
+	sequenceBits = 12
+	maxNode      = 1<<nodeBits - 1
+	maxSequence  = 1<<sequenceBits - 1
+	idLength     = 13
+	idAlphabet   = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+)
+
+// 2023-01-01 00:00:00 UTC
+var idEpoch = time.UnixMilli(1672531200000)
+
+var idLock sync.Mutex
+var lastMilli int64
+var sequence int64
+var nodeID = initNodeID()
+
+// initNodeID read env SCHEDULER_NODE_ID in [0, 1023], see loadNodeID
+func initNodeID() int64 {
+	id, err := loadNodeID()
+	if err != nil {
+		log.Panic(err)
+	}
+	return id
+}
+
+// loadNodeID read env SCHEDULER_NODE_ID in [0, 1023]. Without it a single scheduler derives the id
+// from the host name, which is the pod name in the cluster. The hash of host names may collide, so
+// SCHEDULER_NODE_ID is required when SCHEDULER_REPLICAS is more than 1
+func loadNodeID() (int64, error) {
+	if rawID := os.Getenv("SCHEDULER_NODE_ID"); rawID != "" {
+		id, err := strconv.ParseInt(rawID, 10, 64)
+		if err != nil || id < 0 || id > maxNode {
+			return 0, fmt.Errorf("SCHEDULER_NODE_ID should be in [0, %v], got %v", maxNode, rawID)
+		}
+		return id, nil
+	}
+
+	if rawReplicas := os.Getenv("SCHEDULER_REPLICAS"); rawReplicas != "" {
+		replicas, err := strconv.Atoi(rawReplicas)
+		if err != nil {
+			return 0, fmt.Errorf("invalid SCHEDULER_REPLICAS %v", rawReplicas)
+		}
+		if replicas > 1 {
+			return 0, fmt.Errorf("SCHEDULER_NODE_ID is required with %v replicas, "+
+				"task ids of schedulers with the same id may collide", replicas)
+		}
+	}
+
+	hostName, err := os.Hostname()
+	if err != nil {
+		return 0, err
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(hostName))
+	id := int64(hash.Sum32() % (maxNode + 1))
+	log.Printf("SCHEDULER_NODE_ID is not set, use %v hashed from host name %v, "+
+		"set it if more than one scheduler runs", id, hostName)
+	return id, nil
+}
+
+// GetUniqueID return a new task id
+func GetUniqueID() string {
+	idLock.Lock()
+	milli := time.Since(idEpoch).Milliseconds()
+	// never go back even if the clock does
+	if milli < lastMilli {
+		milli = lastMilli
+	}
+
+	if milli == lastMilli {
+		sequence++
+		if sequence > maxSequence {
+			// borrow the next millisecond
+			milli++
+			sequence = 0
+		}
+	} else {
+		sequence = 0
+	}
+	lastMilli = milli
+
+	id := milli<<(nodeBits+sequenceBits) | nodeID<<sequenceBits | sequence
+	idLock.Unlock()
+
+	return encodeID(uint64(id))
+}
+
+func encodeID(id uint64) string {
+	encoded := make([]byte, idLength)
+	for i := idLength - 1; i >= 0; i-- {
+		encoded[i] = idAlphabet[id&31]
+		id >>= 5
+	}
+	return string(encoded)
+}
+
+// ValidateTaskID check the id is generated by GetUniqueID
+func ValidateTaskID(taskID string) error {
+	if len(taskID) != idLength {
+		return fmt.Errorf("task id %q should have %v chars", taskID, idLength)
+	}
+
+	for i := 0; i < len(taskID); i++ {
+		if strings.IndexByte(idAlphabet, taskID[i]) < 0 {
+			return fmt.Errorf("task id %q has invalid char %q", taskID, taskID[i])
+		}
+	}
+
+	// 13 base32 chars hold 65 bits, the highest char of a 63 bits id is at most 7
+	if taskID[0] > '7' {
+		return fmt.Errorf("task id %q overflow", taskID)
+	}
+
+	return nil
+}
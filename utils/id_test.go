@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestLoadNodeID(t *testing.T) {
+	t.Setenv("SCHEDULER_NODE_ID", "7")
+	t.Setenv("SCHEDULER_REPLICAS", "3")
+	if id, err := loadNodeID(); err != nil || id != 7 {
+		t.Fatalf("expected 7, got %v %v", id, err)
+	}
+
+	t.Setenv("SCHEDULER_NODE_ID", "1024")
+	if _, err := loadNodeID(); err == nil {
+		t.Fatal("an id out of 10 bits should fail")
+	}
+
+	t.Setenv("SCHEDULER_NODE_ID", "")
+	if _, err := loadNodeID(); err == nil {
+		t.Fatal("the id should be required with more than one replica")
+	}
+
+	t.Setenv("SCHEDULER_REPLICAS", "1")
+	first, err := loadNodeID()
+	if err != nil || first < 0 || first > maxNode {
+		t.Fatalf("a single scheduler should hash its host name, got %v %v", first, err)
+	}
+	if second, _ := loadNodeID(); second != first {
+		t.Fatal("the hashed id should be stable")
+	}
+}
+
+func TestGetUniqueID(t *testing.T) {
+	previous := ""
+	for i := 0; i < 10000; i++ {
+		id := GetUniqueID()
+		if err := ValidateTaskID(id); err != nil {
+			t.Fatal(err)
+		}
+		if id <= previous {
+			t.Fatalf("ids should increase, got %v after %v", id, previous)
+		}
+		previous = id
+	}
+}
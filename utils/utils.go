@@ -4,23 +4,9 @@ import (
 	"log"
 	"os"
 	"runtime"
-	"strconv"
-	"sync"
 	"time"
 )
 
-var uniqueID int = 0
-var idLock sync.Mutex
-
-func GetUniqueID() string {
-	var id int
-	idLock.Lock()
-	uniqueID++
-	id = uniqueID
-	idLock.Unlock()
-	return strconv.Itoa(id)
-}
-
 func DebugWithTimeWait(message string) {
 	if os.Getenv("Debug") == "False" {
 		return
@@ -0,0 +1,171 @@
+package worker_pool
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+)
+
+// WorkerInfo is the admin view of a worker
+type WorkerInfo struct {
+	Name      string      `json:"name"`
+	TaskType  string      `json:"task_type"`
+	Node      string      `json:"node"`
+	IP        string      `json:"ip"`
+	Port      string      `json:"port"`
+	PodName   string      `json:"pod_name"`
+	Available bool        `json:"available"`
+	State     WorkerState `json:"state"`
+	Healthy   bool        `json:"healthy"`
+	Cordoned  bool        `json:"cordoned"`
+	Draining  bool        `json:"draining"`
+	TaskID    string      `json:"task_id"`
+	Transport string      `json:"transport"`
+	// SessionAge is filled by the caller, sessions are not known to worker_pool
+	SessionAge        string         `json:"session_age,omitempty"`
+	RecentLatenciesMs []float64      `json:"recent_latencies_ms"`
+	Usage             *ResourceUsage `json:"usage,omitempty"`
+	UsageError        string         `json:"usage_error,omitempty"`
+}
+
+// FindWorkerByName return the worker of the name in any task type
+func FindWorkerByName(name string) (*Worker, bool) {
+	var found *Worker
+	WorkerMap.Range(func(key, value any) bool {
+		if worker, ok := value.(*sync.Map).Load(name); ok {
+			found = worker.(*Worker)
+		}
+		return found == nil
+	})
+	return found, found != nil
+}
+
+// GetWorkerInfos return every worker ordered by task type and name,
+// the resource usage of pods is queried from the metrics server if withUsage
+func GetWorkerInfos(withUsage bool) []WorkerInfo {
+	infos := []WorkerInfo{}
+	workerSelectionLock.Lock()
+	WorkerMap.Range(func(key, value any) bool {
+		value.(*sync.Map).Range(func(key, value any) bool {
+			worker := value.(*Worker)
+			info := WorkerInfo{
+				Name:      worker.wokerName,
+				TaskType:  worker.taskType,
+				Node:      worker.nodeName,
+				IP:        worker.ip,
+				Port:      worker.port,
+				PodName:   worker.podName,
+				Available: worker.isAvailable,
+				State:     worker.state,
+				Healthy:   worker.isHealthy(),
+				Cordoned:  worker.cordoned,
+				Draining:  worker.draining,
+			}
+			if !worker.isAvailable {
+				info.TaskID = worker.taskID
+			}
+			infos = append(infos, info)
+			return true
+		})
+		return true
+	})
+	workerSelectionLock.Unlock()
+
+	for i := range infos {
+		host := net.JoinHostPort(infos[i].IP, infos[i].Port)
+		infos[i].Transport = transportOfHost(host)
+		infos[i].RecentLatenciesMs = RecentLatencies(host)
+		if withUsage && infos[i].PodName != "" {
+			infos[i].Usage, infos[i].UsageError = tryQueryResourceUsage(infos[i].PodName)
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].TaskType != infos[j].TaskType {
+			return infos[i].TaskType < infos[j].TaskType
+		}
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// tryQueryResourceUsage return the error instead of panic when the metrics server is unavailable
+func tryQueryResourceUsage(podName string) (usage *ResourceUsage, usageError string) {
+	defer func() {
+		if err := recover(); err != nil {
+			usage, usageError = nil, fmt.Sprint(err)
+		}
+	}()
+	return QueryResourceUsage(podName), ""
+}
+
+// Cordon stop or resume selecting the worker, a task already on it is not affected
+func (w *Worker) Cordon(cordoned bool) {
+	workerSelectionLock.Lock()
+	w.cordoned = cordoned
+	if !cordoned {
+		dispatchLocked()
+	}
+	workerSelectionLock.Unlock()
+	log.Printf("worker %v cordoned: %v", w.wokerName, cordoned)
+}
+
+// Drain stop selecting the worker and delete it once its task is returned,
+// return true if it is free and deleted now
+func (w *Worker) Drain() bool {
+	workerSelectionLock.Lock()
+	if w.draining {
+		workerSelectionLock.Unlock()
+		return false
+	}
+	w.draining = true
+	w.cordoned = true
+	w.unshareLocked()
+	w.setStateLocked(WorkerDraining)
+	free := w.isAvailable
+	workerSelectionLock.Unlock()
+
+	if free {
+		w.deleteDrained()
+	} else {
+		log.Printf("worker %v will be deleted after task %v", w.wokerName, w.taskID)
+	}
+	return free
+}
+
+// deleteDrained delete the drained worker, a failure is logged instead of crashing the caller
+func (w *Worker) deleteDrained() {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("Delete drained worker %v failed: %v", w.wokerName, err)
+		}
+	}()
+	w.DeleteWorker()
+}
+
+// Delete delete the worker now, refuse if it is running a task.
+// The worker is marked deleted under the same lock as the check, so no task claims it meanwhile
+func (w *Worker) Delete() (err error) {
+	workerSelectionLock.Lock()
+	if !w.isAvailable {
+		taskID := w.taskID
+		workerSelectionLock.Unlock()
+		return fmt.Errorf("worker %v is running task %v, drain it instead", w.wokerName, taskID)
+	}
+	if w.deleted {
+		workerSelectionLock.Unlock()
+		return nil
+	}
+	w.markDeletedLocked()
+	workerSelectionLock.Unlock()
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("delete worker %v failed: %v", w.wokerName, recovered)
+		}
+	}()
+	w.deletePod()
+	return nil
+}
@@ -0,0 +1,153 @@
+package worker_pool
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// podWorkers is readyWorkers with a pod of the same name in a fake cluster
+func podWorkers(t *testing.T, taskType string, names ...string) []*Worker {
+	var pods []runtime.Object
+	for _, name := range names {
+		pods = append(pods, &corev1.Pod{ObjectMeta: meta_v1.ObjectMeta{Name: name, Namespace: WorkerNamespace()}})
+	}
+	podCluster(t, pods...)
+	workers := readyWorkers(t, taskType, "node", names...)
+	for _, worker := range workers {
+		worker.podName = worker.wokerName
+	}
+	return workers
+}
+
+func podExists(t *testing.T, name string) bool {
+	_, err := getCluster().CoreV1().Pods(WorkerNamespace()).Get(context.Background(), name, meta_v1.GetOptions{})
+	return err == nil
+}
+
+// a worker running a task is not deleted, a free one leaves the pool with its pod
+func TestDelete(t *testing.T) {
+	useQueueMode(t, QueueModeEDF)
+	worker := podWorkers(t, "delete-test", "a")[0]
+
+	if _, err := occupyWorker(context.Background(), "delete-test", "task", "node", TaskClass{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.Delete(); err == nil || !strings.Contains(err.Error(), "task") {
+		t.Fatalf("a busy worker should be refused, got %v", err)
+	}
+	if !podExists(t, "a") {
+		t.Fatal("the pod of a busy worker should be kept")
+	}
+
+	worker.ReturnToPool("task")
+	if err := worker.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if podExists(t, "a") || inPool(worker) || worker.GetState() != WorkerDraining {
+		t.Fatal("the deleted worker should leave the pool with its pod")
+	}
+	if err := worker.Delete(); err != nil {
+		t.Fatalf("a deleted worker should be deleted again without error, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := occupyWorker(ctx, "delete-test", "late", "node", TaskClass{}, nil); err == nil {
+		t.Fatal("a deleted worker should not be claimed")
+	}
+}
+
+// a task claiming the worker along Delete either gets it and Delete is refused, or is refused itself
+func TestDeleteRacesWithOccupy(t *testing.T) {
+	useQueueMode(t, QueueModeEDF)
+	for i := 0; i < 20; i++ {
+		taskType := fmt.Sprintf("delete-race-%v", i)
+		worker := podWorkers(t, taskType, fmt.Sprintf("race-%v", i))[0]
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		claimed := make(chan *Worker, 1)
+		go func() {
+			claimer, _ := occupyWorker(ctx, taskType, "task", "node", TaskClass{}, nil)
+			claimed <- claimer
+		}()
+		deleteErr := worker.Delete()
+		claimer := <-claimed
+		cancel()
+
+		if (deleteErr == nil) == (claimer != nil) {
+			t.Fatalf("either the task or Delete should win, got %v and %v", claimer, deleteErr)
+		}
+		if claimer != nil && !podExists(t, worker.podName) {
+			t.Fatal("the pod of the claimed worker should be kept")
+		}
+	}
+}
+
+// a drained worker is deleted once its task is returned
+func TestDrain(t *testing.T) {
+	useQueueMode(t, QueueModeEDF)
+	worker := podWorkers(t, "drain-worker-test", "a")[0]
+
+	if _, err := occupyWorker(context.Background(), "drain-worker-test", "task", "node", TaskClass{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if worker.Drain() {
+		t.Fatal("a busy worker should not be deleted at once")
+	}
+	if worker.Drain() {
+		t.Fatal("a draining worker should not be drained again")
+	}
+	infos := GetWorkerInfos(false)
+	var info WorkerInfo
+	for _, candidate := range infos {
+		if candidate.Name == "a" && candidate.TaskType == "drain-worker-test" {
+			info = candidate
+		}
+	}
+	if !info.Draining || !info.Cordoned || info.TaskID != "task" {
+		t.Fatalf("the info should show the draining worker and its task, got %+v", info)
+	}
+
+	worker.ReturnToPool("task")
+	for deadline := time.Now().Add(2 * time.Second); podExists(t, "a"); {
+		if time.Now().After(deadline) {
+			t.Fatal("the drained worker should be deleted once its task is returned")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// a cordoned worker is not selected until it is resumed
+func TestCordon(t *testing.T) {
+	useQueueMode(t, QueueModeEDF)
+	worker := readyWorkers(t, "cordon-test", "node", "a")[0]
+
+	worker.Cordon(true)
+	if CountAvailable("cordon-test") != 0 {
+		t.Fatal("a cordoned worker should not be available")
+	}
+	done := occupyAsync(context.Background(), "cordon-test", "task", TaskClass{})
+	select {
+	case err := <-done:
+		t.Fatalf("a cordoned worker should not be selected, got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	worker.Cordon(false)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the waiter should get the resumed worker")
+	}
+	worker.ReturnToPool("task")
+}
@@ -0,0 +1,236 @@
+package worker_pool
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// WorkerClientConfig tune the connections of the scheduler to workers.
+// Each worker is a host with its own pool of kept-alive connections, so a frame reuses
+// a warm connection instead of dialing. Durations are in milliseconds, 0 is no limit
+type WorkerClientConfig struct {
+	MaxIdleConnsPerHost     int `json:"max_idle_conns_per_host"`
+	MaxConnsPerHost         int `json:"max_conns_per_host"`
+	IdleConnTimeoutMs       int `json:"idle_conn_timeout_ms"`
+	DialTimeoutMs           int `json:"dial_timeout_ms"`
+	KeepAliveMs             int `json:"keep_alive_ms"`
+	ResponseHeaderTimeoutMs int `json:"response_header_timeout_ms"`
+	// RequestTimeoutMs limits a whole request including the upload of the frame or video
+	RequestTimeoutMs int `json:"request_timeout_ms"`
+}
+
+var DefaultWorkerClientConfig = WorkerClientConfig{
+	MaxIdleConnsPerHost:     16,
+	MaxConnsPerHost:         0,
+	IdleConnTimeoutMs:       90 * 1000,
+	DialTimeoutMs:           3 * 1000,
+	KeepAliveMs:             30 * 1000,
+	ResponseHeaderTimeoutMs: 10 * 1000,
+	RequestTimeoutMs:        2 * 60 * 1000,
+}
+
+// ConnMetrics counts requests and connections to a worker since the scheduler started
+type ConnMetrics struct {
+	Worker       string  `json:"worker"`
+	Host         string  `json:"host"`
+	Transport    string  `json:"transport"`
+	Requests     int64   `json:"requests"`
+	Errors       int64   `json:"errors"`
+	NewConns     int64   `json:"new_conns"`
+	ReusedConns  int64   `json:"reused_conns"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+	MaxLatencyMs float64 `json:"max_latency_ms"`
+
+	totalLatency time.Duration
+	maxLatency   time.Duration
+	// latencies of the last recentLatencySize requests, oldest first
+	recent []time.Duration
+}
+
+const recentLatencySize = 20
+
+// all guarded by workerClientLock
+var workerClientConfig = DefaultWorkerClientConfig
+var workerTLSConfig *tls.Config
+
+var connMetricsLock = sync.Mutex{}
+
+// map from host of a worker to its *ConnMetrics
+var connMetrics = map[string]*ConnMetrics{}
+
+func init() {
+	workerClient = newWorkerClient(workerClientConfig, nil)
+}
+
+func millis(ms int) time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
+
+func newWorkerClient(config WorkerClientConfig, tlsConfig *tls.Config) *http.Client {
+	return &http.Client{
+		Transport: &metricsTransport{
+			next: &routeTransport{fallback: &httpTransport{newHTTPTransport(config, tlsConfig)}},
+		},
+		Timeout: millis(config.RequestTimeoutMs),
+	}
+}
+
+func newHTTPTransport(config WorkerClientConfig, tlsConfig *tls.Config) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   millis(config.DialTimeoutMs),
+		KeepAlive: millis(config.KeepAliveMs),
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   10 * time.Second,
+		MaxIdleConns:          0,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       config.MaxConnsPerHost,
+		IdleConnTimeout:       millis(config.IdleConnTimeoutMs),
+		ResponseHeaderTimeout: millis(config.ResponseHeaderTimeoutMs),
+		ExpectContinueTimeout: time.Second,
+		// frames are already compressed images
+		DisableCompression: true,
+	}
+}
+
+// SetWorkerClientConfig replace the client of worker traffic, idle connections of
+// the previous client are closed and requests in flight are not interrupted
+func SetWorkerClientConfig(config WorkerClientConfig) {
+	workerClientLock.Lock()
+	previous := workerClient
+	workerClientConfig = config
+	workerClient = newWorkerClient(config, workerTLSConfig)
+	workerClientLock.Unlock()
+
+	previous.CloseIdleConnections()
+}
+
+// LoadWorkerClientFromEnv override the default config by the json of WORKER_CLIENT_CONFIG,
+// fields not in the json keep their defaults
+func LoadWorkerClientFromEnv() error {
+	rawConfig := os.Getenv("WORKER_CLIENT_CONFIG")
+	if rawConfig == "" {
+		return nil
+	}
+	config := DefaultWorkerClientConfig
+	if err := json.Unmarshal([]byte(rawConfig), &config); err != nil {
+		return err
+	}
+	SetWorkerClientConfig(config)
+	return nil
+}
+
+func GetWorkerClientConfig() WorkerClientConfig {
+	workerClientLock.RLock()
+	defer workerClientLock.RUnlock()
+	return workerClientConfig
+}
+
+// metricsTransport record the connection and latency of each request by its host
+type metricsTransport struct {
+	next http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	reused := false
+	gotConn := false
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			gotConn = true
+			reused = info.Reused
+		},
+	}
+	request = request.WithContext(httptrace.WithClientTrace(request.Context(), trace))
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(request)
+	latency := time.Since(start)
+
+	connMetricsLock.Lock()
+	metrics, ok := connMetrics[request.URL.Host]
+	if !ok {
+		metrics = &ConnMetrics{Host: request.URL.Host}
+		connMetrics[request.URL.Host] = metrics
+	}
+	metrics.Requests++
+	if err != nil {
+		metrics.Errors++
+	}
+	if gotConn {
+		if reused {
+			metrics.ReusedConns++
+		} else {
+			metrics.NewConns++
+		}
+	}
+	metrics.totalLatency += latency
+	if latency > metrics.maxLatency {
+		metrics.maxLatency = latency
+	}
+	metrics.recent = append(metrics.recent, latency)
+	if len(metrics.recent) > recentLatencySize {
+		metrics.recent = metrics.recent[len(metrics.recent)-recentLatencySize:]
+	}
+	connMetricsLock.Unlock()
+
+	return resp, err
+}
+
+// GetConnMetrics return the metrics of every worker host ordered by worker name,
+// the latency is until the response header is received
+func GetConnMetrics() []ConnMetrics {
+	workerNames := map[string]string{}
+	WorkerMap.Range(func(key, value any) bool {
+		value.(*sync.Map).Range(func(key, value any) bool {
+			worker := value.(*Worker)
+			workerNames[net.JoinHostPort(worker.ip, worker.port)] = worker.GetWorkerName()
+			return true
+		})
+		return true
+	})
+
+	connMetricsLock.Lock()
+	metrics := []ConnMetrics{}
+	for host, hostMetrics := range connMetrics {
+		view := *hostMetrics
+		view.Worker = workerNames[host]
+		view.Transport = transportOfHost(host)
+		if view.Requests != 0 {
+			view.AvgLatencyMs = float64(view.totalLatency.Microseconds()) / 1000 / float64(view.Requests)
+		}
+		view.MaxLatencyMs = float64(view.maxLatency.Microseconds()) / 1000
+		metrics = append(metrics, view)
+	}
+	connMetricsLock.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].Worker != metrics[j].Worker {
+			return metrics[i].Worker < metrics[j].Worker
+		}
+		return metrics[i].Host < metrics[j].Host
+	})
+	return metrics
+}
+
+// RecentLatencies return the latencies in milliseconds of the last requests to the host, oldest first
+func RecentLatencies(host string) []float64 {
+	connMetricsLock.Lock()
+	defer connMetricsLock.Unlock()
+	latencies := []float64{}
+	if metrics, ok := connMetrics[host]; ok {
+		for _, latency := range metrics.recent {
+			latencies = append(latencies, float64(latency.Microseconds())/1000)
+		}
+	}
+	return latencies
+}
@@ -0,0 +1,80 @@
+package worker_pool
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// benchmarkFrame is the size of a typical jpeg frame
+var benchmarkFrame = bytes.Repeat([]byte{0xab}, 200*1024)
+
+// BenchmarkWorkerClient post a frame to a worker the ways the scheduler did before the
+// shared client and with WorkerClient, new_conns/op is the connections dialed per frame
+func BenchmarkWorkerClient(b *testing.B) {
+	var accepted int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		_, _ = w.Write([]byte("ok"))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&accepted, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	cases := []struct {
+		name string
+		post func() (*http.Response, error)
+		// the old http.Post left the body open, so its connection was never reused
+		drain bool
+	}{
+		{
+			name: "http_post_body_open",
+			post: func() (*http.Response, error) {
+				return http.Post(server.URL, "application/octet-stream", bytes.NewReader(benchmarkFrame))
+			},
+		},
+		{
+			name: "per_request_client",
+			post: func() (*http.Response, error) {
+				client := &http.Client{Transport: &http.Transport{}}
+				defer client.CloseIdleConnections()
+				return client.Post(server.URL, "application/octet-stream", bytes.NewReader(benchmarkFrame))
+			},
+			drain: true,
+		},
+		{
+			name: "worker_client",
+			post: func() (*http.Response, error) {
+				return WorkerClient().Post(server.URL, "application/octet-stream", bytes.NewReader(benchmarkFrame))
+			},
+			drain: true,
+		},
+	}
+
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(benchmarkFrame)))
+			start := atomic.LoadInt64(&accepted)
+			for i := 0; i < b.N; i++ {
+				resp, err := c.post()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if c.drain {
+					_, _ = io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(&accepted)-start)/float64(b.N), "new_conns/op")
+		})
+	}
+}
@@ -0,0 +1,350 @@
+package worker_pool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// hamiNodeRegister is the node annotation where HAMi registers the gpus of the node,
+	// "uuid,count,memory,cores,type,numa,health" separated by ":"
+	hamiNodeRegister = "hami.io/node-nvidia-register"
+	// hamiPodAllocated is the pod annotation where HAMi records the gpus given to the pod,
+	// "uuid,type,memory,cores" separated by ":" for devices and ";" for containers
+	hamiPodAllocated = "hami.io/vgpu-devices-allocated"
+	// gpuUUIDAnnotation pin a pod to a gpu chosen by the scheduler
+	gpuUUIDAnnotation = "nvidia.com/use-gpuuuid"
+)
+
+// GPUDevice is a physical gpu of a node shared by vGPU workers,
+// Cores is in percent of the gpu and Memory is in MB
+type GPUDevice struct {
+	Node   string `json:"node"`
+	UUID   string `json:"uuid"`
+	Index  int    `json:"index"`
+	Cores  int64  `json:"cores"`
+	Memory int64  `json:"memory"`
+}
+
+// GPUShare is the partition of a gpu held by a pod
+type GPUShare struct {
+	Pod    string `json:"pod"`
+	UUID   string `json:"uuid"`
+	Cores  int64  `json:"cores"`
+	Memory int64  `json:"memory"`
+}
+
+// GPUAllocation is a row of the allocation table
+type GPUAllocation struct {
+	GPUDevice
+	AllocatedCores  int64      `json:"allocated_cores"`
+	AllocatedMemory int64      `json:"allocated_memory"`
+	FreeCores       int64      `json:"free_cores"`
+	FreeMemory      int64      `json:"free_memory"`
+	Shares          []GPUShare `json:"shares"`
+}
+
+var gpuLock = sync.Mutex{}
+
+// map from node name to its gpus
+var gpuDevices = map[string][]*GPUDevice{}
+
+// map from pod name to its *GPUShare
+var gpuShares = map[string]*GPUShare{}
+
+var gpuSynced = false
+
+// parseHAMiDevices parse the gpus registered by HAMi in the node annotation
+func parseHAMiDevices(node, annotation string) []*GPUDevice {
+	var devices []*GPUDevice
+	for _, entry := range strings.Split(annotation, ":") {
+		fields := strings.Split(entry, ",")
+		if len(fields) < 4 || fields[0] == "" {
+			continue
+		}
+		memory, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		cores, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			continue
+		}
+		devices = append(devices, &GPUDevice{
+			Node: node, UUID: fields[0], Index: len(devices), Cores: cores, Memory: memory,
+		})
+	}
+	return devices
+}
+
+// parseHAMiShares parse the gpus given to a pod by HAMi
+func parseHAMiShares(pod, annotation string) []*GPUShare {
+	var shares []*GPUShare
+	for _, container := range strings.Split(annotation, ";") {
+		for _, entry := range strings.Split(container, ":") {
+			fields := strings.Split(entry, ",")
+			if len(fields) < 4 || fields[0] == "" {
+				continue
+			}
+			memory, _ := strconv.ParseInt(fields[2], 10, 64)
+			cores, _ := strconv.ParseInt(fields[3], 10, 64)
+			shares = append(shares, &GPUShare{Pod: pod, UUID: fields[0], Cores: cores, Memory: memory})
+		}
+	}
+	return shares
+}
+
+// gpuInventory is the gpus of nodes not registered by HAMi, set by the json of GPU_INVENTORY,
+// e.g. {"gpu1": [{"uuid": "GPU-0", "cores": 100, "memory": 24576}]}
+func gpuInventory() (map[string][]*GPUDevice, error) {
+	inventory := map[string][]*GPUDevice{}
+	if rawInventory := os.Getenv("GPU_INVENTORY"); rawInventory != "" {
+		if err := json.Unmarshal([]byte(rawInventory), &inventory); err != nil {
+			return nil, err
+		}
+	}
+	return inventory, nil
+}
+
+// SyncGPUs rebuild the gpus of every node and the shares of living pods from the cluster.
+// A node without HAMi registration uses GPU_INVENTORY, or one gpu of NODE_GPU_CAPACITY
+func SyncGPUs() error {
+	client := getCluster()
+	nodes, err := client.CoreV1().Nodes().List(context.Background(), meta_v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	pods, err := client.CoreV1().Pods("").List(context.Background(), meta_v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	inventory, err := gpuInventory()
+	if err != nil {
+		return err
+	}
+
+	clusterLock.Lock()
+	capacities := gpuCapacities
+	clusterLock.Unlock()
+
+	devices := map[string][]*GPUDevice{}
+	for _, node := range nodes.Items {
+		var nodeDevices []*GPUDevice
+		if annotation, ok := node.Annotations[hamiNodeRegister]; ok {
+			nodeDevices = parseHAMiDevices(node.Name, annotation)
+		} else if configured, ok := inventory[node.Name]; ok {
+			for i, device := range configured {
+				device.Node, device.Index = node.Name, i
+				if device.UUID == "" {
+					device.UUID = fmt.Sprintf("%v-gpu%v", node.Name, i)
+				}
+			}
+			nodeDevices = configured
+		} else if capacity, ok := capacities[node.Name]; ok && capacity.GPUCores != 0 {
+			nodeDevices = []*GPUDevice{{
+				Node: node.Name, UUID: node.Name + "-gpu0", Cores: capacity.GPUCores, Memory: capacity.GPUMemory,
+			}}
+		}
+		if len(nodeDevices) != 0 {
+			devices[node.Name] = nodeDevices
+		}
+	}
+
+	shares := map[string]*GPUShare{}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		if annotation, ok := pod.Annotations[hamiPodAllocated]; ok {
+			// a pod of this scheduler holds one gpu
+			if podShares := parseHAMiShares(pod.Name, annotation); len(podShares) != 0 {
+				shares[pod.Name] = podShares[0]
+				continue
+			}
+		}
+		if uuid, ok := pod.Annotations[gpuUUIDAnnotation]; ok {
+			demand := Resources{}
+			for _, container := range pod.Spec.Containers {
+				demand = demand.add(containerResources(container.Resources))
+			}
+			shares[pod.Name] = &GPUShare{Pod: pod.Name, UUID: uuid, Cores: demand.GPUCores, Memory: demand.GPUMemory}
+		}
+	}
+
+	gpuLock.Lock()
+	gpuDevices = devices
+	gpuShares = shares
+	gpuSynced = true
+	gpuLock.Unlock()
+	return nil
+}
+
+// syncGPUsOnce sync from the cluster before the first allocation
+func syncGPUsOnce() {
+	gpuLock.Lock()
+	synced := gpuSynced
+	gpuLock.Unlock()
+	if synced {
+		return
+	}
+	if err := SyncGPUs(); err != nil {
+		log.Printf("sync gpus failed: %v", err)
+	}
+}
+
+// usageLocked is the cores and memory of the gpu held by shares, except the share of the pod
+func usageLocked(uuid, exceptPod string) (int64, int64) {
+	var cores, memory int64
+	for pod, share := range gpuShares {
+		if share.UUID == uuid && pod != exceptPod {
+			cores += share.Cores
+			memory += share.Memory
+		}
+	}
+	return cores, memory
+}
+
+// AllocateGPU reserve cores and memory of a gpu in the node for the pod. The gpu is the best fit,
+// the one left with the least free after the share, so whole gpus are kept free for big workers.
+// Return nil without error if the gpus of the node are unknown
+func AllocateGPU(node, pod string, cores, memory int64) (*GPUDevice, error) {
+	syncGPUsOnce()
+
+	gpuLock.Lock()
+	defer gpuLock.Unlock()
+
+	devices, ok := gpuDevices[node]
+	if !ok {
+		return nil, nil
+	}
+
+	freeCores, freeMemory := freeLocked(devices, pod)
+	best := bestFit(devices, freeCores, freeMemory, cores, memory)
+	if best == -1 {
+		return nil, fmt.Errorf("no gpu of %v has %v cores and %vMB free", node, cores, memory)
+	}
+
+	gpuShares[pod] = &GPUShare{Pod: pod, UUID: devices[best].UUID, Cores: cores, Memory: memory}
+	device := *devices[best]
+	return &device, nil
+}
+
+// freeLocked is the free cores and memory of each gpu, not counting the share of exceptPod
+func freeLocked(devices []*GPUDevice, exceptPod string) ([]int64, []int64) {
+	freeCores, freeMemory := make([]int64, len(devices)), make([]int64, len(devices))
+	for i, device := range devices {
+		usedCores, usedMemory := usageLocked(device.UUID, exceptPod)
+		freeCores[i], freeMemory[i] = device.Cores-usedCores, device.Memory-usedMemory
+	}
+	return freeCores, freeMemory
+}
+
+// bestFit return the index of the gpu left with the least free after the share, measured by
+// the larger of the fractions of cores and memory left, or -1 if no gpu fits
+func bestFit(devices []*GPUDevice, freeCores, freeMemory []int64, cores, memory int64) int {
+	best := -1
+	bestLeft := 0.0
+	for i, device := range devices {
+		if cores > freeCores[i] || memory > freeMemory[i] {
+			continue
+		}
+		left := 0.0
+		if device.Cores != 0 {
+			left = float64(freeCores[i]-cores) / float64(device.Cores)
+		}
+		if device.Memory != 0 {
+			if memoryLeft := float64(freeMemory[i]-memory) / float64(device.Memory); memoryLeft > left {
+				left = memoryLeft
+			}
+		}
+		if best == -1 || left < bestLeft {
+			best, bestLeft = i, left
+		}
+	}
+	return best
+}
+
+// ReleaseGPU free the share of the pod
+func ReleaseGPU(pod string) {
+	gpuLock.Lock()
+	delete(gpuShares, pod)
+	gpuLock.Unlock()
+}
+
+// GetGPUAllocations return the allocation table of every gpu ordered by node and index,
+// shares on unknown gpus are listed under a row of the uuid
+func GetGPUAllocations() []GPUAllocation {
+	syncGPUsOnce()
+
+	gpuLock.Lock()
+	defer gpuLock.Unlock()
+
+	rows := map[string]*GPUAllocation{}
+	for _, devices := range gpuDevices {
+		for _, device := range devices {
+			rows[device.UUID] = &GPUAllocation{GPUDevice: *device, Shares: []GPUShare{}}
+		}
+	}
+	for _, share := range gpuShares {
+		row, ok := rows[share.UUID]
+		if !ok {
+			row = &GPUAllocation{GPUDevice: GPUDevice{UUID: share.UUID}, Shares: []GPUShare{}}
+			rows[share.UUID] = row
+		}
+		row.AllocatedCores += share.Cores
+		row.AllocatedMemory += share.Memory
+		row.Shares = append(row.Shares, *share)
+	}
+
+	table := []GPUAllocation{}
+	for _, row := range rows {
+		row.FreeCores = row.Cores - row.AllocatedCores
+		row.FreeMemory = row.Memory - row.AllocatedMemory
+		sort.Slice(row.Shares, func(i, j int) bool {
+			return row.Shares[i].Pod < row.Shares[j].Pod
+		})
+		table = append(table, *row)
+	}
+	sort.Slice(table, func(i, j int) bool {
+		if table[i].Node != table[j].Node {
+			return table[i].Node < table[j].Node
+		}
+		return table[i].Index < table[j].Index
+	})
+	return table
+}
+
+// fitGPUs tell whether count shares of cores and memory can all be placed in the gpus of the node,
+// by the same best fit as AllocateGPU. Nodes with unknown gpus always fit
+func fitGPUs(node string, count int, cores, memory int64) error {
+	syncGPUsOnce()
+
+	gpuLock.Lock()
+	defer gpuLock.Unlock()
+
+	devices, ok := gpuDevices[node]
+	if !ok {
+		return nil
+	}
+	freeCores, freeMemory := freeLocked(devices, "")
+	for placed := 0; placed < count; placed++ {
+		best := bestFit(devices, freeCores, freeMemory, cores, memory)
+		if best == -1 {
+			return fmt.Errorf("only %v of %v gpu shares of %v cores and %vMB fit in the gpus of %v",
+				placed, count, cores, memory, node)
+		}
+		freeCores[best] -= cores
+		freeMemory[best] -= memory
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package worker_pool
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// gpuCluster is a fake cluster with gpu1 of two HAMi gpus, GPU-A holding 60 cores of a pod,
+// and gpu2 of one gpu from GPU_INVENTORY
+func gpuCluster(t *testing.T) {
+	t.Setenv("GPU_INVENTORY", `{"gpu2": [{"cores": 100, "memory": 8000}]}`)
+	SetClusterClient(fake.NewSimpleClientset(
+		&corev1.Node{ObjectMeta: meta_v1.ObjectMeta{
+			Name: "gpu1",
+			Annotations: map[string]string{
+				hamiNodeRegister: "GPU-A,10,16000,100,NVIDIA,0,true:GPU-B,10,16000,100,NVIDIA,0,true:",
+			},
+		}},
+		&corev1.Node{ObjectMeta: meta_v1.ObjectMeta{Name: "gpu2"}},
+		&corev1.Pod{
+			ObjectMeta: meta_v1.ObjectMeta{
+				Name:        "held",
+				Namespace:   "default",
+				Annotations: map[string]string{hamiPodAllocated: "GPU-A,NVIDIA,4000,60:;"},
+			},
+			Status: corev1.PodStatus{Phase: corev1.PodRunning},
+		},
+		&corev1.Pod{
+			ObjectMeta: meta_v1.ObjectMeta{
+				Name:        "finished",
+				Namespace:   "default",
+				Annotations: map[string]string{hamiPodAllocated: "GPU-B,NVIDIA,4000,60:;"},
+			},
+			Status: corev1.PodStatus{Phase: corev1.PodSucceeded},
+		},
+	))
+	t.Cleanup(func() {
+		SetClusterClient(nil)
+		gpuLock.Lock()
+		gpuDevices, gpuShares, gpuSynced = map[string][]*GPUDevice{}, map[string]*GPUShare{}, false
+		gpuLock.Unlock()
+	})
+	if err := SyncGPUs(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseHAMiDevices(t *testing.T) {
+	devices := parseHAMiDevices("gpu1", "GPU-A,10,16000,100,NVIDIA,0,true:bad:GPU-B,10,x,100,NVIDIA,0,true:")
+	if len(devices) != 1 {
+		t.Fatalf("expected 1 valid device, got %v", len(devices))
+	}
+	if device := devices[0]; device.UUID != "GPU-A" || device.Memory != 16000 || device.Cores != 100 || device.Node != "gpu1" {
+		t.Fatalf("unexpected device %+v", *device)
+	}
+}
+
+func TestParseHAMiShares(t *testing.T) {
+	shares := parseHAMiShares("pod", "GPU-A,NVIDIA,4000,30:;GPU-B,NVIDIA,2000,10:;")
+	if len(shares) != 2 || shares[0].UUID != "GPU-A" || shares[0].Cores != 30 || shares[1].Memory != 2000 {
+		t.Fatalf("unexpected shares %+v", shares)
+	}
+}
+
+func TestSyncGPUs(t *testing.T) {
+	gpuCluster(t)
+
+	table := GetGPUAllocations()
+	if len(table) != 3 {
+		t.Fatalf("expected 3 gpus, got %+v", table)
+	}
+	if table[0].UUID != "GPU-A" || table[0].FreeCores != 40 || len(table[0].Shares) != 1 {
+		t.Fatalf("GPU-A should be held by a running pod, got %+v", table[0])
+	}
+	if table[1].UUID != "GPU-B" || table[1].FreeCores != 100 {
+		t.Fatalf("a finished pod should not hold GPU-B, got %+v", table[1])
+	}
+	if table[2].UUID != "gpu2-gpu0" || table[2].Memory != 8000 {
+		t.Fatalf("gpu2 should come from GPU_INVENTORY, got %+v", table[2])
+	}
+}
+
+func TestAllocateGPUBestFit(t *testing.T) {
+	gpuCluster(t)
+
+	// GPU-A has 40 cores left, the tighter fit
+	device, err := AllocateGPU("gpu1", "small", 30, 1000)
+	if err != nil || device.UUID != "GPU-A" {
+		t.Fatalf("expected GPU-A, got %+v %v", device, err)
+	}
+	// only GPU-B is left with 50 cores
+	if device, err = AllocateGPU("gpu1", "medium", 50, 1000); err != nil || device.UUID != "GPU-B" {
+		t.Fatalf("expected GPU-B, got %+v %v", device, err)
+	}
+	if _, err = AllocateGPU("gpu1", "large", 60, 1000); err == nil {
+		t.Fatal("60 cores should not fit")
+	}
+
+	ReleaseGPU("medium")
+	if device, err = AllocateGPU("gpu1", "large", 60, 1000); err != nil || device.UUID != "GPU-B" {
+		t.Fatalf("expected GPU-B after release, got %+v %v", device, err)
+	}
+
+	if device, err = AllocateGPU("cpu-only", "pod", 10, 10); device != nil || err != nil {
+		t.Fatalf("a node without gpus should be skipped, got %+v %v", device, err)
+	}
+}
+
+func TestAllocateGPUMemoryFit(t *testing.T) {
+	gpuCluster(t)
+
+	// GPU-A is left with 40% of cores and no memory, GPU-B with 100% of cores
+	device, err := AllocateGPU("gpu1", "heavy", 0, 12000)
+	if err != nil || device.UUID != "GPU-A" {
+		t.Fatalf("expected GPU-A, got %+v %v", device, err)
+	}
+	// GPU-A has cores left but no memory
+	if device, err = AllocateGPU("gpu1", "light", 10, 1000); err != nil || device.UUID != "GPU-B" {
+		t.Fatalf("expected GPU-B, got %+v %v", device, err)
+	}
+}
+
+// fitGPUs should accept exactly the shares AllocateGPU can place one by one
+func TestFitGPUsMatchAllocateGPU(t *testing.T) {
+	cases := []struct {
+		cores, memory int64
+	}{
+		{20, 1000}, {30, 6000}, {40, 1000}, {10, 9000},
+	}
+	for _, c := range cases {
+		gpuCluster(t)
+		placed := 0
+		for ; placed < 10; placed++ {
+			if _, err := AllocateGPU("gpu1", "pod"+string(rune('a'+placed)), c.cores, c.memory); err != nil {
+				break
+			}
+		}
+		gpuLock.Lock()
+		for pod := range gpuShares {
+			if pod != "held" {
+				delete(gpuShares, pod)
+			}
+		}
+		gpuLock.Unlock()
+
+		if err := fitGPUs("gpu1", placed, c.cores, c.memory); err != nil {
+			t.Fatalf("%v shares of %+v were allocated but do not fit: %v", placed, c, err)
+		}
+		if err := fitGPUs("gpu1", placed+1, c.cores, c.memory); err == nil {
+			t.Fatalf("%v shares of %+v fit but only %v were allocated", placed+1, c, placed)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package worker_pool
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// circuit breaker of workers
+// a worker fails FailureThreshold times in a row is unhealthy and will not be selected
+// for UnhealthyCooldown, after that it can be selected again, and a single failure trips it again.
+// Both are guarded by workerSelectionLock, see LoadHealthFromEnv
+var FailureThreshold = 3
+var UnhealthyCooldown = 1 * time.Minute
+
+// LoadHealthFromEnv load WORKER_FAILURE_THRESHOLD and WORKER_UNHEALTHY_COOLDOWN as a duration
+func LoadHealthFromEnv() error {
+	threshold, cooldown := FailureThreshold, UnhealthyCooldown
+	if rawThreshold := os.Getenv("WORKER_FAILURE_THRESHOLD"); rawThreshold != "" {
+		parsed, err := strconv.Atoi(rawThreshold)
+		if err != nil {
+			return err
+		}
+		if parsed <= 0 {
+			return fmt.Errorf("WORKER_FAILURE_THRESHOLD should be positive")
+		}
+		threshold = parsed
+	}
+	if rawCooldown := os.Getenv("WORKER_UNHEALTHY_COOLDOWN"); rawCooldown != "" {
+		parsed, err := time.ParseDuration(rawCooldown)
+		if err != nil {
+			return err
+		}
+		if parsed < 0 {
+			return fmt.Errorf("WORKER_UNHEALTHY_COOLDOWN should not be negative")
+		}
+		cooldown = parsed
+	}
+
+	workerSelectionLock.Lock()
+	FailureThreshold, UnhealthyCooldown = threshold, cooldown
+	workerSelectionLock.Unlock()
+	return nil
+}
+
+// ReportFailure record a failed dispatch or a missing callback of the worker
+func (w *Worker) ReportFailure() {
+	workerSelectionLock.Lock()
+	w.failures++
+	if w.failures >= FailureThreshold {
+		w.unhealthyUntil = time.Now().Add(UnhealthyCooldown)
+		log.Printf("worker %v failed %v times, mark unhealthy until %v",
+			w.wokerName, w.failures, w.unhealthyUntil)
+		// waiters get the worker once it can be selected again
+		time.AfterFunc(UnhealthyCooldown, wakeWaiters)
+	}
+	workerSelectionLock.Unlock()
+}
+
+// ReportSuccess reset the failure count of the worker
+func (w *Worker) ReportSuccess() {
+	workerSelectionLock.Lock()
+	w.failures = 0
+	if !w.unhealthyUntil.IsZero() {
+		w.unhealthyUntil = time.Time{}
+		dispatchLocked()
+	}
+	workerSelectionLock.Unlock()
+}
+
+// isHealthy should be called with workerSelectionLock held
+func (w *Worker) isHealthy() bool {
+	return time.Now().After(w.unhealthyUntil)
+}
+
+// ReplaceWorker return the failed worker of taskID to pool and queue for another worker of the
+// same task type in its node, with the class and tenant the task was given its worker. The caller
+// should reset the task in the old worker first. It never gets the old worker back.
+// It gives up with ErrDeadlineExceeded at the deadline of ctx, or the deadline of the class if earlier,
+// and with the error of ctx if it is canceled
+func ReplaceWorker(ctx context.Context, old *Worker, taskID string) (*Worker, error) {
+	workerSelectionLock.Lock()
+	class := taskClasses[taskID]
+	workerSelectionLock.Unlock()
+	queued := class
+	if deadline, ok := ctx.Deadline(); ok && (queued.Deadline.IsZero() || deadline.Before(queued.Deadline)) {
+		queued.Deadline = deadline
+	}
+
+	// the task leaves the quota of its tenant until it gets the next worker
+	old.ReturnToPool(taskID)
+
+	worker, err := occupyWorker(ctx, old.taskType, taskID, old.nodeName, queued, old)
+	if err != nil {
+		return nil, err
+	}
+	// the deadline of the replacement does not bind the next one
+	workerSelectionLock.Lock()
+	if bound, ok := taskIDWorkerMap.Load(taskID); ok && bound == worker {
+		taskClasses[taskID] = class
+	}
+	workerSelectionLock.Unlock()
+	log.Printf("task %v moved from worker %v to %v", taskID, old.wokerName, worker.wokerName)
+	return worker, nil
+}
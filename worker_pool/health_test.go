@@ -0,0 +1,122 @@
+package worker_pool
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// readyWorkers store ready workers of a task type only used by the test in the node
+func readyWorkers(t *testing.T, taskType, nodeName string, names ...string) []*Worker {
+	var workers []*Worker
+	rawPool, _ := WorkerMap.LoadOrStore(taskType, &sync.Map{})
+	for _, name := range names {
+		worker := &Worker{taskType: taskType, nodeName: nodeName, wokerName: name, isAvailable: true, state: WorkerReady}
+		rawPool.(*sync.Map).Store(name, worker)
+		workers = append(workers, worker)
+	}
+	t.Cleanup(func() {
+		WorkerMap.Delete(taskType)
+		for _, worker := range workers {
+			taskIDWorkerMap.Delete(worker.taskID)
+		}
+	})
+	return workers
+}
+
+func TestReportFailure(t *testing.T) {
+	previousThreshold, previousCooldown := FailureThreshold, UnhealthyCooldown
+	t.Cleanup(func() { FailureThreshold, UnhealthyCooldown = previousThreshold, previousCooldown })
+	FailureThreshold, UnhealthyCooldown = 2, time.Hour
+
+	worker := &Worker{}
+	worker.ReportFailure()
+	if !worker.isHealthy() {
+		t.Fatal("a single failure should not trip the worker")
+	}
+	worker.ReportFailure()
+	if worker.isHealthy() {
+		t.Fatal("the worker should be unhealthy after FailureThreshold failures")
+	}
+	worker.ReportSuccess()
+	if !worker.isHealthy() || worker.failures != 0 {
+		t.Fatal("a success should reset the worker")
+	}
+}
+
+func TestLoadHealthFromEnv(t *testing.T) {
+	previousThreshold, previousCooldown := FailureThreshold, UnhealthyCooldown
+	t.Cleanup(func() { FailureThreshold, UnhealthyCooldown = previousThreshold, previousCooldown })
+
+	t.Setenv("WORKER_FAILURE_THRESHOLD", "5")
+	t.Setenv("WORKER_UNHEALTHY_COOLDOWN", "30s")
+	if err := LoadHealthFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if FailureThreshold != 5 || UnhealthyCooldown != 30*time.Second {
+		t.Fatalf("unexpected health settings %v %v", FailureThreshold, UnhealthyCooldown)
+	}
+
+	t.Setenv("WORKER_FAILURE_THRESHOLD", "0")
+	if err := LoadHealthFromEnv(); err == nil {
+		t.Fatal("a threshold of 0 should fail")
+	}
+	t.Setenv("WORKER_FAILURE_THRESHOLD", "")
+	t.Setenv("WORKER_UNHEALTHY_COOLDOWN", "soon")
+	if err := LoadHealthFromEnv(); err == nil {
+		t.Fatal("an invalid cooldown should fail")
+	}
+}
+
+func TestReplaceWorkerKeepsClass(t *testing.T) {
+	useQueueMode(t, QueueModeEDF)
+	useTenants(t, []*TenantConfig{{ID: "shop", Quotas: map[string]int{"replace-test": 1}}})
+	workers := readyWorkers(t, "replace-test", "node", "a", "b")
+
+	class := TaskClass{Priority: PriorityHigh, Tenant: "shop"}
+	old, err := occupyWorker(context.Background(), "replace-test", "task", "node", class, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the quota of the tenant is held by the task, the replacement should not take a second worker
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	replaced, err := ReplaceWorker(ctx, old, "task")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced == old {
+		t.Fatal("the failed worker should not be given back")
+	}
+	workerSelectionLock.Lock()
+	replacedClass := taskClasses["task"]
+	workerSelectionLock.Unlock()
+	if replacedClass != class {
+		t.Fatalf("the replacement should keep the class, got %+v", replacedClass)
+	}
+	if worker, ok := LookupWorker("task"); !ok || worker != replaced {
+		t.Fatal("the task should be bound to the replacement")
+	}
+	workerSelectionLock.Lock()
+	inUse := tenantStateLocked("shop").inUse["replace-test"]
+	oldFree := old.isAvailable
+	workerSelectionLock.Unlock()
+	if inUse != 1 || !oldFree {
+		t.Fatalf("expected the old worker free and one worker held by the tenant, got %v %v", oldFree, inUse)
+	}
+
+	// with no other worker the replacement waits until the deadline
+	workerSelectionLock.Lock()
+	workers[0].cordoned, workers[1].cordoned = true, true
+	workerSelectionLock.Unlock()
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err = ReplaceWorker(ctx, replaced, "task"); err != ErrDeadlineExceeded {
+		t.Fatalf("expected %v, got %v", ErrDeadlineExceeded, err)
+	}
+	if _, ok := LookupWorker("task"); ok {
+		t.Fatal("a task without replacement should not be bound")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strconv"
 	"sync"
 	"time"
 
@@ -89,35 +90,21 @@ func GetClientSet() *kubernetes.Clientset {
 }
 
 func CreateWorker(taskName, nodeName, hostname,
-	cpuLimit, memLimit, gpuLimit, gpuMemory string) *Worker {
-	// create the Kubernetes client
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		log.Panic(err)
-	}
-	clientSet, err := kubernetes.NewForConfig(config)
+	cpuLimit, memLimit, gpuLimit, gpuMemory string) (*Worker, error) {
+	clientSet := getCluster()
+
+	worker, err := addWorker(hostname, taskName, nodeName)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
-
-	worker := addWorker(hostname, taskName, nodeName)
 	name := worker.GetWorkerName()
 	worker.podName = name
 
 	// define the container
 	container := corev1.Container{
-		Name:  name,
-		Image: containerMap[taskName],
-		Resources: corev1.ResourceRequirements{
-			Limits: corev1.ResourceList{
-				corev1.ResourceCPU:    resource.MustParse(cpuLimit),
-				corev1.ResourceMemory: resource.MustParse(memLimit),
-			},
-			Requests: corev1.ResourceList{
-				corev1.ResourceCPU:    resource.MustParse("0"),
-				corev1.ResourceMemory: resource.MustParse("0"),
-			},
-		},
+		Name:      name,
+		Image:     containerMap[taskName],
+		Resources: workerResources(cpuLimit, memLimit, gpuLimit, gpuMemory),
 		Env: []corev1.EnvVar{
 			{
 				Name:  "task_name",
@@ -127,19 +114,34 @@ func CreateWorker(taskName, nodeName, hostname,
 				Name:  "port",
 				Value: worker.port,
 			},
+			{
+				// the worker serves https if the scheduler connects to it over tls
+				Name:  "scheme",
+				Value: WorkerScheme(),
+			},
 			{
 				Name:  "GPU_CORE_UTILIZATION_POLICY",
 				Value: "force",
 			},
+			{
+				// required by /worker_register to change the transport, see transport.go
+				Name:  "register_token",
+				Value: worker.registerToken,
+			},
+			{
+				Name:  "socket_path",
+				Value: SocketPathOf(worker),
+			},
+			{
+				Name:  "shm_path",
+				Value: ShmPathOf(worker),
+			},
 		},
 	}
 	utils.DebugWithTimeWait(fmt.Sprintf("Must Parse is [%v]", resource.MustParse(cpuLimit)))
 	utils.DebugWithTimeWait(fmt.Sprintf("GPULIMIT is %v, cpu %v, mem %v", gpuLimit, cpuLimit, memLimit))
 	if gpuLimit != "0" {
 		log.Printf("Enable #%v gpu", gpuLimit)
-		container.Resources.Limits["nvidia.com/gpucores"] = resource.MustParse(gpuLimit)
-		container.Resources.Limits["nvidia.com/gpu"] = resource.MustParse("1")
-		container.Resources.Limits["nvidia.com/gpumem"] = resource.MustParse(gpuMemory)
 	}
 
 	utils.DebugWithTimeWait(fmt.Sprintf("Set GPU Limit completed\n container info is %v", container))
@@ -176,6 +178,20 @@ func CreateWorker(taskName, nodeName, hostname,
 	}
 
 	if gpuLimit != "0" {
+		cores, _ := strconv.ParseInt(gpuLimit, 10, 64)
+		memory, _ := strconv.ParseInt(gpuMemory, 10, 64)
+		device, err := AllocateGPU(nodeName, name, cores, memory)
+		if err != nil {
+			abandonWorker(worker, false)
+			return nil, err
+		}
+		// pin the pod to the gpu chosen by the best fit, instead of the first one with room
+		if device != nil {
+			pod.Annotations = map[string]string{gpuUUIDAnnotation: device.UUID}
+			pod.Spec.NodeSelector = map[string]string{"kubernetes.io/hostname": nodeName}
+			log.Printf("Pod %v is placed in gpu %v of %v", name, device.UUID, nodeName)
+		}
+
 		toleration := corev1.Toleration{
 			Key:      "nvidia.com/gpu",
 			Operator: corev1.TolerationOpExists,
@@ -185,11 +201,18 @@ func CreateWorker(taskName, nodeName, hostname,
 		pod.Spec.Tolerations = []corev1.Toleration{toleration}
 	}
 
+	pod, err = applyPodTemplate(pod, worker)
+	if err != nil {
+		abandonWorker(worker, false)
+		return nil, err
+	}
+
 	// create the pod
 	utils.DebugWithTimeWait("Before Created")
-	result, err := clientSet.CoreV1().Pods("default").Create(context.Background(), pod, meta_v1.CreateOptions{})
+	result, err := clientSet.CoreV1().Pods(WorkerNamespace()).Create(context.Background(), pod, meta_v1.CreateOptions{})
 	if err != nil {
-		log.Panic(err)
+		abandonWorker(worker, false)
+		return nil, err
 	}
 
 	utils.DebugWithTimeWait("PodCreated")
@@ -198,7 +221,7 @@ func CreateWorker(taskName, nodeName, hostname,
 
 	// wait until pod created
 	err = wait.PollImmediate(500*time.Millisecond, 2*time.Minute, func() (bool, error) {
-		podFound, err := clientSet.CoreV1().Pods("default").Get(context.Background(),
+		podFound, err := clientSet.CoreV1().Pods(WorkerNamespace()).Get(context.Background(),
 			pod.Name, meta_v1.GetOptions{})
 
 		utils.DebugWithTimeWait(fmt.Sprintf("podFound is %v", podFound))
@@ -212,37 +235,96 @@ func CreateWorker(taskName, nodeName, hostname,
 		return false, nil
 	})
 	if err != nil {
-		log.Panic(err)
+		abandonWorker(worker, true)
+		return nil, fmt.Errorf("pod %v is not running: %v", name, err)
 	}
 	utils.DebugWithTimeWait("PodCreated Waiting End")
 
 	log.Printf("Pod Created!")
-	return worker
+	// the worker is selected once the model inside is up, not when the pod runs
+	go worker.awaitReady()
+	return worker, nil
+}
+
+// abandonWorker undo a worker whose pod failed to be created or to run. It leaves the pool,
+// its pod is deleted if created, and its port lease and gpu share are released
+func abandonWorker(w *Worker, podCreated bool) {
+	workerSelectionLock.Lock()
+	w.deleted = true
+	w.setStateLocked(WorkerFailed)
+	if rawPool, ok := WorkerMap.Load(w.taskType); ok {
+		rawPool.(*sync.Map).Delete(w.wokerName)
+	}
+	workerSelectionLock.Unlock()
+
+	if podCreated {
+		err := getCluster().CoreV1().Pods(WorkerNamespace()).Delete(context.Background(),
+			w.podName, meta_v1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			log.Printf("delete pod %v of the failed worker failed: %v", w.podName, err)
+		}
+	}
+	removeWorkerTransport(w)
+	ReleaseGPU(w.podName)
+	releasePort(w.ip, w.port)
+	log.Printf("worker %v is abandoned", w.wokerName)
+}
+
+// workerResources is the resources of the worker container, the limits are requested too
+// so kubernetes and the resource model account for them
+func workerResources(cpuLimit, memLimit, gpuLimit, gpuMemory string) corev1.ResourceRequirements {
+	requirements := corev1.ResourceRequirements{
+		Limits: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse(cpuLimit),
+			corev1.ResourceMemory: resource.MustParse(memLimit),
+		},
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse(cpuLimit),
+			corev1.ResourceMemory: resource.MustParse(memLimit),
+		},
+	}
+	if gpuLimit != "0" {
+		requirements.Limits[resourceGPUCores] = resource.MustParse(gpuLimit)
+		requirements.Limits["nvidia.com/gpu"] = resource.MustParse("1")
+		requirements.Limits[resourceGPUMemory] = resource.MustParse(gpuMemory)
+	}
+	return requirements
 }
 
+// UpdateResourceLimit set the cpu limit and request of the worker container to mcpu millicores
 func (w *Worker) UpdateResourceLimit(mcpu int64) {
-	clientSet = GetClientSet()
+	clientSet := getCluster()
 
-	pod, err := clientSet.CoreV1().Pods("default").Get(context.Background(), w.podName, meta_v1.GetOptions{})
+	pod, err := clientSet.CoreV1().Pods(WorkerNamespace()).Get(context.Background(), w.podName, meta_v1.GetOptions{})
 	if err != nil {
 		log.Panic(err)
 	}
 
+	cpu := *resource.NewMilliQuantity(mcpu, resource.DecimalSI)
 	for i, container := range pod.Spec.Containers {
 		if container.Name == w.podName {
 			log.Printf("Find container %v", container.Name)
-			pod.Spec.Containers[i].Resources.Limits.Cpu().SetMilli(mcpu)
+			// Cpu() returns a copy, the quantity is written back to the lists
+			resources := &pod.Spec.Containers[i].Resources
+			if resources.Limits == nil {
+				resources.Limits = corev1.ResourceList{}
+			}
+			if resources.Requests == nil {
+				resources.Requests = corev1.ResourceList{}
+			}
+			resources.Limits[corev1.ResourceCPU] = cpu
+			resources.Requests[corev1.ResourceCPU] = cpu
 		}
 	}
 
-	_, err = clientSet.CoreV1().Pods("default").Update(context.Background(), pod, meta_v1.UpdateOptions{})
+	_, err = clientSet.CoreV1().Pods(WorkerNamespace()).Update(context.Background(), pod, meta_v1.UpdateOptions{})
 	if err != nil {
 		log.Panic(err)
 	}
 
 	// wait until pod updated
 	err = wait.PollImmediate(500*time.Millisecond, 2*time.Minute, func() (bool, error) {
-		podFound, err := clientSet.CoreV1().Pods("default").Get(context.Background(),
+		podFound, err := clientSet.CoreV1().Pods(WorkerNamespace()).Get(context.Background(),
 			pod.Name, meta_v1.GetOptions{})
 		if err != nil {
 			log.Panic(err)
@@ -286,7 +368,7 @@ func QueryResourceUsage(podName string) *ResourceUsage {
 	if err != nil {
 		log.Panic(err)
 	}
-	metricsInterface := metricsClient.MetricsV1beta1().PodMetricses("default")
+	metricsInterface := metricsClient.MetricsV1beta1().PodMetricses(WorkerNamespace())
 
 	podMetrics, err := metricsInterface.Get(context.Background(), podName, meta_v1.GetOptions{})
 	if errors.IsNotFound(err) {
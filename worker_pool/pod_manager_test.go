@@ -0,0 +1,113 @@
+package worker_pool
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// usePorts give hosts 3 ports from 20000 without probing, leases are saved to a temporary file
+func usePorts(t *testing.T) string {
+	stateFile := filepath.Join(t.TempDir(), "ports.json")
+	portLock.Lock()
+	portConfig = PortConfig{Ranges: map[string]PortRange{"default": {Min: 20000, Max: 20002}}, StateFile: stateFile}
+	portLeases, restoredLeases = map[string]map[int]string{}, map[string]map[int]bool{}
+	portLock.Unlock()
+	t.Cleanup(func() {
+		portLock.Lock()
+		portConfig = DefaultPortConfig
+		portLeases, restoredLeases = map[string]map[int]string{}, map[string]map[int]bool{}
+		portLock.Unlock()
+	})
+	return stateFile
+}
+
+// a worker failed to be created gives back its port and gpu share, and leaves the pool
+func TestCreateWorkerFailureReleases(t *testing.T) {
+	t.Setenv("Debug", "False")
+	usePorts(t)
+	gpuCluster(t)
+	// the pod name of the first worker is taken, so the pod creation fails
+	if _, err := getCluster().CoreV1().Pods(WorkerNamespace()).Create(context.Background(),
+		&corev1.Pod{ObjectMeta: meta_v1.ObjectMeta{Name: "det-20000-gpu1", Namespace: WorkerNamespace()}},
+		meta_v1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { WorkerMap.Delete("det") })
+
+	if _, err := CreateWorker("det", "gpu1", "10.0.0.1", "100m", "0", "30", "1000"); err == nil {
+		t.Fatal("the pod creation should fail")
+	}
+	if _, leases := GetPortLeases(); len(leases) != 0 {
+		t.Fatalf("the port should be released, got %+v", leases)
+	}
+	gpuLock.Lock()
+	_, held := gpuShares["det-20000-gpu1"]
+	gpuLock.Unlock()
+	if held {
+		t.Fatal("the gpu share should be released")
+	}
+	if rawPool, ok := WorkerMap.Load("det"); ok {
+		rawPool.(*sync.Map).Range(func(key, value any) bool {
+			t.Fatalf("the failed worker %v should leave the pool", key)
+			return false
+		})
+	}
+
+	// a share which does not fit fails before the pod is created
+	if _, err := CreateWorker("det", "gpu1", "10.0.0.1", "100m", "0", "200", "1000"); err == nil {
+		t.Fatal("200 gpu cores should not fit")
+	}
+	if _, leases := GetPortLeases(); len(leases) != 0 {
+		t.Fatalf("the port should be released, got %+v", leases)
+	}
+}
+
+// the demand of a worker is the resources of the container it is created with
+func TestWorkerDemand(t *testing.T) {
+	cpuLimits, gpuLimits, gpuMemorys := map[string]int{"gpu1": 500}, map[string]int{"gpu1": 30}, map[string]int{"gpu1": 1000}
+	demand := WorkerDemand(cpuLimits, gpuLimits, gpuMemorys, "gpu1")
+	if demand != (Resources{CPU: 500, GPUCores: 30, GPUMemory: 1000}) {
+		t.Fatalf("unexpected demand %+v", demand)
+	}
+	if spec := containerResources(workerResources("500m", "256Mi", "0", "0")); spec.Memory != 256<<20 || spec.CPU != 500 {
+		t.Fatalf("the memory of the container should be counted, got %+v", spec)
+	}
+	if demand = WorkerDemand(cpuLimits, gpuLimits, gpuMemorys, "as1"); demand != (Resources{}) {
+		t.Fatalf("a node without limits demands nothing, got %+v", demand)
+	}
+}
+
+// the new cpu limit is written back to the pod, and requested as well
+func TestUpdateResourceLimit(t *testing.T) {
+	worker := &Worker{podName: "fusion-20000-as1"}
+	pod := &corev1.Pod{
+		ObjectMeta: meta_v1.ObjectMeta{Name: worker.podName, Namespace: WorkerNamespace()},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: worker.podName, Resources: workerResources("100m", "0", "0", "0")},
+			{Name: "sidecar"},
+		}},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	SetClusterClient(fake.NewSimpleClientset(pod))
+	t.Cleanup(func() { SetClusterClient(nil) })
+
+	worker.UpdateResourceLimit(300)
+	updated, err := getCluster().CoreV1().Pods(WorkerNamespace()).Get(context.Background(), worker.podName,
+		meta_v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resources := updated.Spec.Containers[0].Resources
+	if resources.Limits.Cpu().MilliValue() != 300 || resources.Requests.Cpu().MilliValue() != 300 {
+		t.Fatalf("expected a cpu limit and request of 300m, got %v %v", resources.Limits.Cpu(), resources.Requests.Cpu())
+	}
+	if sidecar := updated.Spec.Containers[1].Resources; len(sidecar.Limits) != 0 || len(sidecar.Requests) != 0 {
+		t.Fatalf("the sidecar should be left alone, got %+v", sidecar)
+	}
+}
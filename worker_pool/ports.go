@@ -0,0 +1,274 @@
+package worker_pool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// PortRange is the ports given to workers of a host, both ends included
+type PortRange struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+// PortConfig is how ports of workers are allocated. Workers use the host network,
+// so a port is skipped if a pod of the host already uses it or, with Probe, if it accepts connections.
+// Ranges are keyed by host ip, "default" applies to the rest. Leases are saved to StateFile
+// so pods left by a previous run of the scheduler keep their ports
+type PortConfig struct {
+	Ranges    map[string]PortRange `json:"ranges"`
+	Probe     bool                 `json:"probe"`
+	StateFile string               `json:"state_file"`
+}
+
+var DefaultPortConfig = PortConfig{
+	Ranges:    map[string]PortRange{"default": {Min: 20000, Max: 29999}},
+	Probe:     true,
+	StateFile: "worker_ports.json",
+}
+
+// PortLease is a port of a host held by a worker
+type PortLease struct {
+	Host   string `json:"host"`
+	Port   int    `json:"port"`
+	Worker string `json:"worker"`
+}
+
+// probeTimeout is how long a port is dialed, no answer in time is taken as free
+const probeTimeout = 200 * time.Millisecond
+
+var portLock = sync.Mutex{}
+
+// all guarded by portLock
+var portConfig = DefaultPortConfig
+
+// map from host to port to the name of the worker holding it
+var portLeases = map[string]map[int]string{}
+
+// leases restored from the state file, checked against pods before the host allocates
+var restoredLeases = map[string]map[int]bool{}
+
+// LoadPortsFromEnv override the default config by the json of WORKER_PORTS,
+// and restore the leases of the state file
+func LoadPortsFromEnv() error {
+	config := DefaultPortConfig
+	// a range of the json replaces the default one, not the map of DefaultPortConfig
+	config.Ranges = map[string]PortRange{}
+	if rawConfig := os.Getenv("WORKER_PORTS"); rawConfig != "" {
+		if err := json.Unmarshal([]byte(rawConfig), &config); err != nil {
+			return err
+		}
+	}
+	for host, portRange := range config.Ranges {
+		if portRange.Min <= 0 || portRange.Max > 65535 || portRange.Min > portRange.Max {
+			return fmt.Errorf("invalid port range %v-%v of %v", portRange.Min, portRange.Max, host)
+		}
+	}
+	if _, ok := config.Ranges["default"]; !ok {
+		config.Ranges["default"] = DefaultPortConfig.Ranges["default"]
+	}
+
+	leases := map[string]map[int]string{}
+	restored := map[string]map[int]bool{}
+	if config.StateFile != "" {
+		rawLeases, err := os.ReadFile(config.StateFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			var saved []PortLease
+			if err = json.Unmarshal(rawLeases, &saved); err != nil {
+				return err
+			}
+			for _, lease := range saved {
+				if leases[lease.Host] == nil {
+					leases[lease.Host] = map[int]string{}
+					restored[lease.Host] = map[int]bool{}
+				}
+				leases[lease.Host][lease.Port] = lease.Worker
+				restored[lease.Host][lease.Port] = true
+			}
+			log.Printf("restored %v port leases from %v", len(saved), config.StateFile)
+		}
+	}
+
+	portLock.Lock()
+	portConfig = config
+	portLeases = leases
+	restoredLeases = restored
+	portLock.Unlock()
+	return nil
+}
+
+func workerName(taskType, port, nodeName string) string {
+	return fmt.Sprintf("%v-%v-%v", taskType, port, nodeName)
+}
+
+// allocatePort lease the lowest free port of the host to the worker of taskType in the node
+func allocatePort(host, taskType, nodeName string) (string, error) {
+	podPorts, listed := portsOfPods(host)
+
+	portLock.Lock()
+	defer portLock.Unlock()
+
+	leases := portLeases[host]
+	if leases == nil {
+		leases = map[int]string{}
+		portLeases[host] = leases
+	}
+	if listed {
+		dropStaleLeasesLocked(host, podPorts)
+	}
+
+	portRange, ok := portConfig.Ranges[host]
+	if !ok {
+		portRange = portConfig.Ranges["default"]
+	}
+	for port := portRange.Min; port <= portRange.Max; port++ {
+		if _, ok := leases[port]; ok {
+			continue
+		}
+		if pod, ok := podPorts[port]; ok {
+			log.Printf("port %v of %v is used by pod %v, skip it", port, host, pod)
+			continue
+		}
+		if portConfig.Probe && portInUse(host, port) {
+			log.Printf("port %v of %v accepts connections, skip it", port, host)
+			continue
+		}
+
+		rawPort := strconv.Itoa(port)
+		leases[port] = workerName(taskType, rawPort, nodeName)
+		saveLeasesLocked()
+		return rawPort, nil
+	}
+	return "", fmt.Errorf("no free port of %v in %v-%v", host, portRange.Min, portRange.Max)
+}
+
+// releasePort return the port of a deleted worker, it is given to the next worker of the host
+func releasePort(host, rawPort string) {
+	port, err := strconv.Atoi(rawPort)
+	if err != nil {
+		return
+	}
+	portLock.Lock()
+	delete(portLeases[host], port)
+	delete(restoredLeases[host], port)
+	saveLeasesLocked()
+	portLock.Unlock()
+}
+
+// dropStaleLeasesLocked free the leases restored from a previous run whose pods are gone,
+// leases of workers of this run are kept even before their pods are created
+func dropStaleLeasesLocked(host string, podPorts map[int]string) {
+	for port := range restoredLeases[host] {
+		if _, ok := podPorts[port]; ok {
+			continue
+		}
+		log.Printf("port %v of %v held by %v is free, its pod is gone", port, host, portLeases[host][port])
+		delete(portLeases[host], port)
+		delete(restoredLeases[host], port)
+	}
+}
+
+// portsOfPods return the ports used by host network pods of the host, from the port env of workers
+// and the container ports of other pods. Return false if pods can not be listed
+func portsOfPods(host string) (map[int]string, bool) {
+	nodeNames := map[string]bool{}
+	for _, info := range PodsInfo {
+		if info.HostName == host {
+			nodeNames[info.NodeName] = true
+		}
+	}
+
+	pods, err := getCluster().CoreV1().Pods("").List(context.Background(), meta_v1.ListOptions{})
+	if err != nil {
+		log.Printf("list pods for ports of %v failed: %v", host, err)
+		return nil, false
+	}
+
+	ports := map[int]string{}
+	for _, pod := range pods.Items {
+		if !pod.Spec.HostNetwork || (pod.Status.HostIP != host && !nodeNames[pod.Spec.NodeName]) {
+			continue
+		}
+		for _, container := range pod.Spec.Containers {
+			for _, env := range container.Env {
+				if env.Name != "port" {
+					continue
+				}
+				if port, err := strconv.Atoi(env.Value); err == nil {
+					ports[port] = pod.Name
+				}
+			}
+			for _, containerPort := range container.Ports {
+				ports[int(containerPort.ContainerPort)] = pod.Name
+			}
+		}
+	}
+	return ports, true
+}
+
+func portInUse(host string, port int) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), probeTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// saveLeasesLocked write the leases to the state file, should be called with portLock held
+func saveLeasesLocked() {
+	if portConfig.StateFile == "" {
+		return
+	}
+	marshal, err := json.Marshal(leasesLocked())
+	if err != nil {
+		log.Panic(err)
+	}
+	tmpFile := portConfig.StateFile + ".tmp"
+	if err = os.WriteFile(tmpFile, marshal, 0644); err == nil {
+		err = os.Rename(tmpFile, portConfig.StateFile)
+	}
+	if err != nil {
+		log.Printf("save port leases to %v failed: %v", portConfig.StateFile, err)
+	}
+}
+
+func leasesLocked() []PortLease {
+	leases := []PortLease{}
+	for host, hostLeases := range portLeases {
+		for port, worker := range hostLeases {
+			leases = append(leases, PortLease{Host: host, Port: port, Worker: worker})
+		}
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		if leases[i].Host != leases[j].Host {
+			return leases[i].Host < leases[j].Host
+		}
+		return leases[i].Port < leases[j].Port
+	})
+	return leases
+}
+
+// GetPortLeases return the port ranges and the leased ports of every host
+func GetPortLeases() (map[string]PortRange, []PortLease) {
+	portLock.Lock()
+	defer portLock.Unlock()
+	ranges := map[string]PortRange{}
+	for host, portRange := range portConfig.Ranges {
+		ranges[host] = portRange
+	}
+	return ranges, leasesLocked()
+}
@@ -0,0 +1,83 @@
+package worker_pool
+
+import (
+	"os"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// podCluster is a fake cluster of the pods
+func podCluster(t *testing.T, pods ...runtime.Object) {
+	SetClusterClient(fake.NewSimpleClientset(pods...))
+	t.Cleanup(func() { SetClusterClient(nil) })
+}
+
+// hostPod is a host network pod of the host using port by the env of workers
+func hostPod(name, host, port string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: meta_v1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: corev1.PodSpec{
+			HostNetwork: true,
+			Containers:  []corev1.Container{{Name: name, Env: []corev1.EnvVar{{Name: "port", Value: port}}}},
+		},
+		Status: corev1.PodStatus{HostIP: host},
+	}
+}
+
+func TestAllocatePort(t *testing.T) {
+	usePorts(t)
+	podCluster(t, hostPod("other", "10.0.0.1", "20000"))
+
+	port, err := allocatePort("10.0.0.1", "det", "node")
+	if err != nil || port != "20001" {
+		t.Fatalf("the port of a pod should be skipped, got %v %v", port, err)
+	}
+	if port, err = allocatePort("10.0.0.1", "det", "node"); err != nil || port != "20002" {
+		t.Fatalf("expected 20002, got %v %v", port, err)
+	}
+	if _, err = allocatePort("10.0.0.1", "det", "node"); err == nil {
+		t.Fatal("the range should be exhausted")
+	}
+	// another host has its own ports
+	if port, err = allocatePort("10.0.0.2", "det", "node"); err != nil || port != "20000" {
+		t.Fatalf("expected 20000 of another host, got %v %v", port, err)
+	}
+
+	releasePort("10.0.0.1", "20001")
+	if port, err = allocatePort("10.0.0.1", "slam", "node"); err != nil || port != "20001" {
+		t.Fatalf("a released port should be given again, got %v %v", port, err)
+	}
+	_, leases := GetPortLeases()
+	if len(leases) != 3 || leases[0].Worker != "slam-20001-node" {
+		t.Fatalf("unexpected leases %+v", leases)
+	}
+}
+
+func TestLoadPortsRestoresLeases(t *testing.T) {
+	stateFile := usePorts(t)
+	podCluster(t, hostPod("det-20000-node", "10.0.0.1", "20000"))
+	saved := `[{"host": "10.0.0.1", "port": 20000, "worker": "det-20000-node"},` +
+		`{"host": "10.0.0.1", "port": 20001, "worker": "det-20001-node"}]`
+	if err := os.WriteFile(stateFile, []byte(saved), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("WORKER_PORTS", `{"ranges": {"10.0.0.1": {"min": 20000, "max": 20001}}, "probe": false, "state_file": "`+stateFile+`"}`)
+	if err := LoadPortsFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the pod of 20001 is gone, its lease is dropped, the pod of 20000 keeps its port
+	port, err := allocatePort("10.0.0.1", "det", "node")
+	if err != nil || port != "20001" {
+		t.Fatalf("expected the stale lease 20001, got %v %v", port, err)
+	}
+
+	t.Setenv("WORKER_PORTS", `{"ranges": {"default": {"min": 30000, "max": 20000}}}`)
+	if err = LoadPortsFromEnv(); err == nil {
+		t.Fatal("an invalid range should fail")
+	}
+}
@@ -0,0 +1,484 @@
+package worker_pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Priority is the class of a task waiting for a worker, a higher one is served first.
+// The zero value is PriorityNormal
+type Priority int
+
+const (
+	PriorityLow Priority = iota - 1
+	PriorityNormal
+	PriorityHigh
+	PriorityCritical
+)
+
+var priorityNames = []string{"low", "normal", "high", "critical"}
+
+func (p Priority) String() string {
+	if p < PriorityLow || p > PriorityCritical {
+		return fmt.Sprintf("priority(%d)", int(p))
+	}
+	return priorityNames[p-PriorityLow]
+}
+
+// ParsePriority parse the name of a priority class, an empty name is normal
+func ParsePriority(name string) (Priority, error) {
+	if name == "" {
+		return PriorityNormal, nil
+	}
+	for i, priorityName := range priorityNames {
+		if priorityName == name {
+			return Priority(i) + PriorityLow, nil
+		}
+	}
+	return PriorityNormal, fmt.Errorf("unknown priority %v", name)
+}
+
+// TaskClass is the priority, the optional deadline and the tenant of a task to get a worker
+type TaskClass struct {
+	Priority Priority
+	Deadline time.Time
+	Tenant   string
+}
+
+var (
+	ErrPreempted        = errors.New("preempted by a task of higher priority")
+	ErrDeadlineExceeded = errors.New("no worker available before the deadline")
+	ErrNoWorkerPool     = errors.New("no worker pool")
+)
+
+const (
+	QueueModeEDF      = "edf"
+	QueueModePriority = "priority"
+)
+
+// QueueMode is how pending tasks are ordered, both serve the highest priority first.
+// QueueModeEDF serves the earliest deadline first within a priority, tasks without deadline follow.
+// QueueModePriority ignores deadlines, a task is raised by one class every AgingInterval it waits
+// so low priority work is not starved.
+// The queue settings are guarded by workerSelectionLock, see LoadQueueFromEnv
+var QueueMode = QueueModeEDF
+
+var AgingInterval = 10 * time.Second
+
+// MaxQueueLength is the max number of tasks waiting for workers of a task type in a node,
+// a task of higher priority preempts the lowest queued one when the queue is full
+var MaxQueueLength = 64
+
+// LoadQueueFromEnv load QUEUE_MODE, QUEUE_AGING_INTERVAL as a duration and MAX_QUEUE_LENGTH
+func LoadQueueFromEnv() error {
+	mode, agingInterval, maxLength := QueueMode, AgingInterval, MaxQueueLength
+	if rawMode := os.Getenv("QUEUE_MODE"); rawMode != "" {
+		if rawMode != QueueModeEDF && rawMode != QueueModePriority {
+			return fmt.Errorf("unknown queue mode %v", rawMode)
+		}
+		mode = rawMode
+	}
+	if rawInterval := os.Getenv("QUEUE_AGING_INTERVAL"); rawInterval != "" {
+		interval, err := time.ParseDuration(rawInterval)
+		if err != nil {
+			return err
+		}
+		agingInterval = interval
+	}
+	if rawLength := os.Getenv("MAX_QUEUE_LENGTH"); rawLength != "" {
+		length, err := strconv.Atoi(rawLength)
+		if err != nil {
+			return err
+		}
+		if length <= 0 {
+			return fmt.Errorf("MAX_QUEUE_LENGTH should be positive")
+		}
+		maxLength = length
+	}
+
+	workerSelectionLock.Lock()
+	QueueMode, AgingInterval, MaxQueueLength = mode, agingInterval, maxLength
+	workerSelectionLock.Unlock()
+	return nil
+}
+
+type waiter struct {
+	taskType   string
+	taskID     string
+	nodeName   string
+	class      TaskClass
+	enqueuedAt time.Time
+	seq        uint64
+	// the failed worker a replacement should not get back
+	exclude *Worker
+
+	// receive the worker from dispatchLocked, or closed with err set when removed from the queue
+	ready chan *Worker
+	err   error
+}
+
+// PriorityMetrics counts tasks of a priority class that waited for workers
+type PriorityMetrics struct {
+	Enqueued       int64  `json:"enqueued"`
+	Served         int64  `json:"served"`
+	Preempted      int64  `json:"preempted"`
+	DeadlineMisses int64  `json:"deadline_misses"`
+	TotalWait      string `json:"total_wait"`
+
+	totalWait time.Duration
+}
+
+// PendingTask is the json view of a queued task
+type PendingTask struct {
+	TaskType string `json:"task_type"`
+	TaskID   string `json:"task_id"`
+	NodeName string `json:"node_name"`
+	Priority string `json:"priority"`
+	Tenant   string `json:"tenant"`
+	Deadline string `json:"deadline,omitempty"`
+	Waited   string `json:"waited"`
+}
+
+type QueueMetrics struct {
+	Mode       string                     `json:"mode"`
+	Priorities map[string]PriorityMetrics `json:"priorities"`
+	Pending    []PendingTask              `json:"pending"`
+}
+
+// pendingQueue is guarded by workerSelectionLock
+var pendingQueue []*waiter
+var waiterSeq uint64 = 0
+
+// queueRefusal is the error of tasks to be queued while the queue refuses them, see RefuseQueue
+var queueRefusal error
+
+var queueMetrics = map[Priority]*PriorityMetrics{}
+
+func metricsOfLocked(priority Priority) *PriorityMetrics {
+	metrics, ok := queueMetrics[priority]
+	if !ok {
+		metrics = &PriorityMetrics{}
+		queueMetrics[priority] = metrics
+	}
+	return metrics
+}
+
+// effectivePriority is the priority raised by aging in QueueModePriority
+func (w *waiter) effectivePriority(now time.Time) Priority {
+	if QueueMode != QueueModePriority || AgingInterval <= 0 {
+		return w.class.Priority
+	}
+	return w.class.Priority + Priority(now.Sub(w.enqueuedAt)/AgingInterval)
+}
+
+// before tell whether w is served before other
+func (w *waiter) before(other *waiter, now time.Time) bool {
+	if priority, otherPriority := w.effectivePriority(now), other.effectivePriority(now); priority != otherPriority {
+		return priority > otherPriority
+	}
+	if QueueMode == QueueModeEDF {
+		hasDeadline, otherHasDeadline := !w.class.Deadline.IsZero(), !other.class.Deadline.IsZero()
+		if hasDeadline != otherHasDeadline {
+			return hasDeadline
+		}
+		if hasDeadline && !w.class.Deadline.Equal(other.class.Deadline) {
+			return w.class.Deadline.Before(other.class.Deadline)
+		}
+	}
+	if w.class.Tenant != other.class.Tenant {
+		share, otherShare := tenantShareLocked(w.class.Tenant), tenantShareLocked(other.class.Tenant)
+		if share != otherShare {
+			return share < otherShare
+		}
+	}
+	return w.seq < other.seq
+}
+
+// dispatchLocked hand available workers to pending tasks in the queue order, and drop
+// tasks whose deadline has passed. Tasks of a tenant at its quota keep waiting.
+// The best task is chosen again after each assignment, since the share of its tenant changed.
+// It should be called with workerSelectionLock held whenever a worker may become available
+func dispatchLocked() {
+	now := time.Now()
+
+	remaining := pendingQueue[:0]
+	for _, w := range pendingQueue {
+		if !w.class.Deadline.IsZero() && now.After(w.class.Deadline) {
+			metricsOfLocked(w.class.Priority).DeadlineMisses++
+			w.err = ErrDeadlineExceeded
+			close(w.ready)
+			log.Printf("task %v of %v missed its deadline while waiting for a worker", w.taskID, w.taskType)
+			continue
+		}
+		remaining = append(remaining, w)
+	}
+	for i := len(remaining); i < len(pendingQueue); i++ {
+		pendingQueue[i] = nil
+	}
+	pendingQueue = remaining
+
+	for {
+		var best *waiter
+		var bestWorker *Worker
+		for _, w := range pendingQueue {
+			if overQuotaLocked(w.class.Tenant, w.taskType) {
+				continue
+			}
+			if best != nil && !w.before(best, now) {
+				continue
+			}
+			if worker := findAvailableLocked(w.taskType, w.nodeName, w.exclude); worker != nil {
+				best, bestWorker = w, worker
+			}
+		}
+
+		if best == nil {
+			return
+		}
+
+		removeLocked(best)
+		bestWorker.isAvailable = false
+		bestWorker.setStateLocked(WorkerBusy)
+		bestWorker.bindTaskID(best.taskID)
+		taskClasses[best.taskID] = best.class
+		bindTenantLocked(best.class.Tenant, best.taskType, best.taskID)
+
+		metrics := metricsOfLocked(best.class.Priority)
+		metrics.Served++
+		metrics.totalWait += now.Sub(best.enqueuedAt)
+
+		best.ready <- bestWorker
+	}
+}
+
+// findAvailableLocked should be called with workerSelectionLock held, exclude may be nil
+func findAvailableLocked(taskType, nodeName string, exclude *Worker) *Worker {
+	rawPool, ok := WorkerMap.Load(taskType)
+	if !ok {
+		return nil
+	}
+
+	var chooseWorker *Worker = nil
+	rawPool.(*sync.Map).Range(func(key, value any) bool {
+		worker := value.(*Worker)
+		if worker != exclude && worker.isSelectableLocked() && worker.nodeName == nodeName {
+			chooseWorker = worker
+			return false
+		}
+		return true
+	})
+	return chooseWorker
+}
+
+// enqueueLocked add the waiter, preempt the lowest queued task of the same task type and node
+// if the queue is full. Return false if the waiter itself is the lowest
+func enqueueLocked(w *waiter) bool {
+	var lowest *waiter
+	queued := 0
+	now := time.Now()
+	for _, other := range pendingQueue {
+		if other.taskType != w.taskType || other.nodeName != w.nodeName {
+			continue
+		}
+		queued++
+		if lowest == nil || other.class.Priority < lowest.class.Priority ||
+			(other.class.Priority == lowest.class.Priority && other.seq > lowest.seq) {
+			lowest = other
+		}
+	}
+
+	metricsOfLocked(w.class.Priority).Enqueued++
+
+	if queued >= MaxQueueLength {
+		if lowest.class.Priority >= w.class.Priority {
+			metricsOfLocked(w.class.Priority).Preempted++
+			return false
+		}
+		removeLocked(lowest)
+		metricsOfLocked(lowest.class.Priority).Preempted++
+		lowest.err = ErrPreempted
+		close(lowest.ready)
+		log.Printf("queued task %v of %v is preempted by task %v with %v priority",
+			lowest.taskID, lowest.taskType, w.taskID, w.class.Priority)
+	}
+
+	waiterSeq++
+	w.seq = waiterSeq
+	w.enqueuedAt = now
+	pendingQueue = append(pendingQueue, w)
+	return true
+}
+
+// removeLocked return false if the waiter is not in the queue
+func removeLocked(w *waiter) bool {
+	for i, other := range pendingQueue {
+		if other == w {
+			pendingQueue = append(pendingQueue[:i], pendingQueue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// RefuseQueue fail the pending tasks with err, and refuse tasks queued later with it.
+// A nil err accepts tasks again. Return the number of failed tasks
+func RefuseQueue(err error) int {
+	workerSelectionLock.Lock()
+	defer workerSelectionLock.Unlock()
+
+	queueRefusal = err
+	if err == nil {
+		return 0
+	}
+	failed := len(pendingQueue)
+	for _, w := range pendingQueue {
+		w.err = err
+		close(w.ready)
+		log.Printf("queued task %v of %v failed: %v", w.taskID, w.taskType, err)
+	}
+	pendingQueue = nil
+	return failed
+}
+
+// wakeWaiters dispatch workers to the pending queue
+func wakeWaiters() {
+	workerSelectionLock.Lock()
+	dispatchLocked()
+	workerSelectionLock.Unlock()
+}
+
+// OccupyWorkerWithClass wait in the pending queue for a worker of taskType in the node,
+// and bind taskID to it. Return ErrPreempted or ErrDeadlineExceeded if it is given up,
+// or the error of ctx if it is done first
+func OccupyWorkerWithClass(ctx context.Context, taskType, taskID, nodeName string, class TaskClass) (*Worker, error) {
+	return occupyWorker(ctx, taskType, taskID, PodsInfo[taskType+"-"+nodeName].NodeName, class, nil)
+}
+
+// occupyWorker queue for a worker of taskType in nodeName other than exclude.
+// The waiter is woken by dispatchLocked, there is no polling
+func occupyWorker(ctx context.Context, taskType, taskID, nodeName string, class TaskClass,
+	exclude *Worker) (*Worker, error) {
+
+	rawPool, ok := WorkerMap.Load(taskType)
+	if !ok {
+		return nil, fmt.Errorf("%w of task type %v", ErrNoWorkerPool, taskType)
+	}
+
+	hasWorker := false
+	rawPool.(*sync.Map).Range(func(key, value any) bool {
+		hasWorker = true
+		return false
+	})
+	if !hasWorker {
+		return nil, fmt.Errorf("%w of task type %v, it has no worker", ErrNoWorkerPool, taskType)
+	}
+
+	w := &waiter{
+		taskType: taskType,
+		taskID:   taskID,
+		nodeName: nodeName,
+		class:    class,
+		exclude:  exclude,
+		ready:    make(chan *Worker, 1),
+	}
+
+	workerSelectionLock.Lock()
+	if queueRefusal != nil {
+		err := queueRefusal
+		workerSelectionLock.Unlock()
+		return nil, err
+	}
+	if !enqueueLocked(w) {
+		workerSelectionLock.Unlock()
+		return nil, ErrPreempted
+	}
+	dispatchLocked()
+	workerSelectionLock.Unlock()
+
+	var deadline <-chan time.Time
+	if !class.Deadline.IsZero() {
+		timer := time.NewTimer(time.Until(class.Deadline))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	select {
+	case worker, ok := <-w.ready:
+		if !ok {
+			return nil, w.err
+		}
+		return worker, nil
+	case <-deadline:
+		return w.giveUp(ErrDeadlineExceeded)
+	case <-ctx.Done():
+		err := ctx.Err()
+		if err == context.DeadlineExceeded {
+			err = ErrDeadlineExceeded
+		}
+		return w.giveUp(err)
+	}
+}
+
+// giveUp remove the waiter from the queue with err. A worker handed to it in the meantime
+// is taken instead, since it is already bound to the task
+func (w *waiter) giveUp(err error) (*Worker, error) {
+	workerSelectionLock.Lock()
+	if removeLocked(w) {
+		if err == ErrDeadlineExceeded {
+			metricsOfLocked(w.class.Priority).DeadlineMisses++
+			log.Printf("task %v of %v missed its deadline while waiting for a worker", w.taskID, w.taskType)
+		}
+		workerSelectionLock.Unlock()
+		return nil, err
+	}
+	workerSelectionLock.Unlock()
+
+	worker, ok := <-w.ready
+	if !ok {
+		return nil, w.err
+	}
+	return worker, nil
+}
+
+func GetQueueMetrics() QueueMetrics {
+	workerSelectionLock.Lock()
+	defer workerSelectionLock.Unlock()
+
+	now := time.Now()
+	metrics := QueueMetrics{
+		Mode:       QueueMode,
+		Priorities: map[string]PriorityMetrics{},
+		Pending:    []PendingTask{},
+	}
+	for priority, priorityMetrics := range queueMetrics {
+		view := *priorityMetrics
+		view.TotalWait = priorityMetrics.totalWait.String()
+		metrics.Priorities[priority.String()] = view
+	}
+
+	sorted := append([]*waiter{}, pendingQueue...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].before(sorted[j], now)
+	})
+	for _, w := range sorted {
+		pending := PendingTask{
+			TaskType: w.taskType,
+			TaskID:   w.taskID,
+			NodeName: w.nodeName,
+			Priority: w.class.Priority.String(),
+			Tenant:   w.class.Tenant,
+			Waited:   now.Sub(w.enqueuedAt).String(),
+		}
+		if !w.class.Deadline.IsZero() {
+			pending.Deadline = w.class.Deadline.Format(time.RFC3339Nano)
+		}
+		metrics.Pending = append(metrics.Pending, pending)
+	}
+	return metrics
+}
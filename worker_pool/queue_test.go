@@ -0,0 +1,294 @@
+package worker_pool
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// useQueueMode set the queue mode for a test and restore the queue afterwards
+func useQueueMode(t *testing.T, mode string) {
+	previousMode, previousAging, previousLength := QueueMode, AgingInterval, MaxQueueLength
+	QueueMode = mode
+	t.Cleanup(func() {
+		QueueMode, AgingInterval, MaxQueueLength = previousMode, previousAging, previousLength
+		pendingQueue = nil
+		queueMetrics = map[Priority]*PriorityMetrics{}
+	})
+}
+
+func newWaiter(seq uint64, priority Priority, deadline time.Time, enqueuedAt time.Time) *waiter {
+	return &waiter{
+		taskType:   "det",
+		taskID:     "task",
+		nodeName:   "node",
+		class:      TaskClass{Priority: priority, Deadline: deadline},
+		enqueuedAt: enqueuedAt,
+		seq:        seq,
+		ready:      make(chan *Worker, 1),
+	}
+}
+
+func TestParsePriority(t *testing.T) {
+	for name, expected := range map[string]Priority{
+		"": PriorityNormal, "low": PriorityLow, "high": PriorityHigh, "critical": PriorityCritical,
+	} {
+		priority, err := ParsePriority(name)
+		if err != nil || priority != expected {
+			t.Fatalf("%q: expected %v, got %v %v", name, expected, priority, err)
+		}
+		if name != "" && priority.String() != name {
+			t.Fatalf("expected name %v, got %v", name, priority.String())
+		}
+	}
+	if _, err := ParsePriority("urgent"); err == nil {
+		t.Fatal("unknown priority should fail")
+	}
+}
+
+func TestEDFComparesPriorityFirst(t *testing.T) {
+	useQueueMode(t, QueueModeEDF)
+	now := time.Now()
+
+	soon := newWaiter(1, PriorityLow, now.Add(time.Second), now)
+	high := newWaiter(2, PriorityHigh, time.Time{}, now)
+	if !high.before(soon, now) || soon.before(high, now) {
+		t.Fatal("a higher priority should be served before an earlier deadline")
+	}
+
+	later := newWaiter(3, PriorityHigh, now.Add(time.Minute), now)
+	earlier := newWaiter(4, PriorityHigh, now.Add(time.Second), now)
+	if !earlier.before(later, now) {
+		t.Fatal("the earlier deadline should be served first within a priority")
+	}
+	if !later.before(high, now) {
+		t.Fatal("a task with deadline should be served before one without within a priority")
+	}
+
+	first := newWaiter(5, PriorityNormal, time.Time{}, now)
+	second := newWaiter(6, PriorityNormal, time.Time{}, now)
+	if !first.before(second, now) || second.before(first, now) {
+		t.Fatal("tasks of the same class should be served in order")
+	}
+}
+
+func TestPriorityModeAging(t *testing.T) {
+	useQueueMode(t, QueueModePriority)
+	AgingInterval = 10 * time.Second
+	now := time.Now()
+
+	old := newWaiter(1, PriorityLow, time.Time{}, now.Add(-25*time.Second))
+	fresh := newWaiter(2, PriorityNormal, now.Add(time.Second), now)
+	if !old.before(fresh, now) {
+		t.Fatal("a low task waiting two aging intervals should pass a fresh normal one")
+	}
+
+	// deadlines are ignored in the priority mode
+	first := newWaiter(3, PriorityNormal, time.Time{}, now)
+	urgent := newWaiter(4, PriorityNormal, now.Add(time.Millisecond), now)
+	if urgent.before(first, now) {
+		t.Fatal("the deadline should not change the order in the priority mode")
+	}
+}
+
+func TestEnqueuePreemptsLowest(t *testing.T) {
+	useQueueMode(t, QueueModeEDF)
+	MaxQueueLength = 2
+	now := time.Now()
+
+	low := newWaiter(0, PriorityLow, time.Time{}, now)
+	normal := newWaiter(0, PriorityNormal, time.Time{}, now)
+	if !enqueueLocked(low) || !enqueueLocked(normal) {
+		t.Fatal("the queue should accept tasks until it is full")
+	}
+
+	if enqueueLocked(newWaiter(0, PriorityLow, time.Time{}, now)) {
+		t.Fatal("a task not above the lowest queued one should be refused when full")
+	}
+
+	high := newWaiter(0, PriorityHigh, time.Time{}, now)
+	if !enqueueLocked(high) {
+		t.Fatal("a higher task should preempt the lowest queued one")
+	}
+	if _, ok := <-low.ready; ok || low.err != ErrPreempted {
+		t.Fatalf("the low task should be preempted, got %v", low.err)
+	}
+	if len(pendingQueue) != 2 || pendingQueue[0] != normal || pendingQueue[1] != high {
+		t.Fatalf("unexpected queue %v", pendingQueue)
+	}
+	if metrics := queueMetrics[PriorityLow]; metrics.Preempted != 2 || metrics.Enqueued != 2 {
+		t.Fatalf("unexpected low metrics %+v", *metrics)
+	}
+}
+
+func TestLoadQueueFromEnv(t *testing.T) {
+	useQueueMode(t, QueueModeEDF)
+	t.Setenv("QUEUE_MODE", QueueModePriority)
+	t.Setenv("QUEUE_AGING_INTERVAL", "3s")
+	t.Setenv("MAX_QUEUE_LENGTH", "5")
+	if err := LoadQueueFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if QueueMode != QueueModePriority || AgingInterval != 3*time.Second || MaxQueueLength != 5 {
+		t.Fatalf("unexpected queue settings %v %v %v", QueueMode, AgingInterval, MaxQueueLength)
+	}
+
+	t.Setenv("QUEUE_MODE", "fifo")
+	if err := LoadQueueFromEnv(); err == nil {
+		t.Fatal("unknown mode should fail")
+	}
+	t.Setenv("QUEUE_MODE", "")
+	t.Setenv("MAX_QUEUE_LENGTH", "0")
+	if err := LoadQueueFromEnv(); err == nil {
+		t.Fatal("a queue length of 0 should fail")
+	}
+}
+
+// occupyAsync wait for a worker of taskType in the background
+func occupyAsync(ctx context.Context, taskType, taskID string, class TaskClass) chan error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := occupyWorker(ctx, taskType, taskID, "node", class, nil)
+		done <- err
+	}()
+	return done
+}
+
+// a waiter is woken by the returned worker, and gets it before a poll would have
+func TestOccupyWorkerWokenByReturn(t *testing.T) {
+	useQueueMode(t, QueueModeEDF)
+	readyWorkers(t, "wake-test", "node", "a")
+
+	held, err := occupyWorker(context.Background(), "wake-test", "first", "node", TaskClass{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := occupyAsync(context.Background(), "wake-test", "second", TaskClass{})
+	select {
+	case err = <-done:
+		t.Fatalf("the worker is held, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	returned := time.Now()
+	held.ReturnToPool("first")
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the waiter should be woken by the returned worker")
+	}
+	if waited := time.Since(returned); waited > 40*time.Millisecond {
+		t.Fatalf("the waiter should be woken at once, waited %v", waited)
+	}
+	if worker, ok := LookupWorker("second"); !ok || worker != held {
+		t.Fatal("the second task should be bound to the worker")
+	}
+	held.ReturnToPool("second")
+}
+
+// a waiter without a deadline leaves the queue once its context is canceled
+func TestOccupyWorkerCanceled(t *testing.T) {
+	useQueueMode(t, QueueModeEDF)
+	workers := readyWorkers(t, "cancel-test", "node", "a")
+	workers[0].isAvailable = false
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := occupyAsync(ctx, "cancel-test", "task", TaskClass{})
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("expected %v, got %v", context.Canceled, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the canceled waiter should return")
+	}
+	if metrics := GetQueueMetrics(); len(metrics.Pending) != 0 {
+		t.Fatalf("the canceled waiter should leave the queue, got %+v", metrics.Pending)
+	}
+}
+
+func TestOccupyWorkerDeadline(t *testing.T) {
+	useQueueMode(t, QueueModeEDF)
+	workers := readyWorkers(t, "deadline-test", "node", "a")
+	workers[0].isAvailable = false
+
+	class := TaskClass{Deadline: time.Now().Add(50 * time.Millisecond)}
+	if _, err := occupyWorker(context.Background(), "deadline-test", "task", "node", class, nil); err != ErrDeadlineExceeded {
+		t.Fatalf("expected %v, got %v", ErrDeadlineExceeded, err)
+	}
+	if metrics := GetQueueMetrics(); metrics.Priorities["normal"].DeadlineMisses != 1 || len(metrics.Pending) != 0 {
+		t.Fatalf("unexpected metrics %+v", metrics)
+	}
+}
+
+// a worker back from unhealthy wakes the waiters at the end of its cooldown
+func TestOccupyWorkerAfterCooldown(t *testing.T) {
+	useQueueMode(t, QueueModeEDF)
+	previousThreshold, previousCooldown := FailureThreshold, UnhealthyCooldown
+	FailureThreshold, UnhealthyCooldown = 1, 50*time.Millisecond
+	t.Cleanup(func() { FailureThreshold, UnhealthyCooldown = previousThreshold, previousCooldown })
+	workers := readyWorkers(t, "cooldown-test", "node", "a")
+
+	workers[0].ReportFailure()
+	done := occupyAsync(context.Background(), "cooldown-test", "task", TaskClass{})
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the waiter should get the worker after its cooldown")
+	}
+	workers[0].ReturnToPool("task")
+}
+
+func TestOccupyWorkerUnknownTaskType(t *testing.T) {
+	_, err := occupyWorker(context.Background(), "unknown-test", "task", "node", TaskClass{}, nil)
+	if !errors.Is(err, ErrNoWorkerPool) {
+		t.Fatalf("expected %v, got %v", ErrNoWorkerPool, err)
+	}
+}
+
+// queued tasks fail with the refusal, and later tasks are refused until the queue accepts again
+func TestRefuseQueue(t *testing.T) {
+	useQueueMode(t, QueueModeEDF)
+	t.Cleanup(func() { RefuseQueue(nil) })
+	workers := readyWorkers(t, "refuse-test", "node", "a")
+	workers[0].isAvailable = false
+
+	refusal := errors.New("draining")
+	first := occupyAsync(context.Background(), "refuse-test", "first", TaskClass{})
+	second := occupyAsync(context.Background(), "refuse-test", "second", TaskClass{})
+	for deadline := time.Now().Add(time.Second); len(GetQueueMetrics().Pending) != 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("both tasks should be queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if failed := RefuseQueue(refusal); failed != 2 {
+		t.Fatalf("expected 2 failed tasks, got %v", failed)
+	}
+	for _, done := range []chan error{first, second} {
+		if err := <-done; err != refusal {
+			t.Fatalf("expected %v, got %v", refusal, err)
+		}
+	}
+	if err := <-occupyAsync(context.Background(), "refuse-test", "third", TaskClass{}); err != refusal {
+		t.Fatalf("a task queued later should be refused, got %v", err)
+	}
+
+	RefuseQueue(nil)
+	workerSelectionLock.Lock()
+	workers[0].isAvailable = true
+	workerSelectionLock.Unlock()
+	if err := <-occupyAsync(context.Background(), "refuse-test", "fourth", TaskClass{}); err != nil {
+		t.Fatal(err)
+	}
+	workers[0].ReturnToPool("fourth")
+}
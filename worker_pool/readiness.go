@@ -0,0 +1,323 @@
+package worker_pool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// WorkerState is the lifecycle of a worker, only Ready workers are selected for tasks.
+// Creating until the pod runs, WarmingUp until the readiness check and the warm-up request pass,
+// Busy while bound to a task, Draining while deleted, Failed if it never became ready
+type WorkerState string
+
+const (
+	WorkerCreating  WorkerState = "Creating"
+	WorkerWarmingUp WorkerState = "WarmingUp"
+	WorkerReady     WorkerState = "Ready"
+	WorkerBusy      WorkerState = "Busy"
+	WorkerDraining  WorkerState = "Draining"
+	WorkerFailed    WorkerState = "Failed"
+)
+
+const (
+	// ProbeTCP wait until the worker port accepts connections
+	ProbeTCP = "tcp"
+	// ProbeHTTP wait until GET Path of the worker answers 2xx
+	ProbeHTTP = "http"
+	// ProbeKubernetes wait until the pod is Ready, for pods with a readiness probe in their template
+	ProbeKubernetes = "kubernetes"
+	// ProbeNone consider the worker ready once its pod runs
+	ProbeNone = "none"
+)
+
+// ReadinessConfig is how a worker of a task type is checked before it is selected.
+// WarmUpRoute is posted WarmUpBody once the probe passes, so the model is loaded
+// before the first task, and must answer 2xx. Durations are in milliseconds
+type ReadinessConfig struct {
+	Probe             string `json:"probe"`
+	Path              string `json:"path"`
+	IntervalMs        int    `json:"interval_ms"`
+	TimeoutMs         int    `json:"timeout_ms"`
+	WarmUpRoute       string `json:"warm_up_route"`
+	WarmUpBody        string `json:"warm_up_body"`
+	WarmUpContentType string `json:"warm_up_content_type"`
+}
+
+var DefaultReadinessConfig = ReadinessConfig{
+	Probe:             ProbeTCP,
+	Path:              "health",
+	IntervalMs:        500,
+	TimeoutMs:         5 * 60 * 1000,
+	WarmUpContentType: "application/json",
+}
+
+// StateTransition is a state the worker entered and when
+type StateTransition struct {
+	State WorkerState `json:"state"`
+	At    time.Time   `json:"at"`
+}
+
+// stateHistorySize is how many transitions of a worker are kept
+const stateHistorySize = 10
+
+var readinessLock = sync.RWMutex{}
+
+// map from task type to its ReadinessConfig, task types not in it use DefaultReadinessConfig
+var readinessConfigs = map[string]ReadinessConfig{}
+
+// LoadReadinessFromEnv load the json of WORKER_READINESS keyed by task type, "default" applies to the rest,
+// fields not in the json keep their defaults
+func LoadReadinessFromEnv() error {
+	rawConfigs := os.Getenv("WORKER_READINESS")
+	if rawConfigs == "" {
+		return nil
+	}
+	rawByTask := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(rawConfigs), &rawByTask); err != nil {
+		return err
+	}
+
+	base := DefaultReadinessConfig
+	if rawDefault, ok := rawByTask["default"]; ok {
+		if err := json.Unmarshal(rawDefault, &base); err != nil {
+			return err
+		}
+	}
+	configs := map[string]ReadinessConfig{}
+	for taskType, rawConfig := range rawByTask {
+		config := base
+		if err := json.Unmarshal(rawConfig, &config); err != nil {
+			return err
+		}
+		switch config.Probe {
+		case ProbeTCP, ProbeHTTP, ProbeKubernetes, ProbeNone:
+		default:
+			return fmt.Errorf("unknown probe %v of %v", config.Probe, taskType)
+		}
+		if config.IntervalMs <= 0 || config.TimeoutMs <= 0 {
+			return fmt.Errorf("interval_ms and timeout_ms of %v should be positive", taskType)
+		}
+		configs[taskType] = config
+	}
+
+	readinessLock.Lock()
+	readinessConfigs = configs
+	readinessLock.Unlock()
+	return nil
+}
+
+func readinessOf(taskType string) ReadinessConfig {
+	readinessLock.RLock()
+	defer readinessLock.RUnlock()
+	if config, ok := readinessConfigs[taskType]; ok {
+		return config
+	}
+	if config, ok := readinessConfigs["default"]; ok {
+		return config
+	}
+	return DefaultReadinessConfig
+}
+
+// setStateLocked should be called with workerSelectionLock held
+func (w *Worker) setStateLocked(state WorkerState) {
+	if w.state == state {
+		return
+	}
+	w.state = state
+	w.stateHistory = append(w.stateHistory, StateTransition{State: state, At: time.Now()})
+	if len(w.stateHistory) > stateHistorySize {
+		w.stateHistory = w.stateHistory[len(w.stateHistory)-stateHistorySize:]
+	}
+}
+
+func (w *Worker) setState(state WorkerState) {
+	workerSelectionLock.Lock()
+	w.setStateLocked(state)
+	workerSelectionLock.Unlock()
+}
+
+// isSelectableLocked should be called with workerSelectionLock held
+func (w *Worker) isSelectableLocked() bool {
+	return w.isAvailable && w.state == WorkerReady && !w.cordoned && w.isHealthy()
+}
+
+// GetState return the current state of the worker
+func (w *Worker) GetState() WorkerState {
+	workerSelectionLock.Lock()
+	defer workerSelectionLock.Unlock()
+	return w.state
+}
+
+// awaitReady check the worker until it passes the probe and the warm-up request of its task type,
+// then it becomes selectable. The worker is Failed and abandoned if the timeout passes first
+func (w *Worker) awaitReady() {
+	config := readinessOf(w.taskType)
+	w.setState(WorkerWarmingUp)
+
+	deadline := time.Now().Add(millis(config.TimeoutMs))
+	err := w.poll(deadline, config, func() error {
+		return w.probe(config)
+	})
+	if err == nil && config.WarmUpRoute != "" {
+		err = w.poll(deadline, config, func() error {
+			return w.warmUp(config, deadline)
+		})
+	}
+
+	workerSelectionLock.Lock()
+	if w.state != WorkerWarmingUp {
+		// deleted while warming up
+		workerSelectionLock.Unlock()
+		return
+	}
+	if err != nil {
+		w.setStateLocked(WorkerFailed)
+		workerSelectionLock.Unlock()
+		log.Printf("worker %v is not ready: %v", w.wokerName, err)
+		// it would hold its pod, port, gpu share and a place in the pool forever
+		abandonWorker(w, true)
+		return
+	}
+	w.setStateLocked(WorkerReady)
+	dispatchLocked()
+	workerSelectionLock.Unlock()
+	log.Printf("worker %v is ready", w.wokerName)
+}
+
+// poll call check until it succeeds or the deadline passes, return the last error
+func (w *Worker) poll(deadline time.Time, config ReadinessConfig, check func() error) error {
+	for {
+		err := check()
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(podFailedError); ok || time.Now().Add(millis(config.IntervalMs)).After(deadline) {
+			return err
+		}
+		time.Sleep(millis(config.IntervalMs))
+	}
+}
+
+type podFailedError struct {
+	podName string
+}
+
+func (e podFailedError) Error() string {
+	return fmt.Sprintf("pod %v failed", e.podName)
+}
+
+func (w *Worker) probe(config ReadinessConfig) error {
+	switch config.Probe {
+	case ProbeTCP:
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(w.ip, w.port), millis(config.IntervalMs))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case ProbeHTTP:
+		ctx, cancel := context.WithTimeout(context.Background(), millis(config.IntervalMs)+time.Second)
+		defer cancel()
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet,
+			w.GetURL(strings.TrimPrefix(config.Path, "/")), nil)
+		if err != nil {
+			return err
+		}
+		return checkResponse(WorkerClient().Do(request))
+	case ProbeKubernetes:
+		pod, err := getCluster().CoreV1().Pods(WorkerNamespace()).Get(context.Background(),
+			w.podName, meta_v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if pod.Status.Phase == corev1.PodFailed {
+			return podFailedError{w.podName}
+		}
+		if !isPodReady(pod) {
+			return fmt.Errorf("pod %v is not ready", w.podName)
+		}
+		return nil
+	default:
+		return nil
+	}
+}
+
+// warmUp post the warm-up request, given up at the deadline of the readiness check
+func (w *Worker) warmUp(config ReadinessConfig, deadline time.Time) error {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		w.GetURL(strings.TrimPrefix(config.WarmUpRoute, "/")), strings.NewReader(config.WarmUpBody))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", config.WarmUpContentType)
+	return checkResponse(WorkerClient().Do(request))
+}
+
+func checkResponse(resp *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("worker answered %v", resp.Status)
+	}
+	return nil
+}
+
+// WorkerStateInfo is the state of a worker and its recent transitions
+type WorkerStateInfo struct {
+	Worker   string            `json:"worker"`
+	TaskType string            `json:"task_type"`
+	Node     string            `json:"node"`
+	State    WorkerState       `json:"state"`
+	Since    time.Time         `json:"since"`
+	History  []StateTransition `json:"history"`
+}
+
+// GetWorkerStates return the state of every worker ordered by task type and name
+func GetWorkerStates() []WorkerStateInfo {
+	states := []WorkerStateInfo{}
+	workerSelectionLock.Lock()
+	WorkerMap.Range(func(key, value any) bool {
+		value.(*sync.Map).Range(func(key, value any) bool {
+			worker := value.(*Worker)
+			info := WorkerStateInfo{
+				Worker:   worker.wokerName,
+				TaskType: worker.taskType,
+				Node:     worker.nodeName,
+				State:    worker.state,
+				History:  append([]StateTransition{}, worker.stateHistory...),
+			}
+			if len(info.History) != 0 {
+				info.Since = info.History[len(info.History)-1].At
+			}
+			states = append(states, info)
+			return true
+		})
+		return true
+	})
+	workerSelectionLock.Unlock()
+
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].TaskType != states[j].TaskType {
+			return states[i].TaskType < states[j].TaskType
+		}
+		return states[i].Worker < states[j].Worker
+	})
+	return states
+}
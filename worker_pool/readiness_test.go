@@ -0,0 +1,146 @@
+package worker_pool
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// useReadiness set the readiness config of taskType for a test
+func useReadiness(t *testing.T, taskType string, config ReadinessConfig) {
+	readinessLock.Lock()
+	previous := readinessConfigs
+	readinessConfigs = map[string]ReadinessConfig{taskType: config}
+	readinessLock.Unlock()
+	t.Cleanup(func() {
+		readinessLock.Lock()
+		readinessConfigs = previous
+		readinessLock.Unlock()
+	})
+}
+
+// creatingWorker add a Creating worker of taskType served by handler, with its pod in a fake cluster
+func creatingWorker(t *testing.T, taskType string, handler http.HandlerFunc) *Worker {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	ip, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	worker := &Worker{ip: ip, port: port, taskType: taskType, nodeName: "node",
+		wokerName: taskType + "-worker", podName: taskType + "-worker", isAvailable: true}
+	SetClusterClient(fake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: meta_v1.ObjectMeta{Name: worker.podName, Namespace: WorkerNamespace()},
+	}))
+	rawPool, _ := WorkerMap.LoadOrStore(taskType, &sync.Map{})
+	workerSelectionLock.Lock()
+	worker.setStateLocked(WorkerCreating)
+	rawPool.(*sync.Map).Store(worker.wokerName, worker)
+	workerSelectionLock.Unlock()
+	t.Cleanup(func() {
+		SetClusterClient(nil)
+		WorkerMap.Delete(taskType)
+	})
+	return worker
+}
+
+func statesOf(worker *Worker) []WorkerState {
+	workerSelectionLock.Lock()
+	defer workerSelectionLock.Unlock()
+	var states []WorkerState
+	for _, transition := range worker.stateHistory {
+		states = append(states, transition.State)
+	}
+	return states
+}
+
+func inPool(worker *Worker) bool {
+	rawPool, ok := WorkerMap.Load(worker.taskType)
+	if !ok {
+		return false
+	}
+	_, ok = rawPool.(*sync.Map).Load(worker.wokerName)
+	return ok
+}
+
+func TestAwaitReady(t *testing.T) {
+	useReadiness(t, "ready-test", ReadinessConfig{
+		Probe: ProbeHTTP, Path: "/health", IntervalMs: 10, TimeoutMs: 5000, WarmUpRoute: "/warm_up",
+	})
+	var warmedUp atomic.Bool
+	worker := creatingWorker(t, "ready-test", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/warm_up" {
+			warmedUp.Store(true)
+		}
+	})
+
+	worker.awaitReady()
+	states := statesOf(worker)
+	expected := []WorkerState{WorkerCreating, WorkerWarmingUp, WorkerReady}
+	if len(states) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, states)
+	}
+	for i := range expected {
+		if states[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, states)
+		}
+	}
+	if !warmedUp.Load() || CountAvailable("ready-test") != 1 {
+		t.Fatal("the worker should be warmed up and selectable")
+	}
+}
+
+// a worker failing the warm-up leaves the pool, and its pod is deleted
+func TestAwaitReadyFailure(t *testing.T) {
+	useReadiness(t, "failed-test", ReadinessConfig{
+		Probe: ProbeNone, IntervalMs: 10, TimeoutMs: 100, WarmUpRoute: "/warm_up",
+	})
+	worker := creatingWorker(t, "failed-test", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "model not loaded", http.StatusServiceUnavailable)
+	})
+
+	worker.awaitReady()
+	if state := worker.GetState(); state != WorkerFailed {
+		t.Fatalf("expected %v, got %v", WorkerFailed, state)
+	}
+	if inPool(worker) {
+		t.Fatal("the failed worker should leave the pool")
+	}
+	_, err := getCluster().CoreV1().Pods(WorkerNamespace()).Get(context.Background(),
+		worker.podName, meta_v1.GetOptions{})
+	if !errors.IsNotFound(err) {
+		t.Fatalf("the pod of the failed worker should be deleted, got %v", err)
+	}
+}
+
+// a hung warm-up request is given up at the timeout of the readiness check
+func TestAwaitReadyWarmUpTimeout(t *testing.T) {
+	useReadiness(t, "hung-test", ReadinessConfig{
+		Probe: ProbeNone, IntervalMs: 10, TimeoutMs: 200, WarmUpRoute: "/warm_up",
+	})
+	release := make(chan struct{})
+	worker := creatingWorker(t, "hung-test", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	defer close(release)
+
+	start := time.Now()
+	worker.awaitReady()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("the warm-up should stop at the timeout, took %v", elapsed)
+	}
+	if worker.GetState() != WorkerFailed || inPool(worker) {
+		t.Fatal("the worker should be failed and abandoned")
+	}
+}
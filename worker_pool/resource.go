@@ -0,0 +1,364 @@
+package worker_pool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// PlacementBinPack fill the busiest node that still fits, to keep other nodes free for big workers
+	PlacementBinPack = "binpack"
+	// PlacementSpread put each worker on the node with the most free resources
+	PlacementSpread = "spread"
+)
+
+const (
+	resourceGPUCores  corev1.ResourceName = "nvidia.com/gpucores"
+	resourceGPUMemory corev1.ResourceName = "nvidia.com/gpumem"
+)
+
+// Resources is an amount of cpu in millicores, memory in bytes, gpu cores in percent of a gpu
+// and gpu memory in MB
+type Resources struct {
+	CPU       int64 `json:"cpu"`
+	Memory    int64 `json:"memory"`
+	GPUCores  int64 `json:"gpu_cores"`
+	GPUMemory int64 `json:"gpu_memory"`
+}
+
+func (r Resources) add(other Resources) Resources {
+	return Resources{
+		CPU:       r.CPU + other.CPU,
+		Memory:    r.Memory + other.Memory,
+		GPUCores:  r.GPUCores + other.GPUCores,
+		GPUMemory: r.GPUMemory + other.GPUMemory,
+	}
+}
+
+func (r Resources) sub(other Resources) Resources {
+	return r.add(Resources{-other.CPU, -other.Memory, -other.GPUCores, -other.GPUMemory})
+}
+
+// NodeResources is the resource model of a kubernetes node. Used is the sum of the limits,
+// or the requests if larger, of pods living in the node. A zero allocatable is unknown and never checked
+type NodeResources struct {
+	Node        string    `json:"node"`
+	Allocatable Resources `json:"allocatable"`
+	Used        Resources `json:"used"`
+	Free        Resources `json:"free"`
+	Pods        int       `json:"pods"`
+}
+
+// ReadyTimeout is how long InitWorkers waits for a batch of pods to be ready before the next batch
+var ReadyTimeout = 3 * time.Minute
+
+var clusterLock = sync.Mutex{}
+
+var clusterClient kubernetes.Interface = nil
+
+// SetClusterClient replace the kubernetes client of the resource model, such as a fake cluster
+func SetClusterClient(client kubernetes.Interface) {
+	clusterLock.Lock()
+	clusterClient = client
+	clusterLock.Unlock()
+}
+
+func getCluster() kubernetes.Interface {
+	clusterLock.Lock()
+	defer clusterLock.Unlock()
+	if clusterClient == nil {
+		clusterClient = GetClientSet()
+	}
+	return clusterClient
+}
+
+// gpuCapacities override the gpu cores and memory of nodes whose allocatable does not report them,
+// set by the json of NODE_GPU_CAPACITY, e.g. {"gpu1": {"gpu_cores": 100, "gpu_memory": 24576}}
+var gpuCapacities = map[string]Resources{}
+
+// LoadGPUCapacityFromEnv load NODE_GPU_CAPACITY, keyed by kubernetes node name
+func LoadGPUCapacityFromEnv() error {
+	rawCapacities := os.Getenv("NODE_GPU_CAPACITY")
+	if rawCapacities == "" {
+		return nil
+	}
+	capacities := map[string]Resources{}
+	if err := json.Unmarshal([]byte(rawCapacities), &capacities); err != nil {
+		return err
+	}
+	clusterLock.Lock()
+	gpuCapacities = capacities
+	clusterLock.Unlock()
+	return nil
+}
+
+// containerResources is the larger of the limits and the requests of a container
+func containerResources(requirements corev1.ResourceRequirements) Resources {
+	amount := func(name corev1.ResourceName, milli bool) int64 {
+		var value int64
+		for _, list := range []corev1.ResourceList{requirements.Limits, requirements.Requests} {
+			quantity, ok := list[name]
+			if !ok {
+				continue
+			}
+			v := quantity.Value()
+			if milli {
+				v = quantity.MilliValue()
+			}
+			if v > value {
+				value = v
+			}
+		}
+		return value
+	}
+	return Resources{
+		CPU:       amount(corev1.ResourceCPU, true),
+		Memory:    amount(corev1.ResourceMemory, false),
+		GPUCores:  amount(resourceGPUCores, false),
+		GPUMemory: amount(resourceGPUMemory, false),
+	}
+}
+
+// GetNodeResources build the resource model of every node from the kubernetes api
+func GetNodeResources() ([]NodeResources, error) {
+	client := getCluster()
+	nodes, err := client.CoreV1().Nodes().List(context.Background(), meta_v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	pods, err := client.CoreV1().Pods("").List(context.Background(), meta_v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	clusterLock.Lock()
+	capacities := gpuCapacities
+	clusterLock.Unlock()
+
+	models := map[string]*NodeResources{}
+	for _, node := range nodes.Items {
+		allocatable := node.Status.Allocatable
+		model := &NodeResources{
+			Node: node.Name,
+			Allocatable: Resources{
+				CPU:    allocatable.Cpu().MilliValue(),
+				Memory: allocatable.Memory().Value(),
+			},
+		}
+		if quantity, ok := allocatable[resourceGPUCores]; ok {
+			model.Allocatable.GPUCores = quantity.Value()
+		}
+		if quantity, ok := allocatable[resourceGPUMemory]; ok {
+			model.Allocatable.GPUMemory = quantity.Value()
+		}
+		if capacity, ok := capacities[node.Name]; ok {
+			model.Allocatable.GPUCores = capacity.GPUCores
+			model.Allocatable.GPUMemory = capacity.GPUMemory
+		}
+		models[node.Name] = model
+	}
+
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		model, ok := models[pod.Spec.NodeName]
+		if !ok {
+			continue
+		}
+		model.Pods++
+		for _, container := range pod.Spec.Containers {
+			model.Used = model.Used.add(containerResources(container.Resources))
+		}
+	}
+
+	result := []NodeResources{}
+	for _, model := range models {
+		model.Free = model.Allocatable.sub(model.Used)
+		result = append(result, *model)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Node < result[j].Node
+	})
+	return result, nil
+}
+
+// fits tell whether demand fits in free, dimensions with unknown allocatable are not checked
+func fits(free, allocatable, demand Resources) bool {
+	check := func(free, allocatable, demand int64) bool {
+		return allocatable == 0 || demand <= free
+	}
+	return check(free.CPU, allocatable.CPU, demand.CPU) &&
+		check(free.Memory, allocatable.Memory, demand.Memory) &&
+		check(free.GPUCores, allocatable.GPUCores, demand.GPUCores) &&
+		check(free.GPUMemory, allocatable.GPUMemory, demand.GPUMemory)
+}
+
+// freeFraction is the smallest fraction of a known dimension left free
+func freeFraction(free, allocatable Resources) float64 {
+	fraction := 1.0
+	for _, pair := range [][2]int64{
+		{free.CPU, allocatable.CPU},
+		{free.Memory, allocatable.Memory},
+		{free.GPUCores, allocatable.GPUCores},
+		{free.GPUMemory, allocatable.GPUMemory},
+	} {
+		if pair[1] != 0 && float64(pair[0])/float64(pair[1]) < fraction {
+			fraction = float64(pair[0]) / float64(pair[1])
+		}
+	}
+	return fraction
+}
+
+// WorkerDemand is the resources of a worker of the task in a node by the limits of /create_workers,
+// read from the container spec CreateWorker gives the worker
+func WorkerDemand(cpuLimits, gpuLimits, gpuMemorys map[string]int, nodeName string) Resources {
+	return containerResources(workerResources(workerLimits(cpuLimits, gpuLimits, gpuMemorys, nodeName)))
+}
+
+// nodeModels index the resource model by kubernetes node name
+func nodeModels() (map[string]NodeResources, error) {
+	nodes, err := GetNodeResources()
+	if err != nil {
+		return nil, err
+	}
+	models := map[string]NodeResources{}
+	for _, node := range nodes {
+		models[node.Node] = node
+	}
+	return models, nil
+}
+
+// AdmitPlan refuse a plan of workers per node which overcommits the free resources of any node.
+// Node names are the short names of PodsInfo, several of them may share a kubernetes node
+func AdmitPlan(taskName string, workerNumbers, cpuLimits, gpuLimits, gpuMemorys map[string]int) error {
+	models, err := nodeModels()
+	if err != nil {
+		return err
+	}
+
+	demands := map[string]Resources{}
+	for nodeName, workerNumber := range workerNumbers {
+		info, ok := PodsInfo[taskName+"-"+nodeName]
+		if !ok {
+			return fmt.Errorf("unsupported combination %v", taskName+"-"+nodeName)
+		}
+		demand := WorkerDemand(cpuLimits, gpuLimits, gpuMemorys, nodeName)
+		for i := 0; i < workerNumber; i++ {
+			demands[info.NodeName] = demands[info.NodeName].add(demand)
+		}
+		// free gpu cores of the node may be fragmented among its gpus
+		if demand.GPUCores != 0 {
+			if err = fitGPUs(info.NodeName, workerNumber, demand.GPUCores, demand.GPUMemory); err != nil {
+				return err
+			}
+		}
+	}
+
+	for k8sNode, demand := range demands {
+		model, ok := models[k8sNode]
+		if !ok {
+			return fmt.Errorf("node %v not found in the cluster", k8sNode)
+		}
+		if !fits(model.Free, model.Allocatable, demand) {
+			return fmt.Errorf("node %v is overcommitted: demand %+v, free %+v", k8sNode, demand, model.Free)
+		}
+	}
+	return nil
+}
+
+// PlaceWorkers choose the nodes of count workers of the task among the nodes in PodsInfo,
+// one by one with the strategy, and return the number of workers per node
+func PlaceWorkers(taskName string, count int, strategy string,
+	cpuLimits, gpuLimits, gpuMemorys map[string]int) (map[string]int, error) {
+	if strategy != PlacementBinPack && strategy != PlacementSpread {
+		return nil, fmt.Errorf("unknown placement %v", strategy)
+	}
+
+	models, err := nodeModels()
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []string
+	for key, info := range PodsInfo {
+		if info.TaskName != taskName {
+			continue
+		}
+		if _, ok := models[info.NodeName]; ok {
+			candidates = append(candidates, key[len(taskName)+1:])
+		}
+	}
+	sort.Strings(candidates)
+
+	placed := map[string]int{}
+	for i := 0; i < count; i++ {
+		best, bestScore := "", 0.0
+		for _, nodeName := range candidates {
+			model := models[PodsInfo[taskName+"-"+nodeName].NodeName]
+			demand := WorkerDemand(cpuLimits, gpuLimits, gpuMemorys, nodeName)
+			if !fits(model.Free, model.Allocatable, demand) {
+				continue
+			}
+			score := freeFraction(model.Free.sub(demand), model.Allocatable)
+			if strategy == PlacementBinPack {
+				score = -score
+			}
+			if best == "" || score > bestScore {
+				best, bestScore = nodeName, score
+			}
+		}
+		if best == "" {
+			return nil, fmt.Errorf("no node has room for worker %v of %v %v", i+1, count, taskName)
+		}
+
+		placed[best]++
+		k8sNode := PodsInfo[taskName+"-"+best].NodeName
+		model := models[k8sNode]
+		model.Free = model.Free.sub(WorkerDemand(cpuLimits, gpuLimits, gpuMemorys, best))
+		models[k8sNode] = model
+	}
+	return placed, nil
+}
+
+func isPodReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// waitPodsReady wait until every pod is ready, so the next batch is created once the node
+// has finished starting the previous one. Return an error if the timeout passed first
+func waitPodsReady(podNames []string, timeout time.Duration) error {
+	client := getCluster()
+	return wait.PollImmediate(time.Second, timeout, func() (bool, error) {
+		for _, podName := range podNames {
+			pod, err := client.CoreV1().Pods(WorkerNamespace()).Get(context.Background(), podName, meta_v1.GetOptions{})
+			if err != nil {
+				return false, err
+			}
+			if pod.Status.Phase == corev1.PodFailed {
+				return false, fmt.Errorf("pod %v failed", podName)
+			}
+			if !isPodReady(pod) {
+				return false, nil
+			}
+		}
+		log.Printf("%v pods are ready", len(podNames))
+		return true, nil
+	})
+}
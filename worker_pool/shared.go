@@ -0,0 +1,102 @@
+package worker_pool
+
+import (
+	"log"
+)
+
+// A shared worker serves the tasks of several sessions at once instead of being occupied by one.
+// The det worker of a node that batches frames is shared, so frames of different sessions
+// can be sent to it in one request. It is never selected by the pending queue while shared,
+// and returns to the pool once it is unshared and its last task is returned
+
+// map from task type and node name to its shared worker, guarded by workerSelectionLock
+var sharedWorkers = map[string]*Worker{}
+
+func sharedKey(taskType, nodeName string) string {
+	return taskType + "-" + nodeName
+}
+
+// OccupySharedWorker bind taskID to the shared worker of taskType in the node, a free worker
+// is shared first if there is none. Return false if no worker can be shared now,
+// the caller should occupy a worker of its own instead
+func OccupySharedWorker(taskType, taskID, nodeName string, class TaskClass) (*Worker, bool) {
+	nodeName = PodsInfo[taskType+"-"+nodeName].NodeName
+	key := sharedKey(taskType, nodeName)
+
+	workerSelectionLock.Lock()
+	defer workerSelectionLock.Unlock()
+
+	worker, ok := sharedWorkers[key]
+	if ok && (worker.deleted || worker.draining || worker.cordoned || !worker.isHealthy()) {
+		worker.unshareLocked()
+		ok = false
+	}
+	if !ok {
+		if worker = findAvailableLocked(taskType, nodeName, nil); worker == nil {
+			return nil, false
+		}
+		worker.isAvailable = false
+		worker.setStateLocked(WorkerBusy)
+		worker.shared = true
+		sharedWorkers[key] = worker
+		log.Printf("worker %v is shared by tasks of %v", worker.wokerName, nodeName)
+	}
+
+	worker.sharedTasks++
+	taskIDWorkerMap.Store(taskID, worker)
+	taskClasses[taskID] = class
+	bindTenantLocked(class.Tenant, taskType, taskID)
+	return worker, true
+}
+
+// IsShared tell whether the worker serves several tasks at once
+func (w *Worker) IsShared() bool {
+	workerSelectionLock.Lock()
+	defer workerSelectionLock.Unlock()
+	return w.shared || w.sharedTasks != 0
+}
+
+// SharedWorkers return the shared workers of taskType
+func SharedWorkers(taskType string) []*Worker {
+	workerSelectionLock.Lock()
+	defer workerSelectionLock.Unlock()
+
+	var workers []*Worker
+	for _, worker := range sharedWorkers {
+		if worker.taskType == taskType {
+			workers = append(workers, worker)
+		}
+	}
+	return workers
+}
+
+// Unshare stop binding new tasks to the worker, it returns to the pool after its last task
+func (w *Worker) Unshare() {
+	workerSelectionLock.Lock()
+	w.unshareLocked()
+	dispatchLocked()
+	draining := w.draining && w.isAvailable
+	workerSelectionLock.Unlock()
+
+	if draining {
+		go w.deleteDrained()
+	}
+}
+
+// unshareLocked should be called with workerSelectionLock held
+func (w *Worker) unshareLocked() {
+	if !w.shared {
+		return
+	}
+	w.shared = false
+	if key := sharedKey(w.taskType, w.nodeName); sharedWorkers[key] == w {
+		delete(sharedWorkers, key)
+	}
+	if w.sharedTasks == 0 {
+		w.isAvailable = true
+		if w.state == WorkerBusy {
+			w.setStateLocked(WorkerReady)
+		}
+	}
+	log.Printf("worker %v is no longer shared", w.wokerName)
+}
@@ -0,0 +1,66 @@
+package worker_pool
+
+import (
+	"testing"
+)
+
+func TestOccupySharedWorker(t *testing.T) {
+	useTenants(t, nil)
+	workers := readyWorkers(t, "det", "gpu1", "a")
+	t.Cleanup(func() {
+		workerSelectionLock.Lock()
+		sharedWorkers = map[string]*Worker{}
+		workerSelectionLock.Unlock()
+	})
+
+	class := TaskClass{Priority: PriorityNormal, Tenant: DefaultTenant}
+	first, ok := OccupySharedWorker("det", "task-1", "gpu1", class)
+	if !ok || first != workers[0] {
+		t.Fatalf("the free worker should be shared, got %v %v", first, ok)
+	}
+	second, ok := OccupySharedWorker("det", "task-2", "gpu1", class)
+	if !ok || second != first {
+		t.Fatal("tasks of the node should share the same worker")
+	}
+	if !first.IsShared() || CountAvailable("det") != 0 {
+		t.Fatal("a shared worker should not be selected by the queue")
+	}
+	for _, taskID := range []string{"task-1", "task-2"} {
+		if worker, ok := LookupWorker(taskID); !ok || worker != first {
+			t.Fatalf("%v should be bound to the shared worker", taskID)
+		}
+	}
+
+	// the shared worker stays out of the pool while shared, even without tasks
+	first.ReturnToPool("task-1")
+	first.ReturnToPool("task-2")
+	if CountAvailable("det") != 0 {
+		t.Fatal("a shared worker should stay out of the pool")
+	}
+	if _, ok = OccupySharedWorker("det", "task-3", "gpu1", class); !ok {
+		t.Fatal("the shared worker should take new tasks")
+	}
+
+	// unshared, it returns to the pool after its last task
+	first.Unshare()
+	if len(SharedWorkers("det")) != 0 {
+		t.Fatal("the worker should no longer be shared")
+	}
+	if CountAvailable("det") != 0 {
+		t.Fatal("the worker should keep serving task-3")
+	}
+	first.ReturnToPool("task-3")
+	if first.IsShared() || CountAvailable("det") != 1 {
+		t.Fatal("the worker should return to the pool after its last task")
+	}
+}
+
+func TestOccupySharedWorkerWithoutFreeWorker(t *testing.T) {
+	useTenants(t, nil)
+	workers := readyWorkers(t, "det", "gpu1", "a")
+	workers[0].cordoned = true
+
+	if _, ok := OccupySharedWorker("det", "task-1", "gpu1", TaskClass{}); ok {
+		t.Fatal("a cordoned worker should not be shared")
+	}
+}
@@ -0,0 +1,235 @@
+package worker_pool
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// DefaultShmSize is the size of a frame ring if the worker does not tell
+const DefaultShmSize = 64 * 1024 * 1024
+
+// ringHeaderSize is the seq and the length of a frame, little endian uint64s before its bytes
+const ringHeaderSize = 16
+
+// ShmFrame is the json field "<file field>_shm" sent instead of a file part of a multipart request.
+// The worker reads the header at Offset, checks its seq, then reads Length bytes after the header
+type ShmFrame struct {
+	Offset   int64  `json:"offset"`
+	Length   int64  `json:"length"`
+	Seq      uint64 `json:"seq"`
+	FileName string `json:"file_name"`
+}
+
+type ringRegion struct {
+	offset int64
+	length int64
+}
+
+// frameRing is a ring of frames in a file of /dev/shm shared with a co-located worker.
+// The file is mapped into the memory of the scheduler, a frame is copied once into the mapping
+// and the worker maps the same pages, so no bytes go through a socket or a write call.
+// A region is in use until the request carrying it is answered, the worker copies the frame out
+// before it answers. A frame not fitting beside the regions in use is sent inline instead of waiting
+type frameRing struct {
+	file *os.File
+	data []byte
+	size int64
+
+	lock  sync.Mutex
+	head  int64
+	seq   uint64
+	inUse map[uint64]ringRegion
+}
+
+// openFrameRing create the ring at path, which is chosen by the scheduler, see ShmPathOf.
+// A file left at path is removed first, and O_EXCL refuses a link put there meanwhile
+func openFrameRing(path string, size int64) (*frameRing, error) {
+	if path == "" {
+		return nil, fmt.Errorf("shm transport requires shm_path")
+	}
+	if size <= 0 {
+		size = DefaultShmSize
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = file.Truncate(size); err != nil {
+		file.Close()
+		return nil, err
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("map frame ring %v failed: %v", path, err)
+	}
+	return &frameRing{file: file, data: data, size: size, inUse: map[uint64]ringRegion{}}, nil
+}
+
+// close unmap the ring and close its file, the file itself is removed with the worker
+func (r *frameRing) close() error {
+	err := syscall.Munmap(r.data)
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// alloc reserve a region of length bytes at the head, or at the start if it does not fit before the end
+func (r *frameRing) alloc(length int64) (uint64, ringRegion, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	offset := r.head
+	if offset+length > r.size {
+		offset = 0
+	}
+	if offset+length > r.size {
+		return 0, ringRegion{}, false
+	}
+	for _, used := range r.inUse {
+		if offset < used.offset+used.length && used.offset < offset+length {
+			return 0, ringRegion{}, false
+		}
+	}
+
+	r.seq++
+	region := ringRegion{offset: offset, length: length}
+	r.inUse[r.seq] = region
+	r.head = offset + length
+	return r.seq, region, true
+}
+
+func (r *frameRing) release(seq uint64) {
+	r.lock.Lock()
+	delete(r.inUse, seq)
+	r.lock.Unlock()
+}
+
+// put copy the frame into its region of the mapping, return false if there is no room.
+// The region is reserved, so it is written outside the lock
+func (r *frameRing) put(data []byte, fileName string) (ShmFrame, bool) {
+	seq, region, ok := r.alloc(ringHeaderSize + int64(len(data)))
+	if !ok {
+		return ShmFrame{}, false
+	}
+
+	record := r.data[region.offset : region.offset+region.length]
+	binary.LittleEndian.PutUint64(record[0:8], seq)
+	binary.LittleEndian.PutUint64(record[8:16], uint64(len(data)))
+	copy(record[ringHeaderSize:], data)
+
+	return ShmFrame{Offset: region.offset, Length: int64(len(data)), Seq: seq, FileName: fileName}, true
+}
+
+// shmTransport move the file parts of multipart requests into the frame ring,
+// and send the rest of the request by the next transport
+type shmTransport struct {
+	ring *frameRing
+	next WorkerTransport
+}
+
+func (t *shmTransport) Name() string {
+	return TransportShm
+}
+
+func (t *shmTransport) Close() error {
+	t.next.Close()
+	return t.ring.close()
+}
+
+func (t *shmTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	mediaType, params, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || request.Body == nil {
+		return t.next.RoundTrip(request)
+	}
+
+	bodyReader, bodyWriter := io.Pipe()
+	multipartWriter := multipart.NewWriter(bodyWriter)
+
+	// seqs of the regions written, released once the request is answered
+	var seqs []uint64
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		err := t.rewrite(multipart.NewReader(request.Body, params["boundary"]), multipartWriter, &seqs)
+		request.Body.Close()
+		bodyWriter.CloseWithError(err)
+	}()
+
+	shmRequest := request.Clone(request.Context())
+	shmRequest.Body = bodyReader
+	shmRequest.ContentLength = -1
+	shmRequest.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+
+	resp, err := t.next.RoundTrip(shmRequest)
+	// unblock the writer if the request failed before the body is read
+	bodyReader.Close()
+	<-written
+	for _, seq := range seqs {
+		t.ring.release(seq)
+	}
+	return resp, err
+}
+
+// rewrite copy parts in order, a file part becomes a "<name>_shm" field if it fits in the ring
+func (t *shmTransport) rewrite(reader *multipart.Reader, writer *multipart.Writer, seqs *[]uint64) error {
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return writer.Close()
+		}
+		if err != nil {
+			return err
+		}
+
+		if part.FileName() == "" {
+			field, err := writer.CreateFormField(part.FormName())
+			if err == nil {
+				_, err = io.Copy(field, part)
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return err
+		}
+
+		if frame, ok := t.ring.put(data, part.FileName()); ok {
+			*seqs = append(*seqs, frame.Seq)
+			marshal, err := json.Marshal(frame)
+			if err != nil {
+				log.Panic(err)
+			}
+			if err = writer.WriteField(part.FormName()+"_shm", string(marshal)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		file, err := writer.CreateFormFile(part.FormName(), part.FileName())
+		if err == nil {
+			_, err = file.Write(data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package worker_pool
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"sigs.k8s.io/yaml"
+)
+
+// templateContainer is the name of the worker container in a pod template,
+// other containers of the template are kept as sidecars
+const templateContainer = "worker"
+
+// defaultTemplate is the template of task types without their own
+const defaultTemplate = "default"
+
+// A pod template is the yaml of a Pod merged under the pod generated by CreateWorker,
+// so it adds volumes, probes, node selectors, image pull secrets and env, while the generated
+// name, port, resources and host network always win. ${port}, ${task_name}, ${node_name}
+// and ${pod_name} in the yaml are replaced by the values of the worker before parsing.
+// The worker container takes the image of the template if it sets one
+var podTemplateLock = sync.RWMutex{}
+
+// map from task type to the yaml of its pod template
+var podTemplates = map[string]string{}
+
+var workerNamespace = "default"
+
+// WorkerNamespace is the namespace of worker pods
+func WorkerNamespace() string {
+	podTemplateLock.RLock()
+	defer podTemplateLock.RUnlock()
+	return workerNamespace
+}
+
+// LoadPodTemplatesFromEnv set the namespace by WORKER_NAMESPACE,
+// and load <task type>.yaml and default.yaml of the directory POD_TEMPLATE_DIR
+func LoadPodTemplatesFromEnv() error {
+	if namespace := os.Getenv("WORKER_NAMESPACE"); namespace != "" {
+		podTemplateLock.Lock()
+		workerNamespace = namespace
+		podTemplateLock.Unlock()
+	}
+
+	templateDir := os.Getenv("POD_TEMPLATE_DIR")
+	if templateDir == "" {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(templateDir, "*.yaml"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		rawTemplate, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		taskType := strings.TrimSuffix(filepath.Base(file), ".yaml")
+		if err = SetPodTemplate(taskType, string(rawTemplate)); err != nil {
+			return fmt.Errorf("pod template %v: %w", file, err)
+		}
+	}
+	return nil
+}
+
+// SetPodTemplate replace the template of the task type after checking it renders, an empty template removes it
+func SetPodTemplate(taskType, rawTemplate string) error {
+	if strings.TrimSpace(rawTemplate) == "" {
+		podTemplateLock.Lock()
+		delete(podTemplates, taskType)
+		podTemplateLock.Unlock()
+		log.Printf("pod template of %v removed", taskType)
+		return nil
+	}
+
+	sample := &corev1.Pod{
+		ObjectMeta: meta_v1.ObjectMeta{Name: taskType + "-20000-node"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: taskType + "-20000-node", Image: containerMap[taskType]}},
+		},
+	}
+	if _, err := mergePodTemplate(sample, rawTemplate, WorkerNamespace(), templateVars(taskType, "20000", "node", sample.Name)); err != nil {
+		return err
+	}
+
+	podTemplateLock.Lock()
+	podTemplates[taskType] = rawTemplate
+	podTemplateLock.Unlock()
+	log.Printf("pod template of %v loaded", taskType)
+	return nil
+}
+
+// GetPodTemplates return the yaml of every template by task type
+func GetPodTemplates() map[string]string {
+	podTemplateLock.RLock()
+	defer podTemplateLock.RUnlock()
+	templates := map[string]string{}
+	for taskType, rawTemplate := range podTemplates {
+		templates[taskType] = rawTemplate
+	}
+	return templates
+}
+
+func templateVars(taskType, port, nodeName, podName string) map[string]string {
+	return map[string]string{
+		"${port}":      port,
+		"${task_name}": taskType,
+		"${node_name}": nodeName,
+		"${pod_name}":  podName,
+	}
+}
+
+// applyPodTemplate merge the template of the worker's task type under the generated pod
+func applyPodTemplate(pod *corev1.Pod, worker *Worker) (*corev1.Pod, error) {
+	podTemplateLock.RLock()
+	rawTemplate, ok := podTemplates[worker.taskType]
+	if !ok {
+		rawTemplate, ok = podTemplates[defaultTemplate]
+	}
+	namespace := workerNamespace
+	podTemplateLock.RUnlock()
+	if !ok {
+		return pod, nil
+	}
+
+	return mergePodTemplate(pod, rawTemplate, namespace,
+		templateVars(worker.taskType, worker.port, worker.nodeName, pod.Name))
+}
+
+func mergePodTemplate(pod *corev1.Pod, rawTemplate, namespace string, vars map[string]string) (*corev1.Pod, error) {
+	for placeholder, value := range vars {
+		rawTemplate = strings.ReplaceAll(rawTemplate, placeholder, value)
+	}
+
+	template := &corev1.Pod{}
+	if err := yaml.UnmarshalStrict([]byte(rawTemplate), template); err != nil {
+		return nil, err
+	}
+	if template.Namespace != "" && template.Namespace != namespace {
+		return nil, fmt.Errorf("pod template namespace %v is not the worker namespace %v", template.Namespace, namespace)
+	}
+	template.Name = ""
+
+	// the generated pod has a single container, the worker
+	pod = pod.DeepCopy()
+	found := false
+	for i, container := range template.Spec.Containers {
+		if container.Name != templateContainer {
+			continue
+		}
+		template.Spec.Containers[i].Name = pod.Spec.Containers[0].Name
+		if container.Image != "" {
+			pod.Spec.Containers[0].Image = container.Image
+		}
+		found = true
+	}
+	if !found && len(template.Spec.Containers) != 0 {
+		return nil, fmt.Errorf("pod template has containers but none is named %v", templateContainer)
+	}
+	// the tolerations of the generated pod would replace those of the template
+	pod.Spec.Tolerations = append(template.Spec.Tolerations, pod.Spec.Tolerations...)
+
+	original, err := json.Marshal(template)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := json.Marshal(pod)
+	if err != nil {
+		return nil, err
+	}
+	merged, err := strategicpatch.StrategicMergePatch(original, patch, corev1.Pod{})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &corev1.Pod{}
+	if err = json.Unmarshal(merged, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
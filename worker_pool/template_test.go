@@ -0,0 +1,183 @@
+package worker_pool
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// generatedPod is the pod CreateWorker builds for det-20000-gpu1, before the template
+func generatedPod() *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "det-20000-gpu1"},
+		Spec: corev1.PodSpec{
+			HostNetwork: true,
+			Tolerations: []corev1.Toleration{{Key: "generated", Operator: corev1.TolerationOpExists}},
+			Containers: []corev1.Container{{
+				Name:  "det-20000-gpu1",
+				Image: "generated:1",
+				Ports: []corev1.ContainerPort{{ContainerPort: 20000}},
+				Env:   []corev1.EnvVar{{Name: "port", Value: "20000"}},
+				Resources: corev1.ResourceRequirements{
+					Limits: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m")},
+				},
+			}},
+		},
+	}
+}
+
+const fullTemplate = `
+metadata:
+  name: ignored
+  namespace: default
+  labels:
+    app: ${task_name}
+spec:
+  hostNetwork: false
+  nodeSelector:
+    kubernetes.io/hostname: ${node_name}
+  tolerations:
+  - key: template
+    operator: Exists
+  volumes:
+  - name: models
+    hostPath:
+      path: /models
+  containers:
+  - name: worker
+    image: registry/worker:${port}
+    env:
+    - name: port
+      value: "1"
+    - name: POD
+      value: ${pod_name}
+    resources:
+      limits:
+        cpu: "4"
+    volumeMounts:
+    - name: models
+      mountPath: /models
+  - name: sidecar
+    image: sidecar:1
+`
+
+func mergeGenerated(t *testing.T, rawTemplate string) (*corev1.Pod, error) {
+	pod := generatedPod()
+	merged, err := mergePodTemplate(pod, rawTemplate, "default", templateVars("det", "20000", "gpu1", pod.Name))
+	if pod.Spec.Containers[0].Image != "generated:1" || len(pod.Spec.Tolerations) != 1 {
+		t.Fatal("the generated pod should not be modified")
+	}
+	return merged, err
+}
+
+func envOf(container corev1.Container) map[string]string {
+	env := map[string]string{}
+	for _, variable := range container.Env {
+		env[variable.Name] = variable.Value
+	}
+	return env
+}
+
+func TestMergePodTemplate(t *testing.T) {
+	pod, err := mergeGenerated(t, fullTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// generated fields win
+	if pod.Name != "det-20000-gpu1" || !pod.Spec.HostNetwork {
+		t.Fatalf("the generated name and host network should win, got %v %v", pod.Name, pod.Spec.HostNetwork)
+	}
+	if len(pod.Spec.Containers) != 2 {
+		t.Fatalf("the worker and the sidecar should be kept, got %+v", pod.Spec.Containers)
+	}
+	worker := pod.Spec.Containers[0]
+	if worker.Name != "det-20000-gpu1" {
+		t.Fatalf("the worker container should take the generated name, got %v", worker.Name)
+	}
+	if cpu := worker.Resources.Limits[corev1.ResourceCPU]; cpu.String() != "100m" {
+		t.Fatalf("the generated cpu limit should win, got %v", cpu.String())
+	}
+	env := envOf(worker)
+	if env["port"] != "20000" {
+		t.Fatalf("the generated port env should win, got %v", env["port"])
+	}
+	if len(worker.Ports) != 1 || worker.Ports[0].ContainerPort != 20000 {
+		t.Fatalf("the generated port should be kept, got %+v", worker.Ports)
+	}
+
+	// the template adds the rest
+	if worker.Image != "registry/worker:20000" {
+		t.Fatalf("the template image should override, got %v", worker.Image)
+	}
+	if len(worker.VolumeMounts) != 1 || len(pod.Spec.Volumes) != 1 {
+		t.Fatalf("the volumes of the template should be added, got %+v", pod.Spec.Volumes)
+	}
+	if sidecar := pod.Spec.Containers[1]; sidecar.Name != "sidecar" || sidecar.Image != "sidecar:1" {
+		t.Fatalf("the sidecar should be kept as is, got %+v", sidecar)
+	}
+	if len(pod.Spec.Tolerations) != 2 || pod.Spec.Tolerations[0].Key != "template" ||
+		pod.Spec.Tolerations[1].Key != "generated" {
+		t.Fatalf("the tolerations should be appended, got %+v", pod.Spec.Tolerations)
+	}
+
+	// placeholders are replaced by the values of the worker
+	if pod.Labels["app"] != "det" || pod.Spec.NodeSelector["kubernetes.io/hostname"] != "gpu1" ||
+		env["POD"] != "det-20000-gpu1" {
+		t.Fatalf("the placeholders should be replaced, got %v %v %v", pod.Labels, pod.Spec.NodeSelector, env)
+	}
+}
+
+func TestMergePodTemplateKeepsImage(t *testing.T) {
+	pod, err := mergeGenerated(t, `
+spec:
+  containers:
+  - name: worker
+    env:
+    - name: EXTRA
+      value: "1"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if worker := pod.Spec.Containers[0]; worker.Image != "generated:1" || envOf(worker)["EXTRA"] != "1" {
+		t.Fatalf("a template without image should keep the generated one, got %+v", worker)
+	}
+}
+
+func TestMergePodTemplateRefused(t *testing.T) {
+	for name, rawTemplate := range map[string]string{
+		"namespace mismatch":  "metadata:\n  namespace: other\n",
+		"no worker container": "spec:\n  containers:\n  - name: sidecar\n    image: sidecar:1\n",
+		"unknown field":       "spec:\n  unknownField: 1\n",
+	} {
+		if _, err := mergeGenerated(t, rawTemplate); err == nil {
+			t.Fatalf("the template with %v should be refused", name)
+		}
+	}
+}
+
+// a task type without its own template uses the default one
+func TestApplyPodTemplateDefault(t *testing.T) {
+	if err := SetPodTemplate(defaultTemplate, "metadata:\n  labels:\n    app: ${task_name}\n"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetPodTemplate(defaultTemplate, "") })
+	if err := SetPodTemplate("template-test", "metadata:\n  namespace: other\n"); err == nil {
+		t.Fatal("a template which does not render should be refused")
+	}
+
+	worker := &Worker{taskType: "det", port: "20000", nodeName: "gpu1"}
+	pod, err := applyPodTemplate(generatedPod(), worker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pod.Labels["app"] != "det" {
+		t.Fatalf("the default template should apply, got %v", pod.Labels)
+	}
+	if _, ok := GetPodTemplates()["template-test"]; ok {
+		t.Fatal("the refused template should not be stored")
+	}
+}
@@ -0,0 +1,326 @@
+package worker_pool
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultTenant is the tenant of requests whose identity belongs to no tenant.
+// It is limited like any tenant by a config of this id, e.g. {"id": "default", "quotas": {"det": 2}},
+// or else by DefaultTenantQuotas
+const DefaultTenant = "default"
+
+// DefaultTenantQuotas is the quotas of DefaultTenant when the tenant configs have none for it,
+// set by the json of DEFAULT_TENANT_QUOTAS before the tenants are configured
+var DefaultTenantQuotas = map[string]int{}
+
+// LoadDefaultTenantQuotasFromEnv load DEFAULT_TENANT_QUOTAS, e.g. {"det": 2, "fusion": 2}
+func LoadDefaultTenantQuotasFromEnv() error {
+	rawQuotas := os.Getenv("DEFAULT_TENANT_QUOTAS")
+	if rawQuotas == "" {
+		return nil
+	}
+	quotas := map[string]int{}
+	if err := json.Unmarshal([]byte(rawQuotas), &quotas); err != nil {
+		return err
+	}
+	for taskType, quota := range quotas {
+		if quota < 0 {
+			return fmt.Errorf("invalid quota %v of %v", quota, taskType)
+		}
+	}
+	DefaultTenantQuotas = quotas
+	return SetTenants(nil)
+}
+
+// TenantConfig is an application sharing the scheduler.
+// Weight is its share of workers when tenants compete in the pending queue, default 1.
+// Quotas limit the workers of a task type held by the tenant at the same time,
+// a task type not in Quotas is unlimited
+type TenantConfig struct {
+	ID      string         `json:"id"`
+	APIKeys []string       `json:"api_keys,omitempty"`
+	Weight  int            `json:"weight"`
+	Quotas  map[string]int `json:"quotas"`
+}
+
+// TenantUsage is the usage report of a tenant
+type TenantUsage struct {
+	Tenant              string         `json:"tenant"`
+	Weight              int            `json:"weight"`
+	Quotas              map[string]int `json:"quotas"`
+	InUse               map[string]int `json:"in_use"`
+	WorkerSeconds       float64        `json:"worker_seconds"`
+	Frames              int64          `json:"frames"`
+	CPUMillicoreSeconds float64        `json:"cpu_millicore_seconds"`
+}
+
+type tenantState struct {
+	inUse         map[string]int
+	workerSeconds float64
+	frames        int64
+	cpu           float64
+}
+
+// tenantBinding is the tenant holding the worker of a task id
+type tenantBinding struct {
+	tenant   string
+	taskType string
+	since    time.Time
+}
+
+// all guarded by workerSelectionLock
+var tenantConfigs = map[string]*TenantConfig{}
+var tenantAPIKeys = map[string]string{}
+var tenantStates = map[string]*tenantState{}
+var taskTenants = map[string]*tenantBinding{}
+
+// SetTenants replace all tenant configs, the usage of existing tenants is kept
+func SetTenants(configs []*TenantConfig) error {
+	newConfigs := map[string]*TenantConfig{}
+	newAPIKeys := map[string]string{}
+	for _, config := range configs {
+		if config.ID == "" {
+			return fmt.Errorf("tenant without id")
+		}
+		if _, ok := newConfigs[config.ID]; ok {
+			return fmt.Errorf("duplicated tenant %v", config.ID)
+		}
+		if config.Weight < 0 {
+			return fmt.Errorf("invalid weight %v of tenant %v", config.Weight, config.ID)
+		}
+		if config.Weight == 0 {
+			config.Weight = 1
+		}
+		if config.ID == DefaultTenant && len(config.APIKeys) != 0 {
+			return fmt.Errorf("tenant %v is for requests without api key", DefaultTenant)
+		}
+		for _, apiKey := range config.APIKeys {
+			if _, ok := newAPIKeys[apiKey]; ok {
+				return fmt.Errorf("api key of tenant %v is used by another tenant", config.ID)
+			}
+			newAPIKeys[apiKey] = config.ID
+		}
+		newConfigs[config.ID] = config
+	}
+	if _, ok := newConfigs[DefaultTenant]; !ok && len(DefaultTenantQuotas) != 0 {
+		newConfigs[DefaultTenant] = &TenantConfig{ID: DefaultTenant, Weight: 1, Quotas: DefaultTenantQuotas}
+	}
+
+	workerSelectionLock.Lock()
+	tenantConfigs = newConfigs
+	tenantAPIKeys = newAPIKeys
+	dispatchLocked()
+	workerSelectionLock.Unlock()
+	return nil
+}
+
+// TenantAPIKeys return the map from api key to tenant, the keys authenticate devices of the tenant
+func TenantAPIKeys() map[string]string {
+	workerSelectionLock.Lock()
+	defer workerSelectionLock.Unlock()
+	keys := map[string]string{}
+	for apiKey, tenant := range tenantAPIKeys {
+		keys[apiKey] = tenant
+	}
+	return keys
+}
+
+func tenantStateLocked(tenant string) *tenantState {
+	state, ok := tenantStates[tenant]
+	if !ok {
+		state = &tenantState{inUse: map[string]int{}}
+		tenantStates[tenant] = state
+	}
+	return state
+}
+
+func tenantWeightLocked(tenant string) int {
+	if config, ok := tenantConfigs[tenant]; ok {
+		return config.Weight
+	}
+	return 1
+}
+
+// overQuotaLocked tell whether the tenant holds all workers of taskType its quota allows
+func overQuotaLocked(tenant, taskType string) bool {
+	config, ok := tenantConfigs[tenant]
+	if !ok {
+		return false
+	}
+	quota, ok := config.Quotas[taskType]
+	if !ok {
+		return false
+	}
+	return tenantStateLocked(tenant).inUse[taskType] >= quota
+}
+
+// tenantShareLocked is the workers held by the tenant divided by its weight,
+// the tenant with the lowest share is served first among tasks of the same class
+func tenantShareLocked(tenant string) float64 {
+	held := 0
+	for _, inUse := range tenantStateLocked(tenant).inUse {
+		held += inUse
+	}
+	return float64(held) / float64(tenantWeightLocked(tenant))
+}
+
+// bindTenantLocked account the worker of taskID to the tenant
+func bindTenantLocked(tenant, taskType, taskID string) {
+	if tenant == "" {
+		tenant = DefaultTenant
+	}
+	tenantStateLocked(tenant).inUse[taskType]++
+	taskTenants[taskID] = &tenantBinding{tenant: tenant, taskType: taskType, since: time.Now()}
+}
+
+// releaseTenantLocked stop accounting the worker of taskID
+func releaseTenantLocked(taskID string) {
+	binding, ok := taskTenants[taskID]
+	if !ok {
+		return
+	}
+	delete(taskTenants, taskID)
+
+	state := tenantStateLocked(binding.tenant)
+	state.inUse[binding.taskType]--
+	state.workerSeconds += time.Since(binding.since).Seconds()
+}
+
+// RecordFrame count a frame processed for the tenant of taskID
+func RecordFrame(taskID string) {
+	workerSelectionLock.Lock()
+	if binding, ok := taskTenants[taskID]; ok {
+		tenantStateLocked(binding.tenant).frames++
+	}
+	workerSelectionLock.Unlock()
+}
+
+// GetTenantUsage return the usage of every tenant, worker seconds include workers still held
+func GetTenantUsage() []TenantUsage {
+	workerSelectionLock.Lock()
+	defer workerSelectionLock.Unlock()
+
+	tenants := map[string]bool{DefaultTenant: true}
+	for tenant := range tenantConfigs {
+		tenants[tenant] = true
+	}
+	for tenant := range tenantStates {
+		tenants[tenant] = true
+	}
+
+	held := map[string]float64{}
+	for _, binding := range taskTenants {
+		held[binding.tenant] += time.Since(binding.since).Seconds()
+	}
+
+	usages := []TenantUsage{}
+	for tenant := range tenants {
+		state := tenantStateLocked(tenant)
+		usage := TenantUsage{
+			Tenant:              tenant,
+			Weight:              tenantWeightLocked(tenant),
+			Quotas:              map[string]int{},
+			InUse:               map[string]int{},
+			WorkerSeconds:       state.workerSeconds + held[tenant],
+			Frames:              state.frames,
+			CPUMillicoreSeconds: state.cpu,
+		}
+		if config, ok := tenantConfigs[tenant]; ok {
+			for taskType, quota := range config.Quotas {
+				usage.Quotas[taskType] = quota
+			}
+		}
+		for taskType, inUse := range state.inUse {
+			usage.InUse[taskType] = inUse
+		}
+		usages = append(usages, usage)
+	}
+
+	sort.Slice(usages, func(i, j int) bool {
+		return usages[i].Tenant < usages[j].Tenant
+	})
+	return usages
+}
+
+// RunTenantCPUSampler add the cpu usage of workers held by each tenant every interval, never return
+func RunTenantCPUSampler(interval time.Duration) {
+	for range time.Tick(interval) {
+		sampleTenantCPU(interval)
+	}
+}
+
+func sampleTenantCPU(interval time.Duration) {
+	// metrics server may be unavailable, it should not crash the scheduler
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("sample cpu usage of tenants failed: %v", err)
+		}
+	}()
+
+	workerSelectionLock.Lock()
+	podTenants := map[string]string{}
+	for taskID, binding := range taskTenants {
+		if worker, ok := LookupWorker(taskID); ok && worker.podName != "" {
+			podTenants[worker.podName] = binding.tenant
+		}
+	}
+	workerSelectionLock.Unlock()
+
+	cpu := map[string]float64{}
+	for podName, tenant := range podTenants {
+		usage := QueryResourceUsage(podName)
+		if usage.Available {
+			cpu[tenant] += float64(usage.CPU) * interval.Seconds()
+		}
+	}
+
+	workerSelectionLock.Lock()
+	for tenant, millicoreSeconds := range cpu {
+		tenantStateLocked(tenant).cpu += millicoreSeconds
+	}
+	workerSelectionLock.Unlock()
+
+	sample := CPUSample{At: time.Now(), Tenants: map[string]float64{}}
+	for tenant, millicoreSeconds := range cpu {
+		sample.Tenants[tenant] = millicoreSeconds / interval.Seconds()
+	}
+	cpuSampleLock.Lock()
+	cpuSamples = append(cpuSamples, sample)
+	if len(cpuSamples) > cpuHistorySize {
+		cpuSamples = cpuSamples[len(cpuSamples)-cpuHistorySize:]
+	}
+	cpuSampleLock.Unlock()
+}
+
+// CPUSample is the cpu usage in millicores of the workers held by each tenant at a sampling
+type CPUSample struct {
+	At      time.Time          `json:"at"`
+	Tenants map[string]float64 `json:"tenants"`
+}
+
+// cpuHistorySize is how many samplings are kept for the dashboard
+const cpuHistorySize = 240
+
+var cpuSampleLock = sync.Mutex{}
+
+// ring of the latest samplings, oldest first
+var cpuSamples []CPUSample
+
+// GetCPUSamples return the samplings after since, oldest first
+func GetCPUSamples(since time.Time) []CPUSample {
+	cpuSampleLock.Lock()
+	defer cpuSampleLock.Unlock()
+	samples := []CPUSample{}
+	for _, sample := range cpuSamples {
+		if sample.At.After(since) {
+			samples = append(samples, sample)
+		}
+	}
+	return samples
+}
@@ -0,0 +1,120 @@
+package worker_pool
+
+import (
+	"testing"
+)
+
+// useTenants configure tenants for a test, the tenants and their usage are cleared afterwards
+func useTenants(t *testing.T, configs []*TenantConfig) {
+	previousQuotas := DefaultTenantQuotas
+	t.Cleanup(func() {
+		DefaultTenantQuotas = previousQuotas
+		workerSelectionLock.Lock()
+		tenantConfigs, tenantAPIKeys = map[string]*TenantConfig{}, map[string]string{}
+		tenantStates, taskTenants = map[string]*tenantState{}, map[string]*tenantBinding{}
+		workerSelectionLock.Unlock()
+	})
+	if err := SetTenants(configs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetTenantsValidate(t *testing.T) {
+	useTenants(t, nil)
+	cases := map[string][]*TenantConfig{
+		"without id":           {{Weight: 1}},
+		"duplicated":           {{ID: "a"}, {ID: "a"}},
+		"negative weight":      {{ID: "a", Weight: -1}},
+		"shared api key":       {{ID: "a", APIKeys: []string{"k"}}, {ID: "b", APIKeys: []string{"k"}}},
+		"default with api key": {{ID: DefaultTenant, APIKeys: []string{"k"}}},
+	}
+	for name, configs := range cases {
+		if err := SetTenants(configs); err == nil {
+			t.Fatalf("%v should fail", name)
+		}
+	}
+
+	if err := SetTenants([]*TenantConfig{{ID: "a", APIKeys: []string{"k"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if keys := TenantAPIKeys(); len(keys) != 1 || keys["k"] != "a" {
+		t.Fatalf("unexpected api keys %v", keys)
+	}
+	workerSelectionLock.Lock()
+	weight := tenantWeightLocked("a")
+	workerSelectionLock.Unlock()
+	if weight != 1 {
+		t.Fatalf("the weight should default to 1, got %v", weight)
+	}
+}
+
+func TestDefaultTenantQuotas(t *testing.T) {
+	useTenants(t, nil)
+	t.Setenv("DEFAULT_TENANT_QUOTAS", `{"det": 1}`)
+	if err := LoadDefaultTenantQuotasFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+
+	workerSelectionLock.Lock()
+	bindTenantLocked("", "det", "task-1")
+	over := overQuotaLocked(DefaultTenant, "det")
+	unlimited := overQuotaLocked(DefaultTenant, "slam")
+	workerSelectionLock.Unlock()
+	if !over || unlimited {
+		t.Fatalf("the default tenant should be limited by DEFAULT_TENANT_QUOTAS, got %v %v", over, unlimited)
+	}
+
+	// a config of the default tenant wins over DEFAULT_TENANT_QUOTAS
+	if err := SetTenants([]*TenantConfig{{ID: DefaultTenant, Quotas: map[string]int{"det": 2}}}); err != nil {
+		t.Fatal(err)
+	}
+	workerSelectionLock.Lock()
+	over = overQuotaLocked(DefaultTenant, "det")
+	workerSelectionLock.Unlock()
+	if over {
+		t.Fatal("the configured quota of the default tenant should be used")
+	}
+
+	t.Setenv("DEFAULT_TENANT_QUOTAS", `{"det": -1}`)
+	if err := LoadDefaultTenantQuotasFromEnv(); err == nil {
+		t.Fatal("a negative quota should fail")
+	}
+}
+
+func TestTenantAccounting(t *testing.T) {
+	useTenants(t, []*TenantConfig{
+		{ID: "a", Weight: 2, Quotas: map[string]int{"det": 2}},
+		{ID: "b", Weight: 1},
+	})
+
+	workerSelectionLock.Lock()
+	bindTenantLocked("a", "det", "task-1")
+	bindTenantLocked("a", "det", "task-2")
+	bindTenantLocked("b", "det", "task-3")
+	over := overQuotaLocked("a", "det")
+	shareA, shareB := tenantShareLocked("a"), tenantShareLocked("b")
+	workerSelectionLock.Unlock()
+	if !over {
+		t.Fatal("tenant a should be at its quota")
+	}
+	if shareA != 1 || shareB != 1 {
+		t.Fatalf("shares should be divided by weight, got %v %v", shareA, shareB)
+	}
+
+	RecordFrame("task-1")
+	RecordFrame("unknown")
+	workerSelectionLock.Lock()
+	releaseTenantLocked("task-1")
+	releaseTenantLocked("task-1")
+	over = overQuotaLocked("a", "det")
+	workerSelectionLock.Unlock()
+	if over {
+		t.Fatal("a released worker should free the quota")
+	}
+
+	for _, usage := range GetTenantUsage() {
+		if usage.Tenant == "a" && (usage.InUse["det"] != 1 || usage.Frames != 1 || usage.Quotas["det"] != 2) {
+			t.Fatalf("unexpected usage %+v", usage)
+		}
+	}
+}
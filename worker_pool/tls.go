@@ -0,0 +1,96 @@
+package worker_pool
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// WorkerTLSConfig is how the scheduler connects to workers over https.
+// CAFile verifies worker certificates, the system roots are used if it is empty.
+// CertFile and KeyFile are the client certificate presented to workers, optional.
+// ServerName overrides the name verified in worker certificates, since workers are dialed by ip
+type WorkerTLSConfig struct {
+	CAFile     string `json:"ca_file"`
+	CertFile   string `json:"cert_file"`
+	KeyFile    string `json:"key_file"`
+	ServerName string `json:"server_name"`
+}
+
+var workerClientLock = sync.RWMutex{}
+
+// workerScheme is the scheme of worker urls, https once ConfigureWorkerTLS is called
+var workerScheme = "http"
+
+// workerClient is built by newWorkerClient, see client.go
+var workerClient *http.Client
+
+// ConfigureWorkerTLS send all worker traffic over https
+func ConfigureWorkerTLS(config WorkerTLSConfig) error {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: config.ServerName,
+	}
+
+	if config.CAFile != "" {
+		rawCA, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(rawCA) {
+			return fmt.Errorf("no certificate found in %v", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	workerClientLock.Lock()
+	previous := workerClient
+	workerScheme = "https"
+	workerTLSConfig = tlsConfig
+	workerClient = newWorkerClient(workerClientConfig, tlsConfig)
+	workerClientLock.Unlock()
+
+	previous.CloseIdleConnections()
+	return nil
+}
+
+// LoadWorkerTLSFromEnv enable https to workers if WORKER_TLS is true or WORKER_TLS_CA is set,
+// with WORKER_TLS_CA, WORKER_TLS_CERT, WORKER_TLS_KEY and WORKER_TLS_SERVER_NAME
+func LoadWorkerTLSFromEnv() error {
+	config := WorkerTLSConfig{
+		CAFile:     os.Getenv("WORKER_TLS_CA"),
+		CertFile:   os.Getenv("WORKER_TLS_CERT"),
+		KeyFile:    os.Getenv("WORKER_TLS_KEY"),
+		ServerName: os.Getenv("WORKER_TLS_SERVER_NAME"),
+	}
+	if os.Getenv("WORKER_TLS") != "true" && config.CAFile == "" {
+		return nil
+	}
+	return ConfigureWorkerTLS(config)
+}
+
+// WorkerClient return the http client for requests to workers
+func WorkerClient() *http.Client {
+	workerClientLock.RLock()
+	defer workerClientLock.RUnlock()
+	return workerClient
+}
+
+// WorkerScheme return http or https
+func WorkerScheme() string {
+	workerClientLock.RLock()
+	defer workerClientLock.RUnlock()
+	return workerScheme
+}
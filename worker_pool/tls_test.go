@@ -0,0 +1,103 @@
+package worker_pool
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeClientCert write a self-signed client certificate of commonName and its key into dir
+func writeClientCert(t *testing.T, dir, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	rawCert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, commonName+".pem"), filepath.Join(dir, commonName+"-key.pem")
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rawCert}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawKey}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// configuring worker tls again replaces the client, so workers see the new client certificate
+func TestConfigureWorkerTLS(t *testing.T) {
+	workerClientLock.Lock()
+	previousScheme, previousClient, previousTLS := workerScheme, workerClient, workerTLSConfig
+	workerClientLock.Unlock()
+	t.Cleanup(func() {
+		workerClientLock.Lock()
+		workerScheme, workerClient, workerTLSConfig = previousScheme, previousClient, previousTLS
+		workerClientLock.Unlock()
+	})
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	rawCA := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, rawCA, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"first", "second"} {
+		certFile, keyFile := writeClientCert(t, dir, name)
+		if err := ConfigureWorkerTLS(WorkerTLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}); err != nil {
+			t.Fatal(err)
+		}
+		if WorkerScheme() != "https" {
+			t.Fatalf("expected https, got %v", WorkerScheme())
+		}
+		resp, err := WorkerClient().Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		presented, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(presented) != name {
+			t.Fatalf("expected the certificate %v, got %v", name, string(presented))
+		}
+	}
+
+	if err := ConfigureWorkerTLS(WorkerTLSConfig{CAFile: filepath.Join(dir, "first.pem"), CertFile: "missing.pem",
+		KeyFile: "missing-key.pem"}); err == nil {
+		t.Fatal("a missing client certificate should fail")
+	}
+}
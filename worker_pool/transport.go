@@ -0,0 +1,287 @@
+package worker_pool
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	TransportHTTP = "http"
+	TransportUnix = "unix"
+	TransportShm  = "shm"
+)
+
+// WorkerTransport carries the requests of the scheduler to a worker.
+// Requests keep their http urls, a transport only changes how the bytes get to the worker
+type WorkerTransport interface {
+	Name() string
+	RoundTrip(request *http.Request) (*http.Response, error)
+	Close() error
+}
+
+// TransportSpec is how a worker co-located with the scheduler wants to receive requests,
+// sent in the json body of /worker_register with the register token of the worker.
+// The paths are chosen by the scheduler and given to the pod by env, see SocketPathOf and ShmPathOf.
+// A worker may leave them empty, other paths are refused.
+// SocketPath is the unix socket the worker listens on, for unix and optionally for shm.
+// ShmPath and ShmSize are the file in /dev/shm of the frame ring, see shm.go
+type TransportSpec struct {
+	Port       string `json:"port"`
+	Transport  string `json:"transport"`
+	Token      string `json:"token,omitempty"`
+	SocketPath string `json:"socket_path,omitempty"`
+	ShmPath    string `json:"shm_path,omitempty"`
+	ShmSize    int64  `json:"shm_size,omitempty"`
+}
+
+// shmDir is where frame rings are created
+const shmDir = "/dev/shm"
+
+// WorkerSocketDir is where co-located workers listen on unix sockets, set by WORKER_SOCKET_DIR
+var WorkerSocketDir = "/tmp/scheduler-workers"
+
+// maxShmSize limits the frame ring a worker can ask the scheduler to create
+const maxShmSize = 1024 * 1024 * 1024
+
+// SocketPathOf is the only unix socket the scheduler dials for the worker
+func SocketPathOf(worker *Worker) string {
+	return filepath.Join(WorkerSocketDir, worker.wokerName+".sock")
+}
+
+// ShmPathOf is the only frame ring the scheduler creates for the worker
+func ShmPathOf(worker *Worker) string {
+	return filepath.Join(shmDir, "scheduler-"+worker.wokerName+".ring")
+}
+
+func newRegisterToken() string {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		log.Panic(err)
+	}
+	return hex.EncodeToString(raw)
+}
+
+// CheckRegisterToken tell whether the token is the one given to the pod of the worker
+func (w *Worker) CheckRegisterToken(token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(w.registerToken)) == 1
+}
+
+// IsLocalIP tell whether the ip is an address of the host the scheduler runs on
+func IsLocalIP(rawIP string) bool {
+	ip := net.ParseIP(rawIP)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSpec replace the paths of the spec by the ones of the worker, refuse other paths
+func resolveSpec(worker *Worker, spec TransportSpec) (TransportSpec, error) {
+	socketPath, shmPath := SocketPathOf(worker), ShmPathOf(worker)
+	if spec.SocketPath != "" && spec.SocketPath != socketPath {
+		return spec, fmt.Errorf("socket_path of %v should be %v", worker.wokerName, socketPath)
+	}
+	if spec.ShmPath != "" && spec.ShmPath != shmPath {
+		return spec, fmt.Errorf("shm_path of %v should be %v", worker.wokerName, shmPath)
+	}
+	if spec.ShmSize < 0 || spec.ShmSize > maxShmSize {
+		return spec, fmt.Errorf("shm_size should be in [0, %v]", maxShmSize)
+	}
+	switch spec.Transport {
+	case TransportUnix:
+		spec.SocketPath = socketPath
+	case TransportShm:
+		spec.ShmPath = shmPath
+		if spec.SocketPath != "" {
+			spec.SocketPath = socketPath
+		}
+	}
+	return spec, nil
+}
+
+// httpTransport is the default transport, tcp connections pooled per worker
+type httpTransport struct {
+	*http.Transport
+}
+
+func (t *httpTransport) Name() string {
+	return TransportHTTP
+}
+
+func (t *httpTransport) Close() error {
+	t.CloseIdleConnections()
+	return nil
+}
+
+// newUnixTransport dial the unix socket whatever the host of the request url is
+func newUnixTransport(socketPath string, config WorkerClientConfig) *httpTransport {
+	transport := newHTTPTransport(config, nil)
+	dialer := &net.Dialer{Timeout: millis(config.DialTimeoutMs)}
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", socketPath)
+	}
+	return &httpTransport{transport}
+}
+
+type unixTransport struct {
+	*httpTransport
+}
+
+func (t *unixTransport) Name() string {
+	return TransportUnix
+}
+
+// RoundTrip send https requests in plain http, the socket never leaves the host
+func (t *unixTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.URL.Scheme == "https" {
+		request = request.Clone(request.Context())
+		request.URL.Scheme = "http"
+	}
+	return t.httpTransport.RoundTrip(request)
+}
+
+// map from host of a worker to its WorkerTransport, workers not in it use the default http transport
+var workerTransports = map[string]WorkerTransport{}
+
+var workerTransportLock = sync.RWMutex{}
+
+// routeTransport send each request by the transport of its worker
+type routeTransport struct {
+	fallback *httpTransport
+}
+
+func (t *routeTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	workerTransportLock.RLock()
+	transport, ok := workerTransports[request.URL.Host]
+	workerTransportLock.RUnlock()
+	if !ok {
+		return t.fallback.RoundTrip(request)
+	}
+	return transport.RoundTrip(request)
+}
+
+// newWorkerTransport build the transport of the spec, the client config applies to its connections
+func newWorkerTransport(spec TransportSpec, config WorkerClientConfig,
+	tlsConfig *tls.Config) (WorkerTransport, error) {
+	switch spec.Transport {
+	case TransportUnix:
+		return &unixTransport{newUnixTransport(spec.SocketPath, config)}, nil
+	case TransportShm:
+		var next WorkerTransport
+		if spec.SocketPath != "" {
+			next = &unixTransport{newUnixTransport(spec.SocketPath, config)}
+		} else {
+			next = &httpTransport{newHTTPTransport(config, tlsConfig)}
+		}
+		ring, err := openFrameRing(spec.ShmPath, spec.ShmSize)
+		if err != nil {
+			next.Close()
+			return nil, err
+		}
+		return &shmTransport{ring: ring, next: next}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %v", spec.Transport)
+	}
+}
+
+// SetWorkerTransport select the transport of a worker, TransportHTTP restores the default.
+// The caller should have checked the worker is on the host of the scheduler and the register token
+func SetWorkerTransport(worker *Worker, spec TransportSpec) error {
+	var transport WorkerTransport
+	if spec.Transport != TransportHTTP && spec.Transport != "" {
+		var err error
+		if spec, err = resolveSpec(worker, spec); err != nil {
+			return err
+		}
+		workerClientLock.RLock()
+		config, tlsConfig := workerClientConfig, workerTLSConfig
+		workerClientLock.RUnlock()
+		if transport, err = newWorkerTransport(spec, config, tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	host := net.JoinHostPort(worker.ip, worker.port)
+	workerTransportLock.Lock()
+	previous, ok := workerTransports[host]
+	if transport == nil {
+		delete(workerTransports, host)
+	} else {
+		workerTransports[host] = transport
+	}
+	workerTransportLock.Unlock()
+
+	if ok {
+		previous.Close()
+	}
+	log.Printf("worker %v uses %v transport", worker.GetWorkerName(), transportName(transport))
+	return nil
+}
+
+// removeWorkerTransport close the transport of a deleted worker
+func removeWorkerTransport(worker *Worker) {
+	host := net.JoinHostPort(worker.ip, worker.port)
+	workerTransportLock.Lock()
+	transport, ok := workerTransports[host]
+	delete(workerTransports, host)
+	workerTransportLock.Unlock()
+
+	if ok {
+		transport.Close()
+		os.Remove(ShmPathOf(worker))
+	}
+}
+
+func transportName(transport WorkerTransport) string {
+	if transport == nil {
+		return TransportHTTP
+	}
+	return transport.Name()
+}
+
+// transportOfHost return the transport name of the worker host
+func transportOfHost(host string) string {
+	workerTransportLock.RLock()
+	defer workerTransportLock.RUnlock()
+	return transportName(workerTransports[host])
+}
+
+// FindWorker return the worker listening on the ip and port
+func FindWorker(ip, port string) (*Worker, bool) {
+	var found *Worker
+	WorkerMap.Range(func(key, value any) bool {
+		value.(*sync.Map).Range(func(key, value any) bool {
+			worker := value.(*Worker)
+			if worker.ip == ip && worker.port == port {
+				found = worker
+				return false
+			}
+			return true
+		})
+		return found == nil
+	})
+	return found, found != nil
+}
@@ -0,0 +1,227 @@
+package worker_pool
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// serveUnix serve handler on a unix socket in a temporary dir, return the socket path
+func serveUnix(t *testing.T, handler http.HandlerFunc) string {
+	socketPath := filepath.Join(t.TempDir(), "worker.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return socketPath
+}
+
+// postForm post a multipart body of fields and a "frame" file by the transport
+func postForm(t *testing.T, transport WorkerTransport, fields map[string]string, frame []byte) string {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for key, value := range fields {
+		if err := writer.WriteField(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file, err := writer.CreateFormFile("frame", "input.png")
+	if err == nil {
+		_, err = file.Write(frame)
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the host is never dialed, the transport goes to the socket of the worker
+	request, err := http.NewRequest(http.MethodPost, "https://10.0.0.1:9000/run_task", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	resp, err := transport.RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	answer, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("worker answers %v: %s", resp.StatusCode, answer)
+	}
+	return string(answer)
+}
+
+func TestUnixTransport(t *testing.T) {
+	socketPath := serveUnix(t, func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1024 * 1024); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		file, _, err := r.FormFile("frame")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		frame, _ := io.ReadAll(file)
+		fmt.Fprintf(w, "%v %v %s", r.URL.Path, r.FormValue("task_id"), frame)
+	})
+
+	transport, err := newWorkerTransport(TransportSpec{Transport: TransportUnix, SocketPath: socketPath},
+		DefaultWorkerClientConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+
+	if answer := postForm(t, transport, map[string]string{"task_id": "1"}, []byte("frame")); answer != "/run_task 1 frame" {
+		t.Fatalf("worker answers %q", answer)
+	}
+}
+
+// readShmFrame read the frame of the "frame_shm" field from the ring file, as a worker does
+func readShmFrame(ringPath, field string) ([]byte, error) {
+	var frame ShmFrame
+	if err := json.Unmarshal([]byte(field), &frame); err != nil {
+		return nil, err
+	}
+	ring, err := os.ReadFile(ringPath)
+	if err != nil {
+		return nil, err
+	}
+	header := ring[frame.Offset : frame.Offset+ringHeaderSize]
+	if seq := binary.LittleEndian.Uint64(header[0:8]); seq != frame.Seq {
+		return nil, fmt.Errorf("seq in ring is %v, want %v", seq, frame.Seq)
+	}
+	if length := binary.LittleEndian.Uint64(header[8:16]); int64(length) != frame.Length {
+		return nil, fmt.Errorf("length in ring is %v, want %v", length, frame.Length)
+	}
+	start := frame.Offset + ringHeaderSize
+	return ring[start : start+frame.Length], nil
+}
+
+func TestShmTransport(t *testing.T) {
+	ringPath := filepath.Join(t.TempDir(), "worker.ring")
+	socketPath := serveUnix(t, func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1024 * 1024); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var frame []byte
+		if field := r.FormValue("frame_shm"); field != "" {
+			var err error
+			if frame, err = readShmFrame(ringPath, field); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintf(w, "shm ")
+		} else {
+			file, _, err := r.FormFile("frame")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			frame, _ = io.ReadAll(file)
+			fmt.Fprintf(w, "inline ")
+		}
+		fmt.Fprintf(w, "%v %s", r.FormValue("task_id"), frame)
+	})
+
+	transport, err := newWorkerTransport(TransportSpec{
+		Transport:  TransportShm,
+		SocketPath: socketPath,
+		ShmPath:    ringPath,
+		ShmSize:    1024,
+	}, DefaultWorkerClientConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+	ring := transport.(*shmTransport).ring
+
+	// each frame takes the next region, and wraps to the start once released
+	for i := 0; i < 20; i++ {
+		frame := bytes.Repeat([]byte{byte('a' + i)}, 100)
+		answer := postForm(t, transport, map[string]string{"task_id": fmt.Sprint(i)}, frame)
+		if want := fmt.Sprintf("shm %v %s", i, frame); answer != want {
+			t.Fatalf("worker answers %q, want %q", answer, want)
+		}
+	}
+
+	// a frame larger than the ring is sent inline
+	frame := bytes.Repeat([]byte{'z'}, 2048)
+	if answer := postForm(t, transport, map[string]string{"task_id": "big"}, frame); answer != "inline big "+string(frame) {
+		t.Fatalf("worker answers %q", answer)
+	}
+
+	ring.lock.Lock()
+	inUse := len(ring.inUse)
+	ring.lock.Unlock()
+	if inUse != 0 {
+		t.Fatalf("%v regions are in use after the requests are answered", inUse)
+	}
+}
+
+func TestFrameRingAlloc(t *testing.T) {
+	ring, err := openFrameRing(filepath.Join(t.TempDir(), "worker.ring"), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ring.close()
+
+	first, region, ok := ring.alloc(40)
+	if !ok || region.offset != 0 {
+		t.Fatalf("first region is %+v, %v", region, ok)
+	}
+	if _, region, ok = ring.alloc(40); !ok || region.offset != 40 {
+		t.Fatalf("second region is %+v, %v", region, ok)
+	}
+	// the third region wraps to the start, which is still in use
+	if _, _, ok = ring.alloc(40); ok {
+		t.Fatal("region in use is allocated again")
+	}
+	ring.release(first)
+	if _, region, ok = ring.alloc(40); !ok || region.offset != 0 {
+		t.Fatalf("released region is %+v, %v", region, ok)
+	}
+	if _, _, ok = ring.alloc(101); ok {
+		t.Fatal("region larger than the ring is allocated")
+	}
+}
+
+func TestResolveSpec(t *testing.T) {
+	worker := &Worker{wokerName: "det-worker-1"}
+	for _, spec := range []TransportSpec{
+		{Transport: TransportUnix, SocketPath: "/tmp/other.sock"},
+		{Transport: TransportShm, ShmPath: "/dev/shm/other.ring"},
+		{Transport: TransportShm, ShmSize: maxShmSize + 1},
+	} {
+		if _, err := resolveSpec(worker, spec); err == nil {
+			t.Fatalf("spec %+v is accepted", spec)
+		}
+	}
+
+	spec, err := resolveSpec(worker, TransportSpec{Transport: TransportShm, SocketPath: SocketPathOf(worker)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.ShmPath != ShmPathOf(worker) || spec.SocketPath != SocketPathOf(worker) {
+		t.Fatalf("resolved spec is %+v", spec)
+	}
+}
@@ -12,8 +12,6 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 )
 
 // var WorkerMap = make(map[string]map[string]*Worker)
@@ -22,11 +20,12 @@ var WorkerMap sync.Map
 
 var workerSelectionLock = sync.Mutex{}
 
-// map from ip to current assigned port
-var portPoolMap = make(map[string]int)
-
 var taskIDWorkerMap sync.Map
 
+// map from task id to the class it was given its worker with, a replacement worker is occupied with it.
+// Guarded by workerSelectionLock
+var taskClasses = map[string]TaskClass{}
+
 type Worker struct {
 	ip          string
 	taskType    string
@@ -36,10 +35,30 @@ type Worker struct {
 	taskID      string
 	nodeName    string
 	wokerName   string
+	// shared by several tasks, see shared.go
+	shared      bool
+	sharedTasks int
+
+	// consecutive failures, see health.go
+	failures       int
+	unhealthyUntil time.Time
+
+	// see readiness.go
+	state        WorkerState
+	stateHistory []StateTransition
+
+	// not selected if cordoned, deleted once free if draining, see admin.go
+	cordoned bool
+	draining bool
+	// set by the first DeleteWorker, later calls return at once
+	deleted bool
+
+	// given to the pod, required to change the transport, see transport.go
+	registerToken string
 }
 
 func (w *Worker) GetURL(route string) string {
-	return fmt.Sprintf("http://%v:%v/%v", w.ip, w.port, route)
+	return fmt.Sprintf("%v://%v:%v/%v", WorkerScheme(), w.ip, w.port, route)
 }
 
 func (w *Worker) GetIP() string {
@@ -47,24 +66,17 @@ func (w *Worker) GetIP() string {
 }
 
 func (w *Worker) Describe() string {
-	return fmt.Sprintf("[IP: %v, Task Type: %v]", w.ip, w.taskType)
+	return fmt.Sprintf("[Name: %v, IP: %v, Port: %v, Node: %v, Task Type: %v]",
+		w.wokerName, w.ip, w.port, w.nodeName, w.taskType)
 }
 
-// addWorker return assigned port for the worker_pool
-var portAssignLock = sync.Mutex{}
-
-func addWorker(hostName, taskType, nodeName string) *Worker {
-	portAssignLock.Lock()
-	_, ok := portPoolMap[hostName]
-	if !ok {
-		portPoolMap[hostName] = 20000
-	} else {
-		portPoolMap[hostName] += 1
+// addWorker return a worker with a free port of the host, see ports.go
+func addWorker(hostName, taskType, nodeName string) (*Worker, error) {
+	port, err := allocatePort(hostName, taskType, nodeName)
+	if err != nil {
+		return nil, err
 	}
 
-	port := strconv.Itoa(portPoolMap[hostName])
-	portAssignLock.Unlock()
-
 	workerSelectionLock.Lock()
 
 	newWorker := &Worker{
@@ -73,7 +85,9 @@ func addWorker(hostName, taskType, nodeName string) *Worker {
 		port:        port,
 		isAvailable: true,
 		nodeName:    nodeName,
-		wokerName:   fmt.Sprintf("%v-%v-%v", taskType, port, nodeName),
+		wokerName:   workerName(taskType, port, nodeName),
+
+		registerToken: newRegisterToken(),
 	}
 
 	// map from task type to workerMap
@@ -82,110 +96,102 @@ func addWorker(hostName, taskType, nodeName string) *Worker {
 	workerPool, _ := WorkerMap.LoadOrStore(taskType, &sync.Map{})
 
 	workerMap, _ := workerPool.(*sync.Map)
+	newWorker.setStateLocked(WorkerCreating)
 	(*workerMap).Store(newWorker.wokerName, newWorker)
 
 	log.Printf("worker has been store [%v] in task type %v", *newWorker, taskType)
 
+	dispatchLocked()
 	workerSelectionLock.Unlock()
 
-	return newWorker
+	return newWorker, nil
 }
 
 func (w *Worker) GetWorkerName() string {
 	return w.wokerName
 }
 
+// OccupyWorker wait for a worker of taskType in the node with normal priority and no deadline
+// for the default tenant
 func OccupyWorker(taskType, taskID, nodeName string) *Worker {
-	nodeName = PodsInfo[taskType+"-"+nodeName].NodeName
-
-	rawPool, ok := WorkerMap.Load(taskType)
-	if !ok {
-		log.Panicf("Not have task type %v of worker pool", taskType)
-	}
-	workerPool := rawPool.(*sync.Map)
-
-	hasWorker := false
-	(*workerPool).Range(func(key, value any) bool {
-		hasWorker = true
-		return false
-	})
-
-	if !hasWorker {
-		log.Panicf("task type %v has no worker_pool!", taskType)
-	}
-
-	// Do Worker Selection
-	var chooseWorker *Worker = nil
-	for {
-		workerSelectionLock.Lock()
-		(*workerPool).Range(func(key, value any) bool {
-			worker := value.(*Worker)
-			log.Printf("This worker is [%v], expected nodeName is [%v]",
-				*worker, nodeName)
-			if worker.isAvailable && worker.nodeName == nodeName {
-				chooseWorker = worker
-				worker.isAvailable = false
-				worker.bindTaskID(taskID)
-				return false
-			} else {
-				return true
-			}
-		})
-
-		if chooseWorker == nil {
-			log.Printf("Do not has support worker_pool for %v, wait for 50 msec",
-				taskType)
-		} else {
-			workerSelectionLock.Unlock()
-			break
-		}
-		workerSelectionLock.Unlock()
-		time.Sleep(50 * time.Millisecond)
+	worker, err := OccupyWorkerWithClass(context.Background(), taskType, taskID, nodeName,
+		TaskClass{Priority: PriorityNormal, Tenant: DefaultTenant})
+	if err != nil {
+		log.Panicf("occupy worker of %v for task %v failed: %v", taskType, taskID, err)
 	}
-
-	return chooseWorker
+	return worker
 }
 
+// ReturnToPool unbind taskID from the worker, a shared worker stays out of the pool
+// until it is unshared and its last task is returned
 func (w *Worker) ReturnToPool(taskID string) {
 	workerSelectionLock.Lock()
-	w.isAvailable = true
 	taskIDWorkerMap.Delete(taskID)
+	delete(taskClasses, taskID)
+	releaseTenantLocked(taskID)
+	if w.sharedTasks > 0 {
+		w.sharedTasks--
+	}
+	if w.shared || w.sharedTasks != 0 {
+		workerSelectionLock.Unlock()
+		return
+	}
+	w.isAvailable = true
+	if w.state == WorkerBusy {
+		w.setStateLocked(WorkerReady)
+	}
+	dispatchLocked()
+	draining := w.draining
 	workerSelectionLock.Unlock()
+
+	if draining {
+		go w.deleteDrained()
+	}
 }
 
 func (w *Worker) GetPodName() string {
 	return w.podName
 }
 
+// DeleteWorker delete the pod of the worker and release its resources.
+// It is idempotent, a drained worker may be deleted by ReturnToPool and by the handler of its last frame
 func (w *Worker) DeleteWorker() {
 	workerSelectionLock.Lock()
+	if w.deleted {
+		workerSelectionLock.Unlock()
+		return
+	}
 	if !w.isAvailable {
 		workerSelectionLock.Unlock()
 		log.Panicf("Delete worker %v before return", w.nodeName)
 	}
+	w.markDeletedLocked()
+	workerSelectionLock.Unlock()
+	w.deletePod()
+}
+
+// markDeletedLocked take the available worker out of its pool, so no task can claim it
+// before its pod is deleted
+func (w *Worker) markDeletedLocked() {
+	w.deleted = true
+	w.setStateLocked(WorkerDraining)
 	rawPool, _ := WorkerMap.Load(w.taskType)
 	workerPool := rawPool.(*sync.Map)
 	(*workerPool).Delete(w.wokerName)
-	workerSelectionLock.Unlock()
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		log.Panic(err)
-	}
-
-	clientSet, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		log.Panic(err)
-	}
+}
 
-	podsClient := clientSet.CoreV1().Pods("default")
-	err = podsClient.Delete(context.Background(), w.podName, metav1.DeleteOptions{})
-	if err != nil {
+// deletePod delete the pod of the worker marked deleted, and wait until it is gone
+func (w *Worker) deletePod() {
+	clientSet := getCluster()
+	podsClient := clientSet.CoreV1().Pods(WorkerNamespace())
+	err := podsClient.Delete(context.Background(), w.podName, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
 		log.Panic(err)
 	}
 
 	// wait until pod deleted
 	err = wait.PollImmediate(500*time.Millisecond, 2*time.Minute, func() (bool, error) {
-		_, err = clientSet.CoreV1().Pods("default").Get(context.Background(),
+		_, err = clientSet.CoreV1().Pods(WorkerNamespace()).Get(context.Background(),
 			w.GetPodName(), metav1.GetOptions{})
 		if errors.IsNotFound(err) {
 			return true, nil
@@ -199,6 +205,9 @@ func (w *Worker) DeleteWorker() {
 	}
 
 	taskIDWorkerMap.Delete(w.taskID)
+	removeWorkerTransport(w)
+	ReleaseGPU(w.podName)
+	releasePort(w.ip, w.port)
 
 	log.Printf("Pod %v deleted", w.podName)
 }
@@ -218,44 +227,101 @@ func GetWorkerByTaskID(taskID string) *Worker {
 	}
 }
 
+// LookupWorker return the worker bound to taskID, without panic if not exist
+func LookupWorker(taskID string) (*Worker, bool) {
+	worker, ok := taskIDWorkerMap.Load(taskID)
+	if !ok {
+		return nil, false
+	}
+	return worker.(*Worker), true
+}
+
+// UnbindTask remove the binding of taskID so its worker is no longer looked up, and return the worker.
+// The caller is responsible to return the worker to pool
+func UnbindTask(taskID string) (*Worker, bool) {
+	workerSelectionLock.Lock()
+	defer workerSelectionLock.Unlock()
+	worker, ok := taskIDWorkerMap.LoadAndDelete(taskID)
+	if !ok {
+		return nil, false
+	}
+	return worker.(*Worker), true
+}
+
+// workerLimits is the limits of CreateWorker for a worker in the node by the limits of /create_workers
+func workerLimits(cpuLimits, gpuLimits, gpuMemorys map[string]int, nodeName string) (cpuLimit, memLimit,
+	gpuLimit, gpuMemory string) {
+	memLimit = "0"
+	if cpuLimits[nodeName] != 0 {
+		cpuLimit = fmt.Sprintf("%vm", cpuLimits[nodeName])
+	} else {
+		cpuLimit = "0"
+	}
+	return cpuLimit, memLimit, strconv.Itoa(gpuLimits[nodeName]), strconv.Itoa(gpuMemorys[nodeName])
+}
+
+// InitWorkers create workers of the task in each node. Pods of a node are created in batches
+// of batchSizes, the next batch starts once the pods of the previous one are ready,
+// too many slam init at the same time may make the node down.
+// A node stops at its first worker failed to create, the workers created are returned
+// with the first error
 func InitWorkers(workerNumbers, batchSizes, cpuLimits, gpuLimits, gpuMemorys map[string]int,
-	taskName string) []*Worker {
+	taskName string) ([]*Worker, error) {
 	var pool []*Worker
+	var firstErr error
+	poolLock := sync.Mutex{}
 	wg := sync.WaitGroup{}
 	wg.Add(len(workerNumbers))
 	for nodeName, workerNumber := range workerNumbers {
 		go func(nodeName string, workerNumber int) {
+			defer wg.Done()
+			batchSize := batchSizes[nodeName]
+			if batchSize <= 0 {
+				batchSize = workerNumber
+			}
+			var batch []string
+			var err error
 			for i := 0; i < workerNumber; i++ {
 				podsInfo, ok := PodsInfo[taskName+"-"+nodeName]
 				if !ok {
-					log.Panicf("Unsupport combination %v", taskName+"-"+nodeName)
+					err = fmt.Errorf("unsupported combination %v", taskName+"-"+nodeName)
+					break
 				}
 				utils.DebugWithTimeWait(fmt.Sprintf("podinfo:[%v]", podsInfo))
-				memLimit := "0"
-				var cpuLimit string
-				if cpuLimits[nodeName] != 0 {
-					cpuLimit = fmt.Sprintf("%vm", cpuLimits[nodeName])
-				} else {
-					cpuLimit = "0"
-				}
-				gpuMemory := strconv.Itoa(gpuMemorys[nodeName])
-				gpuLimit := strconv.Itoa(gpuLimits[nodeName])
+				cpuLimit, memLimit, gpuLimit, gpuMemory := workerLimits(cpuLimits, gpuLimits, gpuMemorys, nodeName)
 				utils.DebugWithTimeWait("Before CreateWorker")
-				worker := CreateWorker(podsInfo.TaskName, podsInfo.NodeName, podsInfo.HostName,
+				var worker *Worker
+				worker, err = CreateWorker(podsInfo.TaskName, podsInfo.NodeName, podsInfo.HostName,
 					cpuLimit, memLimit, gpuLimit, gpuMemory)
+				if err != nil {
+					break
+				}
 				utils.DebugWithTimeWait("After CreateWorker")
+				poolLock.Lock()
 				pool = append(pool, worker)
-				// slow down, too many slam init may make system down
-				if (i+1)%batchSizes[nodeName] == 0 {
-					log.Printf("Crated %v pods for %v", i+1, nodeName)
-					time.Sleep(30 * time.Second)
+				poolLock.Unlock()
+				batch = append(batch, worker.podName)
+
+				if (i+1)%batchSize == 0 && i+1 < workerNumber {
+					log.Printf("Crated %v pods for %v, waiting for them to be ready", i+1, nodeName)
+					if err := waitPodsReady(batch, ReadyTimeout); err != nil {
+						log.Printf("pods of %v are not ready, create the next batch anyway: %v", nodeName, err)
+					}
+					batch = nil
+				}
+			}
+			if err != nil {
+				log.Printf("create workers of %v in %v failed: %v", taskName, nodeName, err)
+				poolLock.Lock()
+				if firstErr == nil {
+					firstErr = err
 				}
+				poolLock.Unlock()
 			}
-			wg.Done()
 		}(nodeName, workerNumber)
 	}
 	wg.Wait()
-	return pool
+	return pool, firstErr
 }
 
 func GetWorkerPool(taskType string) []*Worker {
@@ -273,3 +339,23 @@ func GetWorkerPool(taskType string) []*Worker {
 func (w *Worker) GetNodeName() string {
 	return w.nodeName
 }
+
+// CountAvailable return the number of free, ready and healthy workers of taskType
+func CountAvailable(taskType string) int {
+	rawPool, ok := WorkerMap.Load(taskType)
+	if !ok {
+		return 0
+	}
+
+	available := 0
+	workerSelectionLock.Lock()
+	rawPool.(*sync.Map).Range(func(key, value any) bool {
+		worker := value.(*Worker)
+		if worker.isSelectableLocked() {
+			available++
+		}
+		return true
+	})
+	workerSelectionLock.Unlock()
+	return available
+}